@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	server "github.com/mactavishz/kuerzen/analytics/grpc"
+	"github.com/mactavishz/kuerzen/analytics/pb"
+	"github.com/mactavishz/kuerzen/service"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const ADMIN_TIMEOUT = 10 * time.Minute
+
+const adminUsage = `Usage: analytics <command> [flags]
+
+Runs an administrative command against the analytics service at ANALYTICS_ADMIN_ADDR (default localhost:ANALYTICS_GRPC_PORT).
+TLS is configured with ANALYTICS_ADMIN_TLS_CA_FILE, ANALYTICS_ADMIN_TLS_CERT_FILE, ANALYTICS_ADMIN_TLS_KEY_FILE and
+ANALYTICS_ADMIN_TLS_SERVER_NAME, the credentials with ANALYTICS_ADMIN_TOKEN or ANALYTICS_ADMIN_JWT_KEY (identity admin, overridden by
+ANALYTICS_ADMIN_IDENTITY).
+
+Commands:
+  purge-links -reason <reason> [-owner <owner>] [-by <name>] [short_url ...]
+        Delete the events and rollups of the short URLs and of the short URLs of the owner
+  jwt-keygen
+        Print a new key pair for the JWTs of an identity, the public key goes into ANALYTICS_AUTH_JWT_KEYS of the server
+        and the private key into the JWT_KEY of the caller
+`
+
+// runAdmin runs the administrative command of the arguments and returns the exit code
+func runAdmin(args []string) int {
+	switch args[0] {
+	case "purge-links":
+		return purgeLinks(args[1:])
+	case "jwt-keygen":
+		return jwtKeygen()
+	default:
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+}
+
+func purgeLinks(args []string) int {
+	flags := flag.NewFlagSet("purge-links", flag.ContinueOnError)
+	reason := flags.String("reason", "", "why the analytics are purged, e.g. the ticket of the erasure request (required)")
+	owner := flags.String("owner", "", "also purge the short URLs of the owner")
+	by := flags.String("by", os.Getenv("USER"), "who requested the purge")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *reason == "" || (*owner == "" && flags.NArg() == 0) {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+
+	addr := service.Getenv("ANALYTICS_ADMIN_ADDR", "localhost:"+service.Getenv("ANALYTICS_GRPC_PORT", DEFAULT_GRPC_PORT))
+	// The server may require TLS and authentication, the admin is configured like the clients with the prefix ANALYTICS_ADMIN_
+	cfg, err := server.ClientConfigFromEnv("ANALYTICS_ADMIN_", "admin")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid admin settings: %v\n", err)
+		return 1
+	}
+	creds, err := server.ClientCredentials(cfg.TLS, zap.NewNop().Sugar())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid TLS settings: %v\n", err)
+		return 1
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if cfg.Credentials != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(cfg.Credentials))
+	}
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to %s: %v\n", addr, err)
+		return 1
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), ADMIN_TIMEOUT)
+	defer cancel()
+	res, err := pb.NewAnalyticsAdminServiceClient(conn).PurgeLinkAnalytics(ctx, &pb.PurgeLinkAnalyticsRequest{
+		ShortUrls:   flags.Args(),
+		Owner:       *owner,
+		Reason:      *reason,
+		RequestedBy: *by,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Purge failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Purged the analytics of %d short URLs\n", len(res.ShortUrls))
+	for _, shortURL := range res.ShortUrls {
+		fmt.Println(shortURL)
+	}
+	return 0
+}
+
+func jwtKeygen() int {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not generate a key: %v\n", err)
+		return 1
+	}
+	fmt.Printf("public key:  %s\n", base64.StdEncoding.EncodeToString(pub))
+	fmt.Printf("private key: %s\n", base64.StdEncoding.EncodeToString(priv.Seed()))
+	return 0
+}
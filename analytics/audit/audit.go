@@ -0,0 +1,86 @@
+// Package audit records administrative actions of the analytics service, like purges of analytics data,
+// as JSON lines in an append-only file. Every entry is synced to disk before Record returns.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	RESULT_REQUESTED = "requested"
+	RESULT_SUCCEEDED = "succeeded"
+	RESULT_FAILED    = "failed"
+)
+
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Result    string    `json:"result"`
+	Actor     string    `json:"actor,omitempty"` // Declared by the caller
+	Peer      string    `json:"peer,omitempty"`  // Address of the caller
+	Reason    string    `json:"reason,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	ShortURLs []string  `json:"short_urls,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type Log struct {
+	mu     sync.Mutex
+	file   *os.File
+	logger *zap.SugaredLogger
+}
+
+func Open(path string, logger *zap.SugaredLogger) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return &Log{file: f, logger: logger}, nil
+}
+
+// Record appends the entry to the log, the time is set if it is zero
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encode audit entry: %w", err)
+	}
+	l.logger.Infow("Audit", "action", e.Action, "result", e.Result, "actor", e.Actor, "peer", e.Peer, "owner", e.Owner,
+		"short_urls", len(e.ShortURLs), "error", e.Error)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return errors.New("audit log is closed")
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write audit entry: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("sync audit log: %w", err)
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/mactavishz/kuerzen/analytics/dlq"
+	"github.com/mactavishz/kuerzen/analytics/rollup"
+	"github.com/mactavishz/kuerzen/service"
+	"github.com/mactavishz/kuerzen/service/health"
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	STORE_INFLUXDB = "influxdb"
+	STORE_POSTGRES = "postgres"
+	STORE_FILE     = "file"
+	STORE_MEMORY   = "memory"
+
+	DEFAULT_STORE_DIR = "/data/analytics"
+	DEFAULT_DLQ_DIR   = "/data/analytics-dlq"
+
+	DEFAULT_AUDIT_LOG = "/data/analytics-audit/audit.jsonl"
+
+	DEFAULT_HOURLY_RETENTION = 90 * 24 * time.Hour
+
+	// DEFAULT_DLQ_MAX_PENDING is the number of batches waiting for replay above which the service stops serving
+	DEFAULT_DLQ_MAX_PENDING = 1000
+)
+
+// Backend is the analytics store selected by ANALYTICS_STORE
+type Backend struct {
+	store.AnalyticsBackend
+	// Reader answers the queries, from the rollups of the store if they are enabled
+	Reader     store.AnalyticsReader
+	DLQ        *dlq.DLQ // nil unless the store writes asynchronously
+	Dependency health.Dependency
+}
+
+// openBackend opens the analytics store selected by ANALYTICS_STORE and registers the components it needs.
+// The dependency of the returned backend checks the store for the readiness endpoint.
+func openBackend(svc *service.Service, reg prometheus.Registerer, logger *zap.SugaredLogger) (*Backend, error) {
+	kind := service.Getenv("ANALYTICS_STORE", STORE_INFLUXDB)
+	var backend store.AnalyticsBackend
+	var deadLetters *dlq.DLQ
+	switch kind {
+	case STORE_INFLUXDB:
+		client := influxdb2.NewClient(os.Getenv("ANALYTICS_DB_URL"), os.Getenv("DOCKER_INFLUXDB_INIT_ADMIN_TOKEN"))
+		influx := store.NewInfluxDBAnalyticsStore(client, os.Getenv("DOCKER_INFLUXDB_INIT_ORG"), os.Getenv("DOCKER_INFLUXDB_INIT_BUCKET"))
+		if bucket := os.Getenv("ANALYTICS_ROLLUP_BUCKET"); bucket != "" {
+			influx.SetRollupBucket(bucket)
+		}
+		q, err := openDLQ(influx, reg, logger)
+		if err != nil {
+			return nil, err
+		}
+		backend, deadLetters = influx, q
+	case STORE_POSTGRES:
+		db, err := service.OpenDatabase(logger)
+		if err != nil {
+			return nil, fmt.Errorf("open database: %w", err)
+		}
+		svc.Add(service.NewCloser("database", db.Close))
+		backend = store.NewPostgresAnalyticsStore(db.DB)
+	case STORE_FILE:
+		fs, err := store.NewFileAnalyticsStore(store.FileStoreConfig{Dir: service.Getenv("ANALYTICS_STORE_DIR", DEFAULT_STORE_DIR)})
+		if err != nil {
+			return nil, fmt.Errorf("open file store: %w", err)
+		}
+		backend = fs
+	case STORE_MEMORY:
+		logger.Warnf("Analytics events are kept in memory and are lost on restart")
+		backend = store.NewMemoryAnalyticsStore()
+	default:
+		return nil, fmt.Errorf("unknown analytics store %q", kind)
+	}
+	logger.Infof("Using the %s analytics store", kind)
+	// The store is stopped last so that all events received before the shutdown are flushed
+	svc.Add(service.NewCloser("analytics store", func() error {
+		backend.Close()
+		return nil
+	}))
+	if deadLetters != nil {
+		// Stopped before the store, batches failing while the store flushes on close are still dead-lettered
+		svc.Add(service.NewComponent("dead-letter replay", deadLetters.Start, deadLetters.Stop))
+	}
+	writeErrors := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_store_write_errors_total",
+		Help: "Number of errors writing events to the analytics store.",
+	})
+	reg.MustRegister(writeErrors)
+	svc.Add(service.NewComponent("store error drain", func(ctx context.Context) error {
+		// Drain the errors until the store closes the channel, a full channel blocks the writer of some stores
+		go func() {
+			for err := range backend.Errors() {
+				writeErrors.Inc()
+				logger.Errorf("Failed to write analytics events: %v", err)
+			}
+		}()
+		return nil
+	}, nil))
+	reader, err := openRollups(svc, backend, reg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{
+		AnalyticsBackend: backend,
+		Reader:           reader,
+		DLQ:              deadLetters,
+		Dependency:       health.Dependency{Name: kind, Checker: health.CheckerFunc(backend.Ping), Critical: true},
+	}, nil
+}
+
+// openDLQ persists the batches the store fails to write to ANALYTICS_DLQ_DIR, they are replayed while the service runs
+func openDLQ(influx *store.InfluxDBAnalyticsStore, reg prometheus.Registerer, logger *zap.SugaredLogger) (*dlq.DLQ, error) {
+	q, err := dlq.Open(dlq.Config{Dir: service.Getenv("ANALYTICS_DLQ_DIR", DEFAULT_DLQ_DIR), Registerer: reg},
+		func(ctx context.Context, batch string) error {
+			err := influx.WriteBatch(ctx, batch)
+			if errors.Is(err, store.ErrWriteRejected) {
+				return fmt.Errorf("%w: %w", dlq.ErrRejected, err)
+			}
+			return err
+		}, logger)
+	if err != nil {
+		return nil, fmt.Errorf("open dead-letter queue: %w", err)
+	}
+	influx.SetWriteFailedCallback(func(batch string, err error) bool {
+		if errors.Is(err, store.ErrWriteRejected) {
+			// Kept for inspection, replaying it would fail again
+			err = fmt.Errorf("%w: %w", dlq.ErrRejected, err)
+		}
+		if dlqErr := q.Add(batch, err); dlqErr != nil {
+			// Leave the batch to the retries of the writer rather than losing it
+			logger.Errorf("Failed to dead-letter a batch: %v", dlqErr)
+			return true
+		}
+		return false
+	})
+	return q, nil
+}
+
+// dlqCheck fails while more than ANALYTICS_DLQ_MAX_PENDING batches wait for replay, rejected batches are not counted
+// as they are only kept for inspection
+func dlqCheck(q *dlq.DLQ) (func(ctx context.Context) error, error) {
+	maxPending, err := strconv.Atoi(service.Getenv("ANALYTICS_DLQ_MAX_PENDING", strconv.Itoa(DEFAULT_DLQ_MAX_PENDING)))
+	if err != nil {
+		return nil, fmt.Errorf("ANALYTICS_DLQ_MAX_PENDING: %w", err)
+	}
+	return func(ctx context.Context) error {
+		st := q.Stats()
+		if pending := st.Batches - st.Rejected; pending > maxPending {
+			return fmt.Errorf("%d batches wait for replay, more than %d", pending, maxPending)
+		}
+		return nil
+	}, nil
+}
+
+// openRollups registers the rollup job of the store unless ANALYTICS_ROLLUP_INTERVAL is 0 and returns the reader
+// of the queries. The ANALYTICS_*_RETENTION variables set how long the data of each resolution is kept, 0 keeps it.
+func openRollups(svc *service.Service, backend store.AnalyticsBackend, reg prometheus.Registerer, logger *zap.SugaredLogger) (store.AnalyticsReader, error) {
+	rollups, ok := backend.(store.RollupStore)
+	if !ok {
+		return backend, nil
+	}
+	var cfg rollup.Config
+	for _, d := range []struct {
+		key   string
+		value *time.Duration
+		def   time.Duration
+	}{
+		{"ANALYTICS_ROLLUP_INTERVAL", &cfg.Interval, rollup.DEFAULT_INTERVAL},
+		{"ANALYTICS_ROLLUP_LAG", &cfg.Lag, rollup.DEFAULT_LAG},
+		{"ANALYTICS_RAW_RETENTION", &cfg.Retention.Raw, 0},
+		{"ANALYTICS_HOURLY_RETENTION", &cfg.Retention.Hourly, DEFAULT_HOURLY_RETENTION},
+		{"ANALYTICS_DAILY_RETENTION", &cfg.Retention.Daily, 0},
+		{"ANALYTICS_ANONYMIZE_AFTER", &cfg.AnonymizeAfter, 0},
+	} {
+		v, err := time.ParseDuration(service.Getenv(d.key, d.def.String()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.key, err)
+		}
+		*d.value = v
+	}
+	if cfg.Interval == 0 {
+		if cfg.AnonymizeAfter != 0 {
+			return nil, errors.New("ANALYTICS_ANONYMIZE_AFTER requires rollups, ANALYTICS_ROLLUP_INTERVAL must not be 0")
+		}
+		logger.Infof("Analytics rollups are disabled")
+		return backend, nil
+	}
+	// Queries of the last days are answered from the raw events or the hourly rollups, they have to be kept that long
+	if r := cfg.Retention.Raw; r != 0 && r < store.RAW_QUERY_MAX_RANGE {
+		return nil, fmt.Errorf("ANALYTICS_RAW_RETENTION must be at least %s", store.RAW_QUERY_MAX_RANGE)
+	}
+	if r := cfg.Retention.Hourly; r != 0 && r < store.HOURLY_QUERY_MAX_RANGE {
+		return nil, fmt.Errorf("ANALYTICS_HOURLY_RETENTION must be at least %s", store.HOURLY_QUERY_MAX_RANGE)
+	}
+	// Visitors of the recent events are counted from the raw events
+	if a := cfg.AnonymizeAfter; a != 0 && a < store.RAW_QUERY_MAX_RANGE {
+		return nil, fmt.Errorf("ANALYTICS_ANONYMIZE_AFTER must be at least %s", store.RAW_QUERY_MAX_RANGE)
+	}
+	cfg.Registerer = reg
+	job, err := rollup.New(cfg, rollups, logger)
+	if err != nil {
+		return nil, fmt.Errorf("create rollup job: %w", err)
+	}
+	// Stopped before the store is closed
+	svc.Add(service.NewComponent("rollup job", job.Start, job.Stop))
+	return store.NewTieredReader(backend, rollups, cfg.Retention), nil
+}
@@ -0,0 +1,130 @@
+// Package dedupe remembers the ids of recently received events, so that events retried by a client are only recorded once.
+package dedupe
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DEFAULT_WINDOW   = 10 * time.Minute
+	DEFAULT_MAX_KEYS = 100000
+)
+
+type Config struct {
+	Window     time.Duration // How long an id is remembered after it was first seen
+	MaxKeys    int           // Upper bound of remembered ids, the oldest ids are forgotten early once it is reached
+	Registerer prometheus.Registerer
+}
+
+type entry struct {
+	id      string
+	expires time.Time
+}
+
+// Set is a bounded set of ids that expire after the window. All ids share the window,
+// so the insertion order is the expiry order and a FIFO queue is enough to evict them.
+type Set struct {
+	window  time.Duration
+	maxKeys int
+	mu      sync.Mutex
+	seen    map[string]struct{}
+	queue   []entry // ids in the order they were first seen
+	head    int     // index of the oldest entry of queue
+	now     func() time.Time
+	checks  *prometheus.CounterVec
+}
+
+func New(cfg Config) (*Set, error) {
+	if cfg.Window <= 0 {
+		cfg.Window = DEFAULT_WINDOW
+	}
+	if cfg.MaxKeys <= 0 {
+		cfg.MaxKeys = DEFAULT_MAX_KEYS
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	s := &Set{
+		window:  cfg.Window,
+		maxKeys: cfg.MaxKeys,
+		seen:    make(map[string]struct{}),
+		now:     time.Now,
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "analytics_event_dedupe_checks_total",
+			Help: "Number of event ids checked for duplicates by result (duplicate or unique), the share of duplicates is the hit rate.",
+		}, []string{"result"}),
+	}
+	keys := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "analytics_event_dedupe_keys",
+		Help: "Number of event ids remembered for deduplication.",
+	}, func() float64 { return float64(s.Len()) })
+	for _, c := range []prometheus.Collector{s.checks, keys} {
+		if err := cfg.Registerer.Register(c); err != nil {
+			return nil, fmt.Errorf("register dedupe metrics: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// Seen reports whether id was added within the window. Events without an id are never duplicates.
+func (s *Set) Seen(id string) bool {
+	if id == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(s.now())
+	if _, ok := s.seen[id]; ok {
+		s.checks.WithLabelValues("duplicate").Inc()
+		return true
+	}
+	s.checks.WithLabelValues("unique").Inc()
+	return false
+}
+
+// Add remembers the ids of recorded events. Ids are only added once the events are stored, so that a retry of an
+// event the store failed to write isn't taken for a duplicate. The window of an id that is added again doesn't restart.
+func (s *Set) Add(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		s.evict(now)
+		if _, ok := s.seen[id]; ok {
+			continue
+		}
+		s.seen[id] = struct{}{}
+		s.queue = append(s.queue, entry{id: id, expires: now.Add(s.window)})
+	}
+}
+
+func (s *Set) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.seen)
+}
+
+// evict forgets the expired ids and the oldest ids beyond MaxKeys - 1, s.mu must be held
+func (s *Set) evict(now time.Time) {
+	for s.head < len(s.queue) {
+		e := s.queue[s.head]
+		if now.Before(e.expires) && len(s.seen) < s.maxKeys {
+			break
+		}
+		delete(s.seen, e.id)
+		s.queue[s.head] = entry{}
+		s.head++
+	}
+	// Reuse the space of the evicted entries once they make up half of the queue
+	if s.head > 0 && s.head >= len(s.queue)/2 {
+		s.queue = append(s.queue[:0], s.queue[s.head:]...)
+		s.head = 0
+	}
+}
@@ -0,0 +1,53 @@
+package dedupe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestSet(t *testing.T, window time.Duration, maxKeys int) (*Set, *time.Time) {
+	s, err := New(Config{Window: window, MaxKeys: maxKeys, Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		t.Fatalf("failed to create set: %v", err)
+	}
+	now := time.Unix(0, 0)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestSetExpiresIDs(t *testing.T) {
+	s, now := newTestSet(t, time.Minute, 10)
+	if s.Seen("a") || s.Seen("a") {
+		t.Error("Expected an id that wasn't added not to be a duplicate")
+	}
+	s.Add("a", "")
+	*now = now.Add(30 * time.Second)
+	if !s.Seen("a") {
+		t.Error("Expected a duplicate within the window")
+	}
+	if s.Seen("") {
+		t.Error("Expected empty ids never to be duplicates")
+	}
+	// The window starts when the id is first added
+	s.Add("a")
+	*now = now.Add(30 * time.Second)
+	if s.Seen("a") {
+		t.Error("Expected the id to expire after the window")
+	}
+}
+
+func TestSetIsBounded(t *testing.T) {
+	s, _ := newTestSet(t, time.Minute, 3)
+	s.Add("a", "b", "c", "d")
+	if s.Len() != 3 {
+		t.Errorf("Expected 3 remembered ids, got %d", s.Len())
+	}
+	if !s.Seen("d") {
+		t.Error("Expected the newest id to be remembered")
+	}
+	if s.Seen("a") {
+		t.Error("Expected the oldest id to be forgotten")
+	}
+}
@@ -0,0 +1,491 @@
+// Package dlq implements an on-disk dead-letter queue for batches of analytics events that could not be written to the store.
+// Every batch is kept in its own file, so that a crash can at most lose the batch that is being written.
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_MIN_BACKOFF = 1 * time.Second
+	DEFAULT_MAX_BACKOFF = 5 * time.Minute
+
+	entrySuffix = ".json"
+)
+
+// ErrRejected marks batches the store refused for good, they are kept for inspection but not replayed
+var ErrRejected = errors.New("batch rejected")
+
+// WriteFunc writes a batch to the store, errors wrapping ErrRejected stop the replay of the batch
+type WriteFunc func(ctx context.Context, batch string) error
+
+type Config struct {
+	Dir        string
+	MinBackoff time.Duration // Delay before replaying again after a failed replay, doubled on every failure
+	MaxBackoff time.Duration
+	Registerer prometheus.Registerer
+}
+
+// Entry is a dead-lettered batch
+type Entry struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"` // When the batch was dead-lettered
+	Batch    string    `json:"batch"`
+	Size     int64     `json:"size"`  // Length of the batch in bytes
+	Error    string    `json:"error"` // The last error writing the batch
+	Attempts int       `json:"attempts"`
+	Rejected bool      `json:"rejected"`
+}
+
+type Stats struct {
+	Batches  int
+	Rejected int
+	Bytes    int64
+	Oldest   time.Time // zero if the queue is empty
+}
+
+type metrics struct {
+	batches  prometheus.GaugeFunc
+	bytes    prometheus.GaugeFunc
+	age      prometheus.GaugeFunc
+	enqueued prometheus.Counter
+	replayed *prometheus.CounterVec
+	purged   prometheus.Counter
+}
+
+// DLQ persists failed batches and replays them in the background until they are written or purged
+type DLQ struct {
+	cfg     Config
+	write   WriteFunc
+	logger  *zap.SugaredLogger
+	metrics metrics
+	// replayMu is held while an entry is replayed, DropLines holds it so that no batch is written with dropped lines
+	replayMu sync.Mutex
+	mu       sync.Mutex
+	entries  map[string]*Entry // index of the entries without their batch, batches are only read from disk when needed
+	seq      int
+	wake     chan struct{}
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func Open(cfg Config, write WriteFunc, logger *zap.SugaredLogger) (*DLQ, error) {
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DEFAULT_MIN_BACKOFF
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = max(DEFAULT_MAX_BACKOFF, cfg.MinBackoff)
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create dlq directory: %w", err)
+	}
+	q := &DLQ{
+		cfg:     cfg,
+		write:   write,
+		logger:  logger,
+		entries: make(map[string]*Entry),
+		wake:    make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	q.metrics = metrics{
+		batches: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "analytics_dlq_batches",
+			Help: "Number of batches in the dead-letter queue.",
+		}, func() float64 { return float64(q.Stats().Batches) }),
+		bytes: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "analytics_dlq_bytes",
+			Help: "Size of the batches in the dead-letter queue in bytes.",
+		}, func() float64 { return float64(q.Stats().Bytes) }),
+		age: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "analytics_dlq_oldest_batch_age_seconds",
+			Help: "Age of the oldest batch in the dead-letter queue, 0 if it is empty.",
+		}, func() float64 {
+			if oldest := q.Stats().Oldest; !oldest.IsZero() {
+				return time.Since(oldest).Seconds()
+			}
+			return 0
+		}),
+		enqueued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "analytics_dlq_enqueued_batches_total",
+			Help: "Number of batches added to the dead-letter queue.",
+		}),
+		replayed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "analytics_dlq_replayed_batches_total",
+			Help: "Number of replay attempts of dead-lettered batches.",
+		}, []string{"result"}),
+		purged: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "analytics_dlq_purged_batches_total",
+			Help: "Number of batches purged from the dead-letter queue.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{q.metrics.batches, q.metrics.bytes, q.metrics.age, q.metrics.enqueued, q.metrics.replayed, q.metrics.purged} {
+		if err := cfg.Registerer.Register(c); err != nil {
+			return nil, fmt.Errorf("register dlq metrics: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// load indexes the entries left by a previous run
+func (q *DLQ) load() error {
+	files, err := os.ReadDir(q.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("read dlq directory: %w", err)
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), entrySuffix) {
+			continue
+		}
+		e, err := q.read(strings.TrimSuffix(f.Name(), entrySuffix))
+		if err != nil {
+			// A torn write of a crashed run, the batch was never acknowledged as dead-lettered
+			q.logger.Warnf("Skipping unreadable dead-letter entry %s: %v", f.Name(), err)
+			continue
+		}
+		e.Batch = ""
+		q.entries[e.ID] = e
+	}
+	return nil
+}
+
+func (q *DLQ) path(id string) string {
+	return filepath.Join(q.cfg.Dir, id+entrySuffix)
+}
+
+func (q *DLQ) read(id string) (*Entry, error) {
+	data, err := os.ReadFile(q.path(id))
+	if err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	e.ID = id
+	return &e, nil
+}
+
+// persist writes the entry atomically, readers either see the old or the new version
+func (q *DLQ) persist(e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(e.ID) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(e.ID))
+}
+
+// Add dead-letters a batch that failed with err, the batch is on disk when Add returns
+func (q *DLQ) Add(batch string, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.seq++
+	e := &Entry{
+		ID:       fmt.Sprintf("%020d-%06d", now.UnixNano(), q.seq%1000000),
+		Time:     now,
+		Batch:    batch,
+		Size:     int64(len(batch)),
+		Error:    err.Error(),
+		Rejected: errors.Is(err, ErrRejected),
+	}
+	if err := q.persist(e); err != nil {
+		return fmt.Errorf("persist dead-letter entry: %w", err)
+	}
+	q.metrics.enqueued.Inc()
+	indexed := *e
+	indexed.Batch = ""
+	q.entries[e.ID] = &indexed
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *DLQ) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var st Stats
+	for _, e := range q.entries {
+		st.Batches++
+		st.Bytes += e.Size
+		if e.Rejected {
+			st.Rejected++
+		}
+		if st.Oldest.IsZero() || e.Time.Before(st.Oldest) {
+			st.Oldest = e.Time
+		}
+	}
+	return st
+}
+
+// List returns up to limit entries including their batches, oldest first
+func (q *DLQ) List(limit int) ([]Entry, error) {
+	q.mu.Lock()
+	ids := q.sortedIDs(func(*Entry) bool { return true })
+	q.mu.Unlock()
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		e, err := q.read(id)
+		if errors.Is(err, os.ErrNotExist) {
+			// Replayed or purged in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read dead-letter entry %s: %w", id, err)
+		}
+		entries = append(entries, *e)
+	}
+	return entries, nil
+}
+
+// Purge deletes the entries with the given ids and returns how many existed
+func (q *DLQ) Purge(ids ...string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	purged := 0
+	for _, id := range ids {
+		if _, ok := q.entries[id]; !ok {
+			continue
+		}
+		if err := q.remove(id); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	q.metrics.purged.Add(float64(purged))
+	return purged, nil
+}
+
+// PurgeAll deletes all entries and returns how many there were
+func (q *DLQ) PurgeAll() (int, error) {
+	q.mu.Lock()
+	ids := q.sortedIDs(func(*Entry) bool { return true })
+	q.mu.Unlock()
+	return q.Purge(ids...)
+}
+
+// DropLines removes the lines drop matches from the batches, e.g. the events of purged short URLs. Entries without
+// lines left are deleted. A replay in progress is finished first. It returns the number of dropped lines.
+func (q *DLQ) DropLines(drop func(line string) bool) (int, error) {
+	q.replayMu.Lock()
+	defer q.replayMu.Unlock()
+	q.mu.Lock()
+	ids := q.sortedIDs(func(*Entry) bool { return true })
+	q.mu.Unlock()
+	dropped := 0
+	for _, id := range ids {
+		e, err := q.read(id)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return dropped, fmt.Errorf("read dead-letter entry %s: %w", id, err)
+		}
+		lines := strings.Split(e.Batch, "\n")
+		kept := slices.DeleteFunc(slices.Clone(lines), func(line string) bool { return line != "" && drop(line) })
+		if len(kept) == len(lines) {
+			continue
+		}
+		if err := q.rewrite(e, kept); err != nil {
+			return dropped, err
+		}
+		dropped += len(lines) - len(kept)
+	}
+	return dropped, nil
+}
+
+// rewrite replaces the batch of the entry by the lines, or deletes the entry if no line is left
+func (q *DLQ) rewrite(e *Entry, lines []string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.entries[e.ID]; !ok {
+		return nil
+	}
+	if strings.TrimSpace(strings.Join(lines, "")) == "" {
+		q.metrics.purged.Inc()
+		return q.remove(e.ID)
+	}
+	e.Batch = strings.Join(lines, "\n")
+	e.Size = int64(len(e.Batch))
+	if err := q.persist(e); err != nil {
+		return fmt.Errorf("update dead-letter entry %s: %w", e.ID, err)
+	}
+	indexed := *e
+	indexed.Batch = ""
+	q.entries[e.ID] = &indexed
+	return nil
+}
+
+// remove deletes an entry, q.mu must be held
+func (q *DLQ) remove(id string) error {
+	if err := os.Remove(q.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("delete dead-letter entry %s: %w", id, err)
+	}
+	delete(q.entries, id)
+	return nil
+}
+
+// sortedIDs returns the ids of the entries matching keep, oldest first, q.mu must be held
+func (q *DLQ) sortedIDs(keep func(*Entry) bool) []string {
+	ids := make([]string, 0, len(q.entries))
+	for id, e := range q.entries {
+		if keep(e) {
+			ids = append(ids, id)
+		}
+	}
+	// ids start with the zero padded time they were added at
+	sort.Strings(ids)
+	return ids
+}
+
+// Start starts replaying the entries in the background until the DLQ is stopped or ctx is cancelled
+func (q *DLQ) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	q.cancel = cancel
+	q.done = make(chan struct{})
+	go q.run(ctx)
+	if st := q.Stats(); st.Batches > 0 {
+		q.logger.Infof("Replaying %d dead-lettered batches (%d rejected)", st.Batches, st.Rejected)
+	}
+	return nil
+}
+
+// Stop stops the replay, entries that were not replayed stay on disk for the next run
+func (q *DLQ) Stop(ctx context.Context) error {
+	if q.cancel == nil {
+		return nil
+	}
+	q.cancel()
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stop dlq replay: %w", ctx.Err())
+	}
+}
+
+func (q *DLQ) run(ctx context.Context) {
+	defer close(q.done)
+	backoff := q.cfg.MinBackoff
+	for {
+		q.mu.Lock()
+		ids := q.sortedIDs(func(e *Entry) bool { return !e.Rejected })
+		q.mu.Unlock()
+		if len(ids) == 0 {
+			select {
+			case <-q.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if q.replay(ctx, ids[0]) {
+			backoff = q.cfg.MinBackoff
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// Full jitter between half and the whole backoff, so that several instances don't replay in lockstep
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, q.cfg.MaxBackoff)
+	}
+}
+
+// replay writes a single entry, it returns false if the store should be given time to recover
+func (q *DLQ) replay(ctx context.Context, id string) bool {
+	q.replayMu.Lock()
+	defer q.replayMu.Unlock()
+	e, err := q.read(id)
+	if errors.Is(err, os.ErrNotExist) {
+		// Purged or dropped since the ids were listed
+		return true
+	}
+	if err != nil {
+		q.logger.Errorf("Dropping unreadable dead-letter entry %s: %v", id, err)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if err := q.remove(id); err != nil {
+			q.logger.Errorf("Failed to drop dead-letter entry %s: %v", id, err)
+		}
+		return true
+	}
+	err = q.write(ctx, e.Batch)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.entries[id]; !ok {
+		// Purged while it was replayed
+		return true
+	}
+	if err == nil {
+		q.metrics.replayed.WithLabelValues("success").Inc()
+		if err := q.remove(id); err != nil {
+			q.logger.Errorf("Failed to delete replayed dead-letter entry %s: %v", id, err)
+		}
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	e.Attempts++
+	e.Error = err.Error()
+	e.Rejected = errors.Is(err, ErrRejected)
+	if err := q.persist(e); err != nil {
+		q.logger.Errorf("Failed to update dead-letter entry %s: %v", id, err)
+	}
+	indexed := *e
+	indexed.Batch = ""
+	q.entries[id] = &indexed
+	if e.Rejected {
+		q.metrics.replayed.WithLabelValues("rejected").Inc()
+		q.logger.Errorf("Dead-lettered batch %s was rejected and won't be replayed again: %v", id, err)
+		return true
+	}
+	q.metrics.replayed.WithLabelValues("failure").Inc()
+	q.logger.Warnf("Failed to replay dead-lettered batch %s (attempt %d): %v", id, e.Attempts, err)
+	return false
+}
@@ -0,0 +1,183 @@
+package dlq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// fakeStore records written batches and fails while err is set
+type fakeStore struct {
+	mu      sync.Mutex
+	err     error
+	written []string
+}
+
+func (fs *fakeStore) write(ctx context.Context, batch string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.err != nil {
+		return fs.err
+	}
+	fs.written = append(fs.written, batch)
+	return nil
+}
+
+func (fs *fakeStore) setErr(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.err = err
+}
+
+func (fs *fakeStore) batches() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]string(nil), fs.written...)
+}
+
+func openTestDLQ(t *testing.T, dir string, fs *fakeStore) *DLQ {
+	q, err := Open(Config{Dir: dir, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, Registerer: prometheus.NewRegistry()},
+		fs.write, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed to open dlq: %v", err)
+	}
+	return q
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDLQPersistsEntries(t *testing.T) {
+	dir := t.TempDir()
+	q := openTestDLQ(t, dir, &fakeStore{})
+	if err := q.Add("m f=1 1", errors.New("timeout")); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := q.Add("m f=2 2", ErrRejected); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	q = openTestDLQ(t, dir, &fakeStore{})
+	st := q.Stats()
+	if st.Batches != 2 || st.Rejected != 1 || st.Bytes != 14 || st.Oldest.IsZero() {
+		t.Errorf("Unexpected stats after reopening %+v", st)
+	}
+	entries, err := q.List(10)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Batch != "m f=1 1" || entries[0].Error != "timeout" || !entries[1].Rejected {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
+
+func TestDLQReplay(t *testing.T) {
+	fs := &fakeStore{err: errors.New("unavailable")}
+	q := openTestDLQ(t, t.TempDir(), fs)
+	if err := q.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer q.Stop(context.Background())
+
+	q.Add("m f=1 1", errors.New("timeout"))
+	q.Add("m f=2 2", ErrRejected)
+	// The batch stays queued while the store fails
+	waitFor(t, func() bool {
+		entries, _ := q.List(1)
+		return len(entries) == 1 && entries[0].Attempts >= 2 && entries[0].Error == "unavailable"
+	})
+
+	fs.setErr(nil)
+	waitFor(t, func() bool { return q.Stats().Batches == 1 })
+	if written := fs.batches(); len(written) != 1 || written[0] != "m f=1 1" {
+		t.Errorf("Expected only the failed batch to be replayed, got %v", written)
+	}
+	if st := q.Stats(); st.Rejected != 1 {
+		t.Errorf("Expected the rejected batch to be kept, got %+v", st)
+	}
+}
+
+func TestDLQStopsWithTheStartContext(t *testing.T) {
+	q := openTestDLQ(t, t.TempDir(), &fakeStore{})
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := q.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	cancel()
+	select {
+	case <-q.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the replay to stop once the context of Start is cancelled")
+	}
+}
+
+func TestDLQReplayRejected(t *testing.T) {
+	fs := &fakeStore{err: ErrRejected}
+	q := openTestDLQ(t, t.TempDir(), fs)
+	q.Add("m f=1 1", errors.New("timeout"))
+	if err := q.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer q.Stop(context.Background())
+	waitFor(t, func() bool { return q.Stats().Rejected == 1 })
+	entries, err := q.List(10)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Attempts != 1 {
+		t.Errorf("Expected a single attempt, got %+v", entries)
+	}
+}
+
+func TestDLQPurge(t *testing.T) {
+	q := openTestDLQ(t, t.TempDir(), &fakeStore{})
+	for range 3 {
+		q.Add("m f=1 1", ErrRejected)
+	}
+	entries, err := q.List(1)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if n, err := q.Purge(entries[0].ID, "unknown"); err != nil || n != 1 {
+		t.Errorf("Expected 1 purged entry, got %d (%v)", n, err)
+	}
+	if n, err := q.PurgeAll(); err != nil || n != 2 {
+		t.Errorf("Expected 2 purged entries, got %d (%v)", n, err)
+	}
+	if st := q.Stats(); st.Batches != 0 || !st.Oldest.IsZero() {
+		t.Errorf("Expected an empty queue, got %+v", st)
+	}
+}
+
+func TestDLQDropLines(t *testing.T) {
+	dir := t.TempDir()
+	q := openTestDLQ(t, dir, &fakeStore{})
+	q.Add("m f=1 1\nm f=2 2\n", errors.New("timeout"))
+	q.Add("m f=2 3", errors.New("timeout"))
+	n, err := q.DropLines(func(line string) bool { return strings.Contains(line, "f=2") })
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 dropped lines, got %d (%v)", n, err)
+	}
+	// The rewritten entry survives a restart
+	entries, err := openTestDLQ(t, dir, &fakeStore{}).List(10)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Batch != "m f=1 1\n" || entries[0].Size != int64(len("m f=1 1\n")) {
+		t.Errorf("Expected a single entry with the first line, got %+v", entries)
+	}
+}
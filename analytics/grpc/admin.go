@@ -0,0 +1,184 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/mactavishz/kuerzen/analytics/audit"
+	"github.com/mactavishz/kuerzen/analytics/dlq"
+	pb "github.com/mactavishz/kuerzen/analytics/pb"
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DEFAULT_DEAD_LETTER_LIMIT = 20
+	MAX_DEAD_LETTER_LIMIT     = 1000
+	DEAD_LETTER_PREVIEW_SIZE  = 512 // Bytes of a batch included in the inspection
+
+	MAX_PURGED_SHORT_URLS = 10000
+	AUDIT_ACTION_PURGE    = "purge_link_analytics"
+)
+
+// AnalyticsAdminServer exposes the dead-letter queue and the erasure of analytics. The dead-letter RPCs are
+// unimplemented if the store has no queue, PurgeLinkAnalytics if the store can't erase or there is no audit log.
+type AnalyticsAdminServer struct {
+	pb.UnimplementedAnalyticsAdminServiceServer
+	dlq      *dlq.DLQ
+	erasable store.ErasableStore
+	audit    *audit.Log
+	logger   *zap.SugaredLogger
+}
+
+func NewAnalyticsAdminServer(q *dlq.DLQ, erasable store.ErasableStore, auditLog *audit.Log, logger *zap.SugaredLogger) *AnalyticsAdminServer {
+	return &AnalyticsAdminServer{
+		dlq:      q,
+		erasable: erasable,
+		audit:    auditLog,
+		logger:   logger,
+	}
+}
+
+func (s *AnalyticsAdminServer) InspectDeadLetters(ctx context.Context, req *pb.InspectDeadLettersRequest) (*pb.DeadLetterReport, error) {
+	if s.dlq == nil {
+		return nil, status.Error(codes.Unimplemented, "the analytics store has no dead-letter queue")
+	}
+	limit := DEFAULT_DEAD_LETTER_LIMIT
+	if req.Limit > 0 {
+		limit = min(int(req.Limit), MAX_DEAD_LETTER_LIMIT)
+	}
+	st := s.dlq.Stats()
+	entries, err := s.dlq.List(limit)
+	if err != nil {
+		s.logger.Errorw("Failed to list dead letters", "error", err)
+		return nil, status.Error(codes.Internal, "failed to read the dead-letter queue")
+	}
+	res := &pb.DeadLetterReport{
+		Batches:     int64(st.Batches),
+		Rejected:    int64(st.Rejected),
+		Bytes:       st.Bytes,
+		DeadLetters: make([]*pb.DeadLetter, len(entries)),
+	}
+	if !st.Oldest.IsZero() {
+		res.OldestTimestamp = st.Oldest.UnixMicro()
+	}
+	for i, e := range entries {
+		preview := e.Batch
+		if len(preview) > DEAD_LETTER_PREVIEW_SIZE {
+			preview = preview[:DEAD_LETTER_PREVIEW_SIZE]
+		}
+		res.DeadLetters[i] = &pb.DeadLetter{
+			Id:        e.ID,
+			Timestamp: e.Time.UnixMicro(),
+			Bytes:     e.Size,
+			Attempts:  int32(e.Attempts),
+			Rejected:  e.Rejected,
+			Error:     e.Error,
+			Preview:   preview,
+		}
+	}
+	return res, nil
+}
+
+func (s *AnalyticsAdminServer) PurgeDeadLetters(ctx context.Context, req *pb.PurgeDeadLettersRequest) (*pb.PurgeDeadLettersResponse, error) {
+	if s.dlq == nil {
+		return nil, status.Error(codes.Unimplemented, "the analytics store has no dead-letter queue")
+	}
+	if req.All == (len(req.Ids) > 0) {
+		return nil, status.Error(codes.InvalidArgument, "either ids or all is required")
+	}
+	var purged int
+	var err error
+	if req.All {
+		purged, err = s.dlq.PurgeAll()
+	} else {
+		purged, err = s.dlq.Purge(req.Ids...)
+	}
+	if purged > 0 {
+		s.logger.Warnw("Dead letters purged", "purged", purged, "all", req.All)
+	}
+	if err != nil {
+		s.logger.Errorw("Failed to purge dead letters", "error", err)
+		return nil, status.Errorf(codes.Internal, "purged %d batches, then failed to purge the rest", purged)
+	}
+	return &pb.PurgeDeadLettersResponse{Purged: int64(purged)}, nil
+}
+
+// PurgeLinkAnalytics deletes the analytics of the short URLs. The purge is only started once the request is recorded
+// in the audit log, its outcome is recorded as well.
+func (s *AnalyticsAdminServer) PurgeLinkAnalytics(ctx context.Context, req *pb.PurgeLinkAnalyticsRequest) (*pb.PurgeLinkAnalyticsResponse, error) {
+	if s.erasable == nil || s.audit == nil {
+		return nil, status.Error(codes.Unimplemented, "the analytics store can't purge analytics")
+	}
+	shortURLs := slices.DeleteFunc(slices.Clone(req.ShortUrls), func(shortURL string) bool { return shortURL == "" })
+	if len(shortURLs) == 0 && req.Owner == "" {
+		return nil, status.Error(codes.InvalidArgument, "short_urls or owner is required")
+	}
+	if req.Reason == "" {
+		return nil, status.Error(codes.InvalidArgument, "reason is required")
+	}
+	if req.Owner != "" {
+		owned, err := s.erasable.ShortURLsOfOwner(ctx, req.Owner)
+		if err != nil {
+			s.logger.Errorw("Failed to list the short URLs of an owner", "error", err)
+			return nil, status.Error(codes.Internal, "failed to list the short URLs of the owner")
+		}
+		shortURLs = append(shortURLs, owned...)
+	}
+	slices.Sort(shortURLs)
+	shortURLs = slices.Compact(shortURLs)
+	if len(shortURLs) > MAX_PURGED_SHORT_URLS {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d short URLs can be purged at once", MAX_PURGED_SHORT_URLS)
+	}
+
+	entry := audit.Entry{
+		Action:    AUDIT_ACTION_PURGE,
+		Result:    audit.RESULT_REQUESTED,
+		Actor:     req.RequestedBy,
+		Reason:    req.Reason,
+		Owner:     req.Owner,
+		ShortURLs: shortURLs,
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		entry.Peer = p.Addr.String()
+	}
+	if err := s.audit.Record(entry); err != nil {
+		s.logger.Errorw("Failed to record a purge in the audit log", "error", err)
+		return nil, status.Error(codes.Internal, "failed to write the audit log")
+	}
+	var err error
+	if len(shortURLs) > 0 {
+		err = s.purge(ctx, shortURLs)
+	}
+	entry.Result = audit.RESULT_SUCCEEDED
+	if err != nil {
+		entry.Result, entry.Error = audit.RESULT_FAILED, err.Error()
+	}
+	if auditErr := s.audit.Record(entry); auditErr != nil {
+		s.logger.Errorw("Failed to record the outcome of a purge in the audit log", "error", auditErr)
+	}
+	if err != nil {
+		s.logger.Errorw("Failed to purge link analytics", "error", err)
+		return nil, status.Error(codes.Internal, "failed to purge, the analytics may be partially purged")
+	}
+	return &pb.PurgeLinkAnalyticsResponse{ShortUrls: shortURLs}, nil
+}
+
+// purge drops the dead-lettered events of the short URLs before it deletes the stored ones, a replay would write them
+// again otherwise
+func (s *AnalyticsAdminServer) purge(ctx context.Context, shortURLs []string) error {
+	if s.dlq != nil {
+		dropped, err := s.dlq.DropLines(store.LinesOfShortURLs(shortURLs))
+		if err != nil {
+			return fmt.Errorf("drop dead-lettered events: %w", err)
+		}
+		if dropped > 0 {
+			s.logger.Infof("Dropped %d dead-lettered events of purged short URLs", dropped)
+		}
+	}
+	return s.erasable.PurgeLinks(ctx, shortURLs)
+}
@@ -0,0 +1,147 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mactavishz/kuerzen/analytics/audit"
+	"github.com/mactavishz/kuerzen/analytics/dlq"
+	pb "github.com/mactavishz/kuerzen/analytics/pb"
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdminDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	q, err := dlq.Open(dlq.Config{Dir: t.TempDir(), Registerer: prometheus.NewRegistry()},
+		func(ctx context.Context, batch string) error { return errors.New("unavailable") }, logger)
+	if err != nil {
+		t.Fatalf("failed to open dlq: %v", err)
+	}
+	q.Add(strings.Repeat("x", DEAD_LETTER_PREVIEW_SIZE+1), errors.New("timeout"))
+	q.Add("m f=1 1", dlq.ErrRejected)
+	s := NewAnalyticsAdminServer(q, nil, nil, logger)
+
+	report, err := s.InspectDeadLetters(ctx, &pb.InspectDeadLettersRequest{Limit: 1})
+	if err != nil {
+		t.Fatalf("InspectDeadLetters failed: %v", err)
+	}
+	if report.Batches != 2 || report.Rejected != 1 || len(report.DeadLetters) != 1 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if dl := report.DeadLetters[0]; len(dl.Preview) != DEAD_LETTER_PREVIEW_SIZE || dl.Bytes != DEAD_LETTER_PREVIEW_SIZE+1 || dl.Error != "timeout" {
+		t.Errorf("Unexpected dead letter %+v", dl)
+	}
+
+	_, err = s.PurgeDeadLetters(ctx, &pb.PurgeDeadLettersRequest{Ids: []string{"a"}, All: true})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for ids and all, got %v", err)
+	}
+	res, err := s.PurgeDeadLetters(ctx, &pb.PurgeDeadLettersRequest{Ids: []string{report.DeadLetters[0].Id}})
+	if err != nil || res.Purged != 1 {
+		t.Errorf("Expected 1 purged batch, got %v (%v)", res, err)
+	}
+	res, err = s.PurgeDeadLetters(ctx, &pb.PurgeDeadLettersRequest{All: true})
+	if err != nil || res.Purged != 1 {
+		t.Errorf("Expected 1 purged batch, got %v (%v)", res, err)
+	}
+
+	_, err = NewAnalyticsAdminServer(nil, nil, nil, logger).InspectDeadLetters(ctx, &pb.InspectDeadLettersRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected Unimplemented without a dlq, got %v", err)
+	}
+}
+
+func TestAdminPurgeLinkAnalytics(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := audit.Open(path, logger)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	ms := store.NewMemoryAnalyticsStore()
+	ms.WriteEvents(ctx, []store.Event{
+		&store.URLCreationEvent{ShortURL: "a", Owner: "alice", Success: true, Timestamp: time.Now()},
+		&store.URLRedirectEvent{ShortURL: "a", Success: true, Timestamp: time.Now()},
+		&store.URLRedirectEvent{ShortURL: "b", Success: true, Timestamp: time.Now()},
+		&store.URLRedirectEvent{ShortURL: "c", Success: true, Timestamp: time.Now()},
+	})
+	s := NewAnalyticsAdminServer(nil, ms, auditLog, logger)
+
+	_, err = s.PurgeLinkAnalytics(ctx, &pb.PurgeLinkAnalyticsRequest{Owner: "alice"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without a reason, got %v", err)
+	}
+	res, err := s.PurgeLinkAnalytics(ctx, &pb.PurgeLinkAnalyticsRequest{ShortUrls: []string{"b"}, Owner: "alice", Reason: "erasure request", RequestedBy: "ops"})
+	if err != nil {
+		t.Fatalf("PurgeLinkAnalytics failed: %v", err)
+	}
+	if !slices.Equal(res.ShortUrls, []string{"a", "b"}) {
+		t.Errorf("Expected a and b to be purged, got %v", res.ShortUrls)
+	}
+	top, _ := ms.TopLinks(ctx, 0, 10)
+	if want := []store.RankEntry{{Key: "c", Clicks: 1}}; !slices.Equal(top, want) {
+		t.Errorf("Expected only the clicks of c to be left, got %v", top)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"result":"requested"`) || !strings.Contains(lines[1], `"result":"succeeded"`) ||
+		!strings.Contains(lines[1], `"actor":"ops"`) {
+		t.Errorf("Expected the request and its outcome in the audit log, got %q", data)
+	}
+
+	_, err = NewAnalyticsAdminServer(nil, nil, nil, logger).PurgeLinkAnalytics(ctx, &pb.PurgeLinkAnalyticsRequest{Owner: "alice", Reason: "test"})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected Unimplemented without an erasable store, got %v", err)
+	}
+}
+
+func TestAdminPurgeDropsDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop().Sugar()
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"), logger)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	q, err := dlq.Open(dlq.Config{Dir: t.TempDir(), Registerer: prometheus.NewRegistry()},
+		func(ctx context.Context, batch string) error { return errors.New("unavailable") }, logger)
+	if err != nil {
+		t.Fatalf("failed to open dlq: %v", err)
+	}
+	kept := `EventURLRedirect,service=redirector short_url="c",success=true 1700000000000000000`
+	q.Add(strings.Join([]string{
+		`EventURLRedirect,service=redirector short_url="a",success=true 1700000000000000000`,
+		kept,
+		`EventURLCreation,service=shortener short_url="b",url="https://example.com",success=true 1700000000000000000`,
+	}, "\n"), errors.New("timeout"))
+	q.Add(`EventURLRedirect,service=redirector short_url="b",success=true 1700000000000000000`, errors.New("timeout"))
+	s := NewAnalyticsAdminServer(q, store.NewMemoryAnalyticsStore(), auditLog, logger)
+
+	if _, err := s.PurgeLinkAnalytics(ctx, &pb.PurgeLinkAnalyticsRequest{ShortUrls: []string{"a", "b"}, Reason: "test"}); err != nil {
+		t.Fatalf("PurgeLinkAnalytics failed: %v", err)
+	}
+	entries, err := q.List(10)
+	if err != nil {
+		t.Fatalf("failed to list dead letters: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Batch != kept {
+		t.Errorf("Expected only the event of c to be left in the dlq, got %+v", entries)
+	}
+}
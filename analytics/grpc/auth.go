@@ -0,0 +1,372 @@
+package grpc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/mactavishz/kuerzen/analytics/pb"
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// JWT_LEEWAY tolerates clock skew between the services when checking the expiry of a JWT
+	JWT_LEEWAY = 30 * time.Second
+	// DEFAULT_JWT_TTL is the lifetime of the JWTs issued by clients, they are renewed after half of it
+	DEFAULT_JWT_TTL = 5 * time.Minute
+)
+
+// DEFAULT_ALLOWLIST permits the RPCs the services of kuerzen call: the shortener records creation events and queries
+// the analytics, the redirector records redirect events and the admin commands call the admin service
+var DEFAULT_ALLOWLIST = map[string][]string{
+	"shortener":  {"CreateShortURLEvent", "RecordEvents", "StreamEvents", "GetLinkStats", "GetClickSeries", "TopLinks", "TopReferrers", "SubscribeEvents"},
+	"redirector": {"RedirectShortURLEvent", "RecordEvents", "StreamEvents"},
+	"admin":      {"AnalyticsAdminService/*", "ServerReflection/*"},
+}
+
+// PUBLIC_SERVICES are called without authentication, probes and load balancers check the health without credentials
+var PUBLIC_SERVICES = []string{healthpb.Health_ServiceDesc.ServiceName}
+
+// AuthConfig configures the authentication of the analytics server. Callers authenticate with a bearer token in the
+// authorization metadata: either a static token of Tokens, or a JWT (EdDSA) whose subject is the identity of the caller,
+// signed with the private key of that identity. The server only knows the public keys, so a caller can't issue JWTs
+// of other identities. Authentication is disabled if neither is set.
+type AuthConfig struct {
+	Tokens  map[string]string            // identity to token
+	JWTKeys map[string]ed25519.PublicKey // identity to the public key its JWTs are verified with
+	// Allowlist maps the identities to the RPCs they may call. An RPC is named by its method (RecordEvents), its
+	// service and method (AnalyticsService/RecordEvents), its full name (/pb.AnalyticsService/RecordEvents), all methods
+	// of a service (AnalyticsAdminService/*) or * for all RPCs. DEFAULT_ALLOWLIST if nil.
+	Allowlist map[string][]string
+}
+
+// Enabled reports whether callers have to authenticate
+func (c AuthConfig) Enabled() bool {
+	return len(c.Tokens) > 0 || len(c.JWTKeys) > 0
+}
+
+// ParseAllowlist parses identity:rpc,rpc;identity:rpc,... into an allowlist
+func ParseAllowlist(s string) (map[string][]string, error) {
+	allowlist := make(map[string][]string)
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		identity, rpcs, ok := strings.Cut(entry, ":")
+		identity = strings.TrimSpace(identity)
+		if !ok || identity == "" {
+			return nil, fmt.Errorf("invalid allowlist entry %q", entry)
+		}
+		for _, rpc := range strings.Split(rpcs, ",") {
+			if rpc = strings.TrimSpace(rpc); rpc != "" {
+				allowlist[identity] = append(allowlist[identity], rpc)
+			}
+		}
+	}
+	return allowlist, nil
+}
+
+// ParseTokens parses identity=token,identity=token into the tokens of an AuthConfig
+func ParseTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		identity, token, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || identity == "" || token == "" {
+			return nil, errors.New("invalid token entry, expected identity=token")
+		}
+		tokens[identity] = token
+	}
+	return tokens, nil
+}
+
+// ParseJWTKeys parses identity=key,identity=key into the JWT keys of an AuthConfig, the keys are base64 encoded Ed25519
+// public keys
+func ParseJWTKeys(s string) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		identity, key, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || identity == "" || key == "" {
+			return nil, errors.New("invalid key entry, expected identity=key")
+		}
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key of %s, expected %d base64 encoded bytes", identity, ed25519.PublicKeySize)
+		}
+		keys[identity] = ed25519.PublicKey(b)
+	}
+	return keys, nil
+}
+
+// ParseJWTPrivateKey parses a base64 encoded Ed25519 private key, or the seed it is derived from
+func ParseJWTPrivateKey(s string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	switch {
+	case err != nil:
+		return nil, errors.New("invalid private key, expected base64")
+	case len(b) == ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case len(b) == ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	default:
+		return nil, fmt.Errorf("invalid private key, expected %d or %d bytes", ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+}
+
+// caller is the authenticated identity of a request, kept in its context
+type caller struct {
+	identity string
+	auth     *Authenticator
+}
+
+type callerKey struct{}
+
+// IdentityFromContext returns the authenticated identity of the caller of an RPC
+func IdentityFromContext(ctx context.Context) (string, bool) {
+	c, ok := ctx.Value(callerKey{}).(caller)
+	return c.identity, ok
+}
+
+// eventPermitted reports whether the caller may record the event, which requires the RPC that records a single event
+// of its type. Batches may mix event types, so the RPCs of batches check every event. Without authentication every
+// event is permitted.
+func eventPermitted(ctx context.Context, event store.Event) bool {
+	c, ok := ctx.Value(callerKey{}).(caller)
+	if !ok {
+		return true
+	}
+	switch event.(type) {
+	case *store.URLCreationEvent:
+		return c.auth.Permits(c.identity, pb.AnalyticsService_CreateShortURLEvent_FullMethodName)
+	case *store.URLRedirectEvent:
+		return c.auth.Permits(c.identity, pb.AnalyticsService_RedirectShortURLEvent_FullMethodName)
+	}
+	return false
+}
+
+// Authenticator authenticates and authorizes the RPCs of the analytics server
+type Authenticator struct {
+	tokens    map[string]string
+	keys      map[string]ed25519.PublicKey
+	allowlist map[string][]string
+	logger    *zap.SugaredLogger
+}
+
+func NewAuthenticator(cfg AuthConfig, logger *zap.SugaredLogger) *Authenticator {
+	if cfg.Allowlist == nil {
+		cfg.Allowlist = DEFAULT_ALLOWLIST
+	}
+	return &Authenticator{
+		tokens:    cfg.Tokens,
+		keys:      cfg.JWTKeys,
+		allowlist: cfg.Allowlist,
+		logger:    logger,
+	}
+}
+
+// Permits reports whether the identity may call the RPC with the full method name
+func (a *Authenticator) Permits(identity string, fullMethod string) bool {
+	service, method, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	serviceName := service[strings.LastIndex(service, ".")+1:]
+	for _, rpc := range a.allowlist[identity] {
+		switch rpc {
+		case "*", fullMethod, method, serviceName + "/" + method, serviceName + "/*", "/" + service + "/*":
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the identity of the bearer token in the metadata of the context
+func (a *Authenticator) authenticate(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", errors.New("missing bearer token")
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok || token == "" {
+		return "", errors.New("malformed authorization")
+	}
+	if len(a.keys) > 0 && strings.Count(token, ".") == 2 {
+		return verifyJWT(a.keys, token, time.Now())
+	}
+	var identity string
+	for id, t := range a.tokens {
+		// Every token is compared to not leak through the timing which one matched
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			identity = id
+		}
+	}
+	if identity == "" {
+		return "", errors.New("unknown token")
+	}
+	return identity, nil
+}
+
+// authorize authenticates the caller of the RPC and checks the allowlist, the returned context carries the caller.
+// Calls of PUBLIC_SERVICES pass without a caller.
+func (a *Authenticator) authorize(ctx context.Context, fullMethod string) (context.Context, error) {
+	service, _, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if slices.Contains(PUBLIC_SERVICES, service) {
+		return ctx, nil
+	}
+	identity, err := a.authenticate(ctx)
+	if err != nil {
+		a.logger.Warnw("Unauthenticated analytics call", "method", fullMethod, "error", err)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !a.Permits(identity, fullMethod) {
+		a.logger.Warnw("Analytics call not permitted", "method", fullMethod, "identity", identity)
+		return nil, status.Errorf(codes.PermissionDenied, "%s may not call %s", identity, fullMethod)
+	}
+	return context.WithValue(ctx, callerKey{}, caller{identity: identity, auth: a}), nil
+}
+
+func (a *Authenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (a *Authenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authorizedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authorizedStream passes the context with the caller to the handler of a stream
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","typ":"JWT"}`))
+
+// SignJWT returns a JWT for the subject that expires after the TTL, signed with the Ed25519 key of the subject
+func SignJWT(key ed25519.PrivateKey, subject string, now time.Time, ttl time.Duration) (string, error) {
+	claims, err := json.Marshal(jwtClaims{Subject: subject, IssuedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()})
+	if err != nil {
+		return "", fmt.Errorf("encode JWT claims: %w", err)
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(unsigned))), nil
+}
+
+// verifyJWT checks the signature of an EdDSA JWT with the key of its subject and its expiry, and returns the subject
+func verifyJWT(keys map[string]ed25519.PublicKey, token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil || header.Alg != "EdDSA" {
+		return "", errors.New("unsupported JWT")
+	}
+	var claims jwtClaims
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(b, &claims) != nil {
+		return "", errors.New("malformed JWT claims")
+	}
+	// The claims are only trusted once the signature is checked with the key of the subject they name
+	key, ok := keys[claims.Subject]
+	if !ok {
+		return "", errors.New("JWT of an unknown subject")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return "", errors.New("invalid JWT signature")
+	}
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(JWT_LEEWAY)) {
+		return "", errors.New("expired JWT")
+	}
+	return claims.Subject, nil
+}
+
+// TokenCredentials sends a static bearer token with every RPC
+type TokenCredentials struct {
+	Token string
+}
+
+func (c TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.Token}, nil
+}
+
+// RequireTransportSecurity is true, the token would be readable on the network otherwise
+func (c TokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// JWTCredentials sends a JWT of the subject signed with its private key with every RPC, the JWT is renewed after half
+// of its TTL
+type JWTCredentials struct {
+	Subject string
+	Key     ed25519.PrivateKey
+	TTL     time.Duration // DEFAULT_JWT_TTL if 0
+	mu      sync.Mutex
+	token   string
+	renewAt time.Time
+}
+
+func (c *JWTCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); c.token == "" || !now.Before(c.renewAt) {
+		ttl := c.TTL
+		if ttl <= 0 {
+			ttl = DEFAULT_JWT_TTL
+		}
+		token, err := SignJWT(c.Key, c.Subject, now, ttl)
+		if err != nil {
+			return nil, err
+		}
+		c.token, c.renewAt = token, now.Add(ttl/2)
+	}
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+// RequireTransportSecurity is true, a JWT can be replayed by anyone who reads it until it expires
+func (c *JWTCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+var _ credentials.PerRPCCredentials = TokenCredentials{}
+var _ credentials.PerRPCCredentials = (*JWTCredentials)(nil)
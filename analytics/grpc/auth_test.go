@@ -0,0 +1,218 @@
+package grpc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mactavishz/kuerzen/analytics/pb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	_, testJWTKey, _  = ed25519.GenerateKey(rand.Reader)
+	_, otherJWTKey, _ = ed25519.GenerateKey(rand.Reader)
+)
+
+// startAuthServer starts an analytics gRPC server with TLS that authenticates with the tokens and JWTs of the tests, it
+// returns the TLS config of its clients
+func startAuthServer(t *testing.T) (*recordingStore, string, TLSConfig) {
+	t.Helper()
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	certFile, keyFile := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	creds, err := ServerCredentials(TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("ServerCredentials failed: %v", err)
+	}
+	rs := &recordingStore{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	auth := NewAuthenticator(AuthConfig{
+		Tokens: map[string]string{"shortener": "shortener-token", "redirector": "redirector-token"},
+		JWTKeys: map[string]ed25519.PublicKey{
+			"redirector": testJWTKey.Public().(ed25519.PublicKey),
+			"scraper":    otherJWTKey.Public().(ed25519.PublicKey),
+		},
+	}, zap.NewNop().Sugar())
+	srv := grpc.NewServer(grpc.Creds(creds), grpc.UnaryInterceptor(auth.UnaryServerInterceptor()), grpc.StreamInterceptor(auth.StreamServerInterceptor()))
+	pb.RegisterAnalyticsServiceServer(srv, NewAnalyticsGRPCServer(rs, nil, nil, nil, zap.NewNop().Sugar()))
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return rs, ln.Addr().String(), TLSConfig{Enabled: true, CAFile: caFile, ServerName: "localhost"}
+}
+
+func newAuthClient(t *testing.T, addr string, tlsCfg TLSConfig, creds credentials.PerRPCCredentials) pb.AnalyticsServiceClient {
+	t.Helper()
+	transport, err := ClientCredentials(tlsCfg, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("ClientCredentials failed: %v", err)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(transport)}
+	if creds != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(creds))
+	}
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewAnalyticsServiceClient(conn)
+}
+
+func TestAuthInterceptors(t *testing.T) {
+	_, addr, tlsCfg := startAuthServer(t)
+	ctx := context.Background()
+	redirect := &pb.RedirectShortURLEventRequest{ServiceName: "redirector", ShortUrl: "abc", Timestamp: time.Now().UnixMicro()}
+	expired, err := SignJWT(testJWTKey, "redirector", time.Now().Add(-time.Hour), time.Minute)
+	if err != nil {
+		t.Fatalf("SignJWT failed: %v", err)
+	}
+	tests := []struct {
+		name  string
+		creds credentials.PerRPCCredentials
+		code  codes.Code
+	}{
+		{"no credentials", nil, codes.Unauthenticated},
+		{"unknown token", TokenCredentials{Token: "guess"}, codes.Unauthenticated},
+		{"not permitted", TokenCredentials{Token: "shortener-token"}, codes.PermissionDenied},
+		{"token", TokenCredentials{Token: "redirector-token"}, codes.OK},
+		{"jwt", &JWTCredentials{Subject: "redirector", Key: testJWTKey}, codes.OK},
+		// An identity with a key of its own can't issue JWTs of another identity
+		{"jwt signed with the key of another identity", &JWTCredentials{Subject: "redirector", Key: otherJWTKey}, codes.Unauthenticated},
+		{"expired jwt", TokenCredentials{Token: expired}, codes.Unauthenticated},
+		{"jwt of an identity without a key", &JWTCredentials{Subject: "shortener", Key: testJWTKey}, codes.Unauthenticated},
+		{"jwt of an identity that isn't permitted", &JWTCredentials{Subject: "scraper", Key: otherJWTKey}, codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newAuthClient(t, addr, tlsCfg, tt.creds).RedirectShortURLEvent(ctx, redirect)
+			if code := status.Code(err); code != tt.code {
+				t.Errorf("Expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+
+	// Credentials are never sent over an insecure channel
+	for _, creds := range []credentials.PerRPCCredentials{TokenCredentials{Token: "redirector-token"}, &JWTCredentials{Subject: "redirector", Key: testJWTKey}} {
+		_, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithPerRPCCredentials(creds))
+		if err == nil {
+			t.Errorf("Expected %T to require TLS", creds)
+		}
+	}
+}
+
+func TestAuthRejectsEventsOfOtherServices(t *testing.T) {
+	rs, addr, tlsCfg := startAuthServer(t)
+	client := newAuthClient(t, addr, tlsCfg, TokenCredentials{Token: "shortener-token"})
+
+	// The redirect events of a batch of the shortener are refused like invalid events
+	ack, err := client.RecordEvents(context.Background(), &pb.EventBatch{Events: mixedEvents()})
+	if err != nil {
+		t.Fatalf("RecordEvents failed: %v", err)
+	}
+	if ack.Accepted != 1 || !slices.Equal(ack.FailedOffsets, []int32{1, 2, 3}) {
+		t.Errorf("Expected 1 accepted event and failed offsets [1 2 3], got %d and %v", ack.Accepted, ack.FailedOffsets)
+	}
+
+	stream, err := client.StreamEvents(context.Background())
+	if err != nil {
+		t.Fatalf("StreamEvents failed: %v", err)
+	}
+	for _, evt := range mixedEvents() {
+		if err := stream.Send(evt); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	ack, err = stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv failed: %v", err)
+	}
+	if ack.Accepted != 1 || !slices.Equal(ack.FailedOffsets, []int32{1, 2, 3}) {
+		t.Errorf("Expected 1 accepted event and failed offsets [1 2 3], got %d and %v", ack.Accepted, ack.FailedOffsets)
+	}
+	if creations, redirects := rs.counts(); creations != 2 || redirects != 0 {
+		t.Errorf("Expected only the creation events in the store, got %d and %d", creations, redirects)
+	}
+}
+
+func TestPermits(t *testing.T) {
+	auth := NewAuthenticator(AuthConfig{Allowlist: map[string][]string{
+		"a": {"RecordEvents"},
+		"b": {"AnalyticsAdminService/*"},
+		"c": {"/pb.AnalyticsService/GetLinkStats", "AnalyticsService/TopLinks"},
+		"d": {"*"},
+	}}, zap.NewNop().Sugar())
+	tests := []struct {
+		identity string
+		method   string
+		want     bool
+	}{
+		{"a", pb.AnalyticsService_RecordEvents_FullMethodName, true},
+		{"a", pb.AnalyticsService_StreamEvents_FullMethodName, false},
+		{"b", pb.AnalyticsAdminService_PurgeLinkAnalytics_FullMethodName, true},
+		{"b", pb.AnalyticsService_RecordEvents_FullMethodName, false},
+		{"c", pb.AnalyticsService_GetLinkStats_FullMethodName, true},
+		{"c", pb.AnalyticsService_TopLinks_FullMethodName, true},
+		{"c", pb.AnalyticsService_TopReferrers_FullMethodName, false},
+		{"d", pb.AnalyticsAdminService_InspectDeadLetters_FullMethodName, true},
+		{"e", pb.AnalyticsService_RecordEvents_FullMethodName, false},
+	}
+	for _, tt := range tests {
+		if got := auth.Permits(tt.identity, tt.method); got != tt.want {
+			t.Errorf("Permits(%s, %s) = %v, want %v", tt.identity, tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	allowlist, err := ParseAllowlist("shortener: CreateShortURLEvent, GetLinkStats ;redirector:RedirectShortURLEvent")
+	if err != nil {
+		t.Fatalf("ParseAllowlist failed: %v", err)
+	}
+	if !slices.Equal(allowlist["shortener"], []string{"CreateShortURLEvent", "GetLinkStats"}) || !slices.Equal(allowlist["redirector"], []string{"RedirectShortURLEvent"}) {
+		t.Errorf("Unexpected allowlist %v", allowlist)
+	}
+	if _, err := ParseAllowlist("RecordEvents"); err == nil {
+		t.Errorf("Expected an entry without identity to fail")
+	}
+	if _, err := ParseTokens("shortener"); err == nil {
+		t.Errorf("Expected a token entry without token to fail")
+	}
+}
+
+func TestParseJWTKeys(t *testing.T) {
+	pub := testJWTKey.Public().(ed25519.PublicKey)
+	keys, err := ParseJWTKeys("redirector=" + base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		t.Fatalf("ParseJWTKeys failed: %v", err)
+	}
+	if !keys["redirector"].Equal(pub) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	if _, err := ParseJWTKeys("redirector=c2VjcmV0"); err == nil {
+		t.Errorf("Expected a key of the wrong size to fail")
+	}
+	for _, encoded := range []string{base64.StdEncoding.EncodeToString(testJWTKey.Seed()), base64.StdEncoding.EncodeToString(testJWTKey)} {
+		key, err := ParseJWTPrivateKey(encoded)
+		if err != nil || !key.Equal(testJWTKey) {
+			t.Errorf("Expected the private key of %q, got %v", encoded, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package grpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/mactavishz/kuerzen/analytics/pb"
+	// Registers the client side health checks the healthCheckConfig of the service config turns on
+	_ "google.golang.org/grpc/health"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// STATIC_SCHEME resolves a fixed list of addresses, e.g. static:///localhost:3003,localhost:3004
+	STATIC_SCHEME = "static"
+	// DEFAULT_EVENT_TIMEOUT bounds a call recording events, DEFAULT_QUERY_TIMEOUT a query
+	DEFAULT_EVENT_TIMEOUT = 5 * time.Second
+	DEFAULT_QUERY_TIMEOUT = 5 * time.Second
+	// NATIVE_RETRY_MAX_ATTEMPTS is the most gRPC allows, the initial attempt included
+	NATIVE_RETRY_MAX_ATTEMPTS = 5
+)
+
+// The codes the channel retries with native retries, the same the send methods hand to retries.Do except
+// DEADLINE_EXCEEDED: the timeout of the service config covers all attempts
+var nativeRetryCodes = []string{"UNAVAILABLE", "INTERNAL", "RESOURCE_EXHAUSTED"}
+
+var (
+	eventMethods = []string{"CreateShortURLEvent", "RedirectShortURLEvent", "RecordEvents"}
+	queryMethods = []string{"GetLinkStats", "GetClickSeries", "TopLinks", "TopReferrers"}
+)
+
+type methodName struct {
+	Service string `json:"service"`
+	Method  string `json:"method,omitempty"`
+}
+
+type retryPolicy struct {
+	MaxAttempts          int      `json:"maxAttempts"`
+	InitialBackoff       string   `json:"initialBackoff"`
+	MaxBackoff           string   `json:"maxBackoff"`
+	BackoffMultiplier    float64  `json:"backoffMultiplier"`
+	RetryableStatusCodes []string `json:"retryableStatusCodes"`
+}
+
+type methodConfig struct {
+	Name        []methodName `json:"name"`
+	Timeout     string       `json:"timeout,omitempty"`
+	RetryPolicy *retryPolicy `json:"retryPolicy,omitempty"`
+}
+
+type retryThrottling struct {
+	MaxTokens  int     `json:"maxTokens"`
+	TokenRatio float64 `json:"tokenRatio"`
+}
+
+type healthCheckConfig struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type serviceConfig struct {
+	LoadBalancingConfig []map[string]struct{} `json:"loadBalancingConfig"`
+	HealthCheckConfig   healthCheckConfig     `json:"healthCheckConfig"`
+	MethodConfig        []methodConfig        `json:"methodConfig"`
+	RetryThrottling     *retryThrottling      `json:"retryThrottling,omitempty"`
+}
+
+// jsonDuration formats d the way service configs expect, in seconds with an "s" suffix
+func jsonDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+func methodNames(methods []string) []methodName {
+	names := make([]methodName, len(methods))
+	for i, m := range methods {
+		names[i] = methodName{Service: pb.AnalyticsService_ServiceDesc.ServiceName, Method: m}
+	}
+	return names
+}
+
+// ServiceConfig returns the service config of the channel: round_robin over every resolved address that reports
+// pb.AnalyticsService as SERVING to the health service, the timeouts of cfg per method and, with cfg.NativeRetries,
+// the retry policy of the unary methods. Streams have no timeout. Servers without the health service count as serving.
+func ServiceConfig(cfg ClientConfig) string {
+	eventTimeout, queryTimeout := cfg.EventTimeout, cfg.QueryTimeout
+	if eventTimeout <= 0 {
+		eventTimeout = DEFAULT_EVENT_TIMEOUT
+	}
+	if queryTimeout <= 0 {
+		queryTimeout = DEFAULT_QUERY_TIMEOUT
+	}
+	sc := serviceConfig{
+		LoadBalancingConfig: []map[string]struct{}{{"round_robin": {}}},
+		HealthCheckConfig:   healthCheckConfig{ServiceName: pb.AnalyticsService_ServiceDesc.ServiceName},
+		MethodConfig: []methodConfig{
+			{Name: methodNames(eventMethods), Timeout: jsonDuration(eventTimeout)},
+			{Name: methodNames(queryMethods), Timeout: jsonDuration(queryTimeout)},
+		},
+	}
+	if cfg.NativeRetries {
+		policy := &retryPolicy{
+			MaxAttempts:          NATIVE_RETRY_MAX_ATTEMPTS,
+			InitialBackoff:       "0.05s",
+			MaxBackoff:           "2s",
+			BackoffMultiplier:    2,
+			RetryableStatusCodes: nativeRetryCodes,
+		}
+		for i := range sc.MethodConfig {
+			sc.MethodConfig[i].RetryPolicy = policy
+		}
+		// Retries stop while more than half of the recent calls failed, so that an outage isn't multiplied
+		sc.RetryThrottling = &retryThrottling{MaxTokens: 10, TokenRatio: 0.1}
+	}
+	out, err := json.Marshal(sc)
+	if err != nil {
+		panic(fmt.Sprintf("marshal service config: %v", err))
+	}
+	return string(out)
+}
+
+// staticBuilder resolves static:///host:port,host:port to the listed addresses, for several servers without DNS
+type staticBuilder struct{}
+
+func (staticBuilder) Scheme() string {
+	return STATIC_SCHEME
+}
+
+func (staticBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	var addrs []resolver.Address
+	for _, addr := range strings.Split(target.Endpoint(), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, resolver.Address{Addr: addr})
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses in target %q", target.URL.String())
+	}
+	if err := cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+		return nil, fmt.Errorf("update resolver state: %w", err)
+	}
+	return staticResolver{}, nil
+}
+
+// OverrideAuthority uses the first address as the authority, which TLS verifies the server certificate against
+func (staticBuilder) OverrideAuthority(target resolver.Target) string {
+	first, _, _ := strings.Cut(target.Endpoint(), ",")
+	return strings.TrimSpace(first)
+}
+
+// staticResolver has nothing to resolve again, the addresses never change
+type staticResolver struct{}
+
+func (staticResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (staticResolver) Close() {}
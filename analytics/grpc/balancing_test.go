@@ -0,0 +1,162 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mactavishz/kuerzen/analytics/pb"
+	"github.com/mactavishz/kuerzen/breaker"
+	"github.com/mactavishz/kuerzen/retries"
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// startServers starts n analytics servers with health services that count their calls, failing fails the calls
+// with codes.Unavailable while it is above 0
+func startServers(t *testing.T, n int, failing *atomic.Int32) (string, []*atomic.Int32, []*health.Server) {
+	calls := make([]*atomic.Int32, n)
+	addrs := make([]string, n)
+	healths := make([]*health.Server, n)
+	for i := range calls {
+		count := &atomic.Int32{}
+		calls[i] = count
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		addrs[i] = ln.Addr().String()
+		srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			count.Add(1)
+			if failing != nil && failing.Add(-1) >= 0 {
+				return nil, status.Error(codes.Unavailable, "overloaded")
+			}
+			return handler(ctx, req)
+		}))
+		pb.RegisterAnalyticsServiceServer(srv, NewAnalyticsGRPCServer(&recordingStore{}, nil, nil, nil, zap.NewNop().Sugar()))
+		healths[i] = health.NewServer()
+		healths[i].SetServingStatus(pb.AnalyticsService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+		healthpb.RegisterHealthServer(srv, healths[i])
+		go srv.Serve(ln)
+		t.Cleanup(srv.Stop)
+	}
+	return STATIC_SCHEME + ":///" + strings.Join(addrs, ","), calls, healths
+}
+
+func TestClientBalancesRoundRobin(t *testing.T) {
+	target, calls, _ := startServers(t, 3, nil)
+	client, err := NewAnalyticsGRPCClient(target, ClientConfig{}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewAnalyticsGRPCClient failed: %v", err)
+	}
+	defer client.Close()
+	send := func() {
+		if err := client.SendURLCreationEvent(context.Background(), &astore.URLCreationEvent{ServiceName: "shortener", ShortURL: "abc"}); err != nil {
+			t.Fatalf("SendURLCreationEvent failed: %v", err)
+		}
+	}
+
+	// Calls only go to the connected servers, send until every server is connected
+	for i := 0; i < 100 && (calls[0].Load() == 0 || calls[1].Load() == 0 || calls[2].Load() == 0); i++ {
+		send()
+	}
+	for _, c := range calls {
+		c.Store(0)
+	}
+	for i := 0; i < 30; i++ {
+		send()
+	}
+	for i, c := range calls {
+		if got := c.Load(); got != 10 {
+			t.Errorf("Expected server %d to get 10 of 30 calls, got %d", i, got)
+		}
+	}
+}
+
+func TestClientSkipsServersThatAreNotServing(t *testing.T) {
+	target, calls, healths := startServers(t, 3, nil)
+	healths[1].SetServingStatus(pb.AnalyticsService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	client, err := NewAnalyticsGRPCClient(target, ClientConfig{}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewAnalyticsGRPCClient failed: %v", err)
+	}
+	defer client.Close()
+	send := func() {
+		if err := client.SendURLCreationEvent(context.Background(), &astore.URLCreationEvent{ServiceName: "shortener", ShortURL: "abc"}); err != nil {
+			t.Fatalf("SendURLCreationEvent failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 100 && (calls[0].Load() == 0 || calls[2].Load() == 0); i++ {
+		send()
+	}
+	for i := 0; i < 30; i++ {
+		send()
+	}
+	if got := calls[1].Load(); got != 0 {
+		t.Errorf("Expected the server that is not serving to get no calls, got %d", got)
+	}
+	if calls[0].Load() == 0 || calls[2].Load() == 0 {
+		t.Errorf("Expected the serving servers to share the calls, got %d and %d", calls[0].Load(), calls[2].Load())
+	}
+}
+
+func TestClientNativeRetries(t *testing.T) {
+	var failing atomic.Int32
+	target, calls, _ := startServers(t, 1, &failing)
+	client, err := NewAnalyticsGRPCClient(target, ClientConfig{NativeRetries: true}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewAnalyticsGRPCClient failed: %v", err)
+	}
+	defer client.Close()
+	event := &astore.URLCreationEvent{ServiceName: "shortener", ShortURL: "abc"}
+
+	failing.Store(2)
+	if err := client.SendURLCreationEvent(context.Background(), event); err != nil {
+		t.Fatalf("Expected the channel to retry, got %v", err)
+	}
+	if got := calls[0].Load(); got != 3 {
+		t.Errorf("Expected 3 attempts in a single call, got %d", got)
+	}
+
+	// Once the channel gave up, retries.Do must not retry again
+	failing.Store(100)
+	err = client.SendURLCreationEvent(context.Background(), event)
+	if errors.Is(err, retries.ErrTransient) || status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the final Unavailable error, got %v", err)
+	}
+}
+
+func TestClientBreakerFailsFast(t *testing.T) {
+	var failing atomic.Int32
+	target, calls, _ := startServers(t, 1, &failing)
+	client, err := NewAnalyticsGRPCClient(target, ClientConfig{}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewAnalyticsGRPCClient failed: %v", err)
+	}
+	defer client.Close()
+	b := breaker.New(breaker.Config{Name: "analytics", ConsecutiveFailures: 2}, zap.NewNop().Sugar())
+	client = client.WithBreaker(b).WithPolicy(retries.InteractivePolicy)
+	event := &astore.URLCreationEvent{ServiceName: "shortener", ShortURL: "abc"}
+
+	// The second attempt trips the breaker, the third isn't made
+	failing.Store(100)
+	err = client.SendURLCreationEvent(context.Background(), event)
+	if !errors.Is(err, breaker.ErrOpen) {
+		t.Fatalf("Expected the breaker to stop the retries, got %v", err)
+	}
+	if got := calls[0].Load(); got != 2 {
+		t.Errorf("Expected 2 attempts before the breaker opened, got %d", got)
+	}
+	if b.State() != breaker.Open {
+		t.Errorf("Expected the breaker to be open, got %s", b.State())
+	}
+}
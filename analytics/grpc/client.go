@@ -2,29 +2,91 @@ package grpc
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"time"
 
+	"github.com/mactavishz/kuerzen/analytics/live"
 	pb "github.com/mactavishz/kuerzen/analytics/pb"
+	"github.com/mactavishz/kuerzen/breaker"
 	"github.com/mactavishz/kuerzen/retries"
 	store "github.com/mactavishz/kuerzen/store/analytics"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
 )
 
+// BUDGET_DEPENDENCY names the retry budget the clients of a process share
+const BUDGET_DEPENDENCY = "analytics"
+
 type AnalyticsGRPCClient struct {
-	conn   *grpc.ClientConn
-	client pb.AnalyticsServiceClient
-	logger *zap.SugaredLogger
+	conn          *grpc.ClientConn
+	client        pb.AnalyticsServiceClient
+	policy        retries.Policy
+	breaker       *breaker.Breaker
+	nativeRetries bool
+	logger        *zap.SugaredLogger
+}
+
+// ClientConfig configures the security and the service config of the channel to the analytics service
+type ClientConfig struct {
+	TLS           TLSConfig
+	Credentials   credentials.PerRPCCredentials // authenticates the RPCs, nil if the server doesn't require authentication
+	EventTimeout  time.Duration                 // DEFAULT_EVENT_TIMEOUT if 0
+	QueryTimeout  time.Duration                 // DEFAULT_QUERY_TIMEOUT if 0
+	NativeRetries bool                          // the channel retries the unary calls instead of retries.Do
+}
+
+// ClientConfigFromEnv reads the TLS settings (see TLSConfigFromEnv) and the credentials of a client: <prefix>TOKEN for
+// a static bearer token, or <prefix>JWT_KEY, the private key of the identity for its JWTs. <prefix>IDENTITY overrides
+// the identity. Credentials require TLS.
+// <prefix>EVENT_TIMEOUT and <prefix>QUERY_TIMEOUT set the timeouts, <prefix>NATIVE_RETRIES=true the native retries.
+func ClientConfigFromEnv(prefix string, identity string) (ClientConfig, error) {
+	cfg := ClientConfig{TLS: TLSConfigFromEnv(prefix), NativeRetries: os.Getenv(prefix+"NATIVE_RETRIES") == "true"}
+	for name, d := range map[string]*time.Duration{"EVENT_TIMEOUT": &cfg.EventTimeout, "QUERY_TIMEOUT": &cfg.QueryTimeout} {
+		if v := os.Getenv(prefix + name); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil {
+				return cfg, fmt.Errorf("invalid %s%s: %w", prefix, name, err)
+			}
+		}
+	}
+	if v := os.Getenv(prefix + "JWT_KEY"); v != "" {
+		key, err := ParseJWTPrivateKey(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %sJWT_KEY: %w", prefix, err)
+		}
+		if v := os.Getenv(prefix + "IDENTITY"); v != "" {
+			identity = v
+		}
+		cfg.Credentials = &JWTCredentials{Subject: identity, Key: key}
+	} else if token := os.Getenv(prefix + "TOKEN"); token != "" {
+		cfg.Credentials = TokenCredentials{Token: token}
+	}
+	if cfg.Credentials != nil && !cfg.TLS.Enabled {
+		return cfg, fmt.Errorf("credentials are only sent with TLS, set %sTLS=true", prefix)
+	}
+	return cfg, nil
 }
 
-func NewAnalyticsGRPCClient(addr string, logger *zap.SugaredLogger) (*AnalyticsGRPCClient, error) {
+// NewAnalyticsGRPCClient creates a client of the analytics service at addr, a gRPC target. Names without a scheme are
+// resolved through DNS and the calls are balanced round robin over every address, static:///host:port,host:port
+// balances over a fixed list.
+func NewAnalyticsGRPCClient(addr string, cfg ClientConfig, logger *zap.SugaredLogger) (*AnalyticsGRPCClient, error) {
+	creds, err := ClientCredentials(cfg.TLS, logger)
+	if err != nil {
+		return nil, fmt.Errorf("set up TLS: %w", err)
+	}
 	dialOpts := []grpc.DialOption{
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithTransportCredentials(creds),
 		grpc.WithConnectParams(grpc.ConnectParams{
 			MinConnectTimeout: 30 * time.Second,
 		}),
@@ -33,6 +95,14 @@ func NewAnalyticsGRPCClient(addr string, logger *zap.SugaredLogger) (*AnalyticsG
 			Timeout:             60 * time.Second, // wait 60 seconds for ping responses
 			PermitWithoutStream: true,             // allow pings even without active streams
 		}),
+		// The trace context of the caller is sent in the metadata, health checks are not traced
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler(otelgrpc.WithFilter(filters.Not(filters.HealthCheck())))),
+		grpc.WithResolvers(staticBuilder{}),
+		grpc.WithDefaultServiceConfig(ServiceConfig(cfg)),
+	}
+
+	if cfg.Credentials != nil {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(cfg.Credentials))
 	}
 
 	// Connect to each client and send keys
@@ -41,99 +111,279 @@ func NewAnalyticsGRPCClient(addr string, logger *zap.SugaredLogger) (*AnalyticsG
 		return nil, err
 	}
 	return &AnalyticsGRPCClient{
-		conn:   conn,
-		client: pb.NewAnalyticsServiceClient(conn),
-		logger: logger,
+		conn:          conn,
+		client:        pb.NewAnalyticsServiceClient(conn),
+		policy:        retries.BackgroundPolicy.WithBudget(retries.BudgetFor(BUDGET_DEPENDENCY)),
+		nativeRetries: cfg.NativeRetries,
+		logger:        logger,
 	}, nil
 }
 
-func (ac *AnalyticsGRPCClient) SendURLCreationEvent(ctx context.Context, event *store.URLCreationEvent) func() retries.RetryableFuncObject {
-	req := &pb.CreateShortURLEventRequest{
-		ServiceName: event.ServiceName,
-		Url:         event.URL,
-		ApiVersion:  event.APIVer,
-		Success:     event.Success,
-		Timestamp:   event.Timestamp.UnixMicro(),
-	}
-	return func() retries.RetryableFuncObject {
-		var rfo retries.RetryableFuncObject
-		rfo.Ctx = ctx
-		rfo.Logger = ac.logger
-		select {
-		case <-ctx.Done():
-			ac.logger.Infof("SendURLCreationEvent operation cancelled: %v", ctx.Err())
-			rfo.Err = ctx.Err()
-			return rfo
-		default:
-		}
-		grpcCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		_, err := ac.client.CreateShortURLEvent(grpcCtx, req)
-		defer cancel()
-		if err != nil {
-			st, ok := status.FromError(err)
-			if ok {
-				if st.Code() == codes.Unavailable || st.Code() == codes.DeadlineExceeded || st.Code() == codes.Internal || st.Code() == codes.ResourceExhausted {
-					ac.logger.Infof("Attempt to send URL creation event failed (%s), retrying: %v", st.Code().String(), err)
-					rfo.Err = retries.ErrTransient
-					return rfo
-				}
-				ac.logger.Errorf("Failed to send URL creation event (non-retryable gRPC error %s): %v", st.Code().String(), err)
-				rfo.Err = err
-				return rfo
+// WithPolicy returns a client on the same connection that retries with policy the calls whose context has no policy of
+// retries.ContextWithPolicy, retries.BackgroundPolicy by default.
+// The retries take from the budget of BUDGET_DEPENDENCY unless policy has a budget.
+func (ac *AnalyticsGRPCClient) WithPolicy(policy retries.Policy) *AnalyticsGRPCClient {
+	c := *ac
+	if policy.Budget == nil {
+		policy.Budget = ac.policy.Budget
+	}
+	c.policy = policy
+	return &c
+}
+
+// WithBreaker returns a client on the same connection whose attempts go through b, so that they fail fast while the
+// service is down. Clients derived from it with WithPolicy share b. Streams bypass the breaker.
+func (ac *AnalyticsGRPCClient) WithBreaker(b *breaker.Breaker) *AnalyticsGRPCClient {
+	c := *ac
+	c.breaker = b
+	return &c
+}
+
+// transient marks an error for retries.Do to retry. With native retries the channel already retried it, and err is
+// returned as is so that the attempts aren't multiplied.
+func (ac *AnalyticsGRPCClient) transient(err error) error {
+	if ac.nativeRetries {
+		return err
+	}
+	return retries.Transient(err)
+}
+
+// call makes a single attempt of an RPC, name describes it in the logs. The errors of an unreachable or overloaded
+// service are transient.
+func call[T any](ac *AnalyticsGRPCClient, ctx context.Context, name string, rpc func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	select {
+	case <-ctx.Done():
+		ac.logger.Infof("Attempt to %s cancelled: %v", name, ctx.Err())
+		return zero, ctx.Err()
+	default:
+	}
+	done, err := ac.breaker.Allow()
+	if err != nil {
+		ac.logger.Warnf("Failed to %s: %v", name, err)
+		return zero, err
+	}
+	// The service config sets the timeout
+	res, err := rpc(ctx)
+	if err != nil {
+		st, ok := status.FromError(err)
+		if ok {
+			if st.Code() == codes.Unavailable || st.Code() == codes.DeadlineExceeded || st.Code() == codes.Internal || st.Code() == codes.ResourceExhausted {
+				done(true)
+				ac.logger.Infof("Attempt to %s failed (%s), retrying: %v", name, st.Code().String(), err)
+				return zero, ac.transient(err)
 			}
-			ac.logger.Infof("Attempt to send URL creation event failed (non-gRPC error), retrying: %v", err)
-			rfo.Err = retries.ErrTransient
-			return rfo
+			// The service answered, it is up
+			done(false)
+			ac.logger.Errorf("Failed to %s (non-retryable gRPC error %s): %v", name, st.Code().String(), err)
+			return zero, err
 		}
+		done(true)
+		ac.logger.Infof("Attempt to %s failed (non-gRPC error), retrying: %v", name, err)
+		return zero, ac.transient(err)
+	}
+	done(false)
+	return res, nil
+}
+
+// retried calls the RPC until it succeeds or fails permanently, with the policy of ctx or else of the client
+func retried[T any](ac *AnalyticsGRPCClient, ctx context.Context, name string, rpc func(ctx context.Context) (T, error)) (T, error) {
+	return retries.Do(ctx, retries.PolicyFromContext(ctx, ac.policy), func(ctx context.Context) (T, error) {
+		return call(ac, ctx, name, rpc)
+	})
+}
+
+func (ac *AnalyticsGRPCClient) SendURLCreationEvent(ctx context.Context, event *store.URLCreationEvent) error {
+	ensureEventID(event)
+	req := creationRequestFromEvent(event)
+	_, err := retried(ac, ctx, "send URL creation event", func(ctx context.Context) (*pb.EventResponse, error) {
+		return ac.client.CreateShortURLEvent(ctx, req)
+	})
+	if err == nil {
 		ac.logger.Infof("Successfully sent URL creation event to Analytics Service.")
-		rfo.Err = nil
-		return rfo
-	}
-}
-
-func (ac *AnalyticsGRPCClient) SendURLRedirectEvent(ctx context.Context, event *store.URLRedirectEvent) func() retries.RetryableFuncObject {
-	req := &pb.RedirectShortURLEventRequest{
-		ServiceName: event.ServiceName,
-		ShortUrl:    event.ShortURL,
-		LongUrl:     event.LongURL,
-		ApiVersion:  event.APIVer,
-		Success:     event.Success,
-		Timestamp:   event.Timestamp.UnixMicro(),
-	}
-	return func() retries.RetryableFuncObject {
-		var rfo retries.RetryableFuncObject
-		rfo.Ctx = ctx
-		rfo.Logger = ac.logger
-		select {
-		case <-ctx.Done():
-			ac.logger.Infof("SendURLRedirectEvent operation cancelled: %v", ctx.Err())
-			rfo.Err = ctx.Err()
-			return rfo
-		default:
+	}
+	return err
+}
+
+func (ac *AnalyticsGRPCClient) SendURLRedirectEvent(ctx context.Context, event *store.URLRedirectEvent) error {
+	ensureEventID(event)
+	req := redirectRequestFromEvent(event)
+	_, err := retried(ac, ctx, "send URL redirect event", func(ctx context.Context) (*pb.EventResponse, error) {
+		return ac.client.RedirectShortURLEvent(ctx, req)
+	})
+	if err == nil {
+		ac.logger.Infof("Successfully sent URL redirect event to Analytics Service.")
+	}
+	return err
+}
+
+// SendEvents sends a batch of mixed events in a single RecordEvents call, retrying transient failures.
+// It returns the offsets of the events the analytics service rejected.
+func (ac *AnalyticsGRPCClient) SendEvents(ctx context.Context, events []store.Event) ([]int32, error) {
+	return retried(ac, ctx, "send event batch", ac.recordEvents(events))
+}
+
+func (ac *AnalyticsGRPCClient) recordEvents(events []store.Event) func(ctx context.Context) ([]int32, error) {
+	req := &pb.EventBatch{Events: make([]*pb.Event, len(events))}
+	for i, event := range events {
+		ensureEventID(event)
+		req.Events[i] = envelopeFromEvent(event)
+	}
+	return func(ctx context.Context) ([]int32, error) {
+		ack, err := ac.client.RecordEvents(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if len(ack.FailedOffsets) > 0 {
+			ac.logger.Warnf("Analytics Service rejected %d of %d events: %s", len(ack.FailedOffsets), len(events), ack.Message)
 		}
-		grpcCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		_, err := ac.client.RedirectShortURLEvent(grpcCtx, req)
-		defer cancel()
+		ac.logger.Infof("Successfully sent %d events to Analytics Service.", ack.Accepted)
+		return ack.FailedOffsets, nil
+	}
+}
+
+// linkStats are the results of GetLinkStats
+type linkStats struct {
+	stats    *store.LinkStats
+	visitors *store.VisitorStats
+}
+
+// GetLinkStats queries the click summary and the unique visitors of a short URL
+func (ac *AnalyticsGRPCClient) GetLinkStats(ctx context.Context, shortURL string, since time.Duration) (*store.LinkStats, *store.VisitorStats, error) {
+	req := &pb.LinkStatsRequest{ShortUrl: shortURL, RangeSeconds: int64(since / time.Second)}
+	res, err := retried(ac, ctx, "query link stats", func(ctx context.Context) (linkStats, error) {
+		res, err := ac.client.GetLinkStats(ctx, req)
 		if err != nil {
-			st, ok := status.FromError(err)
-			if ok {
-				if st.Code() == codes.Unavailable || st.Code() == codes.DeadlineExceeded || st.Code() == codes.Internal || st.Code() == codes.ResourceExhausted {
-					ac.logger.Infof("Attempt to send URL redirect event failed (%s), retrying: %v", st.Code().String(), err)
-					rfo.Err = retries.ErrTransient
-					return rfo
-				}
-				ac.logger.Errorf("Failed to send URL redirect event (non-retryable gRPC error %s): %v", st.Code().String(), err)
-				rfo.Err = err
-				return rfo
-			}
-			ac.logger.Infof("Attempt to send URL redirect event failed (non-gRPC error), retrying: %v", err)
-			rfo.Err = retries.ErrTransient
-			return rfo
+			return linkStats{}, err
 		}
-		ac.logger.Infof("Successfully sent URL redirect event to Analytics Service.")
-		rfo.Err = nil
-		return rfo
+		stats := &store.LinkStats{ShortURL: res.ShortUrl, Clicks: res.Clicks}
+		if res.Clicks > 0 {
+			stats.FirstClick = time.UnixMicro(res.FirstClick)
+			stats.LastClick = time.UnixMicro(res.LastClick)
+		}
+		visitors := &store.VisitorStats{ShortURL: res.ShortUrl, Visitors: res.UniqueVisitors, Daily: make([]store.DailyVisitors, len(res.DailyVisitors))}
+		for i, d := range res.DailyVisitors {
+			visitors.Daily[i] = store.DailyVisitors{Day: time.UnixMicro(d.Day).UTC(), Visitors: d.Visitors}
+		}
+		return linkStats{stats: stats, visitors: visitors}, nil
+	})
+	return res.stats, res.visitors, err
+}
+
+// GetClickSeries queries the clicks of a short URL per interval
+func (ac *AnalyticsGRPCClient) GetClickSeries(ctx context.Context, shortURL string, interval time.Duration, since time.Duration) ([]store.ClickCount, error) {
+	req := &pb.ClickSeriesRequest{ShortUrl: shortURL, IntervalSeconds: int64(interval / time.Second), RangeSeconds: int64(since / time.Second)}
+	return retried(ac, ctx, "query click series", func(ctx context.Context) ([]store.ClickCount, error) {
+		res, err := ac.client.GetClickSeries(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		series := make([]store.ClickCount, len(res.Points))
+		for i, p := range res.Points {
+			series[i] = store.ClickCount{Time: time.UnixMicro(p.Timestamp), Clicks: p.Clicks}
+		}
+		return series, nil
+	})
+}
+
+// TopLinks queries the most clicked short URLs
+func (ac *AnalyticsGRPCClient) TopLinks(ctx context.Context, since time.Duration, limit int) ([]store.RankEntry, error) {
+	req := &pb.TopLinksRequest{RangeSeconds: int64(since / time.Second), Limit: int32(limit)}
+	return retried(ac, ctx, "query top links", func(ctx context.Context) ([]store.RankEntry, error) {
+		res, err := ac.client.TopLinks(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return fromRankResponse(res), nil
+	})
+}
+
+// TopReferrers queries the referrer hosts with the most clicks
+func (ac *AnalyticsGRPCClient) TopReferrers(ctx context.Context, shortURL string, since time.Duration, limit int) ([]store.RankEntry, error) {
+	req := &pb.TopReferrersRequest{ShortUrl: shortURL, RangeSeconds: int64(since / time.Second), Limit: int32(limit)}
+	return retried(ac, ctx, "query top referrers", func(ctx context.Context) ([]store.RankEntry, error) {
+		res, err := ac.client.TopReferrers(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return fromRankResponse(res), nil
+	})
+}
+
+// EventSubscription receives the events of SubscribeEvents
+type EventSubscription struct {
+	stream grpc.ServerStreamingClient[pb.LiveEvent]
+}
+
+// Recv blocks until the next event arrives, dropped is the number of events the analytics service dropped before it
+// because the subscriber was too slow. Subscribers that fall behind for too long fail with codes.ResourceExhausted.
+func (es *EventSubscription) Recv() (event store.Event, dropped int64, err error) {
+	msg, err := es.stream.Recv()
+	if err != nil {
+		return nil, 0, err
+	}
+	event, err = eventFromEnvelope(msg.Event)
+	if err != nil {
+		return nil, 0, err
+	}
+	return event, msg.Dropped, nil
+}
+
+// SubscribeEvents subscribes to the events recorded after it returns, the subscription ends when ctx is done.
+// Unlike the other methods it is not retried, subscribers resubscribe once Recv fails.
+func (ac *AnalyticsGRPCClient) SubscribeEvents(ctx context.Context, filter live.Filter) (*EventSubscription, error) {
+	stream, err := ac.client.SubscribeEvents(ctx, &pb.SubscribeRequest{
+		ShortUrls: filter.ShortURLs,
+		Owner:     filter.Owner,
+		Creations: filter.Creations,
+		Redirects: filter.Redirects,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The server sends the headers once the subscription is in place
+	if _, err := stream.Header(); err != nil {
+		return nil, err
+	}
+	return &EventSubscription{stream: stream}, nil
+}
+
+func fromRankResponse(res *pb.RankResponse) []store.RankEntry {
+	entries := make([]store.RankEntry, len(res.Entries))
+	for i, e := range res.Entries {
+		entries[i] = store.RankEntry{Key: e.Key, Clicks: e.Clicks}
+	}
+	return entries
+}
+
+// CheckConnectivity reports whether the connection to the analytics service is ready and the service is serving.
+// An idle connection is asked to connect and the check waits for the connection to settle until ctx expires.
+// Servers without the health service are taken as serving once connected.
+func (ac *AnalyticsGRPCClient) CheckConnectivity(ctx context.Context) error {
+	state := ac.conn.GetState()
+	if state == connectivity.Idle {
+		ac.conn.Connect()
+	}
+	for state != connectivity.Ready {
+		if state == connectivity.TransientFailure || state == connectivity.Shutdown {
+			return fmt.Errorf("analytics connection is %s", state)
+		}
+		if !ac.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("analytics connection is %s: %w", state, ctx.Err())
+		}
+		state = ac.conn.GetState()
+	}
+	res, err := healthpb.NewHealthClient(ac.conn).Check(ctx, &healthpb.HealthCheckRequest{Service: pb.AnalyticsService_ServiceDesc.ServiceName})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("analytics health check: %w", err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("analytics service is %s", res.Status)
 	}
+	return nil
 }
 
 func (ac *AnalyticsGRPCClient) Close() error {
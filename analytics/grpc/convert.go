@@ -0,0 +1,142 @@
+package grpc
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	pb "github.com/mactavishz/kuerzen/analytics/pb"
+	store "github.com/mactavishz/kuerzen/store/analytics"
+)
+
+var ErrInvalidEvent = errors.New("invalid event")
+
+// ensureEventID assigns an id to events that have none yet, it must be called once before the first attempt to send
+// an event, so that the analytics service recognizes retries of the event
+func ensureEventID(event store.Event) {
+	switch e := event.(type) {
+	case *store.URLCreationEvent:
+		if e.EventID == "" {
+			e.EventID = uuid.NewString()
+		}
+	case *store.URLRedirectEvent:
+		if e.EventID == "" {
+			e.EventID = uuid.NewString()
+		}
+	}
+}
+
+func creationRequestFromEvent(event *store.URLCreationEvent) *pb.CreateShortURLEventRequest {
+	return &pb.CreateShortURLEventRequest{
+		EventId:     event.EventID,
+		ServiceName: event.ServiceName,
+		Url:         event.URL,
+		ApiVersion:  event.APIVer,
+		Success:     event.Success,
+		Timestamp:   event.Timestamp.UnixMicro(),
+		ShortUrl:    event.ShortURL,
+		Owner:       event.Owner,
+	}
+}
+
+func redirectRequestFromEvent(event *store.URLRedirectEvent) *pb.RedirectShortURLEventRequest {
+	return &pb.RedirectShortURLEventRequest{
+		EventId:     event.EventID,
+		ServiceName: event.ServiceName,
+		ShortUrl:    event.ShortURL,
+		LongUrl:     event.LongURL,
+		ApiVersion:  event.APIVer,
+		Success:     event.Success,
+		Timestamp:   event.Timestamp.UnixMicro(),
+
+		ReferrerHost:   event.ReferrerHost,
+		Browser:        event.Browser,
+		Os:             event.OS,
+		Device:         event.Device,
+		AcceptLanguage: event.AcceptLanguage,
+		Ip:             event.IP,
+		ClientIp:       event.ClientIP,
+		CacheTier:      event.CacheTier,
+		LatencyUs:      event.Latency.Microseconds(),
+		VisitorId:      event.VisitorID,
+		BotClass:       event.BotClass,
+	}
+}
+
+func creationEventFromRequest(req *pb.CreateShortURLEventRequest) *store.URLCreationEvent {
+	return &store.URLCreationEvent{
+		EventID:     req.EventId,
+		ServiceName: req.ServiceName,
+		URL:         req.Url,
+		APIVer:      req.ApiVersion,
+		Success:     req.Success,
+		Timestamp:   time.UnixMicro(req.Timestamp),
+		ShortURL:    req.ShortUrl,
+		Owner:       req.Owner,
+	}
+}
+
+func redirectEventFromRequest(req *pb.RedirectShortURLEventRequest) *store.URLRedirectEvent {
+	return &store.URLRedirectEvent{
+		EventID:     req.EventId,
+		ServiceName: req.ServiceName,
+		ShortURL:    req.ShortUrl,
+		LongURL:     req.LongUrl,
+		APIVer:      req.ApiVersion,
+		Success:     req.Success,
+		Timestamp:   time.UnixMicro(req.Timestamp),
+
+		ReferrerHost:   req.ReferrerHost,
+		Browser:        req.Browser,
+		OS:             req.Os,
+		Device:         req.Device,
+		AcceptLanguage: req.AcceptLanguage,
+		IP:             req.Ip,
+		ClientIP:       req.ClientIp,
+		CacheTier:      req.CacheTier,
+		Latency:        time.Duration(req.LatencyUs) * time.Microsecond,
+		VisitorID:      req.VisitorId,
+		BotClass:       req.BotClass,
+	}
+}
+
+func eventID(event store.Event) string {
+	switch e := event.(type) {
+	case *store.URLCreationEvent:
+		return e.EventID
+	case *store.URLRedirectEvent:
+		return e.EventID
+	default:
+		return ""
+	}
+}
+
+// envelopeFromEvent wraps an event of any type into the envelope used by the batch RPCs
+func envelopeFromEvent(event store.Event) *pb.Event {
+	switch e := event.(type) {
+	case *store.URLCreationEvent:
+		return &pb.Event{Event: &pb.Event_Creation{Creation: creationRequestFromEvent(e)}}
+	case *store.URLRedirectEvent:
+		return &pb.Event{Event: &pb.Event_Redirect{Redirect: redirectRequestFromEvent(e)}}
+	default:
+		return &pb.Event{}
+	}
+}
+
+// eventFromEnvelope unwraps and validates an event received by the batch RPCs
+func eventFromEnvelope(env *pb.Event) (store.Event, error) {
+	switch e := env.GetEvent().(type) {
+	case *pb.Event_Creation:
+		if e.Creation.ServiceName == "" || e.Creation.Timestamp <= 0 {
+			return nil, ErrInvalidEvent
+		}
+		return creationEventFromRequest(e.Creation), nil
+	case *pb.Event_Redirect:
+		if e.Redirect.ServiceName == "" || e.Redirect.Timestamp <= 0 {
+			return nil, ErrInvalidEvent
+		}
+		return redirectEventFromRequest(e.Redirect), nil
+	default:
+		return nil, ErrInvalidEvent
+	}
+}
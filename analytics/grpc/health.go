@@ -0,0 +1,135 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/mactavishz/kuerzen/analytics/pb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	DEFAULT_HEALTH_INTERVAL = 5 * time.Second
+	// HEALTH_CHECK_TIMEOUT bounds a round of checks, a check that doesn't return in time fails
+	HEALTH_CHECK_TIMEOUT = 3 * time.Second
+)
+
+// HealthCheck returns an error if the analytics service can't record events
+type HealthCheck func(ctx context.Context) error
+
+// HealthReporter serves grpc.health.v1.Health and drives the serving status of the analytics service from its checks.
+// The overall status ("") follows the analytics service, the admin service keeps serving while the checks fail so
+// that the dead letters can be inspected.
+type HealthReporter struct {
+	server   *health.Server
+	interval time.Duration
+	checks   map[string]HealthCheck
+	logger   *zap.SugaredLogger
+	mu       sync.Mutex
+	failing  error // the failure of the last round, nil if serving
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewHealthReporter creates a reporter checking every interval, DEFAULT_HEALTH_INTERVAL if 0.
+// Everything is NOT_SERVING until the first round of checks passed.
+func NewHealthReporter(interval time.Duration, logger *zap.SugaredLogger) *HealthReporter {
+	if interval <= 0 {
+		interval = DEFAULT_HEALTH_INTERVAL
+	}
+	r := &HealthReporter{
+		server:   health.NewServer(),
+		interval: interval,
+		checks:   make(map[string]HealthCheck),
+		logger:   logger,
+		failing:  errors.New("not checked yet"),
+	}
+	r.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	r.server.SetServingStatus(pb.AnalyticsAdminService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	return r
+}
+
+// Server returns the health service to register on the grpc server
+func (r *HealthReporter) Server() healthpb.HealthServer {
+	return r.server
+}
+
+// AddCheck adds a check by name, it has to be called before Start
+func (r *HealthReporter) AddCheck(name string, check HealthCheck) {
+	r.checks[name] = check
+}
+
+func (r *HealthReporter) setStatus(st healthpb.HealthCheckResponse_ServingStatus) {
+	r.server.SetServingStatus("", st)
+	r.server.SetServingStatus(pb.AnalyticsService_ServiceDesc.ServiceName, st)
+}
+
+// Start runs the checks in the background right away and then every interval, it doesn't wait for the first round
+func (r *HealthReporter) Start(ctx context.Context) error {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	go r.loop(ctx)
+	return nil
+}
+
+// Stop sets every service to NOT_SERVING, clients watching the health stop sending before the grpc server stops
+func (r *HealthReporter) Stop(ctx context.Context) error {
+	r.server.Shutdown()
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *HealthReporter) loop(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.Run(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run runs the checks once and updates the serving status, it returns the first failure
+func (r *HealthReporter) Run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	var failing error
+	for name, check := range r.checks {
+		if err := check(ctx); err != nil {
+			failing = fmt.Errorf("%s: %w", name, err)
+			break
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case failing != nil && r.failing == nil:
+		r.logger.Warnf("Analytics service is not serving: %v", failing)
+	case failing == nil && r.failing != nil:
+		r.logger.Infof("Analytics service is serving")
+	}
+	r.failing = failing
+	if failing != nil {
+		r.setStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	} else {
+		r.setStatus(healthpb.HealthCheckResponse_SERVING)
+	}
+	return failing
+}
@@ -0,0 +1,138 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mactavishz/kuerzen/analytics/pb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+)
+
+// waitForConnectivity polls CheckConnectivity until it reports whether the service serves, the connection follows
+// the serving status with the delay of the health checks of the channel. It returns the last result otherwise.
+func waitForConnectivity(client *AnalyticsGRPCClient, serving bool) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := client.CheckConnectivity(ctx)
+		cancel()
+		if (err == nil) == serving {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				return errors.New("the service serves")
+			}
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthReporter(t *testing.T) {
+	var failing atomic.Bool
+	reporter := NewHealthReporter(time.Hour, zap.NewNop().Sugar())
+	reporter.AddCheck("store", func(ctx context.Context) error {
+		if failing.Load() {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	// Health checks pass without credentials even when the server authenticates its callers
+	auth := NewAuthenticator(AuthConfig{Tokens: map[string]string{"shortener": "shortener-token"}}, zap.NewNop().Sugar())
+	srv := grpc.NewServer(grpc.UnaryInterceptor(auth.UnaryServerInterceptor()))
+	pb.RegisterAnalyticsServiceServer(srv, NewAnalyticsGRPCServer(&recordingStore{}, nil, nil, nil, zap.NewNop().Sugar()))
+	healthpb.RegisterHealthServer(srv, reporter.Server())
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	client, err := NewAnalyticsGRPCClient(ln.Addr().String(), ClientConfig{}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewAnalyticsGRPCClient failed: %v", err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.CheckConnectivity(ctx); err == nil {
+		t.Errorf("Expected the service not to serve before the first check")
+	}
+	if err := reporter.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := waitForConnectivity(client, true); err != nil {
+		t.Errorf("Expected the service to serve, got %v", err)
+	}
+
+	failing.Store(true)
+	if err := reporter.Run(ctx); err == nil {
+		t.Errorf("Expected the failing check to be returned")
+	}
+	if err := waitForConnectivity(client, false); err != nil {
+		t.Errorf("Expected the service not to serve while the store is unreachable")
+	}
+	admin, err := reporter.Server().Check(ctx, &healthpb.HealthCheckRequest{Service: pb.AnalyticsAdminService_ServiceDesc.ServiceName})
+	if err != nil || admin.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected the admin service to keep serving, got %v, %v", admin, err)
+	}
+
+	failing.Store(false)
+	reporter.Run(ctx)
+	if err := waitForConnectivity(client, true); err != nil {
+		t.Errorf("Expected the service to serve again, got %v", err)
+	}
+	if err := reporter.Stop(ctx); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if err := waitForConnectivity(client, false); err != nil {
+		t.Errorf("Expected the service not to serve after Stop")
+	}
+}
+
+func TestReflectionNeedsPermission(t *testing.T) {
+	auth := NewAuthenticator(AuthConfig{Tokens: map[string]string{"admin": "admin-token", "shortener": "shortener-token"}}, zap.NewNop().Sugar())
+	method := "/" + reflectionpb.ServerReflection_ServiceDesc.ServiceName + "/ServerReflectionInfo"
+	if !auth.Permits("admin", method) {
+		t.Errorf("Expected the admin to use reflection")
+	}
+	if auth.Permits("shortener", method) {
+		t.Errorf("Expected the shortener not to use reflection")
+	}
+}
+
+func TestHealthReporterStartDoesNotWaitForTheChecks(t *testing.T) {
+	reporter := NewHealthReporter(time.Hour, zap.NewNop().Sugar())
+	checked := make(chan struct{})
+	reporter.AddCheck("store", func(ctx context.Context) error {
+		close(checked)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err := reporter.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the first round of checks to run after Start")
+	}
+	res, err := reporter.Server().Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil || res.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected NOT_SERVING while the first round runs, got %v, %v", res, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := reporter.Stop(ctx); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+}
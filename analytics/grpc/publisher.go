@@ -0,0 +1,270 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// DropPolicy decides what happens to an event that is published while the queue is full
+type DropPolicy int
+
+const (
+	DropOldest DropPolicy = iota // Evict the oldest queued event to make room for the new one
+	DropNewest                   // Discard the new event
+	Block                        // Wait for free space until the block timeout expires, then discard the new event
+)
+
+func (dp DropPolicy) String() string {
+	switch dp {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Block:
+		return "block"
+	default:
+		return fmt.Sprintf("DropPolicy(%d)", int(dp))
+	}
+}
+
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	for _, dp := range []DropPolicy{DropOldest, DropNewest, Block} {
+		if dp.String() == s {
+			return dp, nil
+		}
+	}
+	return DropOldest, fmt.Errorf("unknown drop policy %q", s)
+}
+
+const (
+	DEFAULT_QUEUE_SIZE     = 10000
+	DEFAULT_WORKERS        = 2
+	DEFAULT_BATCH_SIZE     = 100
+	DEFAULT_FLUSH_INTERVAL = 1 * time.Second
+	DEFAULT_BLOCK_TIMEOUT  = 50 * time.Millisecond
+)
+
+type PublisherConfig struct {
+	QueueSize     int
+	Workers       int
+	BatchSize     int           // A batch is sent as soon as it contains BatchSize events
+	FlushInterval time.Duration // or when it is older than FlushInterval
+	DropPolicy    DropPolicy
+	BlockTimeout  time.Duration // Only used with the Block drop policy
+	Registerer    prometheus.Registerer
+}
+
+type publisherMetrics struct {
+	queueDepth prometheus.GaugeFunc
+	dropped    *prometheus.CounterVec
+	sent       *prometheus.CounterVec
+	batchSize  prometheus.Histogram
+}
+
+// AnalyticsEventPublisher sends analytics events to the analytics service off the request path.
+// Events are queued in a bounded in-memory queue and sent in batches by background workers,
+// so a slow or unavailable analytics service never delays a response.
+type AnalyticsEventPublisher struct {
+	client  *AnalyticsGRPCClient
+	cfg     PublisherConfig
+	logger  *zap.SugaredLogger
+	metrics publisherMetrics
+	queue   chan store.Event
+	mu      sync.RWMutex // guards closed and the queue against sends after close
+	closed  bool
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewAnalyticsEventPublisher(client *AnalyticsGRPCClient, cfg PublisherConfig, logger *zap.SugaredLogger) (*AnalyticsEventPublisher, error) {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = DEFAULT_WORKERS
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DEFAULT_BATCH_SIZE
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DEFAULT_FLUSH_INTERVAL
+	}
+	if cfg.BlockTimeout <= 0 {
+		cfg.BlockTimeout = DEFAULT_BLOCK_TIMEOUT
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &AnalyticsEventPublisher{
+		client: client,
+		cfg:    cfg,
+		logger: logger,
+		queue:  make(chan store.Event, cfg.QueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	p.metrics = publisherMetrics{
+		queueDepth: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "analytics_publisher_queue_depth",
+			Help: "Number of analytics events waiting to be sent.",
+		}, func() float64 {
+			return float64(len(p.queue))
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "analytics_publisher_dropped_events_total",
+			Help: "Number of analytics events dropped before they were sent.",
+		}, []string{"reason"}),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "analytics_publisher_sent_events_total",
+			Help: "Number of analytics events the publisher tried to send.",
+		}, []string{"result"}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "analytics_publisher_batch_size",
+			Help:    "Number of analytics events per sent batch.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+	}
+	for _, c := range []prometheus.Collector{p.metrics.queueDepth, p.metrics.dropped, p.metrics.sent, p.metrics.batchSize} {
+		if err := cfg.Registerer.Register(c); err != nil {
+			return nil, fmt.Errorf("register publisher metrics: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// Start starts the background workers
+func (p *AnalyticsEventPublisher) Start(ctx context.Context) error {
+	for range p.cfg.Workers {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	p.logger.Infof("Analytics event publisher started with %d workers (queue size %d, drop policy %s)", p.cfg.Workers, p.cfg.QueueSize, p.cfg.DropPolicy)
+	return nil
+}
+
+// Close stops accepting events and flushes all queued events.
+// If ctx expires before the queue is drained, pending sends are cancelled and the remaining events are lost.
+func (p *AnalyticsEventPublisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-done
+		return fmt.Errorf("flush analytics events: %w", ctx.Err())
+	}
+}
+
+func (p *AnalyticsEventPublisher) PublishURLCreationEvent(evt *store.URLCreationEvent) {
+	p.publish(evt)
+}
+
+func (p *AnalyticsEventPublisher) PublishURLRedirectEvent(evt *store.URLRedirectEvent) {
+	p.publish(evt)
+}
+
+func (p *AnalyticsEventPublisher) publish(evt store.Event) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.metrics.dropped.WithLabelValues("closed").Inc()
+		return
+	}
+	select {
+	case p.queue <- evt:
+		return
+	default:
+	}
+	switch p.cfg.DropPolicy {
+	case DropNewest:
+		p.metrics.dropped.WithLabelValues("queue_full").Inc()
+	case Block:
+		timer := time.NewTimer(p.cfg.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case p.queue <- evt:
+		case <-timer.C:
+			p.metrics.dropped.WithLabelValues("block_timeout").Inc()
+		}
+	default:
+		for {
+			select {
+			case p.queue <- evt:
+				return
+			default:
+			}
+			select {
+			case <-p.queue:
+				p.metrics.dropped.WithLabelValues("queue_full").Inc()
+			default:
+			}
+		}
+	}
+}
+
+func (p *AnalyticsEventPublisher) worker() {
+	defer p.wg.Done()
+	batch := make([]store.Event, 0, p.cfg.BatchSize)
+	ticker := time.NewTicker(p.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case evt, ok := <-p.queue:
+			if !ok {
+				// The queue was closed and drained
+				p.send(batch)
+				return
+			}
+			batch = append(batch, evt)
+			if len(batch) >= p.cfg.BatchSize {
+				p.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				p.send(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// send sends the whole batch in a single RecordEvents call
+func (p *AnalyticsEventPublisher) send(batch []store.Event) {
+	if len(batch) == 0 {
+		return
+	}
+	p.metrics.batchSize.Observe(float64(len(batch)))
+	rejected, err := p.client.SendEvents(p.ctx, batch)
+	if err != nil {
+		p.logger.Errorf("failed to send %d events: %v", len(batch), err)
+		p.metrics.sent.WithLabelValues("failure").Add(float64(len(batch)))
+		return
+	}
+	failed := len(rejected)
+	p.metrics.sent.WithLabelValues("failure").Add(float64(failed))
+	p.metrics.sent.WithLabelValues("success").Add(float64(len(batch) - failed))
+}
@@ -0,0 +1,195 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mactavishz/kuerzen/analytics/dedupe"
+	"github.com/mactavishz/kuerzen/analytics/live"
+	"github.com/mactavishz/kuerzen/analytics/pb"
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+type recordingStore struct {
+	mu        sync.Mutex
+	creations []*store.URLCreationEvent
+	redirects []*store.URLRedirectEvent
+	failing   int // WriteEvents fails while it is above 0
+}
+
+func (rs *recordingStore) WriteURLCreationEvent(evt *store.URLCreationEvent) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.creations = append(rs.creations, evt)
+}
+
+func (rs *recordingStore) WriteURLRedirectEvent(evt *store.URLRedirectEvent) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.redirects = append(rs.redirects, evt)
+}
+
+func (rs *recordingStore) WriteEvents(ctx context.Context, events []store.Event) error {
+	rs.mu.Lock()
+	if rs.failing > 0 {
+		rs.failing--
+		rs.mu.Unlock()
+		return errors.New("store unavailable")
+	}
+	rs.mu.Unlock()
+	for _, evt := range events {
+		switch e := evt.(type) {
+		case *store.URLCreationEvent:
+			rs.WriteURLCreationEvent(e)
+		case *store.URLRedirectEvent:
+			rs.WriteURLRedirectEvent(e)
+		}
+	}
+	return nil
+}
+
+// failWrites makes the next n calls of WriteEvents fail
+func (rs *recordingStore) failWrites(n int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.failing = n
+}
+
+func (rs *recordingStore) counts() (int, int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.creations), len(rs.redirects)
+}
+
+func (rs *recordingStore) Errors() <-chan error           { return nil }
+func (rs *recordingStore) Ping(ctx context.Context) error { return nil }
+func (rs *recordingStore) Flush()                         {}
+func (rs *recordingStore) Close()                         {}
+
+// startTestServer starts an analytics gRPC server backed by a recording store on a random local port,
+// events are deduplicated and published to live subscribers
+func startTestServer(t *testing.T) (*recordingStore, string) {
+	t.Helper()
+	rs := &recordingStore{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	set, err := dedupe.New(dedupe.Config{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		t.Fatalf("failed to create dedupe set: %v", err)
+	}
+	hub, err := live.NewHub(live.Config{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		t.Fatalf("failed to create live hub: %v", err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterAnalyticsServiceServer(srv, NewAnalyticsGRPCServer(rs, nil, set, hub, zap.NewNop().Sugar()))
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return rs, ln.Addr().String()
+}
+
+func newTestPublisher(t *testing.T, addr string, cfg PublisherConfig) *AnalyticsEventPublisher {
+	t.Helper()
+	logger := zap.NewNop().Sugar()
+	client, err := NewAnalyticsGRPCClient(addr, ClientConfig{}, logger)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	cfg.Registerer = prometheus.NewRegistry()
+	p, err := NewAnalyticsEventPublisher(client, cfg, logger)
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	return p
+}
+
+func TestPublisherFlushesOnClose(t *testing.T) {
+	rs, addr := startTestServer(t)
+	p := newTestPublisher(t, addr, PublisherConfig{BatchSize: 10, FlushInterval: time.Hour})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start publisher: %v", err)
+	}
+	for range 5 {
+		p.PublishURLCreationEvent(&store.URLCreationEvent{ServiceName: "shortener", Timestamp: time.Now()})
+		p.PublishURLRedirectEvent(&store.URLRedirectEvent{ServiceName: "redirector", Timestamp: time.Now()})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Close(ctx); err != nil {
+		t.Fatalf("failed to close publisher: %v", err)
+	}
+	creations, redirects := rs.counts()
+	if creations != 5 || redirects != 5 {
+		t.Errorf("Expected 5 creation and 5 redirect events, got %d and %d", creations, redirects)
+	}
+
+	p.PublishURLCreationEvent(&store.URLCreationEvent{ServiceName: "shortener", Timestamp: time.Now()})
+	if dropped := testutil.ToFloat64(p.metrics.dropped.WithLabelValues("closed")); dropped != 1 {
+		t.Errorf("Expected 1 event dropped after close, got %v", dropped)
+	}
+}
+
+func TestPublisherSendsBatchOnFlushInterval(t *testing.T) {
+	rs, addr := startTestServer(t)
+	p := newTestPublisher(t, addr, PublisherConfig{BatchSize: 100, FlushInterval: 20 * time.Millisecond})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start publisher: %v", err)
+	}
+	defer p.Close(context.Background())
+	p.PublishURLRedirectEvent(&store.URLRedirectEvent{ServiceName: "redirector", Timestamp: time.Now()})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, redirects := rs.counts(); redirects == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the partial batch to be sent after the flush interval")
+}
+
+func TestPublisherDropPolicies(t *testing.T) {
+	// Workers are not started, so the queue fills up
+	newest := func(p *AnalyticsEventPublisher) string { return (<-p.queue).(*store.URLCreationEvent).URL }
+
+	p := newTestPublisher(t, "127.0.0.1:0", PublisherConfig{QueueSize: 2, DropPolicy: DropOldest})
+	for _, url := range []string{"a", "b", "c"} {
+		p.PublishURLCreationEvent(&store.URLCreationEvent{URL: url})
+	}
+	if first := newest(p); first != "b" {
+		t.Errorf("Expected oldest event to be evicted, first queued event is %s", first)
+	}
+	if dropped := testutil.ToFloat64(p.metrics.dropped.WithLabelValues("queue_full")); dropped != 1 {
+		t.Errorf("Expected 1 dropped event, got %v", dropped)
+	}
+
+	p = newTestPublisher(t, "127.0.0.1:0", PublisherConfig{QueueSize: 2, DropPolicy: DropNewest})
+	for _, url := range []string{"a", "b", "c"} {
+		p.PublishURLCreationEvent(&store.URLCreationEvent{URL: url})
+	}
+	if first := newest(p); first != "a" {
+		t.Errorf("Expected newest event to be discarded, first queued event is %s", first)
+	}
+
+	p = newTestPublisher(t, "127.0.0.1:0", PublisherConfig{QueueSize: 1, DropPolicy: Block, BlockTimeout: 10 * time.Millisecond})
+	p.PublishURLCreationEvent(&store.URLCreationEvent{URL: "a"})
+	start := time.Now()
+	p.PublishURLCreationEvent(&store.URLCreationEvent{URL: "b"})
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Expected publish to block for the block timeout, returned after %v", elapsed)
+	}
+	if dropped := testutil.ToFloat64(p.metrics.dropped.WithLabelValues("block_timeout")); dropped != 1 {
+		t.Errorf("Expected 1 event dropped after the block timeout, got %v", dropped)
+	}
+}
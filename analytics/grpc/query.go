@@ -0,0 +1,154 @@
+package grpc
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/mactavishz/kuerzen/analytics/pb"
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DEFAULT_TOP_LIMIT       = 10
+	MAX_TOP_LIMIT           = 100
+	DEFAULT_SERIES_RANGE    = 7 * 24 * time.Hour
+	DEFAULT_SERIES_INTERVAL = 1 * time.Hour
+	MAX_SERIES_POINTS       = 10000 // Upper bound of range / interval, to keep a single series query cheap
+)
+
+func (s *AnalyticsGRPCServer) GetLinkStats(ctx context.Context, req *pb.LinkStatsRequest) (*pb.LinkStatsResponse, error) {
+	if err := s.checkReader(); err != nil {
+		return nil, err
+	}
+	if req.ShortUrl == "" {
+		return nil, status.Error(codes.InvalidArgument, "short_url is required")
+	}
+	since, err := toRange(req.RangeSeconds)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := s.reader.GetLinkStats(ctx, req.ShortUrl, since)
+	if err != nil {
+		return nil, s.queryError(ctx, "GetLinkStats", err)
+	}
+	visitors, err := s.reader.GetVisitorStats(ctx, req.ShortUrl, since)
+	if err != nil {
+		return nil, s.queryError(ctx, "GetLinkStats", err)
+	}
+	res := &pb.LinkStatsResponse{
+		ShortUrl:       stats.ShortURL,
+		Clicks:         stats.Clicks,
+		UniqueVisitors: visitors.Visitors,
+		DailyVisitors:  make([]*pb.DailyVisitors, len(visitors.Daily)),
+	}
+	if stats.Clicks > 0 {
+		res.FirstClick = stats.FirstClick.UnixMicro()
+		res.LastClick = stats.LastClick.UnixMicro()
+	}
+	for i, d := range visitors.Daily {
+		res.DailyVisitors[i] = &pb.DailyVisitors{Day: d.Day.UnixMicro(), Visitors: d.Visitors}
+	}
+	return res, nil
+}
+
+func (s *AnalyticsGRPCServer) GetClickSeries(ctx context.Context, req *pb.ClickSeriesRequest) (*pb.ClickSeriesResponse, error) {
+	if err := s.checkReader(); err != nil {
+		return nil, err
+	}
+	if req.ShortUrl == "" {
+		return nil, status.Error(codes.InvalidArgument, "short_url is required")
+	}
+	if req.IntervalSeconds < 0 || req.RangeSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "interval_seconds and range_seconds must not be negative")
+	}
+	interval := time.Duration(req.IntervalSeconds) * time.Second
+	if interval == 0 {
+		interval = DEFAULT_SERIES_INTERVAL
+	}
+	since := time.Duration(req.RangeSeconds) * time.Second
+	if since == 0 {
+		since = DEFAULT_SERIES_RANGE
+	}
+	if since/interval > MAX_SERIES_POINTS {
+		return nil, status.Errorf(codes.InvalidArgument, "the series must not have more than %d points", MAX_SERIES_POINTS)
+	}
+	series, err := s.reader.GetClickSeries(ctx, req.ShortUrl, interval, since)
+	if err != nil {
+		return nil, s.queryError(ctx, "GetClickSeries", err)
+	}
+	res := &pb.ClickSeriesResponse{Points: make([]*pb.ClickSeriesPoint, len(series))}
+	for i, c := range series {
+		res.Points[i] = &pb.ClickSeriesPoint{Timestamp: c.Time.UnixMicro(), Clicks: c.Clicks}
+	}
+	return res, nil
+}
+
+func (s *AnalyticsGRPCServer) TopLinks(ctx context.Context, req *pb.TopLinksRequest) (*pb.RankResponse, error) {
+	if err := s.checkReader(); err != nil {
+		return nil, err
+	}
+	since, err := toRange(req.RangeSeconds)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.reader.TopLinks(ctx, since, toLimit(req.Limit))
+	if err != nil {
+		return nil, s.queryError(ctx, "TopLinks", err)
+	}
+	return toRankResponse(entries), nil
+}
+
+func (s *AnalyticsGRPCServer) TopReferrers(ctx context.Context, req *pb.TopReferrersRequest) (*pb.RankResponse, error) {
+	if err := s.checkReader(); err != nil {
+		return nil, err
+	}
+	since, err := toRange(req.RangeSeconds)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.reader.TopReferrers(ctx, req.ShortUrl, since, toLimit(req.Limit))
+	if err != nil {
+		return nil, s.queryError(ctx, "TopReferrers", err)
+	}
+	return toRankResponse(entries), nil
+}
+
+func (s *AnalyticsGRPCServer) checkReader() error {
+	if s.reader == nil {
+		return status.Error(codes.Unimplemented, "the analytics store does not support queries")
+	}
+	return nil
+}
+
+// queryError maps errors of the reader to gRPC status errors
+func (s *AnalyticsGRPCServer) queryError(ctx context.Context, method string, err error) error {
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	s.logger.Errorf("%s query failed: %v", method, err)
+	return status.Error(codes.Unavailable, "analytics query failed")
+}
+
+func toRange(seconds int64) (time.Duration, error) {
+	if seconds < 0 {
+		return 0, status.Error(codes.InvalidArgument, "range_seconds must not be negative")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func toLimit(limit int32) int {
+	if limit <= 0 {
+		return DEFAULT_TOP_LIMIT
+	}
+	return min(int(limit), MAX_TOP_LIMIT)
+}
+
+func toRankResponse(entries []store.RankEntry) *pb.RankResponse {
+	res := &pb.RankResponse{Entries: make([]*pb.RankEntry, len(entries))}
+	for i, e := range entries {
+		res.Entries[i] = &pb.RankEntry{Key: e.Key, Clicks: e.Clicks}
+	}
+	return res
+}
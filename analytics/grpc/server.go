@@ -2,49 +2,248 @@ package grpc
 
 import (
 	"context"
-	"time"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 
+	"github.com/mactavishz/kuerzen/analytics/dedupe"
+	"github.com/mactavishz/kuerzen/analytics/live"
 	pb "github.com/mactavishz/kuerzen/analytics/pb"
+	"github.com/mactavishz/kuerzen/service"
 	store "github.com/mactavishz/kuerzen/store/analytics"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Events received through StreamEvents are written to the store in chunks of this size
+	STREAM_CHUNK_SIZE = 500
+	// Upper bound of the short URLs a subscriber filters by
+	MAX_SUBSCRIBED_SHORT_URLS = 10000
 )
 
 type AnalyticsGRPCServer struct {
 	pb.UnimplementedAnalyticsServiceServer
 	store  store.AnalyticsStore
+	reader store.AnalyticsReader
+	dedupe *dedupe.Set
+	hub    *live.Hub
 	logger *zap.SugaredLogger
 }
 
-func NewAnalyticsGRPCServer(store store.AnalyticsStore, logger *zap.SugaredLogger) *AnalyticsGRPCServer {
+// NewAnalyticsGRPCServer creates the server, the query RPCs are unimplemented if reader is nil,
+// events are not deduplicated if dedupe is nil and SubscribeEvents is unimplemented if hub is nil
+func NewAnalyticsGRPCServer(store store.AnalyticsStore, reader store.AnalyticsReader, dedupe *dedupe.Set, hub *live.Hub, logger *zap.SugaredLogger) *AnalyticsGRPCServer {
 	return &AnalyticsGRPCServer{
 		store:  store,
+		reader: reader,
+		dedupe: dedupe,
+		hub:    hub,
 		logger: logger,
 	}
 }
 
+// DUPLICATE_EVENT_MESSAGE answers events that have already been recorded, they count as recorded successfully
+const DUPLICATE_EVENT_MESSAGE = "duplicate event ignored"
+
+// isDuplicate reports whether an event with the id was stored within the dedupe window or comes earlier in pending,
+// the events of the call that are not stored yet. Otherwise it adds the id to pending, which may be nil.
+func (s *AnalyticsGRPCServer) isDuplicate(eventID string, pending map[string]bool) bool {
+	if s.dedupe == nil || eventID == "" {
+		return false
+	}
+	if pending[eventID] || s.dedupe.Seen(eventID) {
+		return true
+	}
+	if pending != nil {
+		pending[eventID] = true
+	}
+	return false
+}
+
+// write stores the events, their ids count as seen once the store confirmed them
+func (s *AnalyticsGRPCServer) write(ctx context.Context, events []store.Event) error {
+	if err := s.store.WriteEvents(ctx, events); err != nil {
+		return err
+	}
+	if s.dedupe != nil {
+		ids := make([]string, len(events))
+		for i, event := range events {
+			ids[i] = eventID(event)
+		}
+		s.dedupe.Add(ids...)
+	}
+	s.publish(events...)
+	return nil
+}
+
+// publish hands recorded events to the live subscribers, it never blocks
+func (s *AnalyticsGRPCServer) publish(events ...store.Event) {
+	if s.hub != nil {
+		s.hub.Publish(events)
+	}
+}
+
 func (s *AnalyticsGRPCServer) CreateShortURLEvent(ctx context.Context, req *pb.CreateShortURLEventRequest) (*pb.EventResponse, error) {
-	event := &store.URLCreationEvent{
-		ServiceName: req.ServiceName,
-		URL:         req.Url,
-		APIVer:      req.ApiVersion,
-		Success:     req.Success,
-		Timestamp:   time.UnixMicro(req.Timestamp),
-	}
-	s.store.WriteURLCreationEvent(event)
-	s.logger.Infow("URL creation event recorded", "service", req.ServiceName)
+	if s.isDuplicate(req.EventId, nil) {
+		return &pb.EventResponse{Success: true, Message: DUPLICATE_EVENT_MESSAGE}, nil
+	}
+	if err := s.write(ctx, []store.Event{creationEventFromRequest(req)}); err != nil {
+		service.TraceLogger(ctx, s.logger).Errorw("Failed to store URL creation event", "error", err)
+		return nil, status.Error(codes.Unavailable, "failed to store the event")
+	}
+	service.TraceLogger(ctx, s.logger).Infow("URL creation event recorded", "service", req.ServiceName)
 	return &pb.EventResponse{Success: true}, nil
 }
 
 func (s *AnalyticsGRPCServer) RedirectShortURLEvent(ctx context.Context, req *pb.RedirectShortURLEventRequest) (*pb.EventResponse, error) {
-	event := &store.URLRedirectEvent{
-		ServiceName: req.ServiceName,
-		ShortURL:    req.ShortUrl,
-		LongURL:     req.LongUrl,
-		APIVer:      req.ApiVersion,
-		Success:     req.Success,
-		Timestamp:   time.UnixMicro(req.Timestamp),
-	}
-	s.store.WriteURLRedirectEvent(event)
-	s.logger.Infow("URL redirect event recorded", "service", req.ServiceName)
+	if s.isDuplicate(req.EventId, nil) {
+		return &pb.EventResponse{Success: true, Message: DUPLICATE_EVENT_MESSAGE}, nil
+	}
+	if err := s.write(ctx, []store.Event{redirectEventFromRequest(req)}); err != nil {
+		service.TraceLogger(ctx, s.logger).Errorw("Failed to store URL redirect event", "error", err)
+		return nil, status.Error(codes.Unavailable, "failed to store the event")
+	}
+	service.TraceLogger(ctx, s.logger).Infow("URL redirect event recorded", "service", req.ServiceName)
 	return &pb.EventResponse{Success: true}, nil
 }
+
+func (s *AnalyticsGRPCServer) RecordEvents(ctx context.Context, batch *pb.EventBatch) (*pb.EventBatchAck, error) {
+	events := make([]store.Event, 0, len(batch.Events))
+	var failed []int32
+	duplicates := 0
+	pending := make(map[string]bool)
+	for i, env := range batch.Events {
+		event, err := eventFromEnvelope(env)
+		if err != nil || !eventPermitted(ctx, event) {
+			failed = append(failed, int32(i))
+			continue
+		}
+		if s.isDuplicate(eventID(event), pending) {
+			duplicates++
+			continue
+		}
+		events = append(events, event)
+	}
+	if err := s.write(ctx, events); err != nil {
+		service.TraceLogger(ctx, s.logger).Errorw("Failed to store event batch", "events", len(events), "error", err)
+		return nil, status.Errorf(codes.Unavailable, "failed to store the %d valid events of the batch, resend it", len(events))
+	}
+	service.TraceLogger(ctx, s.logger).Infow("Event batch recorded", "accepted", len(events), "duplicates", duplicates, "failed", len(failed))
+	return newEventBatchAck(len(events), duplicates, failed), nil
+}
+
+func (s *AnalyticsGRPCServer) StreamEvents(stream grpc.ClientStreamingServer[pb.Event, pb.EventBatchAck]) error {
+	chunk := make([]store.Event, 0, STREAM_CHUNK_SIZE)
+	chunkStart := int32(0) // Offset of the first event of the chunk
+	var failed []int32
+	accepted, duplicates := 0, 0
+	pending := make(map[string]bool)
+	// writeChunk stores the chunk, the events from its first offset on have to be resent if it fails
+	writeChunk := func() error {
+		if err := s.write(stream.Context(), chunk); err != nil {
+			service.TraceLogger(stream.Context(), s.logger).Errorw("Failed to store event stream chunk", "offset", chunkStart, "events", len(chunk), "error", err)
+			return status.Errorf(codes.Unavailable, "failed to store the events from offset %d on, resend them", chunkStart)
+		}
+		accepted += len(chunk)
+		chunk = make([]store.Event, 0, STREAM_CHUNK_SIZE)
+		pending = make(map[string]bool)
+		return nil
+	}
+	for offset := int32(0); ; offset++ {
+		env, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Events of the current chunk have not been acknowledged, the client has to resend them
+			return err
+		}
+		event, err := eventFromEnvelope(env)
+		if err != nil || !eventPermitted(stream.Context(), event) {
+			failed = append(failed, offset)
+			continue
+		}
+		if s.isDuplicate(eventID(event), pending) {
+			duplicates++
+			continue
+		}
+		if len(chunk) == 0 {
+			chunkStart = offset
+		}
+		chunk = append(chunk, event)
+		if len(chunk) == STREAM_CHUNK_SIZE {
+			if err := writeChunk(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writeChunk(); err != nil {
+		return err
+	}
+	service.TraceLogger(stream.Context(), s.logger).Infow("Event stream recorded", "accepted", accepted, "duplicates", duplicates, "failed", len(failed))
+	return stream.SendAndClose(newEventBatchAck(accepted, duplicates, failed))
+}
+
+func (s *AnalyticsGRPCServer) SubscribeEvents(req *pb.SubscribeRequest, stream grpc.ServerStreamingServer[pb.LiveEvent]) error {
+	if s.hub == nil {
+		return status.Error(codes.Unimplemented, "live events are disabled")
+	}
+	if len(req.ShortUrls) > MAX_SUBSCRIBED_SHORT_URLS {
+		return status.Errorf(codes.InvalidArgument, "at most %d short URLs can be subscribed to", MAX_SUBSCRIBED_SHORT_URLS)
+	}
+	sub, err := s.hub.Subscribe(live.Filter{
+		ShortURLs: req.ShortUrls,
+		Owner:     req.Owner,
+		Creations: req.Creations || !req.Redirects,
+		Redirects: req.Redirects || !req.Creations,
+	})
+	if errors.Is(err, live.ErrTooManySubscribers) {
+		return status.Error(codes.ResourceExhausted, "too many subscribers")
+	}
+	if err != nil {
+		return status.Error(codes.Unavailable, "live events are shutting down")
+	}
+	defer sub.Close()
+	// The headers tell the client that the subscription is in place
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	s.logger.Infow("Live subscriber connected", "shortURLs", len(req.ShortUrls), "owner", req.Owner)
+	for {
+		select {
+		case msg := <-sub.Events():
+			if err := stream.Send(&pb.LiveEvent{Event: envelopeFromEvent(msg.Event), Dropped: msg.Dropped}); err != nil {
+				return err
+			}
+		case <-sub.Done():
+			if errors.Is(sub.Err(), live.ErrSlowSubscriber) {
+				s.logger.Warnw("Live subscriber disconnected for falling behind", "owner", req.Owner)
+				return status.Error(codes.ResourceExhausted, "subscriber too slow, events were dropped")
+			}
+			return status.Error(codes.Unavailable, "live events are shutting down")
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+// newEventBatchAck acknowledges duplicates as accepted, they have been recorded before
+func newEventBatchAck(written int, duplicates int, failed []int32) *pb.EventBatchAck {
+	ack := &pb.EventBatchAck{
+		Accepted:      int32(written + duplicates),
+		FailedOffsets: failed,
+	}
+	var msgs []string
+	if len(failed) > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d invalid or not permitted events were not recorded", len(failed)))
+	}
+	if duplicates > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d duplicate events were ignored", duplicates))
+	}
+	ack.Message = strings.Join(msgs, ", ")
+	return ack
+}
@@ -0,0 +1,287 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mactavishz/kuerzen/analytics/live"
+	"github.com/mactavishz/kuerzen/analytics/pb"
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func newTestServiceClient(t *testing.T, addr string) pb.AnalyticsServiceClient {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewAnalyticsServiceClient(conn)
+}
+
+// mixedEvents returns a valid creation event, an empty envelope, a valid redirect event and a redirect event without timestamp
+func mixedEvents() []*pb.Event {
+	ts := time.Now().UnixMicro()
+	return []*pb.Event{
+		{Event: &pb.Event_Creation{Creation: &pb.CreateShortURLEventRequest{ServiceName: "shortener", Url: "https://example.com", Timestamp: ts}}},
+		{},
+		{Event: &pb.Event_Redirect{Redirect: &pb.RedirectShortURLEventRequest{ServiceName: "redirector", ShortUrl: "abc", Timestamp: ts}}},
+		{Event: &pb.Event_Redirect{Redirect: &pb.RedirectShortURLEventRequest{ServiceName: "redirector", ShortUrl: "abc"}}},
+	}
+}
+
+func TestRecordEventsReportsFailedOffsets(t *testing.T) {
+	rs, addr := startTestServer(t)
+	client := newTestServiceClient(t, addr)
+
+	ack, err := client.RecordEvents(context.Background(), &pb.EventBatch{Events: mixedEvents()})
+	if err != nil {
+		t.Fatalf("RecordEvents failed: %v", err)
+	}
+	if ack.Accepted != 2 || !slices.Equal(ack.FailedOffsets, []int32{1, 3}) {
+		t.Errorf("Expected 2 accepted events and failed offsets [1 3], got %d and %v", ack.Accepted, ack.FailedOffsets)
+	}
+	if creations, redirects := rs.counts(); creations != 1 || redirects != 1 {
+		t.Errorf("Expected 1 creation and 1 redirect event in the store, got %d and %d", creations, redirects)
+	}
+}
+
+func TestStreamEventsReportsFailedOffsets(t *testing.T) {
+	rs, addr := startTestServer(t)
+	client := newTestServiceClient(t, addr)
+
+	stream, err := client.StreamEvents(context.Background())
+	if err != nil {
+		t.Fatalf("StreamEvents failed: %v", err)
+	}
+	// Send the events twice, offsets are counted over the whole stream
+	for range 2 {
+		for _, evt := range mixedEvents() {
+			if err := stream.Send(evt); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+	}
+	ack, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv failed: %v", err)
+	}
+	if ack.Accepted != 4 || !slices.Equal(ack.FailedOffsets, []int32{1, 3, 5, 7}) {
+		t.Errorf("Expected 4 accepted events and failed offsets [1 3 5 7], got %d and %v", ack.Accepted, ack.FailedOffsets)
+	}
+	if creations, redirects := rs.counts(); creations != 2 || redirects != 2 {
+		t.Errorf("Expected 2 creation and 2 redirect events in the store, got %d and %d", creations, redirects)
+	}
+}
+
+func TestBatchWriteFailuresAreReported(t *testing.T) {
+	rs, addr := startTestServer(t)
+	client := newTestServiceClient(t, addr)
+
+	rs.failWrites(1)
+	_, err := client.RecordEvents(context.Background(), &pb.EventBatch{Events: mixedEvents()})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable for a batch the store failed to write, got %v", err)
+	}
+
+	stream, err := client.StreamEvents(context.Background())
+	if err != nil {
+		t.Fatalf("StreamEvents failed: %v", err)
+	}
+	for _, evt := range mixedEvents() {
+		if err := stream.Send(evt); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	rs.failWrites(1)
+	_, err = stream.CloseAndRecv()
+	if status.Code(err) != codes.Unavailable || !strings.Contains(status.Convert(err).Message(), "from offset 0 on") {
+		t.Errorf("Expected Unavailable naming the first offset to resend, got %v", err)
+	}
+	if creations, redirects := rs.counts(); creations != 0 || redirects != 0 {
+		t.Errorf("Expected no events in the store, got %d and %d", creations, redirects)
+	}
+}
+
+func TestRetriedEventsAreRecordedOnce(t *testing.T) {
+	rs, addr := startTestServer(t)
+	client, err := NewAnalyticsGRPCClient(addr, ClientConfig{}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	events := []store.Event{
+		&store.URLCreationEvent{ServiceName: "shortener", URL: "https://example.com", Timestamp: time.Now()},
+		&store.URLRedirectEvent{ServiceName: "redirector", ShortURL: "abc", Timestamp: time.Now()},
+	}
+	// The ids are assigned by the first call and reused by the second, like a retry after a lost response
+	for range 2 {
+		if _, err := client.SendEvents(context.Background(), events); err != nil {
+			t.Fatalf("SendEvents failed: %v", err)
+		}
+	}
+	redirect := events[1].(*store.URLRedirectEvent)
+	if err := client.SendURLRedirectEvent(context.Background(), redirect); err != nil {
+		t.Fatalf("SendURLRedirectEvent failed: %v", err)
+	}
+	if redirect.EventID == "" {
+		t.Error("Expected the client to assign an event id")
+	}
+	if creations, redirects := rs.counts(); creations != 1 || redirects != 1 {
+		t.Errorf("Expected 1 creation and 1 redirect event in the store, got %d and %d", creations, redirects)
+	}
+}
+
+func TestEventsOfFailedWritesAreNotDuplicates(t *testing.T) {
+	rs, addr := startTestServer(t)
+	client := newTestServiceClient(t, addr)
+	batch := &pb.EventBatch{Events: []*pb.Event{
+		{Event: &pb.Event_Creation{Creation: &pb.CreateShortURLEventRequest{EventId: "c1", ServiceName: "shortener", Url: "https://example.com", Timestamp: time.Now().UnixMicro()}}},
+	}}
+	redirect := &pb.RedirectShortURLEventRequest{EventId: "r1", ServiceName: "redirector", ShortUrl: "abc", Timestamp: time.Now().UnixMicro()}
+
+	rs.failWrites(2)
+	if _, err := client.RecordEvents(context.Background(), batch); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected the failed write to be reported, got %v", err)
+	}
+	if _, err := client.RedirectShortURLEvent(context.Background(), redirect); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected the failed write to be reported, got %v", err)
+	}
+
+	// The retries are stored rather than acknowledged as duplicates
+	ack, err := client.RecordEvents(context.Background(), batch)
+	if err != nil || ack.Message != "" {
+		t.Fatalf("Expected the retried batch to be recorded, got %v, %v", ack, err)
+	}
+	res, err := client.RedirectShortURLEvent(context.Background(), redirect)
+	if err != nil || res.Message == DUPLICATE_EVENT_MESSAGE {
+		t.Fatalf("Expected the retried event to be recorded, got %v, %v", res, err)
+	}
+	if creations, redirects := rs.counts(); creations != 1 || redirects != 1 {
+		t.Errorf("Expected 1 creation and 1 redirect event in the store, got %d and %d", creations, redirects)
+	}
+	// Only now they are duplicates
+	if res, err := client.RedirectShortURLEvent(context.Background(), redirect); err != nil || res.Message != DUPLICATE_EVENT_MESSAGE {
+		t.Errorf("Expected a duplicate of a stored event to be ignored, got %v, %v", res, err)
+	}
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	_, addr := startTestServer(t)
+	client, err := NewAnalyticsGRPCClient(addr, ClientConfig{}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub, err := client.SubscribeEvents(ctx, live.Filter{Owner: "alice"})
+	if err != nil {
+		t.Fatalf("SubscribeEvents failed: %v", err)
+	}
+
+	events := []store.Event{
+		&store.URLCreationEvent{ServiceName: "shortener", ShortURL: "abc", Owner: "alice", Success: true, Timestamp: time.Now()},
+		&store.URLRedirectEvent{ServiceName: "redirector", ShortURL: "xyz", Timestamp: time.Now()},
+		&store.URLRedirectEvent{ServiceName: "redirector", ShortURL: "abc", Timestamp: time.Now()},
+	}
+	if _, err := client.SendEvents(ctx, events); err != nil {
+		t.Fatalf("SendEvents failed: %v", err)
+	}
+	for _, want := range []store.Event{events[0], events[2]} {
+		event, dropped, err := sub.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if dropped != 0 || eventID(event) != eventID(want) {
+			t.Errorf("Expected event %s without drops, got %+v and %d dropped", eventID(want), event, dropped)
+		}
+	}
+}
+
+type fakeReader struct {
+	stats     *store.LinkStats
+	visitors  *store.VisitorStats
+	referrers []store.RankEntry
+	limit     int
+}
+
+func (fr *fakeReader) GetLinkStats(ctx context.Context, shortURL string, since time.Duration) (*store.LinkStats, error) {
+	return fr.stats, nil
+}
+
+func (fr *fakeReader) GetClickSeries(ctx context.Context, shortURL string, interval time.Duration, since time.Duration) ([]store.ClickCount, error) {
+	return nil, nil
+}
+
+func (fr *fakeReader) TopLinks(ctx context.Context, since time.Duration, limit int) ([]store.RankEntry, error) {
+	return nil, nil
+}
+
+func (fr *fakeReader) GetVisitorStats(ctx context.Context, shortURL string, since time.Duration) (*store.VisitorStats, error) {
+	return fr.visitors, nil
+}
+
+func (fr *fakeReader) TopReferrers(ctx context.Context, shortURL string, since time.Duration, limit int) ([]store.RankEntry, error) {
+	fr.limit = limit
+	return fr.referrers, nil
+}
+
+func TestQueryRPCs(t *testing.T) {
+	last := time.Now().Truncate(time.Microsecond)
+	fr := &fakeReader{
+		stats:     &store.LinkStats{ShortURL: "abc", Clicks: 3, FirstClick: last.Add(-time.Hour), LastClick: last},
+		referrers: []store.RankEntry{{Key: "example.com", Clicks: 2}},
+		visitors:  &store.VisitorStats{ShortURL: "abc", Visitors: 2, Daily: []store.DailyVisitors{{Day: last.UTC().Truncate(24 * time.Hour), Visitors: 2}}},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterAnalyticsServiceServer(srv, NewAnalyticsGRPCServer(&recordingStore{}, fr, nil, nil, zap.NewNop().Sugar()))
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	client, err := NewAnalyticsGRPCClient(ln.Addr().String(), ClientConfig{}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	stats, visitors, err := client.GetLinkStats(context.Background(), "abc", 0)
+	if err != nil {
+		t.Fatalf("GetLinkStats failed: %v", err)
+	}
+	if stats.Clicks != 3 || !stats.LastClick.Equal(last) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if visitors.Visitors != 2 || !slices.Equal(visitors.Daily, fr.visitors.Daily) {
+		t.Errorf("Unexpected visitor stats %+v", visitors)
+	}
+
+	entries, err := client.TopReferrers(context.Background(), "abc", time.Hour, 1000)
+	if err != nil {
+		t.Fatalf("TopReferrers failed: %v", err)
+	}
+	if !slices.Equal(entries, fr.referrers) {
+		t.Errorf("Expected %v, got %v", fr.referrers, entries)
+	}
+	if fr.limit != MAX_TOP_LIMIT {
+		t.Errorf("Expected the limit to be capped at %d, got %d", MAX_TOP_LIMIT, fr.limit)
+	}
+
+	_, err = newTestServiceClient(t, ln.Addr().String()).GetClickSeries(context.Background(), &pb.ClickSeriesRequest{ShortUrl: "abc", IntervalSeconds: 1, RangeSeconds: 365 * 24 * 3600})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a too long series, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package grpc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// DEFAULT_TLS_RELOAD_INTERVAL is how often the certificate files are checked for changes, on the next handshake
+const DEFAULT_TLS_RELOAD_INTERVAL = 10 * time.Second
+
+// TLSConfig configures the transport security of the analytics channel. On the server the certificate is required and
+// a CA turns on mutual TLS: clients have to present a certificate signed by it. On the client the CA verifies the
+// server instead of the system roots, and the certificate is presented to servers that require mutual TLS.
+type TLSConfig struct {
+	Enabled        bool
+	CertFile       string
+	KeyFile        string
+	CAFile         string
+	ServerName     string        // client only, overrides the name the server certificate is verified against
+	ReloadInterval time.Duration // DEFAULT_TLS_RELOAD_INTERVAL if 0
+}
+
+// TLSConfigFromEnv reads <prefix>TLS (true or false), <prefix>TLS_CERT_FILE, <prefix>TLS_KEY_FILE, <prefix>TLS_CA_FILE
+// and <prefix>TLS_SERVER_NAME. TLS is enabled if any file is set even if <prefix>TLS isn't.
+func TLSConfigFromEnv(prefix string) TLSConfig {
+	cfg := TLSConfig{
+		CertFile:   os.Getenv(prefix + "TLS_CERT_FILE"),
+		KeyFile:    os.Getenv(prefix + "TLS_KEY_FILE"),
+		CAFile:     os.Getenv(prefix + "TLS_CA_FILE"),
+		ServerName: os.Getenv(prefix + "TLS_SERVER_NAME"),
+	}
+	cfg.Enabled = os.Getenv(prefix+"TLS") == "true" || cfg.CertFile != "" || cfg.KeyFile != "" || cfg.CAFile != ""
+	return cfg
+}
+
+// certReloader keeps the certificate and CA of a TLSConfig, and reloads them when the contents of the files changed.
+// Files that fail to load keep the previous certificate in use.
+type certReloader struct {
+	cfg     TLSConfig
+	logger  *zap.SugaredLogger
+	mu      sync.Mutex
+	checked time.Time
+	files   [3][]byte // contents of the cert, key and CA file as last loaded
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newCertReloader(cfg TLSConfig, logger *zap.SugaredLogger) (*certReloader, error) {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("TLS certificate and key files have to be set together")
+	}
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = DEFAULT_TLS_RELOAD_INTERVAL
+	}
+	r := &certReloader{cfg: cfg, logger: logger}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	var files [3][]byte
+	for i, name := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		if name == "" {
+			continue
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("read TLS file: %w", err)
+		}
+		files[i] = b
+	}
+	if bytes.Equal(files[0], r.files[0]) && bytes.Equal(files[1], r.files[1]) && bytes.Equal(files[2], r.files[2]) {
+		return nil
+	}
+	var cert *tls.Certificate
+	if files[0] != nil {
+		c, err := tls.X509KeyPair(files[0], files[1])
+		if err != nil {
+			return fmt.Errorf("load TLS certificate: %w", err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if files[2] != nil {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(files[2]) {
+			return fmt.Errorf("load TLS CA: no certificates in %s", r.cfg.CAFile)
+		}
+	}
+	reloaded := r.files[0] != nil || r.files[2] != nil
+	r.files, r.cert, r.pool = files, cert, pool
+	if reloaded {
+		r.logger.Infof("Reloaded TLS certificates of the analytics channel")
+	}
+	return nil
+}
+
+// current returns the certificate and CA, checking the files if the reload interval passed
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= r.cfg.ReloadInterval {
+		r.checked = now
+		if err := r.load(); err != nil {
+			r.logger.Errorf("Failed to reload TLS certificates, keeping the current ones: %v", err)
+		}
+	}
+	return r.cert, r.pool
+}
+
+// ServerCredentials returns the transport credentials of the analytics server, insecure ones if TLS is disabled
+func ServerCredentials(cfg TLSConfig, logger *zap.SugaredLogger) (credentials.TransportCredentials, error) {
+	if !cfg.Enabled {
+		return insecure.NewCredentials(), nil
+	}
+	if cfg.CertFile == "" {
+		return nil, errors.New("the TLS certificate of the server is required")
+	}
+	r, err := newCertReloader(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   []string{"h2"},
+			}
+			if pool != nil {
+				c.ClientCAs = pool
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}), nil
+}
+
+// ClientCredentials returns the transport credentials of analytics clients, insecure ones if TLS is disabled
+func ClientCredentials(cfg TLSConfig, logger *zap.SugaredLogger) (credentials.TransportCredentials, error) {
+	if !cfg.Enabled {
+		return insecure.NewCredentials(), nil
+	}
+	r, err := newCertReloader(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cfg.ServerName,
+	}
+	if cfg.CertFile != "" {
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		}
+	}
+	if cfg.CAFile != "" {
+		// The server is verified against the current CA here instead of a fixed RootCAs, so that the CA can be reloaded
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			_, pool := r.current()
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("the server presented no certificate")
+			}
+			opts := x509.VerifyOptions{DNSName: cs.ServerName, Roots: pool, Intermediates: x509.NewCertPool()}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return credentials.NewTLS(c), nil
+}
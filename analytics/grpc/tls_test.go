@@ -0,0 +1,203 @@
+package grpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kuerzen test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for localhost and its key to the directory and returns their paths
+func (ca *testCA) issue(t *testing.T, dir string, name string, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+}
+
+func startTLSServer(t *testing.T, cfg TLSConfig) string {
+	t.Helper()
+	creds, err := ServerCredentials(cfg, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("ServerCredentials failed: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := grpc.NewServer(grpc.Creds(creds))
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return ln.Addr().String()
+}
+
+// connects reports whether a client with the config completes the handshake
+func connects(t *testing.T, addr string, cfg TLSConfig) bool {
+	t.Helper()
+	client, err := NewAnalyticsGRPCClient(addr, ClientConfig{TLS: cfg}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewAnalyticsGRPCClient failed: %v", err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return client.CheckConnectivity(ctx) == nil
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, other := newTestCA(t), newTestCA(t)
+	caFile, otherFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "other.crt")
+	writeFile(t, caFile, ca.pem)
+	writeFile(t, otherFile, other.pem)
+	certFile, keyFile := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	addr := startTLSServer(t, TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile})
+
+	if !connects(t, addr, TLSConfig{Enabled: true, CAFile: caFile, ServerName: "localhost"}) {
+		t.Errorf("Expected a client trusting the CA to connect")
+	}
+	if connects(t, addr, TLSConfig{Enabled: true, CAFile: otherFile, ServerName: "localhost"}) {
+		t.Errorf("Expected a client trusting another CA not to connect")
+	}
+	if connects(t, addr, TLSConfig{Enabled: true, CAFile: caFile, ServerName: "analytics.example.com"}) {
+		t.Errorf("Expected a client expecting another name not to connect")
+	}
+	if connects(t, addr, TLSConfig{}) {
+		t.Errorf("Expected an insecure client not to connect")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, other := newTestCA(t), newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	certFile, keyFile := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	addr := startTLSServer(t, TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile, CAFile: caFile})
+
+	clientCert, clientKey := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+	if !connects(t, addr, TLSConfig{Enabled: true, CertFile: clientCert, KeyFile: clientKey, CAFile: caFile, ServerName: "localhost"}) {
+		t.Errorf("Expected a client with a certificate of the CA to connect")
+	}
+	// The server rejects the client after the handshake completed on the client side, the connection breaks right away
+	if connects(t, addr, TLSConfig{Enabled: true, CAFile: caFile, ServerName: "localhost"}) {
+		t.Errorf("Expected a client without a certificate not to connect")
+	}
+	otherCert, otherKey := other.issue(t, dir, "other", x509.ExtKeyUsageClientAuth)
+	if connects(t, addr, TLSConfig{Enabled: true, CertFile: otherCert, KeyFile: otherKey, CAFile: caFile, ServerName: "localhost"}) {
+		t.Errorf("Expected a client with a certificate of another CA not to connect")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca, next := newTestCA(t), newTestCA(t)
+	nextFile := filepath.Join(dir, "next-ca.crt")
+	writeFile(t, nextFile, next.pem)
+	certFile, keyFile := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	addr := startTLSServer(t, TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Nanosecond})
+	client := TLSConfig{Enabled: true, CAFile: nextFile, ServerName: "localhost"}
+	if connects(t, addr, client) {
+		t.Fatalf("Expected the certificate of the old CA to be rejected")
+	}
+
+	// The rotated certificate is served without a restart
+	nextCert, nextKey := next.issue(t, dir, "next", x509.ExtKeyUsageServerAuth)
+	for _, f := range [][2]string{{nextCert, certFile}, {nextKey, keyFile}} {
+		if err := os.Rename(f[0], f[1]); err != nil {
+			t.Fatalf("failed to rotate the certificate: %v", err)
+		}
+	}
+	if !connects(t, addr, client) {
+		t.Errorf("Expected the rotated certificate to be served")
+	}
+}
+
+func TestCertReloaderKeepsValidCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCA(t).issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	r, err := newCertReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Nanosecond}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	before, _ := r.current()
+	writeFile(t, certFile, []byte("not a certificate"))
+	if after, _ := r.current(); after != before {
+		t.Errorf("Expected the valid certificate to be kept")
+	}
+	if _, err := newCertReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile}, zap.NewNop().Sugar()); err == nil {
+		t.Errorf("Expected an invalid certificate to fail on start")
+	}
+}
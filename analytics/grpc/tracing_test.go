@@ -0,0 +1,49 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mactavishz/kuerzen/analytics/pb"
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestClientPropagatesTraceContext(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	provider := sdktrace.NewTracerProvider()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	traceparent := make(chan string, 1)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		traceparent <- strings.Join(md.Get("traceparent"), ",")
+		return handler(ctx, req)
+	}))
+	pb.RegisterAnalyticsServiceServer(srv, NewAnalyticsGRPCServer(&recordingStore{}, nil, nil, nil, zap.NewNop().Sugar()))
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	client, err := NewAnalyticsGRPCClient(ln.Addr().String(), ClientConfig{}, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewAnalyticsGRPCClient failed: %v", err)
+	}
+	defer client.Close()
+	ctx, span := provider.Tracer("test").Start(context.Background(), "shorten")
+	defer span.End()
+	if err := client.SendURLCreationEvent(ctx, &astore.URLCreationEvent{ServiceName: "shortener", ShortURL: "abc"}); err != nil {
+		t.Fatalf("SendURLCreationEvent failed: %v", err)
+	}
+	if got, want := <-traceparent, span.SpanContext().TraceID().String(); !strings.Contains(got, want) {
+		t.Errorf("Expected the traceparent of trace %s, got %q", want, got)
+	}
+}
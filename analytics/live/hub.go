@@ -0,0 +1,262 @@
+// Package live fans out recorded events to live subscribers, e.g. to watch the clicks of a link on its launch day.
+// Publishing never blocks: events that don't fit into the buffer of a slow subscriber are dropped for that subscriber,
+// and subscribers that stay too slow for too long are disconnected.
+package live
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DEFAULT_BUFFER_SIZE  = 256
+	DEFAULT_SLOW_TIMEOUT = 10 * time.Second
+	DEFAULT_MAX_SUBS     = 1000
+)
+
+var (
+	ErrTooManySubscribers = errors.New("too many subscribers")
+	// ErrSlowSubscriber ends subscriptions whose buffer was full for longer than the slow timeout
+	ErrSlowSubscriber = errors.New("subscriber too slow")
+	ErrClosed         = errors.New("hub closed")
+)
+
+type Config struct {
+	BufferSize  int           // Events buffered per subscriber
+	SlowTimeout time.Duration // A subscriber whose buffer stays full for this long is disconnected
+	MaxSubs     int
+	Registerer  prometheus.Registerer
+}
+
+// Filter selects the events of a subscription. An event matches if its short URL is one of ShortURLs or if it
+// belongs to Owner, an empty filter matches all events. Creation events of the owner add their short URL to the
+// filter, so that the clicks on links created during the subscription are delivered as well.
+type Filter struct {
+	ShortURLs []string
+	Owner     string
+	Creations bool // Deliver creation events
+	Redirects bool // Deliver redirect events
+}
+
+// Message is an event delivered to a subscriber
+type Message struct {
+	Event   store.Event
+	Dropped int64 // Events dropped for the subscriber since the previous message, because it was too slow
+}
+
+type Subscription struct {
+	hub       *Hub
+	ch        chan Message
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // why the subscription ended, set before done is closed
+
+	// guarded by hub.mu
+	shortURLs map[string]bool
+	owner     string
+	creations bool
+	redirects bool
+	dropped   int64
+	fullSince time.Time // zero while the buffer has room
+}
+
+// Events delivers the messages of the subscription, read it until Done is closed
+func (s *Subscription) Events() <-chan Message {
+	return s.ch
+}
+
+// Done is closed when the subscription ends, Err tells why
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.hub.remove(s, nil)
+}
+
+func (s *Subscription) end(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+type metrics struct {
+	subscribers prometheus.GaugeFunc
+	delivered   prometheus.Counter
+	dropped     prometheus.Counter
+	evicted     prometheus.Counter
+}
+
+type Hub struct {
+	cfg     Config
+	metrics metrics
+	mu      sync.Mutex
+	subs    map[*Subscription]struct{}
+	closed  bool
+	now     func() time.Time
+}
+
+func NewHub(cfg Config) (*Hub, error) {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DEFAULT_BUFFER_SIZE
+	}
+	if cfg.SlowTimeout <= 0 {
+		cfg.SlowTimeout = DEFAULT_SLOW_TIMEOUT
+	}
+	if cfg.MaxSubs <= 0 {
+		cfg.MaxSubs = DEFAULT_MAX_SUBS
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	h := &Hub{
+		cfg:  cfg,
+		subs: make(map[*Subscription]struct{}),
+		now:  time.Now,
+	}
+	h.metrics = metrics{
+		subscribers: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "analytics_live_subscribers",
+			Help: "Number of live event subscribers.",
+		}, func() float64 {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			return float64(len(h.subs))
+		}),
+		delivered: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "analytics_live_delivered_events_total",
+			Help: "Number of events delivered to live subscribers.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "analytics_live_dropped_events_total",
+			Help: "Number of events dropped because the buffer of a live subscriber was full.",
+		}),
+		evicted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "analytics_live_evicted_subscribers_total",
+			Help: "Number of live subscribers disconnected for being too slow.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{h.metrics.subscribers, h.metrics.delivered, h.metrics.dropped, h.metrics.evicted} {
+		if err := cfg.Registerer.Register(c); err != nil {
+			return nil, fmt.Errorf("register live metrics: %w", err)
+		}
+	}
+	return h, nil
+}
+
+func (h *Hub) Subscribe(f Filter) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+	if len(h.subs) >= h.cfg.MaxSubs {
+		return nil, ErrTooManySubscribers
+	}
+	s := &Subscription{
+		hub:       h,
+		ch:        make(chan Message, h.cfg.BufferSize),
+		done:      make(chan struct{}),
+		owner:     f.Owner,
+		creations: f.Creations,
+		redirects: f.Redirects,
+	}
+	if len(f.ShortURLs) > 0 {
+		s.shortURLs = make(map[string]bool, len(f.ShortURLs))
+		for _, shortURL := range f.ShortURLs {
+			s.shortURLs[shortURL] = true
+		}
+	}
+	h.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Publish hands the events to the matching subscribers without blocking
+func (h *Hub) Publish(events []store.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	now := h.now()
+	for _, event := range events {
+		for s := range h.subs {
+			if !s.matches(event) {
+				continue
+			}
+			select {
+			case s.ch <- Message{Event: event, Dropped: s.dropped}:
+				s.dropped = 0
+				s.fullSince = time.Time{}
+				h.metrics.delivered.Inc()
+			default:
+				s.dropped++
+				h.metrics.dropped.Inc()
+				if s.fullSince.IsZero() {
+					s.fullSince = now
+				} else if now.Sub(s.fullSince) > h.cfg.SlowTimeout {
+					h.metrics.evicted.Inc()
+					h.removeLocked(s, ErrSlowSubscriber)
+				}
+			}
+		}
+	}
+}
+
+// matches reports whether the event is delivered to s, h.mu must be held
+func (s *Subscription) matches(event store.Event) bool {
+	switch e := event.(type) {
+	case *store.URLCreationEvent:
+		if s.owner != "" && e.Owner == s.owner && e.ShortURL != "" {
+			if s.shortURLs == nil {
+				s.shortURLs = make(map[string]bool)
+			}
+			s.shortURLs[e.ShortURL] = true
+		}
+		return s.creations && s.selects(e.ShortURL, e.Owner)
+	case *store.URLRedirectEvent:
+		return s.redirects && s.selects(e.ShortURL, "")
+	default:
+		return false
+	}
+}
+
+func (s *Subscription) selects(shortURL string, owner string) bool {
+	if s.shortURLs == nil && s.owner == "" {
+		return true
+	}
+	return s.shortURLs[shortURL] || (s.owner != "" && owner == s.owner)
+}
+
+func (h *Hub) remove(s *Subscription, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(s, err)
+}
+
+func (h *Hub) removeLocked(s *Subscription, err error) {
+	delete(h.subs, s)
+	s.end(err)
+}
+
+// Close ends all subscriptions, later subscriptions fail with ErrClosed
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.removeLocked(s, ErrClosed)
+	}
+}
@@ -0,0 +1,109 @@
+package live
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestHub(t *testing.T, cfg Config) *Hub {
+	t.Helper()
+	cfg.Registerer = prometheus.NewRegistry()
+	h, err := NewHub(cfg)
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+	return h
+}
+
+func click(shortURL string) store.Event {
+	return &store.URLRedirectEvent{ServiceName: "redirector", ShortURL: shortURL, Success: true, Timestamp: time.Now()}
+}
+
+// received drains the buffered messages of s
+func received(s *Subscription) []Message {
+	var msgs []Message
+	for {
+		select {
+		case msg := <-s.Events():
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestHubFilters(t *testing.T) {
+	h := newTestHub(t, Config{})
+	all, _ := h.Subscribe(Filter{Creations: true, Redirects: true})
+	byURL, _ := h.Subscribe(Filter{ShortURLs: []string{"a"}, Redirects: true})
+	byOwner, _ := h.Subscribe(Filter{Owner: "alice", Creations: true, Redirects: true})
+
+	h.Publish([]store.Event{
+		click("a"),
+		click("b"),
+		&store.URLCreationEvent{ServiceName: "shortener", ShortURL: "c", Owner: "alice", Success: true, Timestamp: time.Now()},
+		click("c"),
+	})
+	if n := len(received(all)); n != 4 {
+		t.Errorf("Expected all 4 events without a filter, got %d", n)
+	}
+	if msgs := received(byURL); len(msgs) != 1 || msgs[0].Event.(*store.URLRedirectEvent).ShortURL != "a" {
+		t.Errorf("Expected the click on a, got %+v", msgs)
+	}
+	// The owner's new URL is followed from its creation on
+	if msgs := received(byOwner); len(msgs) != 2 || msgs[1].Event.(*store.URLRedirectEvent).ShortURL != "c" {
+		t.Errorf("Expected the creation of c and the click on it, got %+v", msgs)
+	}
+}
+
+func TestHubDropsForSlowSubscribers(t *testing.T) {
+	h := newTestHub(t, Config{BufferSize: 2, SlowTimeout: time.Minute})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	slow, _ := h.Subscribe(Filter{Redirects: true})
+
+	h.Publish([]store.Event{click("a"), click("b"), click("c"), click("d")})
+	if msgs := received(slow); len(msgs) != 2 {
+		t.Fatalf("Expected the buffered 2 events, got %d", len(msgs))
+	}
+	h.Publish([]store.Event{click("e")})
+	if msgs := received(slow); len(msgs) != 1 || msgs[0].Dropped != 2 {
+		t.Errorf("Expected the next event to report 2 dropped events, got %+v", msgs)
+	}
+
+	// A subscriber whose buffer stays full past the timeout is disconnected
+	h.Publish([]store.Event{click("f"), click("g"), click("h")})
+	now = now.Add(2 * time.Minute)
+	h.Publish([]store.Event{click("i")})
+	select {
+	case <-slow.Done():
+	default:
+		t.Fatal("Expected the slow subscriber to be disconnected")
+	}
+	if !errors.Is(slow.Err(), ErrSlowSubscriber) {
+		t.Errorf("Expected ErrSlowSubscriber, got %v", slow.Err())
+	}
+}
+
+func TestHubLimitsSubscribers(t *testing.T) {
+	h := newTestHub(t, Config{MaxSubs: 1})
+	s, err := h.Subscribe(Filter{})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if _, err := h.Subscribe(Filter{}); !errors.Is(err, ErrTooManySubscribers) {
+		t.Errorf("Expected ErrTooManySubscribers, got %v", err)
+	}
+	s.Close()
+	if _, err := h.Subscribe(Filter{}); err != nil {
+		t.Errorf("Expected a free slot after closing, got %v", err)
+	}
+	h.Close()
+	if _, err := h.Subscribe(Filter{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -2,48 +2,53 @@ package main
 
 import (
 	"context"
-	"net"
+	"fmt"
 	"net/http"
 	"os"
-	"syscall"
+	"strconv"
 	"time"
 
 	grpcprom "github.com/grpc-ecosystem/go-grpc-middleware/providers/prometheus"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/mactavishz/kuerzen/analytics/audit"
+	"github.com/mactavishz/kuerzen/analytics/dedupe"
 	server "github.com/mactavishz/kuerzen/analytics/grpc"
+	"github.com/mactavishz/kuerzen/analytics/live"
 	"github.com/mactavishz/kuerzen/analytics/pb"
+	"github.com/mactavishz/kuerzen/service"
+	"github.com/mactavishz/kuerzen/service/health"
 	store "github.com/mactavishz/kuerzen/store/analytics"
-	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"go.uber.org/zap"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
 )
 
 const (
 	DEFAULT_GRPC_PORT    = "3003"
 	DEFAULT_METRICS_PORT = "3002"
+	// DEFAULT_MAX_CONNECTION_AGE makes clients reconnect now and then, resolving the replicas again
+	DEFAULT_MAX_CONNECTION_AGE = 5 * time.Minute
 )
 
 func main() {
-	// We use sugar logger for better readability in development
-	logger := zap.Must(zap.NewProduction()).Sugar()
-	if os.Getenv("APP_ENV") == "development" || os.Getenv("APP_ENV") == "" {
-		logger = zap.Must(zap.NewDevelopment()).Sugar()
+	if len(os.Args) > 1 {
+		os.Exit(runAdmin(os.Args[1:]))
 	}
-	defer logger.Sync()
-
-	grpcPort := os.Getenv("ANALYTICS_GRPC_PORT")
-	metricsPort := os.Getenv("ANALYTICS_PORT")
-
-	if len(grpcPort) == 0 {
-		grpcPort = DEFAULT_GRPC_PORT
+	logger := service.NewLogger()
+	svc := service.New(service.Config{Name: "analytics"}, logger)
+	tracing, err := service.SetupTracing("analytics", logger)
+	if err != nil {
+		logger.Fatalf("Could not set up tracing: %v", err)
 	}
+	// Stopped last so that the spans of the shutdown are exported
+	svc.Add(tracing)
 
-	if len(metricsPort) == 0 {
-		metricsPort = DEFAULT_METRICS_PORT
-	}
+	grpcPort := service.Getenv("ANALYTICS_GRPC_PORT", DEFAULT_GRPC_PORT)
+	metricsPort := service.Getenv("ANALYTICS_PORT", DEFAULT_METRICS_PORT)
 
 	// Setup prometheus metrics
 	// Ref: https://github.com/grpc-ecosystem/go-grpc-middleware/tree/main/examples
@@ -55,14 +60,37 @@ func main() {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(srvMetrics)
 
-	client := influxdb2.NewClient(os.Getenv("ANALYTICS_DB_URL"), os.Getenv("DOCKER_INFLUXDB_INIT_ADMIN_TOKEN"))
-	analyticsStore := store.NewInfluxDBAnalyticsStore(client, os.Getenv("DOCKER_INFLUXDB_INIT_ORG"), os.Getenv("DOCKER_INFLUXDB_INIT_BUCKET"))
-	defer analyticsStore.Close()
-	analyticsGRPCServer := server.NewAnalyticsGRPCServer(analyticsStore, logger)
+	backend, err := openBackend(svc, reg, logger)
+	if err != nil {
+		logger.Fatalf("Could not set up analytics store: %v", err)
+	}
+	auditLog, err := audit.Open(service.Getenv("ANALYTICS_AUDIT_LOG", DEFAULT_AUDIT_LOG), logger)
+	if err != nil {
+		logger.Fatalf("Could not open the audit log: %v", err)
+	}
+	// Closed after the grpc server stopped
+	svc.Add(service.NewCloser("audit log", auditLog.Close))
+	dedupeSet, err := dedupeSet(reg)
+	if err != nil {
+		logger.Fatalf("Could not set up event deduplication: %v", err)
+	}
+	hub, err := liveHub(reg)
+	if err != nil {
+		logger.Fatalf("Could not set up live events: %v", err)
+	}
+	analyticsGRPCServer := server.NewAnalyticsGRPCServer(backend, backend.Reader, dedupeSet, hub, logger)
+	erasable, _ := backend.AnalyticsBackend.(store.ErasableStore)
+	adminGRPCServer := server.NewAnalyticsAdminServer(backend.DLQ, erasable, auditLog, logger)
+	maxConnectionAge, err := time.ParseDuration(service.Getenv("ANALYTICS_MAX_CONNECTION_AGE", DEFAULT_MAX_CONNECTION_AGE.String()))
+	if err != nil {
+		logger.Fatalf("Invalid ANALYTICS_MAX_CONNECTION_AGE: %v", err)
+	}
 	// Define keepalive server parameters
 	kasp := keepalive.ServerParameters{
 		Time:    30 * time.Second, // Ping the client if it is idle for 30 seconds to ensure the connection is still active
 		Timeout: 60 * time.Second, // Wait 60 second for the ping ack before assuming the connection is dead
+		// Clients pick up new replicas when they reconnect, streams open at that age may run on (0 never closes)
+		MaxConnectionAge: maxConnectionAge,
 	}
 
 	// Define keepalive enforcement policy
@@ -70,57 +98,140 @@ func main() {
 		MinTime:             5 * time.Second, // If a client pings more than once every 5 seconds, terminate the connection
 		PermitWithoutStream: true,            // Allow pings even when there are no active streams
 	}
+	tlsCfg := server.TLSConfigFromEnv("ANALYTICS_")
+	creds, err := server.ServerCredentials(tlsCfg, logger)
+	if err != nil {
+		logger.Fatalf("Invalid TLS settings: %v", err)
+	}
+	unary := []grpc.UnaryServerInterceptor{srvMetrics.UnaryServerInterceptor()}
+	stream := []grpc.StreamServerInterceptor{srvMetrics.StreamServerInterceptor()}
+	authCfg, err := authConfig()
+	if err != nil {
+		logger.Fatalf("Invalid auth settings: %v", err)
+	}
+	if authCfg.Enabled() {
+		if !tlsCfg.Enabled {
+			// The clients don't send their credentials without TLS either
+			logger.Fatalf("Authentication requires TLS, set ANALYTICS_TLS_CERT_FILE and ANALYTICS_TLS_KEY_FILE")
+		}
+		// Rejected calls are still counted by the metrics
+		auth := server.NewAuthenticator(authCfg, logger)
+		unary = append(unary, auth.UnaryServerInterceptor())
+		stream = append(stream, auth.StreamServerInterceptor())
+	} else {
+		logger.Warnf("Authentication of the analytics service is disabled, set ANALYTICS_AUTH_TOKENS or ANALYTICS_AUTH_JWT_KEYS; the admin service is not served")
+	}
 	serverOpts := []grpc.ServerOption{
+		grpc.Creds(creds),
+		grpc.StatsHandler(otelgrpc.NewServerHandler(otelgrpc.WithFilter(filters.Not(filters.HealthCheck())))),
 		grpc.KeepaliveParams(kasp),
 		grpc.KeepaliveEnforcementPolicy(kaep),
-		grpc.ChainUnaryInterceptor(srvMetrics.UnaryServerInterceptor()),
-		grpc.ChainStreamInterceptor(srvMetrics.StreamServerInterceptor()),
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	}
+
+	healthInterval, err := time.ParseDuration(service.Getenv("ANALYTICS_HEALTH_INTERVAL", server.DEFAULT_HEALTH_INTERVAL.String()))
+	if err != nil {
+		logger.Fatalf("Invalid ANALYTICS_HEALTH_INTERVAL: %v", err)
+	}
+	healthReporter := server.NewHealthReporter(healthInterval, logger)
+	healthReporter.AddCheck(backend.Dependency.Name, backend.Ping)
+	if backend.DLQ != nil {
+		check, err := dlqCheck(backend.DLQ)
+		if err != nil {
+			logger.Fatalf("Invalid dead-letter queue settings: %v", err)
+		}
+		healthReporter.AddCheck("dead-letter queue", check)
 	}
 
 	grpcServer := grpc.NewServer(serverOpts...)
 	pb.RegisterAnalyticsServiceServer(grpcServer, analyticsGRPCServer)
+	// Anyone who reaches the port could purge analytics otherwise
+	if authCfg.Enabled() {
+		pb.RegisterAnalyticsAdminServiceServer(grpcServer, adminGRPCServer)
+	}
+	healthpb.RegisterHealthServer(grpcServer, healthReporter.Server())
+	if service.Getenv("ANALYTICS_GRPC_REFLECTION", "false") == "true" {
+		reflection.Register(grpcServer)
+	}
 	srvMetrics.InitializeMetrics(grpcServer)
+	svc.Add(service.NewGRPCServer("grpc server", grpcServer, ":"+grpcPort))
+	// Stopped before the grpc server, clients see NOT_SERVING while the server drains
+	svc.Add(service.NewComponent("health reporter", healthReporter.Start, healthReporter.Stop))
+	// Live subscriptions never end on their own, they are closed before the graceful stop of the grpc server waits for them
+	svc.Add(service.NewCloser("live hub", func() error {
+		hub.Close()
+		return nil
+	}))
 
-	g := &run.Group{}
-	g.Add(func() error {
-		listener, err := net.Listen("tcp", ":"+grpcPort)
-		if err != nil {
-			logger.Fatalf("failed to listen: %v", err)
-		}
-		logger.Infof("Analytics service GRPC listening on port :%s", grpcPort)
-		return grpcServer.Serve(listener)
-	}, func(err error) {
-		logger.Errorf("Failed to serve gRPC: %v", err)
-		grpcServer.GracefulStop()
-		grpcServer.Stop()
-	})
 	// Start metrics HTTP server
-	httpServer := &http.Server{Addr: ":" + metricsPort}
-	g.Add(func() error {
-		http.Handle("/metrics", promhttp.HandlerFor(
-			reg,
-			promhttp.HandlerOpts{
-				EnableOpenMetrics: true,
-			},
-		))
-		http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			_, err := w.Write([]byte("{\"status\": \"healthy\"}"))
-			if err != nil {
-				logger.Errorf("failed to write health response: %v", err)
-			}
-		})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(
+		reg,
+		promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		},
+	))
+	registry := health.NewRegistry(health.DEFAULT_CACHE_TTL)
+	registry.Register(backend.Dependency)
+	service.RegisterHealthHandlers(mux, svc, registry)
+	svc.Add(service.NewHTTPServer("metrics server", &http.Server{Addr: ":" + metricsPort, Handler: mux}))
+
+	svc.OnStart(func(ctx context.Context) error {
+		logger.Infof("Analytics service GRPC listening on port :%s", grpcPort)
 		logger.Infof("Metrics server listening on port :%s", metricsPort)
-		return httpServer.ListenAndServe()
-	}, func(err error) {
-		if err := httpServer.Close(); err != nil {
-			logger.Errorf("failed to serve metrics: %v", err)
-		}
+		return nil
 	})
-	g.Add(run.SignalHandler(context.Background(), syscall.SIGINT, syscall.SIGTERM))
-	if err := g.Run(); err != nil {
-		logger.Errorf("program interrupted: %v", err)
-		os.Exit(1)
+	os.Exit(svc.Run())
+}
+
+// authConfig reads the tokens, the JWT keys and the allowlist of the callers
+func authConfig() (server.AuthConfig, error) {
+	var cfg server.AuthConfig
+	var err error
+	if cfg.Tokens, err = server.ParseTokens(os.Getenv("ANALYTICS_AUTH_TOKENS")); err != nil {
+		return cfg, fmt.Errorf("ANALYTICS_AUTH_TOKENS: %w", err)
+	}
+	if cfg.JWTKeys, err = server.ParseJWTKeys(os.Getenv("ANALYTICS_AUTH_JWT_KEYS")); err != nil {
+		return cfg, fmt.Errorf("ANALYTICS_AUTH_JWT_KEYS: %w", err)
+	}
+	if v := os.Getenv("ANALYTICS_AUTH_ALLOWLIST"); v != "" {
+		if cfg.Allowlist, err = server.ParseAllowlist(v); err != nil {
+			return cfg, fmt.Errorf("ANALYTICS_AUTH_ALLOWLIST: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// dedupeSet remembers the event ids of ANALYTICS_DEDUPE_WINDOW, a window of 0 turns deduplication off
+func dedupeSet(reg prometheus.Registerer) (*dedupe.Set, error) {
+	window, err := time.ParseDuration(service.Getenv("ANALYTICS_DEDUPE_WINDOW", dedupe.DEFAULT_WINDOW.String()))
+	if err != nil {
+		return nil, fmt.Errorf("ANALYTICS_DEDUPE_WINDOW: %w", err)
+	}
+	if window == 0 {
+		return nil, nil
+	}
+	maxKeys, err := strconv.Atoi(service.Getenv("ANALYTICS_DEDUPE_MAX_KEYS", strconv.Itoa(dedupe.DEFAULT_MAX_KEYS)))
+	if err != nil {
+		return nil, fmt.Errorf("ANALYTICS_DEDUPE_MAX_KEYS: %w", err)
+	}
+	return dedupe.New(dedupe.Config{Window: window, MaxKeys: maxKeys, Registerer: reg})
+}
+
+// liveHub fans out the recorded events to the subscribers of SubscribeEvents
+func liveHub(reg prometheus.Registerer) (*live.Hub, error) {
+	bufferSize, err := strconv.Atoi(service.Getenv("ANALYTICS_LIVE_BUFFER_SIZE", strconv.Itoa(live.DEFAULT_BUFFER_SIZE)))
+	if err != nil {
+		return nil, fmt.Errorf("ANALYTICS_LIVE_BUFFER_SIZE: %w", err)
+	}
+	slowTimeout, err := time.ParseDuration(service.Getenv("ANALYTICS_LIVE_SLOW_TIMEOUT", live.DEFAULT_SLOW_TIMEOUT.String()))
+	if err != nil {
+		return nil, fmt.Errorf("ANALYTICS_LIVE_SLOW_TIMEOUT: %w", err)
+	}
+	maxSubs, err := strconv.Atoi(service.Getenv("ANALYTICS_LIVE_MAX_SUBSCRIBERS", strconv.Itoa(live.DEFAULT_MAX_SUBS)))
+	if err != nil {
+		return nil, fmt.Errorf("ANALYTICS_LIVE_MAX_SUBSCRIBERS: %w", err)
 	}
+	return live.NewHub(live.Config{BufferSize: bufferSize, SlowTimeout: slowTimeout, MaxSubs: maxSubs, Registerer: reg})
 }
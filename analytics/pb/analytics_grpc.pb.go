@@ -21,6 +21,13 @@ const _ = grpc.SupportPackageIsVersion9
 const (
 	AnalyticsService_CreateShortURLEvent_FullMethodName   = "/pb.AnalyticsService/CreateShortURLEvent"
 	AnalyticsService_RedirectShortURLEvent_FullMethodName = "/pb.AnalyticsService/RedirectShortURLEvent"
+	AnalyticsService_RecordEvents_FullMethodName          = "/pb.AnalyticsService/RecordEvents"
+	AnalyticsService_StreamEvents_FullMethodName          = "/pb.AnalyticsService/StreamEvents"
+	AnalyticsService_GetLinkStats_FullMethodName          = "/pb.AnalyticsService/GetLinkStats"
+	AnalyticsService_GetClickSeries_FullMethodName        = "/pb.AnalyticsService/GetClickSeries"
+	AnalyticsService_TopLinks_FullMethodName              = "/pb.AnalyticsService/TopLinks"
+	AnalyticsService_TopReferrers_FullMethodName          = "/pb.AnalyticsService/TopReferrers"
+	AnalyticsService_SubscribeEvents_FullMethodName       = "/pb.AnalyticsService/SubscribeEvents"
 )
 
 // AnalyticsServiceClient is the client API for AnalyticsService service.
@@ -31,6 +38,22 @@ type AnalyticsServiceClient interface {
 	CreateShortURLEvent(ctx context.Context, in *CreateShortURLEventRequest, opts ...grpc.CallOption) (*EventResponse, error)
 	// Record an event when a short URL is accessed
 	RedirectShortURLEvent(ctx context.Context, in *RedirectShortURLEventRequest, opts ...grpc.CallOption) (*EventResponse, error)
+	// Record a batch of events in a single round trip, fails with UNAVAILABLE if the store could not write them
+	RecordEvents(ctx context.Context, in *EventBatch, opts ...grpc.CallOption) (*EventBatchAck, error)
+	// Record a stream of events, the acknowledgement for the whole stream is sent once the client closes it.
+	// Fails with UNAVAILABLE naming the first offset to resend if the store could not write a chunk
+	StreamEvents(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[Event, EventBatchAck], error)
+	// Summarize the clicks of a short URL
+	GetLinkStats(ctx context.Context, in *LinkStatsRequest, opts ...grpc.CallOption) (*LinkStatsResponse, error)
+	// Get the clicks of a short URL per interval
+	GetClickSeries(ctx context.Context, in *ClickSeriesRequest, opts ...grpc.CallOption) (*ClickSeriesResponse, error)
+	// Rank the short URLs by clicks
+	TopLinks(ctx context.Context, in *TopLinksRequest, opts ...grpc.CallOption) (*RankResponse, error)
+	// Rank the referrer hosts by clicks
+	TopReferrers(ctx context.Context, in *TopReferrersRequest, opts ...grpc.CallOption) (*RankResponse, error)
+	// Receive the events recorded from now on. Events are dropped for subscribers that don't keep up,
+	// subscribers that fall behind for too long are disconnected with RESOURCE_EXHAUSTED.
+	SubscribeEvents(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LiveEvent], error)
 }
 
 type analyticsServiceClient struct {
@@ -61,6 +84,88 @@ func (c *analyticsServiceClient) RedirectShortURLEvent(ctx context.Context, in *
 	return out, nil
 }
 
+func (c *analyticsServiceClient) RecordEvents(ctx context.Context, in *EventBatch, opts ...grpc.CallOption) (*EventBatchAck, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EventBatchAck)
+	err := c.cc.Invoke(ctx, AnalyticsService_RecordEvents_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsServiceClient) StreamEvents(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[Event, EventBatchAck], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AnalyticsService_ServiceDesc.Streams[0], AnalyticsService_StreamEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Event, EventBatchAck]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AnalyticsService_StreamEventsClient = grpc.ClientStreamingClient[Event, EventBatchAck]
+
+func (c *analyticsServiceClient) GetLinkStats(ctx context.Context, in *LinkStatsRequest, opts ...grpc.CallOption) (*LinkStatsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LinkStatsResponse)
+	err := c.cc.Invoke(ctx, AnalyticsService_GetLinkStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsServiceClient) GetClickSeries(ctx context.Context, in *ClickSeriesRequest, opts ...grpc.CallOption) (*ClickSeriesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ClickSeriesResponse)
+	err := c.cc.Invoke(ctx, AnalyticsService_GetClickSeries_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsServiceClient) TopLinks(ctx context.Context, in *TopLinksRequest, opts ...grpc.CallOption) (*RankResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RankResponse)
+	err := c.cc.Invoke(ctx, AnalyticsService_TopLinks_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsServiceClient) TopReferrers(ctx context.Context, in *TopReferrersRequest, opts ...grpc.CallOption) (*RankResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RankResponse)
+	err := c.cc.Invoke(ctx, AnalyticsService_TopReferrers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsServiceClient) SubscribeEvents(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LiveEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AnalyticsService_ServiceDesc.Streams[1], AnalyticsService_SubscribeEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SubscribeRequest, LiveEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AnalyticsService_SubscribeEventsClient = grpc.ServerStreamingClient[LiveEvent]
+
 // AnalyticsServiceServer is the server API for AnalyticsService service.
 // All implementations must embed UnimplementedAnalyticsServiceServer
 // for forward compatibility.
@@ -69,6 +174,22 @@ type AnalyticsServiceServer interface {
 	CreateShortURLEvent(context.Context, *CreateShortURLEventRequest) (*EventResponse, error)
 	// Record an event when a short URL is accessed
 	RedirectShortURLEvent(context.Context, *RedirectShortURLEventRequest) (*EventResponse, error)
+	// Record a batch of events in a single round trip, fails with UNAVAILABLE if the store could not write them
+	RecordEvents(context.Context, *EventBatch) (*EventBatchAck, error)
+	// Record a stream of events, the acknowledgement for the whole stream is sent once the client closes it.
+	// Fails with UNAVAILABLE naming the first offset to resend if the store could not write a chunk
+	StreamEvents(grpc.ClientStreamingServer[Event, EventBatchAck]) error
+	// Summarize the clicks of a short URL
+	GetLinkStats(context.Context, *LinkStatsRequest) (*LinkStatsResponse, error)
+	// Get the clicks of a short URL per interval
+	GetClickSeries(context.Context, *ClickSeriesRequest) (*ClickSeriesResponse, error)
+	// Rank the short URLs by clicks
+	TopLinks(context.Context, *TopLinksRequest) (*RankResponse, error)
+	// Rank the referrer hosts by clicks
+	TopReferrers(context.Context, *TopReferrersRequest) (*RankResponse, error)
+	// Receive the events recorded from now on. Events are dropped for subscribers that don't keep up,
+	// subscribers that fall behind for too long are disconnected with RESOURCE_EXHAUSTED.
+	SubscribeEvents(*SubscribeRequest, grpc.ServerStreamingServer[LiveEvent]) error
 	mustEmbedUnimplementedAnalyticsServiceServer()
 }
 
@@ -85,6 +206,27 @@ func (UnimplementedAnalyticsServiceServer) CreateShortURLEvent(context.Context,
 func (UnimplementedAnalyticsServiceServer) RedirectShortURLEvent(context.Context, *RedirectShortURLEventRequest) (*EventResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method RedirectShortURLEvent not implemented")
 }
+func (UnimplementedAnalyticsServiceServer) RecordEvents(context.Context, *EventBatch) (*EventBatchAck, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RecordEvents not implemented")
+}
+func (UnimplementedAnalyticsServiceServer) StreamEvents(grpc.ClientStreamingServer[Event, EventBatchAck]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvents not implemented")
+}
+func (UnimplementedAnalyticsServiceServer) GetLinkStats(context.Context, *LinkStatsRequest) (*LinkStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLinkStats not implemented")
+}
+func (UnimplementedAnalyticsServiceServer) GetClickSeries(context.Context, *ClickSeriesRequest) (*ClickSeriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetClickSeries not implemented")
+}
+func (UnimplementedAnalyticsServiceServer) TopLinks(context.Context, *TopLinksRequest) (*RankResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TopLinks not implemented")
+}
+func (UnimplementedAnalyticsServiceServer) TopReferrers(context.Context, *TopReferrersRequest) (*RankResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TopReferrers not implemented")
+}
+func (UnimplementedAnalyticsServiceServer) SubscribeEvents(*SubscribeRequest, grpc.ServerStreamingServer[LiveEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeEvents not implemented")
+}
 func (UnimplementedAnalyticsServiceServer) mustEmbedUnimplementedAnalyticsServiceServer() {}
 func (UnimplementedAnalyticsServiceServer) testEmbeddedByValue()                          {}
 
@@ -142,6 +284,114 @@ func _AnalyticsService_RedirectShortURLEvent_Handler(srv interface{}, ctx contex
 	return interceptor(ctx, in, info, handler)
 }
 
+func _AnalyticsService_RecordEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EventBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServiceServer).RecordEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AnalyticsService_RecordEvents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServiceServer).RecordEvents(ctx, req.(*EventBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AnalyticsService_StreamEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AnalyticsServiceServer).StreamEvents(&grpc.GenericServerStream[Event, EventBatchAck]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AnalyticsService_StreamEventsServer = grpc.ClientStreamingServer[Event, EventBatchAck]
+
+func _AnalyticsService_GetLinkStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LinkStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServiceServer).GetLinkStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AnalyticsService_GetLinkStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServiceServer).GetLinkStats(ctx, req.(*LinkStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AnalyticsService_GetClickSeries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClickSeriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServiceServer).GetClickSeries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AnalyticsService_GetClickSeries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServiceServer).GetClickSeries(ctx, req.(*ClickSeriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AnalyticsService_TopLinks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TopLinksRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServiceServer).TopLinks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AnalyticsService_TopLinks_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServiceServer).TopLinks(ctx, req.(*TopLinksRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AnalyticsService_TopReferrers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TopReferrersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsServiceServer).TopReferrers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AnalyticsService_TopReferrers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsServiceServer).TopReferrers(ctx, req.(*TopReferrersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AnalyticsService_SubscribeEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AnalyticsServiceServer).SubscribeEvents(m, &grpc.GenericServerStream[SubscribeRequest, LiveEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AnalyticsService_SubscribeEventsServer = grpc.ServerStreamingServer[LiveEvent]
+
 // AnalyticsService_ServiceDesc is the grpc.ServiceDesc for AnalyticsService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -157,6 +407,225 @@ var AnalyticsService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "RedirectShortURLEvent",
 			Handler:    _AnalyticsService_RedirectShortURLEvent_Handler,
 		},
+		{
+			MethodName: "RecordEvents",
+			Handler:    _AnalyticsService_RecordEvents_Handler,
+		},
+		{
+			MethodName: "GetLinkStats",
+			Handler:    _AnalyticsService_GetLinkStats_Handler,
+		},
+		{
+			MethodName: "GetClickSeries",
+			Handler:    _AnalyticsService_GetClickSeries_Handler,
+		},
+		{
+			MethodName: "TopLinks",
+			Handler:    _AnalyticsService_TopLinks_Handler,
+		},
+		{
+			MethodName: "TopReferrers",
+			Handler:    _AnalyticsService_TopReferrers_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       _AnalyticsService_StreamEvents_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "SubscribeEvents",
+			Handler:       _AnalyticsService_SubscribeEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pb/analytics.proto",
+}
+
+const (
+	AnalyticsAdminService_InspectDeadLetters_FullMethodName = "/pb.AnalyticsAdminService/InspectDeadLetters"
+	AnalyticsAdminService_PurgeDeadLetters_FullMethodName   = "/pb.AnalyticsAdminService/PurgeDeadLetters"
+	AnalyticsAdminService_PurgeLinkAnalytics_FullMethodName = "/pb.AnalyticsAdminService/PurgeLinkAnalytics"
+)
+
+// AnalyticsAdminServiceClient is the client API for AnalyticsAdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Operations on the dead-letter queue of batches that could not be written to the store and on the stored analytics
+type AnalyticsAdminServiceClient interface {
+	// Summarize the dead-letter queue and list the oldest batches
+	InspectDeadLetters(ctx context.Context, in *InspectDeadLettersRequest, opts ...grpc.CallOption) (*DeadLetterReport, error)
+	// Delete dead-lettered batches without replaying them
+	PurgeDeadLetters(ctx context.Context, in *PurgeDeadLettersRequest, opts ...grpc.CallOption) (*PurgeDeadLettersResponse, error)
+	// Delete the events and rollups of short URLs, e.g. for a request of erasure. Purges are recorded in the audit log.
+	PurgeLinkAnalytics(ctx context.Context, in *PurgeLinkAnalyticsRequest, opts ...grpc.CallOption) (*PurgeLinkAnalyticsResponse, error)
+}
+
+type analyticsAdminServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAnalyticsAdminServiceClient(cc grpc.ClientConnInterface) AnalyticsAdminServiceClient {
+	return &analyticsAdminServiceClient{cc}
+}
+
+func (c *analyticsAdminServiceClient) InspectDeadLetters(ctx context.Context, in *InspectDeadLettersRequest, opts ...grpc.CallOption) (*DeadLetterReport, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeadLetterReport)
+	err := c.cc.Invoke(ctx, AnalyticsAdminService_InspectDeadLetters_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsAdminServiceClient) PurgeDeadLetters(ctx context.Context, in *PurgeDeadLettersRequest, opts ...grpc.CallOption) (*PurgeDeadLettersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PurgeDeadLettersResponse)
+	err := c.cc.Invoke(ctx, AnalyticsAdminService_PurgeDeadLetters_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *analyticsAdminServiceClient) PurgeLinkAnalytics(ctx context.Context, in *PurgeLinkAnalyticsRequest, opts ...grpc.CallOption) (*PurgeLinkAnalyticsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PurgeLinkAnalyticsResponse)
+	err := c.cc.Invoke(ctx, AnalyticsAdminService_PurgeLinkAnalytics_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AnalyticsAdminServiceServer is the server API for AnalyticsAdminService service.
+// All implementations must embed UnimplementedAnalyticsAdminServiceServer
+// for forward compatibility.
+//
+// Operations on the dead-letter queue of batches that could not be written to the store and on the stored analytics
+type AnalyticsAdminServiceServer interface {
+	// Summarize the dead-letter queue and list the oldest batches
+	InspectDeadLetters(context.Context, *InspectDeadLettersRequest) (*DeadLetterReport, error)
+	// Delete dead-lettered batches without replaying them
+	PurgeDeadLetters(context.Context, *PurgeDeadLettersRequest) (*PurgeDeadLettersResponse, error)
+	// Delete the events and rollups of short URLs, e.g. for a request of erasure. Purges are recorded in the audit log.
+	PurgeLinkAnalytics(context.Context, *PurgeLinkAnalyticsRequest) (*PurgeLinkAnalyticsResponse, error)
+	mustEmbedUnimplementedAnalyticsAdminServiceServer()
+}
+
+// UnimplementedAnalyticsAdminServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAnalyticsAdminServiceServer struct{}
+
+func (UnimplementedAnalyticsAdminServiceServer) InspectDeadLetters(context.Context, *InspectDeadLettersRequest) (*DeadLetterReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InspectDeadLetters not implemented")
+}
+func (UnimplementedAnalyticsAdminServiceServer) PurgeDeadLetters(context.Context, *PurgeDeadLettersRequest) (*PurgeDeadLettersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PurgeDeadLetters not implemented")
+}
+func (UnimplementedAnalyticsAdminServiceServer) PurgeLinkAnalytics(context.Context, *PurgeLinkAnalyticsRequest) (*PurgeLinkAnalyticsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PurgeLinkAnalytics not implemented")
+}
+func (UnimplementedAnalyticsAdminServiceServer) mustEmbedUnimplementedAnalyticsAdminServiceServer() {}
+func (UnimplementedAnalyticsAdminServiceServer) testEmbeddedByValue()                               {}
+
+// UnsafeAnalyticsAdminServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AnalyticsAdminServiceServer will
+// result in compilation errors.
+type UnsafeAnalyticsAdminServiceServer interface {
+	mustEmbedUnimplementedAnalyticsAdminServiceServer()
+}
+
+func RegisterAnalyticsAdminServiceServer(s grpc.ServiceRegistrar, srv AnalyticsAdminServiceServer) {
+	// If the following call pancis, it indicates UnimplementedAnalyticsAdminServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&AnalyticsAdminService_ServiceDesc, srv)
+}
+
+func _AnalyticsAdminService_InspectDeadLetters_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InspectDeadLettersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsAdminServiceServer).InspectDeadLetters(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AnalyticsAdminService_InspectDeadLetters_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsAdminServiceServer).InspectDeadLetters(ctx, req.(*InspectDeadLettersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AnalyticsAdminService_PurgeDeadLetters_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurgeDeadLettersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsAdminServiceServer).PurgeDeadLetters(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AnalyticsAdminService_PurgeDeadLetters_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsAdminServiceServer).PurgeDeadLetters(ctx, req.(*PurgeDeadLettersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AnalyticsAdminService_PurgeLinkAnalytics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurgeLinkAnalyticsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AnalyticsAdminServiceServer).PurgeLinkAnalytics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AnalyticsAdminService_PurgeLinkAnalytics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AnalyticsAdminServiceServer).PurgeLinkAnalytics(ctx, req.(*PurgeLinkAnalyticsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// AnalyticsAdminService_ServiceDesc is the grpc.ServiceDesc for AnalyticsAdminService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AnalyticsAdminService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pb.AnalyticsAdminService",
+	HandlerType: (*AnalyticsAdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "InspectDeadLetters",
+			Handler:    _AnalyticsAdminService_InspectDeadLetters_Handler,
+		},
+		{
+			MethodName: "PurgeDeadLetters",
+			Handler:    _AnalyticsAdminService_PurgeDeadLetters_Handler,
+		},
+		{
+			MethodName: "PurgeLinkAnalytics",
+			Handler:    _AnalyticsAdminService_PurgeLinkAnalytics_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pb/analytics.proto",
@@ -0,0 +1,267 @@
+// Package rollup builds the hourly and daily rollups of the redirect events and expires the data past its retention.
+// The hourly rollups are built from the raw events, the daily rollups from the hourly ones. Every resolution has a
+// watermark, the end of the range it was rolled up to, so that a run continues where the previous one stopped.
+package rollup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_INTERVAL = 5 * time.Minute
+	DEFAULT_LAG      = 5 * time.Minute
+	// Range of raw events rolled up per write, so that catching up on a long backlog makes progress step by step
+	MAX_STEP = 24 * time.Hour
+	// Range of hourly rollups rolled up into days per write
+	MAX_DAILY_STEP = 30 * 24 * time.Hour
+)
+
+type Config struct {
+	Interval time.Duration // Delay between runs
+	// Events arriving later than Lag after the end of their hour are not rolled up, they only count as raw events
+	Lag       time.Duration
+	Retention store.Retention
+	// Redirect events are anonymized once they are older than AnonymizeAfter and rolled up, 0 keeps them as they are
+	AnonymizeAfter time.Duration
+	Registerer     prometheus.Registerer
+}
+
+type metrics struct {
+	runs      *prometheus.CounterVec
+	watermark *prometheus.GaugeVec
+}
+
+// Job rolls up the events of a store periodically
+type Job struct {
+	cfg     Config
+	store   store.RollupStore
+	logger  *zap.SugaredLogger
+	metrics metrics
+	now     func() time.Time
+	// The events before are anonymized. It starts at zero, so that the first run of a process covers all events.
+	anonymized time.Time
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+func New(cfg Config, rollups store.RollupStore, logger *zap.SugaredLogger) (*Job, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DEFAULT_INTERVAL
+	}
+	if cfg.Lag <= 0 {
+		cfg.Lag = DEFAULT_LAG
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	if _, ok := rollups.(store.ErasableStore); cfg.AnonymizeAfter > 0 && !ok {
+		return nil, errors.New("the store can't anonymize redirect events")
+	}
+	j := &Job{
+		cfg:    cfg,
+		store:  rollups,
+		logger: logger,
+		now:    time.Now,
+		metrics: metrics{
+			runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "analytics_rollup_runs_total",
+				Help: "Number of runs of the rollup job.",
+			}, []string{"result"}),
+			watermark: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "analytics_rollup_watermark_seconds",
+				Help: "Unix time up to which the redirect events are rolled up.",
+			}, []string{"resolution"}),
+		},
+	}
+	for _, c := range []prometheus.Collector{j.metrics.runs, j.metrics.watermark} {
+		if err := cfg.Registerer.Register(c); err != nil {
+			return nil, fmt.Errorf("register rollup metrics: %w", err)
+		}
+	}
+	return j, nil
+}
+
+// Start runs the job now and then every interval until it is stopped or ctx is cancelled
+func (j *Job) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	j.cancel = cancel
+	j.done = make(chan struct{})
+	go j.loop(ctx)
+	return nil
+}
+
+// Stop cancels the current run, the rollups written so far are kept
+func (j *Job) Stop(ctx context.Context) error {
+	if j.cancel == nil {
+		return nil
+	}
+	j.cancel()
+	select {
+	case <-j.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stop rollup job: %w", ctx.Err())
+	}
+}
+
+func (j *Job) loop(ctx context.Context) {
+	defer close(j.done)
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := j.Run(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			j.metrics.runs.WithLabelValues("error").Inc()
+			j.logger.Errorf("Failed to roll up analytics events: %v", err)
+		} else {
+			j.metrics.runs.WithLabelValues("success").Inc()
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Run rolls up the hours that ended at least Lag ago and the days of the hourly rollups, then anonymizes the redirect
+// events and expires the data past its retention. Data is only anonymized or expired once it is rolled up into the
+// next coarser resolution, so that the rollups keep counting the visitors.
+func (j *Job) Run(ctx context.Context) error {
+	now := j.now()
+	hourly, err := j.rollUpRedirects(ctx, now.Add(-j.cfg.Lag).Truncate(store.RESOLUTION_HOUR))
+	if err != nil {
+		return err
+	}
+	daily, err := j.rollUpHours(ctx, hourly.Truncate(store.RESOLUTION_DAY))
+	if err != nil {
+		return err
+	}
+	if !hourly.IsZero() && j.cfg.AnonymizeAfter > 0 {
+		if before := earliest(now.Add(-j.cfg.AnonymizeAfter), hourly); before.After(j.anonymized) {
+			if err := j.store.(store.ErasableStore).AnonymizeRedirects(ctx, j.anonymized, before); err != nil {
+				return fmt.Errorf("anonymize redirects: %w", err)
+			}
+			j.anonymized = before
+		}
+	}
+	if !hourly.IsZero() && j.cfg.Retention.Raw > 0 {
+		if err := j.store.ExpireRedirects(ctx, earliest(now.Add(-j.cfg.Retention.Raw), hourly)); err != nil {
+			return err
+		}
+	}
+	if !daily.IsZero() && j.cfg.Retention.Hourly > 0 {
+		before := earliest(now.Add(-j.cfg.Retention.Hourly).Truncate(store.RESOLUTION_HOUR), daily)
+		if err := j.store.ExpireRollups(ctx, store.RESOLUTION_HOUR, before); err != nil {
+			return err
+		}
+	}
+	if j.cfg.Retention.Daily > 0 {
+		before := now.Add(-j.cfg.Retention.Daily).Truncate(store.RESOLUTION_DAY)
+		if err := j.store.ExpireRollups(ctx, store.RESOLUTION_DAY, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollUpRedirects builds the hourly rollups of the redirects up to the time and returns the new hourly watermark
+func (j *Job) rollUpRedirects(ctx context.Context, until time.Time) (time.Time, error) {
+	from, err := j.store.RolledUpUntil(ctx, store.RESOLUTION_HOUR)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query hourly watermark: %w", err)
+	}
+	start, err := j.firstStep(ctx, from, 0, store.RESOLUTION_HOUR)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for from.Before(until) {
+		// Without any redirects a single step records the watermark
+		to := until
+		if !start.IsZero() {
+			to = earliest(start.Add(MAX_STEP), until)
+		}
+		b := store.NewRollupBuilder(store.RESOLUTION_HOUR)
+		if err := j.store.ScanRedirects(ctx, "", from, to, b.AddRedirect); err != nil {
+			return time.Time{}, fmt.Errorf("scan redirects: %w", err)
+		}
+		if err := j.store.WriteRollups(ctx, store.RESOLUTION_HOUR, to, b.Rollups()); err != nil {
+			return time.Time{}, fmt.Errorf("write hourly rollups: %w", err)
+		}
+		from, start = to, to
+	}
+	j.setWatermark(store.RESOLUTION_HOUR, from)
+	return from, nil
+}
+
+// rollUpHours builds the daily rollups of the hourly rollups up to the time and returns the new daily watermark
+func (j *Job) rollUpHours(ctx context.Context, until time.Time) (time.Time, error) {
+	from, err := j.store.RolledUpUntil(ctx, store.RESOLUTION_DAY)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query daily watermark: %w", err)
+	}
+	start, err := j.firstStep(ctx, from, store.RESOLUTION_HOUR, store.RESOLUTION_DAY)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for from.Before(until) {
+		to := until
+		if !start.IsZero() {
+			to = earliest(start.Add(MAX_DAILY_STEP), until)
+		}
+		hours, err := j.store.ReadRollups(ctx, store.RESOLUTION_HOUR, store.RollupQuery{From: from, To: to, Visitors: true, Referrers: true})
+		if err != nil {
+			return time.Time{}, fmt.Errorf("read hourly rollups: %w", err)
+		}
+		b := store.NewRollupBuilder(store.RESOLUTION_DAY)
+		for _, r := range hours {
+			b.AddRollup(r)
+		}
+		if err := j.store.WriteRollups(ctx, store.RESOLUTION_DAY, to, b.Rollups()); err != nil {
+			return time.Time{}, fmt.Errorf("write daily rollups: %w", err)
+		}
+		from, start = to, to
+	}
+	j.setWatermark(store.RESOLUTION_DAY, from)
+	return from, nil
+}
+
+// firstStep returns where the steps of a resolution start: at its watermark, or if nothing was rolled up yet at the
+// bucket of the oldest data it is built from, zero if there is none. The first step still scans from the watermark,
+// so that it doesn't miss older data written meanwhile, but a first run doesn't roll up the whole history at once.
+func (j *Job) firstStep(ctx context.Context, watermark time.Time, source time.Duration, resolution time.Duration) (time.Time, error) {
+	if !watermark.IsZero() {
+		return watermark, nil
+	}
+	oldest, err := j.store.Oldest(ctx, source)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query oldest data: %w", err)
+	}
+	if oldest.IsZero() {
+		return oldest, nil
+	}
+	// Steps end at bucket boundaries, a bucket split over two steps would be replaced by its second part
+	return oldest.Truncate(resolution), nil
+}
+
+func (j *Job) setWatermark(resolution time.Duration, until time.Time) {
+	if !until.IsZero() {
+		j.metrics.watermark.WithLabelValues(resolution.String()).Set(float64(until.Unix()))
+	}
+}
+
+func earliest(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
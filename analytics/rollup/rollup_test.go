@@ -0,0 +1,211 @@
+package rollup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	store "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func newTestJob(t *testing.T, s store.RollupStore, retention store.Retention, now time.Time) *Job {
+	j, err := New(Config{Lag: time.Minute, Retention: retention, Registerer: prometheus.NewRegistry()}, s, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed to create job: %v", err)
+	}
+	j.now = func() time.Time { return now }
+	return j
+}
+
+func sum(t *testing.T, s store.RollupStore, resolution time.Duration, shortURL string) (clicks int64, failures int64) {
+	rollups, err := s.ReadRollups(context.Background(), resolution, store.RollupQuery{ShortURL: shortURL, To: time.Now()})
+	if err != nil {
+		t.Fatalf("ReadRollups failed: %v", err)
+	}
+	for _, r := range rollups {
+		clicks += r.Clicks
+		failures += r.Failures
+	}
+	return clicks, failures
+}
+
+// noonYesterday returns half past noon of yesterday, so that the clicks of the last hours are of the same day
+func noonYesterday() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour).Add(-11*time.Hour - 30*time.Minute)
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryAnalyticsStore()
+	now := noonYesterday()
+	for _, ago := range []time.Duration{10 * 24 * time.Hour, 3 * 24 * time.Hour, 2 * time.Hour, time.Hour, 10 * time.Minute} {
+		s.WriteURLRedirectEvent(&store.URLRedirectEvent{ShortURL: "a", Success: true, Timestamp: now.Add(-ago), VisitorID: "v"})
+	}
+	s.WriteURLRedirectEvent(&store.URLRedirectEvent{ShortURL: "a", Success: false, Timestamp: now.Add(-2 * time.Hour)})
+
+	j := newTestJob(t, s, store.Retention{}, now)
+	if err := j.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	hourly, _ := s.RolledUpUntil(ctx, store.RESOLUTION_HOUR)
+	if !hourly.Equal(now.Truncate(time.Hour)) {
+		t.Errorf("Expected the hours up to %v to be rolled up, got %v", now.Truncate(time.Hour), hourly)
+	}
+	daily, _ := s.RolledUpUntil(ctx, store.RESOLUTION_DAY)
+	if !daily.Equal(now.Truncate(24 * time.Hour)) {
+		t.Errorf("Expected the days up to %v to be rolled up, got %v", now.Truncate(24*time.Hour), daily)
+	}
+	// The click of the current hour isn't rolled up yet
+	if clicks, failures := sum(t, s, store.RESOLUTION_HOUR, "a"); clicks != 4 || failures != 1 {
+		t.Errorf("Expected 4 clicks and 1 failure in the hourly rollups, got %d and %d", clicks, failures)
+	}
+	if clicks, _ := sum(t, s, store.RESOLUTION_DAY, ""); clicks != 2 {
+		t.Errorf("Expected the 2 clicks of the past days in the daily rollups, got %d", clicks)
+	}
+
+	// A later run continues at the watermark and rolls up the new hour only
+	later := now.Add(time.Hour)
+	j.now = func() time.Time { return later }
+	if err := j.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if clicks, _ := sum(t, s, store.RESOLUTION_HOUR, "a"); clicks != 5 {
+		t.Errorf("Expected 5 clicks in the hourly rollups, got %d", clicks)
+	}
+}
+
+func TestRunExpiresRolledUpData(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryAnalyticsStore()
+	now := noonYesterday()
+	for _, ago := range []time.Duration{10 * 24 * time.Hour, 3 * 24 * time.Hour, 2 * time.Hour} {
+		s.WriteURLRedirectEvent(&store.URLRedirectEvent{ShortURL: "a", Success: true, Timestamp: now.Add(-ago)})
+	}
+
+	retention := store.Retention{Raw: 48 * time.Hour, Hourly: 5 * 24 * time.Hour, Daily: 7 * 24 * time.Hour}
+	if err := newTestJob(t, s, retention, now).Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	stats, err := s.GetLinkStats(ctx, "a", 0)
+	if err != nil {
+		t.Fatalf("GetLinkStats failed: %v", err)
+	}
+	if stats.Clicks != 1 {
+		t.Errorf("Expected the raw events of the last 48 hours only, got %d clicks", stats.Clicks)
+	}
+	if clicks, _ := sum(t, s, store.RESOLUTION_HOUR, "a"); clicks != 2 {
+		t.Errorf("Expected the hourly rollups of the last 5 days only, got %d clicks", clicks)
+	}
+	if clicks, _ := sum(t, s, store.RESOLUTION_DAY, "a"); clicks != 1 {
+		t.Errorf("Expected the daily rollups of the last 7 days only, got %d clicks", clicks)
+	}
+
+	// The tiered reader still counts the expired events from the rollups
+	tr := store.NewTieredReader(s, s, retention)
+	stats, err = tr.GetLinkStats(ctx, "a", 6*24*time.Hour)
+	if err != nil {
+		t.Fatalf("GetLinkStats failed: %v", err)
+	}
+	if stats.Clicks != 2 {
+		t.Errorf("Expected 2 clicks in the last 6 days, got %d", stats.Clicks)
+	}
+}
+
+func TestRunAnonymizesRolledUpRedirects(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryAnalyticsStore()
+	now := noonYesterday()
+	for _, ago := range []time.Duration{3 * 24 * time.Hour, 2 * time.Hour} {
+		s.WriteURLRedirectEvent(&store.URLRedirectEvent{ShortURL: "a", Success: true, Timestamp: now.Add(-ago), IP: "192.0.2.0", VisitorID: "v"})
+	}
+	j, err := New(Config{AnonymizeAfter: 48 * time.Hour, Registerer: prometheus.NewRegistry()}, s, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("failed to create job: %v", err)
+	}
+	j.now = func() time.Time { return now }
+	if err := j.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	err = s.ScanRedirects(ctx, "", time.Time{}, now, func(e *store.URLRedirectEvent) {
+		if old := e.Timestamp.Before(now.Add(-48 * time.Hour)); old != (e.IP == "" && e.VisitorID == "") {
+			t.Errorf("Expected only the events older than 48 hours to be anonymized, got %+v", e)
+		}
+	})
+	if err != nil {
+		t.Fatalf("ScanRedirects failed: %v", err)
+	}
+	// The rollups still count the visitor of the anonymized event
+	tr := store.NewTieredReader(s, s, store.Retention{})
+	visitors, err := tr.GetVisitorStats(ctx, "a", 0)
+	if err != nil {
+		t.Fatalf("GetVisitorStats failed: %v", err)
+	}
+	if len(visitors.Daily) != 2 {
+		t.Errorf("Expected visitors on 2 days, got %+v", visitors)
+	}
+}
+
+// scanRecorder records the ranges of the redirect scans
+type scanRecorder struct {
+	*store.MemoryAnalyticsStore
+	scans [][2]time.Time
+}
+
+func (s *scanRecorder) ScanRedirects(ctx context.Context, shortURL string, from time.Time, to time.Time, fn func(*store.URLRedirectEvent)) error {
+	s.scans = append(s.scans, [2]time.Time{from, to})
+	return s.MemoryAnalyticsStore.ScanRedirects(ctx, shortURL, from, to, fn)
+}
+
+func TestRunBoundsTheFirstSteps(t *testing.T) {
+	ctx := context.Background()
+	s := &scanRecorder{MemoryAnalyticsStore: store.NewMemoryAnalyticsStore()}
+	now := noonYesterday()
+	oldest := now.Add(-10 * 24 * time.Hour)
+	for _, ts := range []time.Time{oldest, now.Add(-3 * 24 * time.Hour)} {
+		s.WriteURLRedirectEvent(&store.URLRedirectEvent{ShortURL: "a", Success: true, Timestamp: ts, ReferrerHost: "example.com"})
+	}
+
+	j := newTestJob(t, s, store.Retention{}, now)
+	if err := j.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(s.scans) < 10 {
+		t.Fatalf("Expected the 10 days of history to be scanned in steps, got %d scans", len(s.scans))
+	}
+	// The first scan starts at zero, but doesn't reach further than a step past the oldest redirect
+	if !s.scans[0][0].IsZero() || s.scans[0][1].After(oldest.Truncate(time.Hour).Add(MAX_STEP)) {
+		t.Errorf("Expected the first scan to end a step after the oldest redirect, got %v", s.scans[0])
+	}
+	for _, scan := range s.scans[1:] {
+		if scan[1].Sub(scan[0]) > MAX_STEP {
+			t.Errorf("Expected scans of %v at most, got %v", MAX_STEP, scan)
+		}
+	}
+	rollups, err := s.ReadRollups(ctx, store.RESOLUTION_DAY, store.RollupQuery{To: now, Referrers: true})
+	if err != nil {
+		t.Fatalf("ReadRollups failed: %v", err)
+	}
+	var referred int64
+	for _, r := range rollups {
+		referred += r.Referrers["example.com"]
+	}
+	if referred != 2 {
+		t.Errorf("Expected the referrers of both clicks in the daily rollups, got %d", referred)
+	}
+}
+
+func TestJobStopsWithTheStartContext(t *testing.T) {
+	j := newTestJob(t, store.NewMemoryAnalyticsStore(), store.Retention{}, noonYesterday())
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := j.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	cancel()
+	select {
+	case <-j.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the job to stop once the context of Start is cancelled")
+	}
+}
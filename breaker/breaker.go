@@ -0,0 +1,284 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mactavishz/kuerzen/retries"
+	"go.uber.org/zap"
+)
+
+// State of a circuit breaker
+type State int
+
+const (
+	Closed   State = iota // Calls pass, their outcomes are counted
+	Open                  // Calls fail fast with ErrOpen until the open timeout passed
+	HalfOpen              // A few probe calls pass, they decide whether the breaker closes or opens again
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+const (
+	DEFAULT_FAILURE_RATE         = 0.5
+	DEFAULT_MIN_CALLS            = 20
+	DEFAULT_WINDOW               = 30 * time.Second
+	DEFAULT_CONSECUTIVE_FAILURES = 5
+	DEFAULT_SLOW_CALL            = 1 * time.Second
+	DEFAULT_OPEN_TIMEOUT         = 10 * time.Second
+	DEFAULT_HALF_OPEN_CALLS      = 3
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+// OpenError is the error of a call the breaker rejected, it wraps ErrOpen
+type OpenError struct {
+	Name       string
+	RetryAfter time.Duration // Time until the breaker lets probe calls through, zero while the probes are in flight
+}
+
+func (e *OpenError) Error() string {
+	return e.Name + ": " + ErrOpen.Error()
+}
+
+func (e *OpenError) Unwrap() error {
+	return ErrOpen
+}
+
+// RetryAfter returns how long to wait before retrying a call a breaker rejected with err, e.g. for a Retry-After
+// header, and false if err isn't a rejection
+func RetryAfter(err error) (time.Duration, bool) {
+	var open *OpenError
+	if !errors.As(err, &open) {
+		return 0, false
+	}
+	return open.RetryAfter, true
+}
+
+// RetryAfterSeconds is RetryAfter in whole seconds for a Retry-After header, rounded up and at least 1
+func RetryAfterSeconds(err error) int {
+	d, _ := RetryAfter(err)
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// Config configures a breaker, the zero values take the defaults
+type Config struct {
+	Name                string
+	FailureRate         float64       // Trips once this share of the calls in the window failed, and at least MinCalls were made
+	MinCalls            int           // Calls in the window before the failure rate counts
+	Window              time.Duration // Period the failure rate is measured over
+	ConsecutiveFailures int           // Trips after this many failures in a row
+	SlowCall            time.Duration // Calls that take at least this long count as failures even if they succeed
+	OpenTimeout         time.Duration // Time the breaker stays open before it lets probe calls through
+	HalfOpenCalls       int           // Probe calls in half-open, the breaker closes once all of them succeeded
+	// IsFailure decides which errors of Do count as failures of the dependency, by default the transient errors of
+	// the retries module and timeouts. Errors like a missing row say nothing about the health of the dependency.
+	IsFailure func(err error) bool
+	Now       func() time.Time // time.Now if nil, for tests
+}
+
+// IsTransient is the default of Config.IsFailure
+func IsTransient(err error) bool {
+	return errors.Is(err, retries.ErrTransient) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type bucket struct {
+	calls    int
+	failures int
+}
+
+// Breaker stops calls to a dependency that keeps failing, so that callers fail fast rather than wait for timeouts
+// and the dependency gets time to recover. It trips on the failure rate within a sliding window or on consecutive
+// failures, and probes the dependency with a few calls once the open timeout passed.
+type Breaker struct {
+	cfg    Config
+	logger *zap.SugaredLogger
+
+	mu          sync.Mutex
+	state       State
+	generation  int // Changes with every transition, outcomes of calls admitted before are ignored
+	openedAt    time.Time
+	consecutive int
+	window      *retries.Window[bucket]
+	probes      int // Calls admitted in half-open
+	successes   int // Probe calls that succeeded
+}
+
+func New(cfg Config, logger *zap.SugaredLogger) *Breaker {
+	if cfg.FailureRate <= 0 {
+		cfg.FailureRate = DEFAULT_FAILURE_RATE
+	}
+	if cfg.MinCalls <= 0 {
+		cfg.MinCalls = DEFAULT_MIN_CALLS
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DEFAULT_WINDOW
+	}
+	if cfg.ConsecutiveFailures <= 0 {
+		cfg.ConsecutiveFailures = DEFAULT_CONSECUTIVE_FAILURES
+	}
+	if cfg.SlowCall <= 0 {
+		cfg.SlowCall = DEFAULT_SLOW_CALL
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = DEFAULT_OPEN_TIMEOUT
+	}
+	if cfg.HalfOpenCalls <= 0 {
+		cfg.HalfOpenCalls = DEFAULT_HALF_OPEN_CALLS
+	}
+	if cfg.IsFailure == nil {
+		cfg.IsFailure = IsTransient
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	b := &Breaker{cfg: cfg, logger: logger, window: retries.NewWindow[bucket](cfg.Window, cfg.Now())}
+	b.setStateMetric()
+	return b
+}
+
+// State returns the state of the breaker. An open breaker whose timeout passed is half-open, even though it only
+// transitions with the next call.
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && b.cfg.Now().Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// String returns the name of the state, e.g. for the readiness report
+func (b *Breaker) String() string {
+	return b.State().String()
+}
+
+// Allow admits a call, or returns an error wrapping ErrOpen if the breaker rejects it. The caller reports whether the
+// call failed to done, which also measures its duration. A nil breaker admits every call.
+func (b *Breaker) Allow() (done func(failed bool), err error) {
+	if b == nil {
+		return func(bool) {}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.cfg.Now()
+	if b.state == Open {
+		if now.Sub(b.openedAt) < b.cfg.OpenTimeout {
+			callsTotal.WithLabelValues(b.cfg.Name, "rejected").Inc()
+			return nil, &OpenError{Name: b.cfg.Name, RetryAfter: b.cfg.OpenTimeout - now.Sub(b.openedAt)}
+		}
+		b.transition(HalfOpen, now)
+	}
+	if b.state == HalfOpen {
+		if b.probes >= b.cfg.HalfOpenCalls {
+			callsTotal.WithLabelValues(b.cfg.Name, "rejected").Inc()
+			return nil, &OpenError{Name: b.cfg.Name}
+		}
+		b.probes++
+	}
+	generation := b.generation
+	return func(failed bool) {
+		b.record(generation, now, failed)
+	}, nil
+}
+
+// Do calls fn unless the breaker is open, Config.IsFailure classifies its error. A nil breaker calls fn.
+func Do[T any](b *Breaker, fn func() (T, error)) (T, error) {
+	done, err := b.Allow()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	res, err := fn()
+	done(b != nil && err != nil && b.cfg.IsFailure(err))
+	return res, err
+}
+
+func (b *Breaker) record(generation int, start time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.cfg.Now()
+	slow := now.Sub(start) >= b.cfg.SlowCall
+	switch {
+	case failed:
+		callsTotal.WithLabelValues(b.cfg.Name, "failure").Inc()
+	case slow:
+		callsTotal.WithLabelValues(b.cfg.Name, "slow").Inc()
+	default:
+		callsTotal.WithLabelValues(b.cfg.Name, "success").Inc()
+	}
+	if generation != b.generation {
+		return
+	}
+	failed = failed || slow
+	switch b.state {
+	case HalfOpen:
+		if failed {
+			b.transition(Open, now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenCalls {
+			b.transition(Closed, now)
+		}
+	case Closed:
+		bucket := b.window.Bucket(now)
+		bucket.calls++
+		if !failed {
+			b.consecutive = 0
+			return
+		}
+		bucket.failures++
+		b.consecutive++
+		if b.consecutive >= b.cfg.ConsecutiveFailures {
+			b.logger.Warnf("Circuit breaker %s trips after %d consecutive failures", b.cfg.Name, b.consecutive)
+			b.transition(Open, now)
+			return
+		}
+		var calls, failures int
+		for _, bk := range b.window.Buckets() {
+			calls += bk.calls
+			failures += bk.failures
+		}
+		if calls >= b.cfg.MinCalls && float64(failures)/float64(calls) >= b.cfg.FailureRate {
+			b.logger.Warnf("Circuit breaker %s trips after %d of %d calls failed", b.cfg.Name, failures, calls)
+			b.transition(Open, now)
+		}
+	}
+}
+
+func (b *Breaker) transition(to State, now time.Time) {
+	if to != Open || b.state != Closed {
+		// Tripping from closed is logged with its reason
+		b.logger.Infof("Circuit breaker %s is %s", b.cfg.Name, to)
+	}
+	b.state = to
+	b.generation++
+	b.probes, b.successes = 0, 0
+	switch to {
+	case Open:
+		b.openedAt = now
+	case Closed:
+		b.consecutive = 0
+		b.window.Reset(now)
+	}
+	b.setStateMetric()
+}
@@ -0,0 +1,218 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mactavishz/kuerzen/retries"
+	"go.uber.org/zap"
+)
+
+// fakeClock is a clock the tests advance by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+var errDown = retries.Transient(errors.New("connection refused"))
+
+func newTestBreaker(cfg Config) (*Breaker, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cfg.Name = "test"
+	cfg.Now = clock.Now
+	return New(cfg, zap.NewNop().Sugar()), clock
+}
+
+// call makes a call through b that takes d and fails with err
+func call(b *Breaker, clock *fakeClock, d time.Duration, err error) error {
+	_, err = Do(b, func() (struct{}, error) {
+		clock.Advance(d)
+		return struct{}{}, err
+	})
+	return err
+}
+
+func TestTripsOnConsecutiveFailures(t *testing.T) {
+	b, clock := newTestBreaker(Config{ConsecutiveFailures: 3})
+	for i := 0; i < 2; i++ {
+		call(b, clock, 0, errDown)
+	}
+	// A success resets the count
+	call(b, clock, 0, nil)
+	for i := 0; i < 2; i++ {
+		call(b, clock, 0, errDown)
+	}
+	if b.State() != Closed {
+		t.Fatalf("Expected closed after 2 consecutive failures, got %s", b.State())
+	}
+	call(b, clock, 0, errDown)
+	if b.State() != Open {
+		t.Fatalf("Expected open after 3 consecutive failures, got %s", b.State())
+	}
+	called := false
+	_, err := Do(b, func() (struct{}, error) {
+		called = true
+		return struct{}{}, nil
+	})
+	if !errors.Is(err, ErrOpen) || called {
+		t.Errorf("Expected an open breaker to reject the call with ErrOpen, got %v", err)
+	}
+	if errors.Is(err, retries.ErrTransient) {
+		t.Errorf("Expected ErrOpen not to be transient, so that retries stop")
+	}
+	clock.Advance(4 * time.Second)
+	_, err = Do(b, func() (struct{}, error) { return struct{}{}, nil })
+	if d, ok := RetryAfter(err); !ok || d != DEFAULT_OPEN_TIMEOUT-4*time.Second {
+		t.Errorf("Expected to retry once the open timeout passed, got %v", d)
+	}
+	if s := RetryAfterSeconds(err); s != 6 {
+		t.Errorf("Expected to retry after 6 seconds, got %d", s)
+	}
+}
+
+func TestTripsOnFailureRate(t *testing.T) {
+	b, clock := newTestBreaker(Config{FailureRate: 0.5, MinCalls: 10, ConsecutiveFailures: 100})
+	// Alternating calls fail half the time, the breaker waits for MinCalls
+	for i := 0; i < 9; i++ {
+		var err error
+		if i%2 == 0 {
+			err = errDown
+		}
+		call(b, clock, 0, err)
+	}
+	if b.State() != Closed {
+		t.Fatalf("Expected closed before MinCalls, got %s", b.State())
+	}
+	call(b, clock, 0, nil)
+	if b.State() != Closed {
+		t.Fatalf("Expected closed at 5 of 10 calls failed after a success, got %s", b.State())
+	}
+	call(b, clock, 0, errDown)
+	if b.State() != Open {
+		t.Fatalf("Expected open at 6 of 11 calls failed, got %s", b.State())
+	}
+}
+
+func TestWindowForgetsOldCalls(t *testing.T) {
+	b, clock := newTestBreaker(Config{FailureRate: 0.5, MinCalls: 4, Window: 10 * time.Second, ConsecutiveFailures: 100})
+	call(b, clock, 0, errDown)
+	call(b, clock, 0, errDown)
+	call(b, clock, 0, nil)
+	clock.Advance(11 * time.Second)
+	call(b, clock, 0, errDown)
+	call(b, clock, 0, nil)
+	call(b, clock, 0, nil)
+	call(b, clock, 0, nil)
+	if b.State() != Closed {
+		t.Fatalf("Expected the failures outside the window not to count, got %s", b.State())
+	}
+}
+
+func TestIgnoresOtherErrors(t *testing.T) {
+	b, clock := newTestBreaker(Config{ConsecutiveFailures: 2})
+	notFound := errors.New("not found")
+	for i := 0; i < 5; i++ {
+		if err := call(b, clock, 0, notFound); err != notFound {
+			t.Fatalf("Expected the error of the call, got %v", err)
+		}
+	}
+	if b.State() != Closed {
+		t.Errorf("Expected errors that are no failures not to trip the breaker, got %s", b.State())
+	}
+}
+
+func TestSlowCallsCountAsFailures(t *testing.T) {
+	b, clock := newTestBreaker(Config{ConsecutiveFailures: 2, SlowCall: time.Second})
+	call(b, clock, 500*time.Millisecond, nil)
+	call(b, clock, 2*time.Second, nil)
+	if b.State() != Closed {
+		t.Fatalf("Expected closed after a single slow call, got %s", b.State())
+	}
+	call(b, clock, 2*time.Second, nil)
+	if b.State() != Open {
+		t.Fatalf("Expected open after 2 slow calls, got %s", b.State())
+	}
+}
+
+func TestHalfOpenCloses(t *testing.T) {
+	b, clock := newTestBreaker(Config{ConsecutiveFailures: 1, OpenTimeout: 10 * time.Second, HalfOpenCalls: 2})
+	call(b, clock, 0, errDown)
+	clock.Advance(9 * time.Second)
+	if b.State() != Open {
+		t.Fatalf("Expected open before the timeout, got %s", b.State())
+	}
+	clock.Advance(time.Second)
+	if b.State() != HalfOpen {
+		t.Fatalf("Expected half-open after the timeout, got %s", b.State())
+	}
+
+	// Two probes are admitted at once, a third is rejected
+	done1, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Expected the first probe to be admitted, got %v", err)
+	}
+	done2, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Expected the second probe to be admitted, got %v", err)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Fatalf("Expected a third probe to be rejected, got %v", err)
+	}
+	done1(false)
+	if b.State() != HalfOpen {
+		t.Fatalf("Expected half-open until every probe succeeded, got %s", b.State())
+	}
+	done2(false)
+	if b.State() != Closed {
+		t.Fatalf("Expected closed after the probes succeeded, got %s", b.State())
+	}
+}
+
+func TestHalfOpenReopens(t *testing.T) {
+	b, clock := newTestBreaker(Config{ConsecutiveFailures: 1, OpenTimeout: 10 * time.Second})
+	call(b, clock, 0, errDown)
+	clock.Advance(10 * time.Second)
+	call(b, clock, 0, errDown)
+	if b.State() != Open {
+		t.Fatalf("Expected a failed probe to open the breaker again, got %s", b.State())
+	}
+	// The timeout starts over
+	clock.Advance(5 * time.Second)
+	if err := call(b, clock, 0, nil); !errors.Is(err, ErrOpen) {
+		t.Errorf("Expected the call to be rejected before the new timeout, got %v", err)
+	}
+}
+
+func TestIgnoresCallsFromBeforeTransition(t *testing.T) {
+	b, clock := newTestBreaker(Config{ConsecutiveFailures: 1, OpenTimeout: time.Second, HalfOpenCalls: 1})
+	done, _ := b.Allow()
+	call(b, clock, 0, errDown)
+	clock.Advance(time.Second)
+	call(b, clock, 0, nil)
+	if b.State() != Closed {
+		t.Fatalf("Expected closed after the probe, got %s", b.State())
+	}
+	// The call admitted before the breaker opened ended late
+	done(true)
+	if b.State() != Closed {
+		t.Errorf("Expected the outcome of a stale call to be ignored, got %s", b.State())
+	}
+}
+
+func TestNilBreaker(t *testing.T) {
+	var b *Breaker
+	if _, err := Do(b, func() (int, error) { return 1, errDown }); err != errDown {
+		t.Errorf("Expected a nil breaker to pass the call, got %v", err)
+	}
+	if b.State() != Closed {
+		t.Errorf("Expected a nil breaker to be closed, got %s", b.State())
+	}
+}
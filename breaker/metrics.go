@@ -0,0 +1,85 @@
+package breaker
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	stateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "1 for the current state of the circuit breaker (closed, open or half-open), 0 for the others.",
+	}, []string{"breaker", "state"})
+	callsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_breaker_calls_total",
+		Help: "Number of calls through the circuit breaker, by result (success, failure, slow or rejected).",
+	}, []string{"breaker", "result"})
+)
+
+// RegisterMetrics registers the metrics of the breakers, with prometheus.DefaultRegisterer if reg is nil
+func RegisterMetrics(reg prometheus.Registerer) error {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	for _, c := range []prometheus.Collector{stateGauge, callsTotal} {
+		if err := reg.Register(c); err != nil {
+			return fmt.Errorf("register circuit breaker metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *Breaker) setStateMetric() {
+	for _, s := range []State{Closed, Open, HalfOpen} {
+		v := 0.0
+		if s == b.state {
+			v = 1
+		}
+		stateGauge.WithLabelValues(b.cfg.Name, s.String()).Set(v)
+	}
+}
+
+// ConfigFromEnv reads the config of the breaker of a dependency: BREAKER_FAILURE_RATE, BREAKER_MIN_CALLS,
+// BREAKER_WINDOW, BREAKER_CONSECUTIVE_FAILURES, BREAKER_SLOW_CALL, BREAKER_OPEN_TIMEOUT and BREAKER_HALF_OPEN_CALLS
+// apply to every breaker of the service
+func ConfigFromEnv(name string) (Config, error) {
+	cfg := Config{Name: name}
+	for key, v := range map[string]*time.Duration{
+		"BREAKER_WINDOW":       &cfg.Window,
+		"BREAKER_SLOW_CALL":    &cfg.SlowCall,
+		"BREAKER_OPEN_TIMEOUT": &cfg.OpenTimeout,
+	} {
+		if s := os.Getenv(key); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*v = d
+		}
+	}
+	for key, v := range map[string]*int{
+		"BREAKER_MIN_CALLS":            &cfg.MinCalls,
+		"BREAKER_CONSECUTIVE_FAILURES": &cfg.ConsecutiveFailures,
+		"BREAKER_HALF_OPEN_CALLS":      &cfg.HalfOpenCalls,
+	} {
+		if s := os.Getenv(key); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*v = n
+		}
+	}
+	if s := os.Getenv("BREAKER_FAILURE_RATE"); s != "" {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return cfg, fmt.Errorf("BREAKER_FAILURE_RATE must be a number between 0 and 1")
+		}
+		cfg.FailureRate = rate
+	}
+	return cfg, nil
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mactavishz/kuerzen/redirector/bots"
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+)
+
+// BotConfig controls the classification of the traffic in redirect events
+type BotConfig struct {
+	Classifier *bots.Classifier // redirects aren't classified if nil
+	// Serve link unfurlers a page with OpenGraph metadata of the long URL instead of redirecting them
+	ServeOpenGraph bool
+}
+
+// classify sets the traffic class of the event and reports whether the client is a link unfurler
+func (bc BotConfig) classify(c *fiber.Ctx, evt *astore.URLRedirectEvent) bool {
+	if bc.Classifier == nil {
+		return false
+	}
+	result := bc.Classifier.Classify(bots.Request{
+		UserAgent:      c.Get(fiber.HeaderUserAgent),
+		Accept:         c.Get(fiber.HeaderAccept),
+		AcceptLanguage: c.Get(fiber.HeaderAcceptLanguage),
+		Client:         clientIP(c),
+	})
+	evt.BotClass = result.Class
+	return result.Unfurler
+}
+
+var openGraphPage = template.Must(template.New("opengraph").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="canonical" href="{{.URL}}">
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:url" content="{{.URL}}">
+<meta property="og:site_name" content="kuerzen">
+<meta name="twitter:card" content="summary">
+</head>
+<body><a href="{{.URL}}">{{.Title}}</a></body>
+</html>
+`))
+
+// renderOpenGraph renders a page that describes the long URL for link previews
+func renderOpenGraph(longURL string) ([]byte, error) {
+	title := longURL
+	if u, err := url.Parse(longURL); err == nil && u.Host != "" {
+		title = u.Host + strings.TrimSuffix(u.Path, "/")
+	}
+	var buf bytes.Buffer
+	err := openGraphPage.Execute(&buf, struct{ Title, URL string }{title, longURL})
+	return buf.Bytes(), err
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mactavishz/kuerzen/redirector/bots"
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+)
+
+func TestClassify(t *testing.T) {
+	classifier, err := bots.NewClassifier(bots.Config{})
+	if err != nil {
+		t.Fatalf("NewClassifier failed: %v", err)
+	}
+	tests := []struct {
+		name      string
+		bc        BotConfig
+		userAgent string
+		class     string
+		unfurler  bool
+	}{
+		{"human", BotConfig{Classifier: classifier}, "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", astore.BOT_CLASS_HUMAN, false},
+		{"unfurler", BotConfig{Classifier: classifier}, "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", astore.BOT_CLASS_BOT, true},
+		{"not classified", BotConfig{}, "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var evt astore.URLRedirectEvent
+			var unfurler bool
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				unfurler = tt.bc.classify(c, &evt)
+				return nil
+			})
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			req.Header.Set("Accept", "text/html")
+			req.Header.Set("Accept-Language", "de-DE,de;q=0.9,en;q=0.8")
+			if _, err := app.Test(req); err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if evt.BotClass != tt.class || unfurler != tt.unfurler {
+				t.Errorf("got class %q and unfurler %v, want %q and %v", evt.BotClass, unfurler, tt.class, tt.unfurler)
+			}
+		})
+	}
+}
+
+func TestRenderOpenGraph(t *testing.T) {
+	page, err := renderOpenGraph(`https://example.com/a"b/?q=<script>`)
+	if err != nil {
+		t.Fatalf("renderOpenGraph failed: %v", err)
+	}
+	html := string(page)
+	if !strings.Contains(html, `<meta property="og:url" content="https://example.com/a&#34;b/?q=&lt;script&gt;">`) {
+		t.Errorf("Expected an escaped og:url, got %s", html)
+	}
+	if strings.Contains(html, "<script>") {
+		t.Errorf("Expected the long URL to be escaped, got %s", html)
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/mssola/useragent"
+)
+
+// IPMode decides how client addresses are stored in redirect events
+type IPMode int
+
+const (
+	IPTruncate IPMode = iota // Zero the host part of the address (/24 for IPv4, /48 for IPv6)
+	IPHash                   // Replace the address by a salted hash, so that clicks of the same client can be correlated
+	IPDrop                   // Don't store the address at all
+)
+
+func (m IPMode) String() string {
+	switch m {
+	case IPTruncate:
+		return "truncate"
+	case IPHash:
+		return "hash"
+	case IPDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("IPMode(%d)", int(m))
+	}
+}
+
+func ParseIPMode(s string) (IPMode, error) {
+	for _, m := range []IPMode{IPTruncate, IPHash, IPDrop} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return IPTruncate, fmt.Errorf("unknown ip mode %q", s)
+}
+
+// Cache tiers that can resolve a short URL
+const (
+	CACHE_TIER_LOCAL    = "local"
+	CACHE_TIER_EXTERNAL = "external"
+	CACHE_TIER_DATABASE = "database"
+)
+
+// Device classes derived from the User-Agent header
+const (
+	DEVICE_DESKTOP = "desktop"
+	DEVICE_MOBILE  = "mobile"
+	DEVICE_TABLET  = "tablet"
+	DEVICE_BOT     = "bot"
+)
+
+// PrivacyConfig controls which parts of the click context are kept in redirect events
+type PrivacyConfig struct {
+	KeepReferrer       bool
+	KeepUserAgent      bool
+	KeepAcceptLanguage bool
+	IPMode             IPMode
+	IPSalt             string // Key of the hash, required by the IPHash mode
+	VisitorSalt        string // Key of the visitor fingerprint, visitors are not fingerprinted if it is empty
+}
+
+var ErrMissingIPSalt = errors.New("the hash ip mode requires a salt")
+
+func (pc PrivacyConfig) Validate() error {
+	if pc.IPMode == IPHash && pc.IPSalt == "" {
+		return ErrMissingIPSalt
+	}
+	return nil
+}
+
+// fillClickContext adds the click context of the request to the event, as far as the privacy settings allow
+func (pc PrivacyConfig) fillClickContext(c *fiber.Ctx, evt *astore.URLRedirectEvent) {
+	if pc.KeepReferrer {
+		evt.ReferrerHost = referrerHost(c.Get(fiber.HeaderReferer))
+	}
+	if pc.KeepUserAgent {
+		evt.Browser, evt.OS, evt.Device = parseUserAgent(c.Get(fiber.HeaderUserAgent))
+	}
+	if pc.KeepAcceptLanguage {
+		evt.AcceptLanguage = preferredLanguage(c.Get(fiber.HeaderAcceptLanguage))
+	}
+	evt.IP = pc.anonymizeIP(c.IP())
+	if len(c.IPs()) > 0 {
+		evt.ClientIP = pc.anonymizeIP(clientIP(c))
+	}
+	evt.VisitorID = pc.visitorID(clientIP(c), c.Get(fiber.HeaderUserAgent))
+}
+
+// clientIP returns the address of the client, which is the peer unless the request passed the gateway
+func clientIP(c *fiber.Ctx) string {
+	// The gateway appends the address of its peer to X-Forwarded-For, so the last entry is the one we can trust
+	if ips := c.IPs(); len(ips) > 0 {
+		return ips[len(ips)-1]
+	}
+	return c.IP()
+}
+
+// visitorID fingerprints a visitor by the client address and the User-Agent header. The fingerprint is a salted hash,
+// so it identifies a visitor for counting without revealing the address, regardless of the IP mode.
+func (pc PrivacyConfig) visitorID(clientIP string, userAgent string) string {
+	if pc.VisitorSalt == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(pc.VisitorSalt))
+	mac.Write([]byte(strings.TrimSpace(clientIP)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userAgent))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (pc PrivacyConfig) anonymizeIP(addr string) string {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return ""
+	}
+	switch pc.IPMode {
+	case IPTruncate:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case IPHash:
+		mac := hmac.New(sha256.New, []byte(pc.IPSalt))
+		mac.Write([]byte(ip.String()))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	default:
+		return ""
+	}
+}
+
+func referrerHost(referrer string) string {
+	if referrer == "" {
+		return ""
+	}
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func parseUserAgent(header string) (browser string, os string, device string) {
+	if header == "" {
+		return "", "", ""
+	}
+	ua := useragent.New(header)
+	browser, _ = ua.Browser()
+	os = ua.OSInfo().Name
+	switch {
+	case ua.Bot():
+		device = DEVICE_BOT
+	case strings.Contains(header, "iPad") || strings.Contains(header, "Tablet") ||
+		(strings.Contains(header, "Android") && !strings.Contains(header, "Mobile")):
+		device = DEVICE_TABLET
+	case ua.Mobile():
+		device = DEVICE_MOBILE
+	default:
+		device = DEVICE_DESKTOP
+	}
+	return browser, os, device
+}
+
+// preferredLanguage returns the first language tag of an Accept-Language header,
+// clients list their preferred language first
+func preferredLanguage(header string) string {
+	tag, _, _ := strings.Cut(header, ",")
+	tag, _, _ = strings.Cut(tag, ";")
+	tag = strings.TrimSpace(tag)
+	if tag == "*" {
+		return ""
+	}
+	return tag
+}
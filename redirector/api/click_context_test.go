@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		mode IPMode
+		addr string
+		want string
+	}{
+		{IPTruncate, "203.0.113.42", "203.0.113.0"},
+		{IPTruncate, "2001:db8:abcd:12::1", "2001:db8:abcd::"},
+		{IPTruncate, "not an ip", ""},
+		{IPDrop, "203.0.113.42", ""},
+	}
+	for _, tt := range tests {
+		if got := (PrivacyConfig{IPMode: tt.mode}).anonymizeIP(tt.addr); got != tt.want {
+			t.Errorf("anonymizeIP(%s, %q) = %q, want %q", tt.mode, tt.addr, got, tt.want)
+		}
+	}
+
+	pc := PrivacyConfig{IPMode: IPHash, IPSalt: "salt"}
+	hashed := pc.anonymizeIP("203.0.113.42")
+	if hashed == "" || hashed == "203.0.113.42" || hashed != pc.anonymizeIP("203.0.113.42") {
+		t.Errorf("Expected a stable hash, got %q", hashed)
+	}
+	if other := (PrivacyConfig{IPMode: IPHash, IPSalt: "pepper"}).anonymizeIP("203.0.113.42"); other == hashed {
+		t.Errorf("Expected different salts to produce different hashes")
+	}
+}
+
+func TestVisitorID(t *testing.T) {
+	pc := PrivacyConfig{VisitorSalt: "salt"}
+	id := pc.visitorID("198.51.100.7", "Firefox")
+	if len(id) != 32 || id != pc.visitorID("198.51.100.7", "Firefox") {
+		t.Errorf("Expected a stable fingerprint, got %q", id)
+	}
+	if id == pc.visitorID("198.51.100.7", "Chrome") || id == pc.visitorID("198.51.100.8", "Firefox") {
+		t.Error("Expected different visitors to have different fingerprints")
+	}
+	if id := (PrivacyConfig{}).visitorID("198.51.100.7", "Firefox"); id != "" {
+		t.Errorf("Expected no fingerprint without a salt, got %q", id)
+	}
+}
+
+func TestFillClickContext(t *testing.T) {
+	tests := []struct {
+		name string
+		pc   PrivacyConfig
+		want astore.URLRedirectEvent
+	}{
+		{
+			name: "keep all",
+			pc:   PrivacyConfig{KeepReferrer: true, KeepUserAgent: true, KeepAcceptLanguage: true, IPMode: IPTruncate},
+			want: astore.URLRedirectEvent{
+				ReferrerHost:   "news.example.com",
+				Browser:        "Firefox",
+				OS:             "Linux",
+				Device:         DEVICE_DESKTOP,
+				AcceptLanguage: "de-DE",
+				IP:             "0.0.0.0", // app.Test serves requests over an in-memory connection without peer address
+				ClientIP:       "198.51.100.0",
+			},
+		},
+		{
+			name: "keep nothing",
+			pc:   PrivacyConfig{IPMode: IPDrop},
+			want: astore.URLRedirectEvent{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got astore.URLRedirectEvent
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				tt.pc.fillClickContext(c, &got)
+				return nil
+			})
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Referer", "https://News.example.com/article?id=1")
+			req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+			req.Header.Set("Accept-Language", "de-DE,de;q=0.9,en;q=0.8")
+			req.Header.Set("X-Forwarded-For", "10.0.0.1, 198.51.100.7")
+			if _, err := app.Test(req); err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,15 +1,15 @@
 package api
 
 import (
-	"context"
 	"errors"
+	"strconv"
 	"time"
 
-	"github.com/mactavishz/kuerzen/retries"
-
 	"github.com/gofiber/fiber/v2"
 	"github.com/mactavishz/kuerzen/analytics/grpc"
+	"github.com/mactavishz/kuerzen/breaker"
 	"github.com/mactavishz/kuerzen/redirector/cache"
+	"github.com/mactavishz/kuerzen/service"
 	astore "github.com/mactavishz/kuerzen/store/analytics"
 	store "github.com/mactavishz/kuerzen/store/url"
 	"go.uber.org/zap"
@@ -17,19 +17,23 @@ import (
 
 type RedirectHandler struct {
 	urlStore      store.URLStore
-	client        *grpc.AnalyticsGRPCClient
+	events        *grpc.AnalyticsEventPublisher
 	logger        *zap.SugaredLogger
 	localCache    cache.CacheProvider
 	externalCache cache.CacheProvider
+	privacy       PrivacyConfig
+	bots          BotConfig
 }
 
-func NewRedirectHandler(urlStore store.URLStore, client *grpc.AnalyticsGRPCClient, logger *zap.SugaredLogger, localCache cache.CacheProvider, externalCache cache.CacheProvider) *RedirectHandler {
+func NewRedirectHandler(urlStore store.URLStore, events *grpc.AnalyticsEventPublisher, logger *zap.SugaredLogger, localCache cache.CacheProvider, externalCache cache.CacheProvider, privacy PrivacyConfig, bots BotConfig) *RedirectHandler {
 	return &RedirectHandler{
 		urlStore:      urlStore,
-		client:        client,
+		events:        events,
 		logger:        logger,
 		localCache:    localCache,
 		externalCache: externalCache,
+		privacy:       privacy,
+		bots:          bots,
 	}
 }
 
@@ -42,62 +46,77 @@ func (h *RedirectHandler) HandleRedirect(c *fiber.Ctx) error {
 		APIVer:      1,
 		Success:     false,
 		ShortURL:    shortURL,
-		LongURL:     longURL,
 		Timestamp:   time.Now(),
 	}
+	ctx := c.UserContext()
+	logger := service.TraceLogger(ctx, h.logger)
+	h.privacy.fillClickContext(c, evt)
+	unfurler := h.bots.classify(c, evt)
 
-	longURL, found = h.localCache.Get(shortURL)
+	longURL, found = h.localCache.Get(ctx, shortURL)
 	if found {
-		h.logger.Infof("Cache Hit: Local Cache for shortURL: %s", shortURL)
-		return h.performRedirect(c, evt, shortURL, longURL)
+		logger.Infof("Cache Hit: Local Cache for shortURL: %s", shortURL)
+		evt.CacheTier = CACHE_TIER_LOCAL
+		return h.performRedirect(c, evt, shortURL, longURL, unfurler)
 	}
-	h.logger.Infof("Cache Miss: Local Cache for shortURL: %s", shortURL)
+	logger.Infof("Cache Miss: Local Cache for shortURL: %s", shortURL)
 
-	longURL, found = h.externalCache.Get(shortURL)
+	longURL, found = h.externalCache.Get(ctx, shortURL)
 	if found {
-		h.logger.Infof("Cache Hit: External Cache for shortURL: %s", shortURL)
-		h.localCache.Set(shortURL, longURL)
-		return h.performRedirect(c, evt, shortURL, longURL)
+		logger.Infof("Cache Hit: External Cache for shortURL: %s", shortURL)
+		evt.CacheTier = CACHE_TIER_EXTERNAL
+		h.localCache.Set(ctx, shortURL, longURL)
+		return h.performRedirect(c, evt, shortURL, longURL, unfurler)
 	}
-	h.logger.Infof("Cache Miss: External Cache for shortURL: %s", shortURL)
+	logger.Infof("Cache Miss: External Cache for shortURL: %s", shortURL)
 
-	rfo := retries.Retry(h.urlStore.GetLongURL(shortURL, c.Context()))
-	longURL, ok := rfo.Rest[0].(string)
-	if !ok {
-		h.logger.Errorf("Failed to cast longURL from rfo.Rest[0] to string. Received type: %T", rfo.Rest[0])
-		return errors.New("invalid type for long URL in retry result")
-	}
-	err := rfo.Err
+	evt.CacheTier = CACHE_TIER_DATABASE
+	longURL, err := h.urlStore.GetLongURL(ctx, shortURL)
 	if err != nil {
 		if errors.Is(err, store.ErrShortURLNotFound) {
-			h.logger.Infow("short URL not found", "shortURL", shortURL)
-			err = retries.Retry(h.client.SendURLRedirectEvent(context.TODO(), evt)).Err
-			if err != nil {
-				h.logger.Errorf("failed to send event: %v\n", err)
-			}
+			logger.Infow("short URL not found", "shortURL", shortURL)
+			h.publish(evt)
 			return c.Status(fiber.StatusNotFound).SendString("Not Found")
 		}
-		err = retries.Retry(h.client.SendURLRedirectEvent(context.TODO(), evt)).Err
-		if err != nil {
-			h.logger.Errorf("failed to send event: %v\n", err)
+		h.publish(evt)
+		if errors.Is(err, store.ErrUnavailable) {
+			// The database is down, the client may try again once the breaker lets calls through
+			logger.Warnf("failed to get long URL: %v\n", err)
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(breaker.RetryAfterSeconds(err)))
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Service Unavailable")
 		}
-		h.logger.Errorf("failed to get long URL: %v\n", err)
+		logger.Errorf("failed to get long URL: %v\n", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
 	}
 
-	h.logger.Infof("DB Hit: Found %s in DB. Populating caches.", shortURL)
-	h.localCache.Set(shortURL, longURL)
-	h.externalCache.Set(shortURL, longURL)
-	return h.performRedirect(c, evt, shortURL, longURL)
+	logger.Infof("DB Hit: Found %s in DB. Populating caches.", shortURL)
+	h.localCache.Set(ctx, shortURL, longURL)
+	h.externalCache.Set(ctx, shortURL, longURL)
+	return h.performRedirect(c, evt, shortURL, longURL, unfurler)
 }
 
-func (h *RedirectHandler) performRedirect(c *fiber.Ctx, urlRE *astore.URLRedirectEvent, shortURL string, longURL string) error {
+func (h *RedirectHandler) performRedirect(c *fiber.Ctx, urlRE *astore.URLRedirectEvent, shortURL string, longURL string, unfurler bool) error {
+	logger := service.TraceLogger(c.UserContext(), h.logger)
 	urlRE.Success = true
-	err := retries.Retry(h.client.SendURLRedirectEvent(context.TODO(), urlRE)).Err
-	if err != nil {
-		h.logger.Errorf("failed to send event for %s: %v\n", shortURL, err)
+	urlRE.LongURL = longURL
+	h.publish(urlRE)
+	if unfurler && h.bots.ServeOpenGraph {
+		page, err := renderOpenGraph(longURL)
+		if err != nil {
+			logger.Errorf("failed to render OpenGraph page: %v\n", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		}
+		logger.Infow("served OpenGraph page to link unfurler", "shortURL", shortURL, "longURL", longURL)
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		return c.Send(page)
 	}
 	// use 307 to prevent browsers from caching the redirect
-	h.logger.Infow("request redirected", "shortURL", shortURL, "longURL", longURL)
+	logger.Infow("request redirected", "shortURL", shortURL, "longURL", longURL)
 	return c.Redirect(longURL, fiber.StatusTemporaryRedirect)
 }
+
+// publish records the time spent on the redirect so far and publishes the event
+func (h *RedirectHandler) publish(evt *astore.URLRedirectEvent) {
+	evt.Latency = time.Since(evt.Timestamp)
+	h.events.PublishURLRedirectEvent(evt)
+}
@@ -0,0 +1,182 @@
+// Package bots classifies the clients of redirects as humans, known bots or suspected bots, so that link unfurlers,
+// crawlers and scanners don't inflate the click statistics.
+package bots
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/mssola/useragent"
+)
+
+const (
+	DEFAULT_RATE_LIMIT  = 60
+	DEFAULT_RATE_WINDOW = time.Minute
+	DEFAULT_MAX_CLIENTS = 100000
+)
+
+// Reasons of a classification, for logs and metrics
+const (
+	REASON_USER_AGENT_LIST = "user_agent_list"
+	REASON_USER_AGENT      = "user_agent" // flagged by the User-Agent parser
+	REASON_NO_USER_AGENT   = "no_user_agent"
+	REASON_MISSING_HEADERS = "missing_headers"
+	REASON_RATE            = "rate"
+	REASON_LINK_UNFURLER   = "link_unfurler"
+)
+
+// The user agent list in the format of github.com/monperrus/crawler-user-agents.
+// A newer copy of that list can be loaded with ParseUserAgents instead.
+//
+//go:embed user_agents.json
+var defaultUserAgents []byte
+
+// unfurlers are the link preview bots of chat apps and social networks. They fetch a link once per post or
+// message to render a preview, and understand OpenGraph metadata.
+var unfurlers = regexp.MustCompile(`Slackbot|Slack-ImgProxy|Twitterbot|facebookexternalhit|Facebot|LinkedInBot|WhatsApp/|` +
+	`TelegramBot|Discordbot|SkypeUriPreview|redditbot|Pinterest|Mastodon/|Iframely|Embedly|vkShare|Snapchat|Viber`)
+
+// Pattern is an entry of a user agent list
+type Pattern struct {
+	Pattern   string   `json:"pattern"` // regular expression matched against the User-Agent header
+	URL       string   `json:"url,omitempty"`
+	Instances []string `json:"instances,omitempty"` // examples of matching User-Agent headers
+}
+
+// ParseUserAgents decodes a user agent list in the format of github.com/monperrus/crawler-user-agents
+func ParseUserAgents(data []byte) ([]Pattern, error) {
+	var patterns []Pattern
+	if err := json.Unmarshal(data, &patterns); err != nil {
+		return nil, fmt.Errorf("decode user agent list: %w", err)
+	}
+	return patterns, nil
+}
+
+// DefaultUserAgents returns the embedded user agent list
+func DefaultUserAgents() []Pattern {
+	patterns, err := ParseUserAgents(defaultUserAgents)
+	if err != nil {
+		panic(err)
+	}
+	return patterns
+}
+
+type Config struct {
+	UserAgents []Pattern // known bots, the embedded list if nil
+	// A client that sends more than RateLimit requests in a RateWindow is a suspected bot, 0 disables the limit
+	RateLimit  int
+	RateWindow time.Duration
+	MaxClients int // clients whose requests are counted per window, later clients of a window aren't counted
+}
+
+// Request holds the headers of a request that the classification looks at
+type Request struct {
+	UserAgent      string
+	Accept         string
+	AcceptLanguage string
+	Client         string // address of the client, requests are counted per client
+}
+
+type Result struct {
+	Class    string // one of astore.BOT_CLASS_HUMAN, astore.BOT_CLASS_BOT and astore.BOT_CLASS_SUSPECTED
+	Reason   string
+	Unfurler bool // a link preview bot, which may be served OpenGraph metadata instead of a redirect
+}
+
+// Classifier classifies requests by their User-Agent header, headers that browsers always send and the request rate of
+// their client. Known bots are matched against the user agent list, clients that only look like bots are suspected.
+type Classifier struct {
+	cfg      Config
+	patterns *regexp.Regexp
+	now      func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    map[string]int // requests per client of the current window
+}
+
+func NewClassifier(cfg Config) (*Classifier, error) {
+	if cfg.UserAgents == nil {
+		cfg.UserAgents = DefaultUserAgents()
+	}
+	if cfg.RateLimit < 0 {
+		return nil, errors.New("rate limit must not be negative")
+	}
+	if cfg.RateWindow <= 0 {
+		cfg.RateWindow = DEFAULT_RATE_WINDOW
+	}
+	if cfg.MaxClients <= 0 {
+		cfg.MaxClients = DEFAULT_MAX_CLIENTS
+	}
+	// A single alternation of all patterns matches in one pass, RE2 doesn't backtrack
+	alternatives := make([]string, 0, len(cfg.UserAgents))
+	for _, p := range cfg.UserAgents {
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			return nil, fmt.Errorf("user agent pattern %q: %w", p.Pattern, err)
+		}
+		alternatives = append(alternatives, "(?:"+p.Pattern+")")
+	}
+	if len(alternatives) == 0 {
+		return nil, errors.New("user agent list is empty")
+	}
+	patterns, err := regexp.Compile(strings.Join(alternatives, "|"))
+	if err != nil {
+		return nil, fmt.Errorf("compile user agent list: %w", err)
+	}
+	return &Classifier{
+		cfg:      cfg,
+		patterns: patterns,
+		now:      time.Now,
+		requests: make(map[string]int),
+	}, nil
+}
+
+func (c *Classifier) Classify(r Request) Result {
+	// Every request counts towards the rate of its client, also those of known bots
+	overLimit := c.count(r.Client)
+	switch {
+	case r.UserAgent == "":
+		return Result{Class: astore.BOT_CLASS_SUSPECTED, Reason: REASON_NO_USER_AGENT}
+	case unfurlers.MatchString(r.UserAgent):
+		return Result{Class: astore.BOT_CLASS_BOT, Reason: REASON_LINK_UNFURLER, Unfurler: true}
+	case c.patterns.MatchString(r.UserAgent):
+		return Result{Class: astore.BOT_CLASS_BOT, Reason: REASON_USER_AGENT_LIST}
+	case useragent.New(r.UserAgent).Bot():
+		return Result{Class: astore.BOT_CLASS_BOT, Reason: REASON_USER_AGENT}
+	// Browsers send both headers with every navigation, scripts and scanners often don't
+	case r.Accept == "" || r.AcceptLanguage == "":
+		return Result{Class: astore.BOT_CLASS_SUSPECTED, Reason: REASON_MISSING_HEADERS}
+	case overLimit:
+		return Result{Class: astore.BOT_CLASS_SUSPECTED, Reason: REASON_RATE}
+	default:
+		return Result{Class: astore.BOT_CLASS_HUMAN}
+	}
+}
+
+// count counts a request of the client and reports whether the client exceeded the rate limit in the current window.
+// The windows are fixed, the counts of all clients are dropped once a window ends.
+func (c *Classifier) count(client string) bool {
+	if c.cfg.RateLimit == 0 || client == "" {
+		return false
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.windowStart) >= c.cfg.RateWindow {
+		c.windowStart = now
+		c.requests = make(map[string]int)
+	}
+	n, ok := c.requests[client]
+	if !ok && len(c.requests) >= c.cfg.MaxClients {
+		return false
+	}
+	c.requests[client] = n + 1
+	return n+1 > c.cfg.RateLimit
+}
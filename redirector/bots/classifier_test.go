@@ -0,0 +1,125 @@
+package bots
+
+import (
+	"testing"
+	"time"
+
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+)
+
+var browsers = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 14.6; rv:130.0) Gecko/20100101 Firefox/130.0",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Mobile/15E148 Safari/604.1",
+	"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Mobile Safari/537.36",
+}
+
+func browserRequest(userAgent string) Request {
+	return Request{UserAgent: userAgent, Accept: "text/html", AcceptLanguage: "en-US,en;q=0.9", Client: "198.51.100.7"}
+}
+
+func TestClassifyUserAgentList(t *testing.T) {
+	c, err := NewClassifier(Config{})
+	if err != nil {
+		t.Fatalf("NewClassifier failed: %v", err)
+	}
+	for _, p := range DefaultUserAgents() {
+		for _, instance := range p.Instances {
+			if got := c.Classify(browserRequest(instance)); got.Class != astore.BOT_CLASS_BOT {
+				t.Errorf("Expected %q to be a bot by %q, got %+v", instance, p.Pattern, got)
+			}
+		}
+	}
+	for _, ua := range browsers {
+		if got := c.Classify(browserRequest(ua)); got.Class != astore.BOT_CLASS_HUMAN {
+			t.Errorf("Expected %q to be human, got %+v", ua, got)
+		}
+	}
+}
+
+func TestClassifyUnfurlers(t *testing.T) {
+	c, err := NewClassifier(Config{})
+	if err != nil {
+		t.Fatalf("NewClassifier failed: %v", err)
+	}
+	for _, ua := range []string{
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+		"facebookexternalhit/1.1 Facebot Twitterbot/1.0", // iMessage
+		"TelegramBot (like TwitterBot)",
+	} {
+		if got := c.Classify(browserRequest(ua)); got.Class != astore.BOT_CLASS_BOT || !got.Unfurler {
+			t.Errorf("Expected %q to be an unfurler, got %+v", ua, got)
+		}
+	}
+	if got := c.Classify(browserRequest("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")); got.Unfurler {
+		t.Errorf("Expected a crawler not to be an unfurler, got %+v", got)
+	}
+}
+
+func TestClassifyMissingHeaders(t *testing.T) {
+	c, err := NewClassifier(Config{})
+	if err != nil {
+		t.Fatalf("NewClassifier failed: %v", err)
+	}
+	tests := []struct {
+		req    Request
+		reason string
+	}{
+		{Request{Accept: "text/html", AcceptLanguage: "en"}, REASON_NO_USER_AGENT},
+		{Request{UserAgent: browsers[0], AcceptLanguage: "en"}, REASON_MISSING_HEADERS},
+		{Request{UserAgent: browsers[0], Accept: "text/html"}, REASON_MISSING_HEADERS},
+	}
+	for _, tt := range tests {
+		if got := c.Classify(tt.req); got.Class != astore.BOT_CLASS_SUSPECTED || got.Reason != tt.reason {
+			t.Errorf("Expected %+v to be suspected for %s, got %+v", tt.req, tt.reason, got)
+		}
+	}
+}
+
+func TestClassifyRate(t *testing.T) {
+	c, err := NewClassifier(Config{RateLimit: 3, RateWindow: time.Minute, MaxClients: 2})
+	if err != nil {
+		t.Fatalf("NewClassifier failed: %v", err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	req := browserRequest(browsers[0])
+	for i := range 3 {
+		if got := c.Classify(req); got.Class != astore.BOT_CLASS_HUMAN {
+			t.Fatalf("Expected request %d to be human, got %+v", i+1, got)
+		}
+	}
+	if got := c.Classify(req); got.Class != astore.BOT_CLASS_SUSPECTED || got.Reason != REASON_RATE {
+		t.Errorf("Expected the fourth request to be suspected, got %+v", got)
+	}
+	other := req
+	other.Client = "203.0.113.1"
+	if got := c.Classify(other); got.Class != astore.BOT_CLASS_HUMAN {
+		t.Errorf("Expected another client to be human, got %+v", got)
+	}
+	// Clients beyond MaxClients aren't counted
+	untracked := req
+	untracked.Client = "203.0.113.2"
+	for range 5 {
+		if got := c.Classify(untracked); got.Class != astore.BOT_CLASS_HUMAN {
+			t.Fatalf("Expected an untracked client to be human, got %+v", got)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if got := c.Classify(req); got.Class != astore.BOT_CLASS_HUMAN {
+		t.Errorf("Expected the count to reset with the window, got %+v", got)
+	}
+}
+
+func TestNewClassifierRejectsInvalidList(t *testing.T) {
+	if _, err := NewClassifier(Config{UserAgents: []Pattern{{Pattern: "Foo("}}}); err == nil {
+		t.Errorf("Expected an invalid pattern to be rejected")
+	}
+	if _, err := NewClassifier(Config{UserAgents: []Pattern{}}); err == nil {
+		t.Errorf("Expected an empty list to be rejected")
+	}
+	if _, err := ParseUserAgents([]byte(`{"pattern": "x"}`)); err == nil {
+		t.Errorf("Expected a list that isn't an array to be rejected")
+	}
+}
@@ -3,16 +3,30 @@ package cache
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/mactavishz/kuerzen/breaker"
+	"github.com/mactavishz/kuerzen/retries"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 type CacheProvider interface {
-	Get(shortURL string) (string, bool)
-	Set(shortURL string, longURL string)
+	Get(ctx context.Context, shortURL string) (string, bool)
+	Set(ctx context.Context, shortURL string, longURL string)
+}
+
+var tracer = otel.Tracer("github.com/mactavishz/kuerzen/redirector/cache")
+
+// startSpan starts the span of a cache operation, the tier is local or redis
+func startSpan(ctx context.Context, tier string, operation string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, tier+" cache "+operation, trace.WithAttributes(attribute.String("cache.tier", tier)))
 }
 
 const EXPIRATION_TIME = 5 * time.Minute
@@ -58,7 +72,15 @@ func NewRedirectLocalCacheInstance(maxSize int, logger *zap.SugaredLogger) (*Red
 	}, nil
 }
 
-func (rci *RedirectLocalCacheInstance) Get(shortURL string) (string, bool) {
+func (rci *RedirectLocalCacheInstance) Get(ctx context.Context, shortURL string) (string, bool) {
+	_, span := startSpan(ctx, "local", "get")
+	defer span.End()
+	longURL, found := rci.get(shortURL)
+	span.SetAttributes(attribute.Bool("cache.hit", found))
+	return longURL, found
+}
+
+func (rci *RedirectLocalCacheInstance) get(shortURL string) (string, bool) {
 	rci.mu.Lock()
 	defer rci.mu.Unlock()
 	entry, found := rci.data[shortURL]
@@ -122,7 +144,13 @@ func (rci *RedirectLocalCacheInstance) Get(shortURL string) (string, bool) {
 	return entry.longURL, true
 }
 
-func (rci *RedirectLocalCacheInstance) Set(key string, longURL string) {
+func (rci *RedirectLocalCacheInstance) Set(ctx context.Context, key string, longURL string) {
+	_, span := startSpan(ctx, "local", "set")
+	defer span.End()
+	rci.set(key, longURL)
+}
+
+func (rci *RedirectLocalCacheInstance) set(key string, longURL string) {
 	rci.mu.Lock()
 	defer rci.mu.Unlock()
 	// Check whether entry should be updated
@@ -213,47 +241,149 @@ func (rci *RedirectLocalCacheInstance) CleanUp() {
 	}
 }
 
-// Starts a new goroutine that periodically cleans up expired entries from the cache.
-func (rci *RedirectLocalCacheInstance) StartCleanupRoutine(interval time.Duration) {
+// Periodically cleans up expired entries from the cache until ctx is done, run it in a goroutine.
+func (rci *RedirectLocalCacheInstance) StartCleanupRoutine(ctx context.Context, interval time.Duration) {
 	// Create a new ticker that will send a signal on its channel (ticker.C) every 'interval'.
 	ticker := time.NewTicker(interval)
 	// Ensures that the ticker is stopped when the function is terminated.
 	defer ticker.Stop()
-	// This is an infinite loop that listens for signals from the ticker's channel.
 	// This ticker acts as a timer to trigger the periodic cleanup.
-	for range ticker.C {
-		rci.CleanUp()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rci.CleanUp()
+		}
+	}
+}
+
+// CacheCleaner runs the cleanup routine of a local cache in the background, it is a service component
+type CacheCleaner struct {
+	cache    *RedirectLocalCacheInstance
+	interval time.Duration
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func NewCacheCleaner(cache *RedirectLocalCacheInstance, interval time.Duration) *CacheCleaner {
+	return &CacheCleaner{cache: cache, interval: interval}
+}
+
+// Start runs the cleanup routine until the cleaner is stopped or ctx is cancelled
+func (c *CacheCleaner) Start(ctx context.Context) error {
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		c.cache.StartCleanupRoutine(ctx, c.interval)
+	}()
+	return nil
+}
+
+// Stop ends the cleanup routine, a cleanup in progress finishes first
+func (c *CacheCleaner) Stop(ctx context.Context) error {
+	if c.cancel == nil {
+		return nil
+	}
+	c.cancel()
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stop cache cleanup: %w", ctx.Err())
 	}
 }
 
+// BUDGET_DEPENDENCY names the retry budget the Redis caches of a process share
+const BUDGET_DEPENDENCY = "redis"
+
+// REDIS_TIMEOUT bounds an operation on Redis including its retries
+const REDIS_TIMEOUT = 2 * time.Second
+
 type RedisSimpleCache struct {
-	client *redis.Client
-	logger *zap.SugaredLogger
+	client  *redis.Client
+	policy  retries.Policy
+	breaker *breaker.Breaker
+	logger  *zap.SugaredLogger
 }
 
 func NewRedisSimpleCache(client *redis.Client, logger *zap.SugaredLogger) *RedisSimpleCache {
-	return &RedisSimpleCache{client: client, logger: logger}
+	return &RedisSimpleCache{
+		client: client,
+		policy: retries.InteractivePolicy.WithBudget(retries.BudgetFor(BUDGET_DEPENDENCY)),
+		logger: logger,
+	}
+}
+
+// WithBreaker returns a cache on the same client whose lookups go through b. While b is open a lookup is a miss and
+// nothing is stored, rather than each request waiting for Redis to time out.
+func (rsc *RedisSimpleCache) WithBreaker(b *breaker.Breaker) *RedisSimpleCache {
+	c := *rsc
+	c.breaker = b
+	return &c
 }
 
-func (rsc *RedisSimpleCache) Get(shortURL string) (string, bool) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+// Ping checks whether the Redis server is reachable
+func (rsc *RedisSimpleCache) Ping(ctx context.Context) error {
+	return rsc.client.Ping(ctx).Err()
+}
+
+// do retries fn with the policy of ctx or else retries.InteractivePolicy, every attempt passes the breaker. A missing
+// key is no failure. The request may be cancelled, the operation isn't.
+func (rsc *RedisSimpleCache) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), REDIS_TIMEOUT)
 	defer cancel()
-	val, err := rsc.client.Get(ctx, shortURL).Result()
+	_, err := retries.Do(ctx, retries.PolicyFromContext(ctx, rsc.policy), func(ctx context.Context) (struct{}, error) {
+		return breaker.Do(rsc.breaker, func() (struct{}, error) {
+			err := fn(ctx)
+			if err != nil && !errors.Is(err, redis.Nil) {
+				err = retries.Transient(err)
+			}
+			return struct{}{}, err
+		})
+	})
+	return err
+}
+
+func (rsc *RedisSimpleCache) Get(ctx context.Context, shortURL string) (string, bool) {
+	ctx, span := startSpan(ctx, "redis", "get")
+	defer span.End()
+	var val string
+	err := rsc.do(ctx, func(ctx context.Context) (err error) {
+		val, err = rsc.client.Get(ctx, shortURL).Result()
+		return err
+	})
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return "", false
+		span.SetAttributes(attribute.Bool("cache.hit", false))
+		switch {
+		case errors.Is(err, redis.Nil):
+		case errors.Is(err, breaker.ErrOpen):
+			span.SetAttributes(attribute.Bool("cache.skipped", true))
+		default:
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			rsc.logger.Errorf("Error getting key '%s' from Redis: %v", shortURL, err)
 		}
-		rsc.logger.Errorf("Error getting key '%s' from Redis: %v", shortURL, err)
 		return "", false
 	}
+	span.SetAttributes(attribute.Bool("cache.hit", true))
 	return val, true
 }
 
-func (rsc *RedisSimpleCache) Set(shortURL string, longURL string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	err := rsc.client.Set(ctx, shortURL, longURL, 24*time.Hour).Err()
-	if err != nil {
+func (rsc *RedisSimpleCache) Set(ctx context.Context, shortURL string, longURL string) {
+	ctx, span := startSpan(ctx, "redis", "set")
+	defer span.End()
+	err := rsc.do(ctx, func(ctx context.Context) error {
+		return rsc.client.Set(ctx, shortURL, longURL, 24*time.Hour).Err()
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, breaker.ErrOpen):
+		span.SetAttributes(attribute.Bool("cache.skipped", true))
+	default:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		rsc.logger.Errorf("Error setting key '%s' in Redis: %v", shortURL, err)
 	}
 }
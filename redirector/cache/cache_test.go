@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"go.uber.org/zap"
 	"testing"
 	"time"
@@ -43,11 +44,13 @@ func TestNewRedirectLocalCacheInstance(t *testing.T) {
 	}
 }
 
+var ctx = context.Background()
+
 func TestSetNewEntry(t *testing.T) {
 	logger := zap.Must(zap.NewDevelopment()).Sugar()
 	cache, _ := NewRedirectLocalCacheInstance(3, logger)
 
-	cache.Set("short1", "long1")
+	cache.Set(ctx, "short1", "long1")
 	if len(cache.data) != 1 {
 		t.Errorf("Expected 1 entry, got %d", len(cache.data))
 	}
@@ -59,7 +62,7 @@ func TestSetNewEntry(t *testing.T) {
 		t.Error("Entry short1 not found or value incorrect")
 	}
 
-	cache.Set("short2", "long2")
+	cache.Set(ctx, "short2", "long2")
 	if len(cache.data) != 2 {
 		t.Errorf("Expected 2 entries, got %d", len(cache.data))
 	}
@@ -73,7 +76,7 @@ func TestSetNewEntry(t *testing.T) {
 		t.Error("Linked list for short1-short2 incorrect (start/end)")
 	}
 
-	cache.Set("short3", "long3")
+	cache.Set(ctx, "short3", "long3")
 	if len(cache.data) != 3 {
 		t.Errorf("Expected 3 entries, got %d", len(cache.data))
 	}
@@ -87,7 +90,7 @@ func TestSetNewEntry(t *testing.T) {
 		t.Error("Linked list for short1-short2 incorrect (start/end)")
 	}
 
-	cache.Set("short4", "long4")
+	cache.Set(ctx, "short4", "long4")
 	if len(cache.data) != 3 {
 		t.Errorf("Expected 3 entries after eviction, got %d", len(cache.data))
 	}
@@ -107,7 +110,7 @@ func TestSetNewEntry(t *testing.T) {
 		t.Error("predecessor of short2 should be short3")
 	}
 
-	cache.Set("short3", "long3_updated")
+	cache.Set(ctx, "short3", "long3_updated")
 	if len(cache.data) != 3 {
 		t.Errorf("Expected 3 entries after update, got %d", len(cache.data))
 	}
@@ -136,11 +139,11 @@ func TestGet(t *testing.T) {
 	logger := zap.Must(zap.NewDevelopment()).Sugar()
 	cache, _ := NewRedirectLocalCacheInstance(3, logger)
 
-	cache.Set("short1", "long1") // LA: short1, LRU: short1
-	cache.Set("short2", "long2") // LA: short2, LRU: short1
-	cache.Set("short3", "long3") // LA: short3, LRU: short1
+	cache.Set(ctx, "short1", "long1") // LA: short1, LRU: short1
+	cache.Set(ctx, "short2", "long2") // LA: short2, LRU: short1
+	cache.Set(ctx, "short3", "long3") // LA: short3, LRU: short1
 
-	val, found := cache.Get("short3")
+	val, found := cache.Get(ctx, "short3")
 	if !found || val != "long3" {
 		t.Error("Expected short3 to be found and value correct")
 	}
@@ -163,7 +166,7 @@ func TestGet(t *testing.T) {
 		t.Error("short1 should be the end of the list after Get")
 	}
 
-	val, found = cache.Get("short1")
+	val, found = cache.Get(ctx, "short1")
 	if !found || val != "long1" {
 		t.Error("Expected short1 to be found and value correct")
 	}
@@ -186,7 +189,7 @@ func TestGet(t *testing.T) {
 		t.Error("short2 should be the end of the list after Get")
 	}
 
-	_, found = cache.Get("nonExistent")
+	_, found = cache.Get(ctx, "nonExistent")
 	if found {
 		t.Error("Did not expect 'nonExistent' to be found")
 	}
@@ -195,10 +198,10 @@ func TestGet(t *testing.T) {
 		t.Errorf("Cache state changed after getting non-existent key, LA:%s, LRU:%s", cache.keyLA, cache.keyLRU)
 	}
 
-	cache.Set("expired", "expired_long")
+	cache.Set(ctx, "expired", "expired_long")
 	cache.data["expired"].hardTTL = time.Now().Add(-1 * time.Second)
 
-	_, found = cache.Get("expired")
+	_, found = cache.Get(ctx, "expired")
 	if found {
 		t.Error("Expected 'expired' to be deleted and not found")
 	}
@@ -222,8 +225,8 @@ func TestGet(t *testing.T) {
 		t.Errorf("Expected 2 entries after update, got %d", len(cache.data))
 	}
 
-	cache.Set("short4", "long4")
-	val, found = cache.Get("short3")
+	cache.Set(ctx, "short4", "long4")
+	val, found = cache.Get(ctx, "short3")
 	if !found || val != "long3" {
 		t.Error("Expected short3 to be found and value correct")
 	}
@@ -251,10 +254,10 @@ func TestCleanUp(t *testing.T) {
 	logger := zap.Must(zap.NewDevelopment()).Sugar()
 	cache, _ := NewRedirectLocalCacheInstance(5, logger)
 
-	cache.Set("s1", "l1")
-	cache.Set("s2", "l2")
-	cache.Set("s3", "l3")
-	cache.Set("s4", "l4")
+	cache.Set(ctx, "s1", "l1")
+	cache.Set(ctx, "s2", "l2")
+	cache.Set(ctx, "s3", "l3")
+	cache.Set(ctx, "s4", "l4")
 
 	// Manipulate TTL
 	cache.data["s1"].hardTTL = time.Now().Add(-2 * time.Second)
@@ -313,22 +316,32 @@ func TestCleanUp(t *testing.T) {
 func TestStartCleanupRoutine(t *testing.T) {
 	logger := zap.Must(zap.NewDevelopment()).Sugar()
 	cache, _ := NewRedirectLocalCacheInstance(5, logger)
-	cache.Set("s1", "l1")
-	cache.Set("s2", "l2")
-	cache.Set("s3", "l3")
-	cache.Set("s4", "l4")
-	cache.Set("s5", "l5")
+	cache.Set(ctx, "s1", "l1")
+	cache.Set(ctx, "s2", "l2")
+	cache.Set(ctx, "s3", "l3")
+	cache.Set(ctx, "s4", "l4")
+	cache.Set(ctx, "s5", "l5")
 	cache.data["s1"].hardTTL = time.Now().Add(250 * time.Millisecond)
 	cache.data["s2"].hardTTL = time.Now().Add(550 * time.Millisecond)
 	cache.data["s3"].hardTTL = time.Now().Add(570 * time.Millisecond)
 	cache.data["s4"].hardTTL = time.Now().Add(1150 * time.Millisecond)
 	cache.data["s5"].hardTTL = time.Now().Add(1450 * time.Millisecond)
 
-	go cache.StartCleanupRoutine(300 * time.Millisecond)
+	cleaner := NewCacheCleaner(cache, 300*time.Millisecond)
+	if err := cleaner.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		if err := cleaner.Stop(stopCtx); err != nil {
+			t.Errorf("Stop failed: %v", err)
+		}
+	}()
 
 	time.Sleep(310 * time.Millisecond)
 
-	if _, found := cache.Get("s1"); found {
+	if _, found := cache.Get(ctx, "s1"); found {
 		t.Error("s1 should have been cleaned up by routine")
 	}
 	if len(cache.data) != 4 {
@@ -354,10 +367,10 @@ func TestStartCleanupRoutine(t *testing.T) {
 	}
 
 	time.Sleep(300 * time.Millisecond)
-	if _, found := cache.Get("s2"); found {
+	if _, found := cache.Get(ctx, "s2"); found {
 		t.Error("s2 should have been cleaned up by routine")
 	}
-	if _, found := cache.Get("s3"); found {
+	if _, found := cache.Get(ctx, "s3"); found {
 		t.Error("s3 should have been cleaned up by routine")
 	}
 	if len(cache.data) != 2 {
@@ -386,7 +399,7 @@ func TestStartCleanupRoutine(t *testing.T) {
 	if _, ok := cache.data["s4"]; !ok {
 		t.Error("s4 should still be present")
 	}
-	cache.Get("s4")
+	cache.Get(ctx, "s4")
 	cache.data["s4"].hardTTL = time.Now().Add(350 * time.Millisecond)
 	time.Sleep(300 * time.Millisecond)
 	if len(cache.data) != 2 {
@@ -2,53 +2,67 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 
-	"github.com/ansrivas/fiberprometheus/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/timeout"
 	"github.com/mactavishz/kuerzen/analytics/grpc"
-	"github.com/mactavishz/kuerzen/middleware/loadshed"
+	"github.com/mactavishz/kuerzen/breaker"
 	"github.com/mactavishz/kuerzen/redirector/api"
+	"github.com/mactavishz/kuerzen/redirector/bots"
 	"github.com/mactavishz/kuerzen/redirector/cache"
-	database "github.com/mactavishz/kuerzen/store/db"
-	"github.com/mactavishz/kuerzen/store/migrations"
+	"github.com/mactavishz/kuerzen/retries"
+	"github.com/mactavishz/kuerzen/service"
+	"github.com/mactavishz/kuerzen/service/health"
 	store "github.com/mactavishz/kuerzen/store/url"
-	"go.uber.org/zap"
 )
 
 const DEFAULT_PORT = "3001"
 const DEFAULT_CACHE_PORT = "6379"
 
 func main() {
-	// We use sugar logger for better readability in development
-	logger := zap.Must(zap.NewProduction()).Sugar()
-	if os.Getenv("APP_ENV") == "development" || os.Getenv("APP_ENV") == "" {
-		logger = zap.Must(zap.NewDevelopment()).Sugar()
-	}
-	defer logger.Sync()
-	db := database.NewDatabase(logger)
-
-	err := db.Open()
+	logger := service.NewLogger()
+	svc := service.New(service.Config{Name: "redirector"}, logger)
+	tracing, err := service.SetupTracing("redirector", logger)
 	if err != nil {
-		logger.Fatalf("Could not connect to database: %v", err)
+		logger.Fatalf("Could not set up tracing: %v", err)
+	}
+	// Stopped last so that the spans of the shutdown are exported
+	svc.Add(tracing)
+	for _, dependency := range []string{"postgres", "redis", "analytics"} {
+		budgetCfg, err := retries.BudgetConfigFromEnv(dependency)
+		if err != nil {
+			logger.Fatalf("Invalid retry budget settings: %v", err)
+		}
+		retries.ConfigureBudget(dependency, budgetCfg)
+	}
+	if err := retries.RegisterBudgetMetrics(nil); err != nil {
+		logger.Fatalf("Could not set up retry budget metrics: %v", err)
+	}
+	if err := breaker.RegisterMetrics(nil); err != nil {
+		logger.Fatalf("Could not set up circuit breaker metrics: %v", err)
 	}
+	newBreaker := func(name string) *breaker.Breaker {
+		cfg, err := breaker.ConfigFromEnv(name)
+		if err != nil {
+			logger.Fatalf("Invalid circuit breaker settings: %v", err)
+		}
+		return breaker.New(cfg, logger)
+	}
+	dbBreaker, cacheBreaker, analyticsBreaker := newBreaker("postgres"), newBreaker("redis"), newBreaker("analytics")
 
-	err = db.MigrateFS(migrations.FS, ".")
+	db, err := service.OpenDatabase(logger)
 	if err != nil {
-		logger.Fatalf("Could not run database migrations: %v", err)
+		logger.Fatalf("Could not set up database: %v", err)
 	}
+	svc.Add(service.NewCloser("database", db.Close))
 
-	redisAddr := os.Getenv("CACHE_URL")
-	if redisAddr == "" {
-		redisAddr = "localhost:" + DEFAULT_CACHE_PORT
-	}
+	redisAddr := service.Getenv("CACHE_URL", "localhost:"+DEFAULT_CACHE_PORT)
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     redisAddr,
 		Password: "",
@@ -62,84 +76,134 @@ func main() {
 		logger.Fatalf("Could not connect to Redis at %s: %v", redisAddr, err)
 	}
 	logger.Infof("Successfully connected to Redis at %s", redisAddr)
-	defer func() {
-		if err := rdb.Close(); err != nil {
-			logger.Errorf("Error closing Redis client: %v", err)
-		}
-	}()
+	svc.Add(service.NewCloser("redis client", rdb.Close))
 
-	externalCache := cache.NewRedisSimpleCache(rdb, logger)
+	externalCache := cache.NewRedisSimpleCache(rdb, logger).WithBreaker(cacheBreaker)
 
 	localCache, err := cache.NewRedirectLocalCacheInstance(10000, logger)
 	if err != nil {
 		logger.Fatalf("Could not initialize local cache: %v", err)
 	}
 
-	go localCache.StartCleanupRoutine(5 * time.Minute)
+	cleaner := cache.NewCacheCleaner(localCache, 5*time.Minute)
+	svc.Add(service.NewComponent("local cache cleanup", cleaner.Start, cleaner.Stop))
 
-	app := fiber.New(fiber.Config{
-		AppName:   "redirector",
-		BodyLimit: 1024 * 1024 * 1, // 1MB
-		GETOnly:   true,
-	})
+	clientCfg, err := grpc.ClientConfigFromEnv("ANALYTICS_CLIENT_", "redirector")
+	if err != nil {
+		logger.Fatalf("Invalid analytics client settings: %v", err)
+	}
+	client, err := grpc.NewAnalyticsGRPCClient(os.Getenv("ANALYTICS_SERVICE_URL"), clientCfg, logger)
+	if err != nil {
+		logger.Fatalf("Could not set up grpc client: %v", err)
+	}
+	client = client.WithBreaker(analyticsBreaker)
+	svc.Add(service.NewCloser("analytics client", client.Close))
 
-	prometheus := fiberprometheus.New("redirector")
-	prometheus.RegisterAt(app, "/metrics")
-	prometheus.SetSkipPaths([]string{"/health"}) // Optional: Remove some paths from metrics
-	app.Use(prometheus.Middleware)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	loadshedMiddleware, err := loadshed.NewLoadSheddingMiddleware(ctx, loadshed.Config{
-		CPUThreshold: 0.9,
-		MemThreshold: 0.9,
-		Interval:     500 * time.Millisecond,
-	})
+	dropPolicy, err := grpc.ParseDropPolicy(service.Getenv("ANALYTICS_DROP_POLICY", grpc.DropOldest.String()))
 	if err != nil {
-		logger.Fatalf("Could not set up load shedding middleware: %v", err)
+		logger.Fatalf("Invalid analytics drop policy: %v", err)
 	}
-	app.Use(loadshedMiddleware)
+	publisher, err := grpc.NewAnalyticsEventPublisher(client, grpc.PublisherConfig{DropPolicy: dropPolicy}, logger)
+	if err != nil {
+		logger.Fatalf("Could not set up analytics event publisher: %v", err)
+	}
+	// The publisher is stopped before the client, so that queued events are flushed over the still open connection
+	svc.Add(service.NewComponent("analytics publisher", publisher.Start, publisher.Close))
 
-	urlStore := store.NewPostgresURLStore(db.DB, logger)
-	client, err := grpc.NewAnalyticsGRPCClient(os.Getenv("ANALYTICS_SERVICE_URL"), logger)
+	app, err := service.NewFiberApp(svc.Context(), service.FiberConfig{Name: "redirector", GETOnly: true})
 	if err != nil {
-		logger.Fatalf("Could not set up grpc client: %v", err)
+		logger.Fatalf("Could not set up http server: %v", err)
+	}
+
+	privacy, err := privacyConfig()
+	if err != nil {
+		logger.Fatalf("Invalid analytics privacy settings: %v", err)
+	}
+	if privacy.VisitorSalt == "" {
+		logger.Error("ANALYTICS_VISITOR_SALT is not set, redirects are recorded without visitor fingerprints and the unique visitors of every link are 0")
+	}
+
+	botConfig, err := botConfig()
+	if err != nil {
+		logger.Fatalf("Invalid bot classification settings: %v", err)
 	}
-	defer func() {
-		if err := client.Close(); err != nil {
-			logger.Errorf("Error closing grpc client: %v", err)
-		}
-	}()
-	defer func() {
-		if err := db.Close(); err != nil {
-			logger.Errorf("Error closing database connection: %v", err)
-		}
-	}()
-	handler := api.NewRedirectHandler(urlStore, client, logger, localCache, externalCache)
+
+	// A redirect is worth little once the user gave up waiting for it
+	urlStore := store.NewPostgresURLStore(db.DB, logger).WithBreaker(dbBreaker)
+	app.Use(func(c *fiber.Ctx) error {
+		c.SetUserContext(retries.ContextWithPolicy(c.UserContext(), retries.InteractivePolicy))
+		return c.Next()
+	})
+	handler := api.NewRedirectHandler(urlStore, publisher, logger, localCache, externalCache, privacy, botConfig)
 
 	app.Get("/api/v1/url/:shortURL", timeout.NewWithContext(handler.HandleRedirect, 3*time.Second))
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"status": "healthy"})
+
+	registry := health.NewRegistry(health.DEFAULT_CACHE_TTL)
+	registry.Register(health.Dependency{Name: "database", Checker: health.PingDB(db.DB), Critical: true, Breaker: dbBreaker})
+	// Redis is only a cache and analytics events are best effort, redirects still work without them
+	registry.Register(health.Dependency{Name: "cache", Checker: health.CheckerFunc(externalCache.Ping), Breaker: cacheBreaker})
+	registry.Register(health.Dependency{Name: "analytics", Checker: health.CheckerFunc(client.CheckConnectivity), Breaker: analyticsBreaker})
+	service.RegisterHealthRoutes(app, svc, registry)
+
+	port := service.Getenv("REDIRECTOR_PORT", DEFAULT_PORT)
+	svc.Add(service.NewFiberServer("http server", app, ":"+port))
+	svc.OnStart(func(ctx context.Context) error {
+		logger.Infof("Redirector service listening on port :%s", port)
+		return nil
 	})
+	os.Exit(svc.Run())
+}
 
-	port := os.Getenv("REDIRECTOR_PORT")
-	if len(port) == 0 {
-		port = DEFAULT_PORT
-	}
-	go func() {
-		if err := app.Listen(":" + port); err != nil {
-			log.Panic(err)
+// privacyConfig reads the settings that control which parts of the click context are kept in redirect events
+func privacyConfig() (api.PrivacyConfig, error) {
+	var pc api.PrivacyConfig
+	var err error
+	for key, keep := range map[string]*bool{
+		"ANALYTICS_KEEP_REFERRER":        &pc.KeepReferrer,
+		"ANALYTICS_KEEP_USER_AGENT":      &pc.KeepUserAgent,
+		"ANALYTICS_KEEP_ACCEPT_LANGUAGE": &pc.KeepAcceptLanguage,
+	} {
+		if *keep, err = strconv.ParseBool(service.Getenv(key, "true")); err != nil {
+			return pc, fmt.Errorf("%s: %w", key, err)
 		}
-	}()
-
-	logger.Infof("Redirector service listening on port :%s", port)
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	}
+	if pc.IPMode, err = api.ParseIPMode(service.Getenv("ANALYTICS_IP_MODE", api.IPTruncate.String())); err != nil {
+		return pc, err
+	}
+	pc.IPSalt = os.Getenv("ANALYTICS_IP_SALT")
+	pc.VisitorSalt = os.Getenv("ANALYTICS_VISITOR_SALT")
+	return pc, pc.Validate()
+}
 
-	logger.Infof("Gracefully shutting down...")
-	if err := app.Shutdown(); err != nil {
-		logger.Errorf("Error shutting down: %v", err)
+// botConfig reads the settings of the classification of bot traffic in redirect events
+func botConfig() (api.BotConfig, error) {
+	var bc api.BotConfig
+	classify, err := strconv.ParseBool(service.Getenv("ANALYTICS_CLASSIFY_BOTS", "true"))
+	if err != nil {
+		return bc, fmt.Errorf("ANALYTICS_CLASSIFY_BOTS: %w", err)
+	}
+	if bc.ServeOpenGraph, err = strconv.ParseBool(service.Getenv("REDIRECTOR_UNFURL_OPENGRAPH", "false")); err != nil {
+		return bc, fmt.Errorf("REDIRECTOR_UNFURL_OPENGRAPH: %w", err)
+	}
+	if !classify {
+		return bc, nil
+	}
+	var cfg bots.Config
+	if path := os.Getenv("ANALYTICS_BOT_USER_AGENTS"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return bc, fmt.Errorf("ANALYTICS_BOT_USER_AGENTS: %w", err)
+		}
+		if cfg.UserAgents, err = bots.ParseUserAgents(data); err != nil {
+			return bc, fmt.Errorf("ANALYTICS_BOT_USER_AGENTS: %w", err)
+		}
+	}
+	if cfg.RateLimit, err = strconv.Atoi(service.Getenv("ANALYTICS_BOT_RATE_LIMIT", strconv.Itoa(bots.DEFAULT_RATE_LIMIT))); err != nil {
+		return bc, fmt.Errorf("ANALYTICS_BOT_RATE_LIMIT: %w", err)
+	}
+	if cfg.RateWindow, err = time.ParseDuration(service.Getenv("ANALYTICS_BOT_RATE_WINDOW", bots.DEFAULT_RATE_WINDOW.String())); err != nil {
+		return bc, fmt.Errorf("ANALYTICS_BOT_RATE_WINDOW: %w", err)
 	}
-	logger.Infof("Server was gracefully shut down")
+	bc.Classifier, err = bots.NewClassifier(cfg)
+	return bc, err
 }
@@ -0,0 +1,195 @@
+package retries
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DEFAULT_BUDGET_RATIO   = 0.1 // A retry for every 10 first attempts
+	DEFAULT_BUDGET_RESERVE = 10  // Retries allowed per window without first attempts, e.g. after a quiet period
+	DEFAULT_BUDGET_WINDOW  = 10 * time.Second
+)
+
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+// BudgetConfig configures the budget of a dependency, the zero values take the defaults. Reserve is a pointer because
+// no reserve at all is a valid setting, only nil takes DEFAULT_BUDGET_RESERVE.
+type BudgetConfig struct {
+	Ratio   float64          // Retries allowed per first attempt in the window
+	Reserve *float64         // Retries allowed per window on top of the ratio, so that rare operations can retry
+	Window  time.Duration    // Period the attempts are counted over
+	Now     func() time.Time // time.Now if nil, for tests
+}
+
+// BudgetConfigFromEnv reads the config of the budget of a dependency from RETRY_BUDGET_RATIO, RETRY_BUDGET_RESERVE
+// and RETRY_BUDGET_WINDOW. The same variables with the dependency after the prefix, e.g. RETRY_BUDGET_REDIS_RATIO,
+// override them for that dependency. A reserve of 0 turns the reserve off.
+func BudgetConfigFromEnv(dependency string) (BudgetConfig, error) {
+	var cfg BudgetConfig
+	for _, prefix := range []string{"RETRY_BUDGET_", "RETRY_BUDGET_" + strings.ToUpper(dependency) + "_"} {
+		if s := os.Getenv(prefix + "RATIO"); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil || f <= 0 {
+				return cfg, fmt.Errorf("%sRATIO must be a positive number", prefix)
+			}
+			cfg.Ratio = f
+		}
+		if s := os.Getenv(prefix + "RESERVE"); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil || f < 0 {
+				return cfg, fmt.Errorf("%sRESERVE must be a number of at least 0", prefix)
+			}
+			cfg.Reserve = &f
+		}
+		if s := os.Getenv(prefix + "WINDOW"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return cfg, fmt.Errorf("%sWINDOW must be a positive duration", prefix)
+			}
+			cfg.Window = d
+		}
+	}
+	return cfg, nil
+}
+
+func (cfg BudgetConfig) withDefaults() BudgetConfig {
+	if cfg.Ratio <= 0 {
+		cfg.Ratio = DEFAULT_BUDGET_RATIO
+	}
+	if cfg.Reserve == nil {
+		reserve := float64(DEFAULT_BUDGET_RESERVE)
+		cfg.Reserve = &reserve
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DEFAULT_BUDGET_WINDOW
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	return cfg
+}
+
+type budgetBucket struct {
+	firsts  int
+	retries int
+}
+
+// Budget limits the retries of a dependency to a share of the recent first attempts, so that the callers of a
+// dependency that is down don't multiply its load. The attempts are counted in a sliding window: a retry is allowed
+// while the retries in the window stay below Ratio times the first attempts in it plus the Reserve. Attempts that
+// slid out of the window no longer count, so the budget refills over time.
+type Budget struct {
+	dependency string
+
+	mu     sync.Mutex
+	cfg    BudgetConfig
+	window *Window[budgetBucket]
+}
+
+var (
+	budgetsMu sync.Mutex
+	budgets   = make(map[string]*Budget)
+
+	budgetAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "retry_budget_attempts_total",
+		Help: "Number of attempts of operations with a retry budget, by dependency and result (first, retry or denied).",
+	}, []string{"dependency", "result"})
+	budgetTokens = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "retry_budget_tokens",
+		Help: "Number of retries the budget of the dependency allowed as of its last attempt.",
+	}, []string{"dependency"})
+)
+
+func newBudget(dependency string, cfg BudgetConfig) *Budget {
+	cfg = cfg.withDefaults()
+	b := &Budget{dependency: dependency, cfg: cfg, window: NewWindow[budgetBucket](cfg.Window, cfg.Now())}
+	budgetTokens.WithLabelValues(dependency).Set(*cfg.Reserve)
+	return b
+}
+
+// BudgetFor returns the process-wide budget of a dependency, e.g. "postgres", with the defaults until ConfigureBudget
+// configured it
+func BudgetFor(dependency string) *Budget {
+	budgetsMu.Lock()
+	defer budgetsMu.Unlock()
+	b, ok := budgets[dependency]
+	if !ok {
+		b = newBudget(dependency, BudgetConfig{})
+		budgets[dependency] = b
+	}
+	return b
+}
+
+// ConfigureBudget configures the budget of a dependency, whether BudgetFor returned it already or not. The attempts
+// counted so far are kept.
+func ConfigureBudget(dependency string, cfg BudgetConfig) {
+	b := BudgetFor(dependency)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cfg = cfg.withDefaults()
+	b.window.Length = b.cfg.Window
+}
+
+// RegisterBudgetMetrics registers the metrics of the budgets, with prometheus.DefaultRegisterer if reg is nil
+func RegisterBudgetMetrics(reg prometheus.Registerer) error {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	for _, c := range []prometheus.Collector{budgetAttempts, budgetTokens} {
+		if err := reg.Register(c); err != nil {
+			return fmt.Errorf("register retry budget metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// firstAttempt adds to the budget, b may be nil
+func (b *Budget) firstAttempt() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.window.Bucket(b.cfg.Now()).firsts++
+	budgetTokens.WithLabelValues(b.dependency).Set(b.available())
+	b.mu.Unlock()
+	budgetAttempts.WithLabelValues(b.dependency, "first").Inc()
+}
+
+// allowRetry counts a retry if the budget allows one and reports whether it did, b may be nil
+func (b *Budget) allowRetry() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	bucket := b.window.Bucket(b.cfg.Now())
+	allowed := b.available() >= 1
+	if allowed {
+		bucket.retries++
+	}
+	budgetTokens.WithLabelValues(b.dependency).Set(b.available())
+	b.mu.Unlock()
+	if !allowed {
+		budgetAttempts.WithLabelValues(b.dependency, "denied").Inc()
+		return false
+	}
+	budgetAttempts.WithLabelValues(b.dependency, "retry").Inc()
+	return true
+}
+
+// available returns the number of retries the window allows, b.mu is held
+func (b *Budget) available() float64 {
+	var firsts, retries int
+	for _, bk := range b.window.Buckets() {
+		firsts += bk.firsts
+		retries += bk.retries
+	}
+	return max(0, b.cfg.Ratio*float64(firsts)+*b.cfg.Reserve-float64(retries))
+}
@@ -0,0 +1,144 @@
+package retries
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock the tests advance by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestBudget(cfg BudgetConfig) (*Budget, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cfg.Now = clock.Now
+	return newBudget("test", cfg), clock
+}
+
+func reserve(f float64) *float64 {
+	return &f
+}
+
+// retriesAllowed takes retries from b until it denies one and returns how many it allowed
+func retriesAllowed(b *Budget) int {
+	n := 0
+	for b.allowRetry() {
+		n++
+	}
+	return n
+}
+
+func TestBudgetExhausts(t *testing.T) {
+	b, _ := newTestBudget(BudgetConfig{Ratio: 0.5, Reserve: reserve(2), Window: 10 * time.Second})
+	if n := retriesAllowed(b); n != 2 {
+		t.Fatalf("Expected the reserve to allow 2 retries, got %d", n)
+	}
+	for i := 0; i < 4; i++ {
+		b.firstAttempt()
+	}
+	if n := retriesAllowed(b); n != 2 {
+		t.Errorf("Expected 4 first attempts to allow 2 more retries, got %d", n)
+	}
+}
+
+func TestBudgetRefills(t *testing.T) {
+	b, clock := newTestBudget(BudgetConfig{Ratio: 0.5, Reserve: reserve(1), Window: 10 * time.Second})
+	for i := 0; i < 4; i++ {
+		b.firstAttempt()
+	}
+	clock.Advance(5 * time.Second)
+	if n := retriesAllowed(b); n != 3 {
+		t.Fatalf("Expected 3 retries, got %d", n)
+	}
+	// The first attempts slide out of the window, the retries after them are still in it
+	clock.Advance(5 * time.Second)
+	if b.allowRetry() {
+		t.Fatalf("Expected the retries in the window to use up the reserve")
+	}
+	clock.Advance(5 * time.Second)
+	if n := retriesAllowed(b); n != 1 {
+		t.Errorf("Expected the reserve once the retries left the window, got %d retries", n)
+	}
+}
+
+func TestDoStopsWhenTheBudgetIsExhausted(t *testing.T) {
+	b, _ := newTestBudget(BudgetConfig{Ratio: 0.1, Reserve: reserve(1)})
+	policy := fastPolicy
+	policy.MaxAttempts = 10
+	calls := 0
+	_, err := Do(context.Background(), policy.WithBudget(b), func(ctx context.Context) (struct{}, error) {
+		calls++
+		return struct{}{}, ErrTransient
+	})
+	if !errors.Is(err, ErrBudgetExhausted) || !errors.Is(err, ErrTransient) {
+		t.Errorf("Expected the last error wrapped in ErrBudgetExhausted, got %v", err)
+	}
+	// The first attempt adds 0.1, the reserve allows a single retry
+	if calls != 2 {
+		t.Errorf("Expected 2 attempts, got %d", calls)
+	}
+}
+
+func TestBudgetConfigFromEnv(t *testing.T) {
+	t.Setenv("RETRY_BUDGET_RATIO", "0.2")
+	t.Setenv("RETRY_BUDGET_WINDOW", "1m")
+	t.Setenv("RETRY_BUDGET_REDIS_RATIO", "0.5")
+	t.Setenv("RETRY_BUDGET_REDIS_RESERVE", "3")
+	cfg, err := BudgetConfigFromEnv("redis")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Ratio != 0.5 || cfg.Reserve == nil || *cfg.Reserve != 3 || cfg.Window != time.Minute {
+		t.Errorf("Expected the settings of redis over the common ones, got %+v", cfg)
+	}
+	cfg, err = BudgetConfigFromEnv("postgres")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Ratio != 0.2 || cfg.Reserve != nil || cfg.Window != time.Minute {
+		t.Errorf("Expected the common settings, got %+v", cfg)
+	}
+	t.Setenv("RETRY_BUDGET_POSTGRES_RESERVE", "0")
+	cfg, err = BudgetConfigFromEnv("postgres")
+	if err != nil || cfg.Reserve == nil || *cfg.Reserve != 0 {
+		t.Fatalf("Expected a reserve of 0, got %+v, %v", cfg, err)
+	}
+	cfg.Now = (&fakeClock{}).Now
+	if n := retriesAllowed(newBudget("test", cfg)); n != 0 {
+		t.Errorf("Expected no retries without a reserve, got %d", n)
+	}
+	t.Setenv("RETRY_BUDGET_POSTGRES_RESERVE", "-1")
+	if _, err := BudgetConfigFromEnv("postgres"); err == nil {
+		t.Errorf("Expected a negative reserve to fail")
+	}
+	t.Setenv("RETRY_BUDGET_POSTGRES_RESERVE", "")
+	t.Setenv("RETRY_BUDGET_POSTGRES_WINDOW", "soon")
+	if _, err := BudgetConfigFromEnv("postgres"); err == nil {
+		t.Errorf("Expected an invalid window to fail")
+	}
+}
+
+func TestConfigureBudget(t *testing.T) {
+	b := BudgetFor("configure-test")
+	ConfigureBudget("configure-test", BudgetConfig{Reserve: reserve(1)})
+	if BudgetFor("configure-test") != b {
+		t.Fatalf("Expected the same budget for the same dependency")
+	}
+	if n := retriesAllowed(b); n != 1 {
+		t.Errorf("Expected the configured reserve to allow 1 retry, got %d", n)
+	}
+	if *BudgetFor("configure-other").cfg.Reserve != DEFAULT_BUDGET_RESERVE {
+		t.Errorf("Expected the config of other dependencies to stay the default")
+	}
+}
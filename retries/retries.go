@@ -3,86 +3,230 @@ package retries
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
 	"math/rand"
 	"time"
 
-	"go.uber.org/zap"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// AllAt is a flexible type that acts as a container for diverse data types.
-// This is used for holding various results of an operation when returned.
-type AllAt interface{}
+// Jitter decides how the backoff between two attempts is randomized
+// Ref: https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type Jitter int
+
+const (
+	DecorrelatedJitter Jitter = iota // A random backoff between Base and three times the previous one
+	FullJitter                       // A random backoff between 0 and the exponential backoff
+	EqualJitter                      // Half the exponential backoff plus a random share of the other half
+	NoJitter                         // The exponential backoff, Base doubled with every retry
+)
+
+func (j Jitter) String() string {
+	switch j {
+	case DecorrelatedJitter:
+		return "decorrelated"
+	case FullJitter:
+		return "full"
+	case EqualJitter:
+		return "equal"
+	case NoJitter:
+		return "none"
+	default:
+		return fmt.Sprintf("Jitter(%d)", int(j))
+	}
+}
 
-type RetryableFuncObject struct {
-	Err    error
-	Ctx    context.Context
-	Logger *zap.SugaredLogger
-	Rest   []AllAt //If more than the error must be returned, different return values can be contained here.
+func ParseJitter(s string) (Jitter, error) {
+	for _, j := range []Jitter{DecorrelatedJitter, FullJitter, EqualJitter, NoJitter} {
+		if j.String() == s {
+			return j, nil
+		}
+	}
+	return DecorrelatedJitter, fmt.Errorf("unknown jitter %q", s)
 }
 
-// RetryableFunc defines the signature for any operation that can be retried.
-// This function type is designed to be implemented by a Closure.
-// A Closure allows capturing necessary data.
-// By using this standardized signature, several different functions (e.g. CreateShortURL, GetLongURL, SendURLCreationEvent)
-// can be used within the Retry logic, regardless of their original parameters or their specific task.
-type RetryableFunc func() RetryableFuncObject
+// Policy bounds the attempts of Do and the backoff between them
+type Policy struct {
+	MaxAttempts    int           // Attempts including the initial one, a single attempt if 0
+	MaxElapsedTime time.Duration // Total duration of all attempts, 0 for no limit. The deadline of the context also bounds it.
+	Base           time.Duration // The backoff before the first retry
+	Cap            time.Duration // The longest backoff between two attempts
+	Jitter         Jitter
+	Budget         *Budget // Retries are only made while the budget of the dependency allows them, nil for no budget
+}
 
-const (
-	maxElapsedTime       = 30 * time.Second      // Maximum total duration that all retries may last (including the initial attempt)
-	initialSleepInterval = 50 * time.Millisecond // The initial waiting time before the first retry (base)
-	maxSleepInterval     = 5 * time.Second       // The longest possible waiting time between two retries (cap)
-	maxRetries           = 10                    // Upper limit for the number of retries if time is not the primary termination condition
-)
+// WithBudget returns the policy with the budget
+func (p Policy) WithBudget(b *Budget) Policy {
+	p.Budget = b
+	return p
+}
+
+type policyKey struct{}
+
+// ContextWithPolicy returns a context that makes the callers of Do retry with policy, so that the call site picks the
+// policy rather than the component that retries, e.g. requests a user waits for pick InteractivePolicy for every store
+// they call
+func ContextWithPolicy(ctx context.Context, policy Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// PolicyFromContext returns the policy of ContextWithPolicy, or fallback if ctx has none. A policy without a budget
+// takes the budget of fallback, which is the budget of the dependency the caller retries.
+func PolicyFromContext(ctx context.Context, fallback Policy) Policy {
+	policy, ok := ctx.Value(policyKey{}).(Policy)
+	if !ok {
+		return fallback
+	}
+	if policy.Budget == nil {
+		policy.Budget = fallback.Budget
+	}
+	return policy
+}
+
+// InteractivePolicy gives up quickly, for requests a user waits for
+var InteractivePolicy = Policy{
+	MaxAttempts:    3,
+	MaxElapsedTime: 2 * time.Second,
+	Base:           25 * time.Millisecond,
+	Cap:            250 * time.Millisecond,
+	Jitter:         FullJitter,
+}
+
+// BackgroundPolicy keeps retrying for a while, for jobs nobody waits for
+var BackgroundPolicy = Policy{
+	MaxAttempts:    11,
+	MaxElapsedTime: 30 * time.Second,
+	Base:           50 * time.Millisecond,
+	Cap:            5 * time.Second,
+	Jitter:         DecorrelatedJitter,
+}
+
+// random draws the jitter, tests replace it
+var random = rand.Float64
+
+// backoff returns the backoff before the retry-th retry (1 for the first), prev is the previous backoff
+func (p Policy) backoff(retry int, prev time.Duration) time.Duration {
+	limit := max(p.Cap, p.Base)
+	if retry <= 1 && p.Jitter == DecorrelatedJitter {
+		return p.Base
+	}
+	exp := float64(p.Base) * math.Pow(2, float64(retry-1))
+	exp = math.Min(float64(limit), exp)
+	switch p.Jitter {
+	case DecorrelatedJitter:
+		// sleep = min(cap, random_between(base, sleep * 3))
+		return time.Duration(math.Min(float64(limit), float64(p.Base)+random()*float64(3*prev-p.Base)))
+	case FullJitter:
+		return time.Duration(random() * exp)
+	case EqualJitter:
+		return time.Duration(exp/2 + random()*exp/2)
+	default:
+		return time.Duration(exp)
+	}
+}
 
 var ErrMaxElapsedTimeExceeded = errors.New("max elapsed time for operation exceeded")
 var ErrRetriesExhausted = errors.New("operation failed after all retries exhausted")
 var ErrTransient = errors.New("transient error, retry")
 
-// The Retry simply repeats the function calls
-// and passes the error or success it receives from the RetryableFunc at the end
-// Ref: https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
-func Retry(rf RetryableFunc) RetryableFuncObject {
+// transientError keeps the cause of a transient error, it matches both ErrTransient and the cause
+type transientError struct {
+	err error
+}
+
+func (te transientError) Error() string {
+	return te.err.Error()
+}
+
+func (te transientError) Unwrap() []error {
+	return []error{ErrTransient, te.err}
+}
+
+// Transient marks err as transient so that Do retries it
+func Transient(err error) error {
+	if err == nil {
+		return ErrTransient
+	}
+	return transientError{err: err}
+}
+
+var tracer = otel.Tracer("github.com/mactavishz/kuerzen/retries")
+
+// traceAttempt records an attempt as a span of the trace in ctx. The span is started and ended with the times of the
+// attempt, so that the attempt doesn't depend on tracing. The backoff before the next attempt is added as an event,
+// backoff is 0 if there is none.
+func traceAttempt(ctx context.Context, err error, attempt int, start time.Time, backoff time.Duration) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	end := time.Now()
+	_, span := tracer.Start(ctx, "retry attempt", trace.WithTimestamp(start), trace.WithAttributes(attribute.Int("retry.attempt", attempt)))
+	if err != nil {
+		span.RecordError(err, trace.WithTimestamp(end))
+		span.SetStatus(codes.Error, err.Error())
+	}
+	if backoff > 0 {
+		span.AddEvent("backoff", trace.WithTimestamp(end), trace.WithAttributes(attribute.String("retry.backoff", backoff.String())))
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// Do calls fn until it succeeds or fails with an error that isn't transient (see Transient), within the bounds of the
+// policy. Once they are exceeded the last error is returned wrapped in ErrRetriesExhausted, ErrMaxElapsedTimeExceeded or
+// ErrBudgetExhausted, if ctx is done during a backoff ctx.Err() is returned.
+func Do[T any](ctx context.Context, policy Policy, fn func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
 	startTime := time.Now()
-	sleep := initialSleepInterval
-	var rfo RetryableFuncObject
-	// Iteration i=0 is the initial attempt; iterations i=1 to maxRetries are subsequent retries.
-	for i := 0; i <= maxRetries; i++ {
-		rfo = rf()
-		if rfo.Err == ErrTransient {
-			// Error can possibly be fixed by repeating
-			// Check if there are still attempts available for Retry
-			if i == maxRetries {
-				rfo.Logger.Errorf("Operation failed after all retries exhausted")
-				rfo.Err = ErrRetriesExhausted
-				break
-			}
-			// The first retry takes place after initialSleepInterval
-			// A new sleep does not have to be calculated until the first retry
-			if i != 0 {
-				// sleep = min(cap, random_between(base, sleep * 3)
-				sleep = time.Duration(math.Min(float64(maxSleepInterval), float64(initialSleepInterval)+rand.Float64()*float64(3*sleep-initialSleepInterval)))
-			}
-			rfo.Logger.Infof("Waiting for %v before next retry attempt for (attempt %d)", sleep, i+1)
-			// Proactive check whether the maxSleepInterval would be exceeded after waiting sleep-long
-			if time.Since(startTime)+sleep >= maxElapsedTime {
-				rfo.Logger.Errorf("Operation timed out after %v", maxElapsedTime)
-				rfo.Err = ErrMaxElapsedTimeExceeded
-				break
-			}
-			select {
-			// Successfully waited for the backoff duration. Proceed to the next iteration (retry)
-			case <-time.After(sleep):
-			// Listen for cancellation of the context used for the current operation attempt.
-			case <-rfo.Ctx.Done():
-				rfo.Logger.Errorf("Operation cancelled during backoff: %v", rfo.Ctx.Err())
-				rfo.Err = rfo.Ctx.Err()
-				break
-			}
-		} else {
-			// rfo.err == nil or rfo.err is a permanent error
-			break
+	var sleep time.Duration
+	for attempt := 1; ; attempt++ {
+		attemptStart := time.Now()
+		res, err := fn(ctx)
+		if attempt == 1 {
+			policy.Budget.firstAttempt()
+		}
+		if !errors.Is(err, ErrTransient) {
+			// err == nil or err is a permanent error
+			traceAttempt(ctx, err, attempt, attemptStart, 0)
+			return res, err
+		}
+		if attempt >= policy.MaxAttempts {
+			traceAttempt(ctx, err, attempt, attemptStart, 0)
+			return zero, fmt.Errorf("%w: %w", ErrRetriesExhausted, err)
+		}
+		// Fail fast rather than add to the load of a dependency that most callers fail to reach
+		if !policy.Budget.allowRetry() {
+			traceAttempt(ctx, err, attempt, attemptStart, 0)
+			return zero, fmt.Errorf("%w: %w", ErrBudgetExhausted, err)
 		}
+		sleep = policy.backoff(attempt, sleep)
+		// Proactive check whether the deadline would be exceeded after waiting sleep-long
+		if deadline := policy.deadline(ctx, startTime); !deadline.IsZero() && !time.Now().Add(sleep).Before(deadline) {
+			traceAttempt(ctx, err, attempt, attemptStart, 0)
+			return zero, fmt.Errorf("%w after %v: %w", ErrMaxElapsedTimeExceeded, time.Since(startTime).Round(time.Millisecond), err)
+		}
+		traceAttempt(ctx, err, attempt, attemptStart, sleep)
+		select {
+		// Successfully waited for the backoff duration. Proceed to the next attempt
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// deadline returns the time the attempts have to end by, the earlier of MaxElapsedTime and the deadline of ctx, zero
+// if there is none. There is no point in waiting for an attempt the context doesn't leave time for.
+func (p Policy) deadline(ctx context.Context, start time.Time) time.Time {
+	var deadline time.Time
+	if p.MaxElapsedTime > 0 {
+		deadline = start.Add(p.MaxElapsedTime)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
 	}
-	return rfo
+	return deadline
 }
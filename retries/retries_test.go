@@ -0,0 +1,156 @@
+package retries
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// fastPolicy makes the tests of the retries quick
+var fastPolicy = Policy{MaxAttempts: 3, Base: time.Millisecond, Cap: time.Millisecond, Jitter: NoJitter}
+
+func TestTransient(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := Transient(cause)
+	if !errors.Is(err, ErrTransient) || !errors.Is(err, cause) || err.Error() != cause.Error() {
+		t.Errorf("Expected a transient error that keeps its cause, got %v", err)
+	}
+	if Transient(nil) != ErrTransient {
+		t.Errorf("Expected Transient(nil) to be ErrTransient")
+	}
+}
+
+func TestDo(t *testing.T) {
+	errDown := Transient(errors.New("connection refused"))
+	errPermanent := errors.New("not found")
+	tests := []struct {
+		name     string
+		policy   Policy
+		errs     []error // errors of the attempts, the attempts after the last one succeed
+		attempts int
+		want     []error // errors the result has to match, nil for success
+	}{
+		{"success", fastPolicy, nil, 1, nil},
+		{"retried until success", fastPolicy, []error{errDown, errDown}, 3, nil},
+		{"permanent errors aren't retried", fastPolicy, []error{errDown, errPermanent}, 2, []error{errPermanent}},
+		{"max attempts", fastPolicy, []error{errDown, errDown, errDown}, 3, []error{ErrRetriesExhausted, errDown}},
+		{"zero max attempts is a single attempt", Policy{}, []error{errDown}, 1, []error{ErrRetriesExhausted, errDown}},
+		{"max elapsed time", Policy{MaxAttempts: 10, MaxElapsedTime: 5 * time.Millisecond, Base: 10 * time.Millisecond, Jitter: NoJitter},
+			[]error{errDown, errDown}, 1, []error{ErrMaxElapsedTimeExceeded, errDown}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			res, err := Do(context.Background(), tt.policy, func(ctx context.Context) (int, error) {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return 0, tt.errs[attempts-1]
+				}
+				return attempts, nil
+			})
+			if attempts != tt.attempts {
+				t.Errorf("Expected %d attempts, got %d", tt.attempts, attempts)
+			}
+			if tt.want == nil && (err != nil || res != attempts) {
+				t.Errorf("Expected the result of the last attempt, got %d and %v", res, err)
+			}
+			for _, want := range tt.want {
+				if !errors.Is(err, want) {
+					t.Errorf("Expected the error to match %v, got %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDoEndsWithTheContext(t *testing.T) {
+	policy := Policy{MaxAttempts: 1000, Base: 10 * time.Millisecond, Cap: 10 * time.Millisecond, Jitter: NoJitter}
+	fail := func(ctx context.Context) (struct{}, error) { return struct{}{}, ErrTransient }
+
+	// No attempt is made that the deadline doesn't leave time for
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Millisecond)
+	defer cancel()
+	if _, err := Do(ctx, policy, fail); !errors.Is(err, ErrMaxElapsedTimeExceeded) {
+		t.Errorf("Expected ErrMaxElapsedTimeExceeded at the deadline, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(15*time.Millisecond, cancel)
+	if _, err := Do(ctx, policy, fail); err != context.Canceled {
+		t.Errorf("Expected the error of the context once it is canceled during a backoff, got %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := func(j Jitter) Policy {
+		return Policy{Base: 100 * time.Millisecond, Cap: time.Second, Jitter: j}
+	}
+	tests := []struct {
+		name   string
+		policy Policy
+		retry  int
+		prev   time.Duration
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"none doubles", policy(NoJitter), 3, 0, 400 * time.Millisecond, 400 * time.Millisecond},
+		{"none is capped", policy(NoJitter), 10, 0, time.Second, time.Second},
+		{"full", policy(FullJitter), 3, 0, 0, 400 * time.Millisecond},
+		{"full is capped", policy(FullJitter), 10, 0, 0, time.Second},
+		{"equal", policy(EqualJitter), 3, 0, 200 * time.Millisecond, 400 * time.Millisecond},
+		{"equal is capped", policy(EqualJitter), 10, 0, 500 * time.Millisecond, time.Second},
+		{"decorrelated starts at base", policy(DecorrelatedJitter), 1, 0, 100 * time.Millisecond, 100 * time.Millisecond},
+		{"decorrelated", policy(DecorrelatedJitter), 2, 200 * time.Millisecond, 100 * time.Millisecond, 600 * time.Millisecond},
+		{"decorrelated is capped", policy(DecorrelatedJitter), 5, 800 * time.Millisecond, 100 * time.Millisecond, time.Second},
+		{"cap below base", Policy{Base: time.Second, Cap: time.Millisecond, Jitter: NoJitter}, 3, 0, time.Second, time.Second},
+		{"huge retry", policy(NoJitter), 5000, 0, time.Second, time.Second},
+	}
+	defer func(r func() float64) { random = r }(random)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The extremes of the jitter and a seeded sequence in between
+			seeded := rand.New(rand.NewSource(1))
+			draws := []float64{0, 0.999999}
+			for range 100 {
+				draws = append(draws, seeded.Float64())
+			}
+			for _, r := range draws {
+				random = func() float64 { return r }
+				if d := tt.policy.backoff(tt.retry, tt.prev); d < tt.min || d > tt.max {
+					t.Fatalf("Expected a backoff between %v and %v, got %v at %v", tt.min, tt.max, d, r)
+				}
+			}
+		})
+	}
+}
+
+func TestParseJitter(t *testing.T) {
+	for _, j := range []Jitter{DecorrelatedJitter, FullJitter, EqualJitter, NoJitter} {
+		if parsed, err := ParseJitter(j.String()); err != nil || parsed != j {
+			t.Errorf("Expected %s to parse, got %v (%v)", j, parsed, err)
+		}
+	}
+	if _, err := ParseJitter("random"); err == nil {
+		t.Errorf("Expected an unknown jitter to fail")
+	}
+}
+
+func TestPolicyFromContext(t *testing.T) {
+	budget := &Budget{}
+	fallback := BackgroundPolicy.WithBudget(budget)
+	if p := PolicyFromContext(context.Background(), fallback); p != fallback {
+		t.Errorf("Expected the fallback without a policy in the context, got %+v", p)
+	}
+	ctx := ContextWithPolicy(context.Background(), InteractivePolicy)
+	want := InteractivePolicy.WithBudget(budget)
+	if p := PolicyFromContext(ctx, fallback); p != want {
+		t.Errorf("Expected the policy of the context with the budget of the fallback, got %+v", p)
+	}
+	own := &Budget{}
+	ctx = ContextWithPolicy(context.Background(), InteractivePolicy.WithBudget(own))
+	if p := PolicyFromContext(ctx, fallback); p.Budget != own {
+		t.Errorf("Expected the policy of the context to keep its budget")
+	}
+}
@@ -0,0 +1,59 @@
+package retries
+
+import "time"
+
+// WINDOW_BUCKETS is the number of buckets a Window slides by
+const WINDOW_BUCKETS = 10
+
+// Window counts events over a sliding period in WINDOW_BUCKETS buckets of T, e.g. the attempts of a retry budget or
+// the calls of a circuit breaker. Buckets that fall out of the period are reset to the zero value. A Window isn't safe
+// for concurrent use, its owner locks it.
+type Window[T any] struct {
+	Length time.Duration // Period the window covers, it can be changed at any time
+
+	buckets     [WINDOW_BUCKETS]T
+	current     int       // Index of the bucket events are counted in
+	bucketStart time.Time // Start of the current bucket
+}
+
+// NewWindow returns an empty window of length that starts at now
+func NewWindow[T any](length time.Duration, now time.Time) *Window[T] {
+	return &Window[T]{Length: length, bucketStart: now}
+}
+
+// Bucket moves the window to now and returns the bucket to count the events of now in
+func (w *Window[T]) Bucket(now time.Time) *T {
+	w.slide(now)
+	return &w.buckets[w.current]
+}
+
+// Buckets returns the buckets of the window as of its last move
+func (w *Window[T]) Buckets() []T {
+	return w.buckets[:]
+}
+
+// Reset empties the window, it starts again at now
+func (w *Window[T]) Reset(now time.Time) {
+	w.buckets = [WINDOW_BUCKETS]T{}
+	w.current = 0
+	w.bucketStart = now
+}
+
+// slide moves the window to now, dropping the buckets that fell out of it
+func (w *Window[T]) slide(now time.Time) {
+	width := w.Length / WINDOW_BUCKETS
+	steps := int(now.Sub(w.bucketStart) / width)
+	if steps <= 0 {
+		return
+	}
+	if steps >= WINDOW_BUCKETS {
+		w.buckets = [WINDOW_BUCKETS]T{}
+	} else {
+		var zero T
+		for i := 0; i < steps; i++ {
+			w.current = (w.current + 1) % WINDOW_BUCKETS
+			w.buckets[w.current] = zero
+		}
+	}
+	w.bucketStart = w.bucketStart.Add(time.Duration(steps) * width)
+}
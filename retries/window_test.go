@@ -0,0 +1,40 @@
+package retries
+
+import (
+	"testing"
+	"time"
+)
+
+func sum(w *Window[int]) int {
+	n := 0
+	for _, b := range w.Buckets() {
+		n += b
+	}
+	return n
+}
+
+func TestWindowSlides(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	w := NewWindow[int](10*time.Second, clock.Now())
+	*w.Bucket(clock.Now())++
+	clock.Advance(5 * time.Second)
+	*w.Bucket(clock.Now()) += 2
+	if n := sum(w); n != 3 {
+		t.Fatalf("Expected 3 events in the window, got %d", n)
+	}
+	clock.Advance(5 * time.Second)
+	w.Bucket(clock.Now())
+	if n := sum(w); n != 2 {
+		t.Errorf("Expected the first event to slide out of the window, got %d events", n)
+	}
+	clock.Advance(time.Minute)
+	w.Bucket(clock.Now())
+	if n := sum(w); n != 0 {
+		t.Errorf("Expected an empty window after a quiet period, got %d events", n)
+	}
+	*w.Bucket(clock.Now())++
+	w.Reset(clock.Now())
+	if n := sum(w); n != 0 {
+		t.Errorf("Expected an empty window after Reset, got %d events", n)
+	}
+}
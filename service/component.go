@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+type State int32
+
+const (
+	StateIdle State = iota
+	StateStarting
+	StateRunning
+	StateStopping
+	StateStopped
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	case StateFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("state(%d)", int32(s))
+	}
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Component is a part of a service with a lifecycle, e.g. a server, a client connection or a background worker.
+type Component interface {
+	Name() string
+	// Start must not block, long running work has to be moved into a goroutine.
+	// The context is cancelled when the service begins to shut down.
+	Start(ctx context.Context) error
+	// Stop releases the resources of the component, the context carries the deadline for stopping.
+	Stop(ctx context.Context) error
+}
+
+// Watcher is implemented by components that keep running in the background after Start returned
+// and can fail while doing so. A value received from Err triggers the shutdown of the service.
+type Watcher interface {
+	Err() <-chan error
+}
+
+type funcComponent struct {
+	name  string
+	start func(ctx context.Context) error
+	stop  func(ctx context.Context) error
+}
+
+// NewComponent creates a component from a start and a stop function, either of them may be nil
+func NewComponent(name string, start func(ctx context.Context) error, stop func(ctx context.Context) error) Component {
+	return &funcComponent{name: name, start: start, stop: stop}
+}
+
+// NewCloser creates a component for a resource that has been opened before the service runs
+// and only needs to be closed on shutdown, e.g. a database connection pool
+func NewCloser(name string, close func() error) Component {
+	return NewComponent(name, nil, func(ctx context.Context) error {
+		return runWithContext(ctx, close)
+	})
+}
+
+func (fc *funcComponent) Name() string {
+	return fc.name
+}
+
+func (fc *funcComponent) Start(ctx context.Context) error {
+	if fc.start == nil {
+		return nil
+	}
+	return fc.start(ctx)
+}
+
+func (fc *funcComponent) Stop(ctx context.Context) error {
+	if fc.stop == nil {
+		return nil
+	}
+	return fc.stop(ctx)
+}
+
+// runWithContext runs fn and returns early with the context error when the deadline expires before fn returns
+func runWithContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type server struct {
+	name     string
+	addr     string
+	serve    func(net.Listener) error
+	shutdown func(ctx context.Context) error
+	stopping atomic.Bool
+	errs     chan error
+}
+
+// NewServer creates a component for a network server listening on addr.
+// The listener is created synchronously in Start so that e.g. a port which is already in use fails the start up,
+// serve is run in the background until shutdown is called.
+func NewServer(name string, addr string, serve func(net.Listener) error, shutdown func(ctx context.Context) error) Component {
+	return &server{
+		name:     name,
+		addr:     addr,
+		serve:    serve,
+		shutdown: shutdown,
+		errs:     make(chan error, 1),
+	}
+}
+
+// NewHTTPServer creates a component for a net/http server
+func NewHTTPServer(name string, srv *http.Server) Component {
+	return NewServer(name, srv.Addr, srv.Serve, srv.Shutdown)
+}
+
+func (s *server) Name() string {
+	return s.name
+}
+
+func (s *server) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", s.addr, err)
+	}
+	go func() {
+		err := s.serve(ln)
+		if s.stopping.Load() {
+			err = nil
+		} else if err == nil || errors.Is(err, http.ErrServerClosed) {
+			err = fmt.Errorf("%s stopped serving unexpectedly", s.name)
+		}
+		s.errs <- err
+		close(s.errs)
+	}()
+	return nil
+}
+
+func (s *server) Stop(ctx context.Context) error {
+	s.stopping.Store(true)
+	return s.shutdown(ctx)
+}
+
+func (s *server) Err() <-chan error {
+	return s.errs
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"os"
+
+	database "github.com/mactavishz/kuerzen/store/db"
+	"github.com/mactavishz/kuerzen/store/migrations"
+	"go.uber.org/zap"
+)
+
+// NewLogger creates the logger shared by all services.
+// We use sugar logger for better readability in development
+func NewLogger() *zap.SugaredLogger {
+	if os.Getenv("APP_ENV") == "development" || os.Getenv("APP_ENV") == "" {
+		return zap.Must(zap.NewDevelopment()).Sugar()
+	}
+	return zap.Must(zap.NewProduction()).Sugar()
+}
+
+// Getenv returns the value of the environment variable named by key or fallback if it is empty
+func Getenv(key string, fallback string) string {
+	if v := os.Getenv(key); len(v) > 0 {
+		return v
+	}
+	return fallback
+}
+
+// OpenDatabase connects to the URL database and runs all pending migrations
+func OpenDatabase(logger *zap.SugaredLogger) (*database.Database, error) {
+	db := database.NewDatabase(logger)
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	if err := db.MigrateFS(migrations.FS, "."); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
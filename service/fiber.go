@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ansrivas/fiberprometheus/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/mactavishz/kuerzen/middleware/loadshed"
+)
+
+type FiberConfig struct {
+	Name      string
+	BodyLimit int
+	GETOnly   bool
+	LoadShed  loadshed.Config
+}
+
+// DefaultLoadShedConfig sheds load if CPU or memory usage exceeds 90%
+var DefaultLoadShedConfig = loadshed.Config{
+	CPUThreshold: 0.9,
+	MemThreshold: 0.9,
+	Interval:     500 * time.Millisecond,
+}
+
+// NewFiberApp creates a fiber app with prometheus metrics exposed at /metrics, tracing and load shedding enabled.
+// The load shedding stat updater runs until ctx is cancelled.
+func NewFiberApp(ctx context.Context, cfg FiberConfig) (*fiber.App, error) {
+	if cfg.BodyLimit == 0 {
+		cfg.BodyLimit = 1024 * 1024 * 1 // 1MB
+	}
+	if cfg.LoadShed.Interval == 0 {
+		cfg.LoadShed = DefaultLoadShedConfig
+	}
+	app := fiber.New(fiber.Config{
+		AppName:   cfg.Name,
+		BodyLimit: cfg.BodyLimit,
+		GETOnly:   cfg.GETOnly,
+	})
+
+	prometheus := fiberprometheus.New(cfg.Name)
+	prometheus.RegisterAt(app, "/metrics")
+	prometheus.SetSkipPaths([]string{"/health", "/live", "/ready"}) // Optional: Remove some paths from metrics
+	app.Use(prometheus.Middleware)
+	app.Use(tracingMiddleware())
+
+	loadshedMiddleware, err := loadshed.NewLoadSheddingMiddleware(ctx, cfg.LoadShed)
+	if err != nil {
+		return nil, fmt.Errorf("load shedding middleware: %w", err)
+	}
+	app.Use(loadshedMiddleware)
+	return app, nil
+}
+
+// NewFiberServer creates a component that serves the fiber app on addr and drains in-flight requests on stop
+func NewFiberServer(name string, app *fiber.App, addr string) Component {
+	return NewServer(name, addr, app.Listener, app.ShutdownWithContext)
+}
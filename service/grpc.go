@@ -0,0 +1,26 @@
+package service
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// NewGRPCServer creates a component that serves srv on addr.
+// On stop, in-flight RPCs are drained until the deadline expires, after that all connections are closed forcefully.
+func NewGRPCServer(name string, srv *grpc.Server, addr string) Component {
+	return NewServer(name, addr, srv.Serve, func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			srv.Stop()
+			return ctx.Err()
+		}
+	})
+}
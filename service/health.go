@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mactavishz/kuerzen/service/health"
+)
+
+// RegisterHealthRoutes registers the liveness (/live and the legacy /health) and readiness (/ready) endpoints on the fiber app.
+// The service is reported as not ready as soon as its shutdown begins.
+func RegisterHealthRoutes(app *fiber.App, svc *Service, registry *health.Registry) {
+	live := func(c *fiber.Ctx) error {
+		if !svc.Healthy() {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "unhealthy"})
+		}
+		return c.JSON(fiber.Map{"status": "healthy"})
+	}
+	app.Get("/live", live)
+	app.Get("/health", live)
+	app.Get("/ready", func(c *fiber.Ctx) error {
+		report := registry.Check(c.UserContext())
+		return c.Status(report.HTTPStatus()).JSON(report)
+	})
+	svc.OnShutdown(markShuttingDown(registry))
+}
+
+// RegisterHealthHandlers is the net/http counterpart of RegisterHealthRoutes
+func RegisterHealthHandlers(mux *http.ServeMux, svc *Service, registry *health.Registry) {
+	live := health.LiveHandler(svc.Healthy)
+	mux.Handle("/live", live)
+	mux.Handle("/health", live)
+	mux.Handle("/ready", registry.ReadyHandler())
+	svc.OnShutdown(markShuttingDown(registry))
+}
+
+func markShuttingDown(registry *health.Registry) Hook {
+	return func(ctx context.Context) error {
+		registry.SetShuttingDown()
+		return nil
+	}
+}
@@ -0,0 +1,208 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_CHECK_TIMEOUT = 1 * time.Second
+	DEFAULT_CACHE_TTL     = 2 * time.Second
+)
+
+// Overall status of a service
+const (
+	StatusReady       = "ready"       // all dependencies are up
+	StatusDegraded    = "degraded"    // at least one non-critical dependency is down
+	StatusUnavailable = "unavailable" // at least one critical dependency is down or the service is shutting down
+)
+
+// Status of a single dependency
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Checker checks whether a dependency is reachable, a nil error means the dependency is up
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc is an adapter to allow the use of ordinary functions as checkers
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// PingDB returns a checker that pings the database
+func PingDB(db *sql.DB) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	})
+}
+
+type Dependency struct {
+	Name     string
+	Checker  Checker
+	Critical bool          // A critical dependency that is down makes the service unavailable, any other dependency only degrades it
+	Timeout  time.Duration // Deadline for a single check, defaults to DEFAULT_CHECK_TIMEOUT
+	// Breaker reports the state of the circuit breaker in front of the dependency, if any. The state is shown next to
+	// the check but doesn't change the status: the check probes the dependency on its own.
+	Breaker fmt.Stringer
+}
+
+type DependencyReport struct {
+	Status    string    `json:"status"`
+	Critical  bool      `json:"critical"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+	Breaker   string    `json:"breaker,omitempty"`
+}
+
+type Report struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyReport `json:"dependencies"`
+}
+
+type dependency struct {
+	Dependency
+	mu     sync.Mutex
+	report DependencyReport
+}
+
+// Registry holds the dependencies of a service and caches the results of their checks,
+// so that frequent probes from the gateway or the orchestrator don't hammer the dependencies.
+type Registry struct {
+	mu           sync.RWMutex
+	deps         []*dependency
+	ttl          time.Duration
+	shuttingDown atomic.Bool
+}
+
+func NewRegistry(ttl time.Duration) *Registry {
+	if ttl <= 0 {
+		ttl = DEFAULT_CACHE_TTL
+	}
+	return &Registry{ttl: ttl}
+}
+
+func (r *Registry) Register(dep Dependency) {
+	if dep.Timeout <= 0 {
+		dep.Timeout = DEFAULT_CHECK_TIMEOUT
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deps = append(r.deps, &dependency{Dependency: dep})
+}
+
+// SetShuttingDown marks the service as not ready, so that no new traffic is routed to it while it drains
+func (r *Registry) SetShuttingDown() {
+	r.shuttingDown.Store(true)
+}
+
+// Check runs all dependency checks concurrently, results younger than the cache TTL are reused
+func (r *Registry) Check(ctx context.Context) Report {
+	r.mu.RLock()
+	deps := append([]*dependency(nil), r.deps...)
+	r.mu.RUnlock()
+
+	reports := make([]DependencyReport, len(deps))
+	var wg sync.WaitGroup
+	for i, dep := range deps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reports[i] = r.check(ctx, dep)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusReady, Dependencies: make(map[string]DependencyReport, len(deps))}
+	for i, dep := range deps {
+		dr := reports[i]
+		// The state of the breaker is read live, the cached check may be older
+		if dep.Breaker != nil {
+			dr.Breaker = dep.Breaker.String()
+		}
+		report.Dependencies[dep.Name] = dr
+		if dr.Status == StatusUp {
+			continue
+		}
+		if dep.Critical {
+			report.Status = StatusUnavailable
+		} else if report.Status == StatusReady {
+			report.Status = StatusDegraded
+		}
+	}
+	if r.shuttingDown.Load() {
+		report.Status = StatusUnavailable
+	}
+	return report
+}
+
+func (r *Registry) check(ctx context.Context, dep *dependency) DependencyReport {
+	// Holding the lock while checking makes concurrent probes wait for a single check instead of starting their own
+	dep.mu.Lock()
+	defer dep.mu.Unlock()
+	if !dep.report.CheckedAt.IsZero() && time.Since(dep.report.CheckedAt) < r.ttl {
+		return dep.report
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, dep.Timeout)
+	defer cancel()
+	start := time.Now()
+	err := dep.Checker.Check(checkCtx)
+	dr := DependencyReport{
+		Status:    StatusUp,
+		Critical:  dep.Critical,
+		LatencyMS: time.Since(start).Milliseconds(),
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		dr.Status = StatusDown
+		dr.Error = err.Error()
+	}
+	dep.report = dr
+	return dr
+}
+
+// HTTPStatus maps the overall status to the status code of the readiness endpoint
+func (rp Report) HTTPStatus() int {
+	if rp.Status == StatusUnavailable {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// ReadyHandler serves the readiness report as JSON
+func (r *Registry) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		report := r.Check(req.Context())
+		writeJSON(w, report.HTTPStatus(), report)
+	})
+}
+
+// LiveHandler reports whether the process is alive, it does not check any dependency.
+// alive may be nil, e.g. to check whether all components of the service are running.
+func LiveHandler(alive func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if alive != nil && !alive() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unhealthy"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "healthy"})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,116 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckStatus(t *testing.T) {
+	up := CheckerFunc(func(ctx context.Context) error { return nil })
+	down := CheckerFunc(func(ctx context.Context) error { return errors.New("connection refused") })
+
+	registry := NewRegistry(time.Minute)
+	registry.Register(Dependency{Name: "database", Checker: up, Critical: true})
+	report := registry.Check(context.Background())
+	if report.Status != StatusReady {
+		t.Errorf("Expected status %s, got %s", StatusReady, report.Status)
+	}
+
+	registry.Register(Dependency{Name: "analytics", Checker: down})
+	report = registry.Check(context.Background())
+	if report.Status != StatusDegraded {
+		t.Errorf("Expected status %s with a non-critical dependency down, got %s", StatusDegraded, report.Status)
+	}
+	if report.HTTPStatus() != http.StatusOK {
+		t.Errorf("Expected a degraded service to be ready, got %d", report.HTTPStatus())
+	}
+	dr := report.Dependencies["analytics"]
+	if dr.Status != StatusDown || dr.Error != "connection refused" || dr.Critical {
+		t.Errorf("Unexpected report for analytics: %+v", dr)
+	}
+
+	registry.Register(Dependency{Name: "cache", Checker: down, Critical: true})
+	report = registry.Check(context.Background())
+	if report.Status != StatusUnavailable {
+		t.Errorf("Expected status %s with a critical dependency down, got %s", StatusUnavailable, report.Status)
+	}
+	if report.HTTPStatus() != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, report.HTTPStatus())
+	}
+}
+
+type stateStringer struct{ state atomic.Value }
+
+func (s *stateStringer) String() string {
+	return s.state.Load().(string)
+}
+
+func TestCheckReportsBreakerState(t *testing.T) {
+	b := &stateStringer{}
+	b.state.Store("closed")
+	registry := NewRegistry(time.Minute)
+	registry.Register(Dependency{Name: "database", Checker: CheckerFunc(func(ctx context.Context) error { return nil }), Critical: true, Breaker: b})
+	if got := registry.Check(context.Background()).Dependencies["database"].Breaker; got != "closed" {
+		t.Errorf("Expected breaker state closed, got %q", got)
+	}
+
+	// The state is current even though the check is cached
+	b.state.Store("open")
+	report := registry.Check(context.Background())
+	if got := report.Dependencies["database"].Breaker; got != "open" {
+		t.Errorf("Expected breaker state open, got %q", got)
+	}
+	if report.Status != StatusReady {
+		t.Errorf("Expected an open breaker not to change the status, got %s", report.Status)
+	}
+}
+
+func TestCheckCachesResults(t *testing.T) {
+	var calls atomic.Int32
+	registry := NewRegistry(50 * time.Millisecond)
+	registry.Register(Dependency{Name: "database", Critical: true, Checker: CheckerFunc(func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	})})
+
+	for range 5 {
+		registry.Check(context.Background())
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 check within the cache TTL, got %d", calls.Load())
+	}
+	time.Sleep(60 * time.Millisecond)
+	registry.Check(context.Background())
+	if calls.Load() != 2 {
+		t.Errorf("Expected 2 checks after the cache TTL expired, got %d", calls.Load())
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	registry := NewRegistry(time.Minute)
+	registry.Register(Dependency{Name: "database", Critical: true, Timeout: 10 * time.Millisecond, Checker: CheckerFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})})
+	report := registry.Check(context.Background())
+	if report.Dependencies["database"].Status != StatusDown {
+		t.Errorf("Expected a check exceeding its timeout to be down, got %+v", report.Dependencies["database"])
+	}
+}
+
+func TestReadyHandlerWhileShuttingDown(t *testing.T) {
+	registry := NewRegistry(time.Minute)
+	registry.Register(Dependency{Name: "database", Critical: true, Checker: CheckerFunc(func(ctx context.Context) error { return nil })})
+	registry.SetShuttingDown()
+
+	rec := httptest.NewRecorder()
+	registry.ReadyHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d while shutting down, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
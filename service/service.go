@@ -0,0 +1,255 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Exit codes returned by [Service.Run]
+const (
+	ExitOK              = 0 // all components started and were stopped gracefully
+	ExitFailure         = 1 // a component failed to start or failed while running
+	ExitShutdownTimeout = 2 // at least one component did not stop within its deadline
+)
+
+const (
+	DEFAULT_STOP_TIMEOUT     = 10 * time.Second
+	DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+)
+
+type Config struct {
+	Name            string
+	StopTimeout     time.Duration // Deadline for stopping a single component
+	ShutdownTimeout time.Duration // Deadline for stopping all components
+	Signals         []os.Signal   // Signals that trigger a graceful shutdown, defaults to SIGINT and SIGTERM
+}
+
+// Hook is a function that is run at a specific point of the service lifecycle.
+type Hook func(ctx context.Context) error
+
+type entry struct {
+	component Component
+	state     atomic.Int32
+}
+
+// Service owns the lifecycle of the components a binary is made of.
+// Components are started in the order they were added and stopped in reverse order,
+// so that e.g. a HTTP server is drained before the database it depends on is closed.
+type Service struct {
+	cfg        Config
+	logger     *zap.SugaredLogger
+	ctx        context.Context
+	cancel     context.CancelFunc
+	mu         sync.Mutex
+	components []*entry
+	onStart    []Hook
+	onShutdown []Hook
+	onStop     []Hook
+	failures   chan error
+	stopOnce   sync.Once
+	stop       chan struct{}
+}
+
+func New(cfg Config, logger *zap.SugaredLogger) *Service {
+	if cfg.StopTimeout <= 0 {
+		cfg.StopTimeout = DEFAULT_STOP_TIMEOUT
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	if len(cfg.Signals) == 0 {
+		cfg.Signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Service{
+		cfg:      cfg,
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+		failures: make(chan error, 1),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Context returns a context that lives as long as the service, it is cancelled as soon as the shutdown begins.
+// Use it for background routines that are not registered as components.
+func (s *Service) Context() context.Context {
+	return s.ctx
+}
+
+// Add registers a component, components are started in the order they are added.
+func (s *Service) Add(c Component) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.components = append(s.components, &entry{component: c})
+}
+
+// OnStart registers a hook that runs after all components have been started.
+// An error returned from the hook aborts the start up.
+func (s *Service) OnStart(h Hook) {
+	s.onStart = append(s.onStart, h)
+}
+
+// OnShutdown registers a hook that runs when the shutdown begins, before any component is stopped.
+func (s *Service) OnShutdown(h Hook) {
+	s.onShutdown = append(s.onShutdown, h)
+}
+
+// OnStop registers a hook that runs after all components have been stopped.
+func (s *Service) OnStop(h Hook) {
+	s.onStop = append(s.onStop, h)
+}
+
+// Shutdown asks a running service to stop gracefully, it does not wait for the shutdown to complete.
+func (s *Service) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// Status returns the current state of every component keyed by its name
+func (s *Service) Status() map[string]State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := make(map[string]State, len(s.components))
+	for _, e := range s.components {
+		status[e.component.Name()] = State(e.state.Load())
+	}
+	return status
+}
+
+// Healthy reports whether all components are running
+func (s *Service) Healthy() bool {
+	for _, st := range s.Status() {
+		if st != StateRunning {
+			return false
+		}
+	}
+	return true
+}
+
+// Run starts all components, blocks until a shutdown signal is received or a component fails,
+// then stops all components and returns an exit code for the process.
+func (s *Service) Run() int {
+	defer s.logger.Sync()
+	s.mu.Lock()
+	components := append([]*entry(nil), s.components...)
+	s.mu.Unlock()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, s.cfg.Signals...)
+	defer signal.Stop(sigCh)
+
+	code := ExitOK
+	started := 0
+	for _, e := range components {
+		name := e.component.Name()
+		e.state.Store(int32(StateStarting))
+		s.logger.Infof("Starting %s", name)
+		if err := e.component.Start(s.ctx); err != nil {
+			e.state.Store(int32(StateFailed))
+			s.logger.Errorf("Could not start %s: %v", name, err)
+			code = ExitFailure
+			break
+		}
+		e.state.Store(int32(StateRunning))
+		started++
+		if w, ok := e.component.(Watcher); ok {
+			go s.watch(e, w)
+		}
+	}
+
+	if code == ExitOK {
+		if err := s.runHooks(s.ctx, "start", s.onStart); err != nil {
+			code = ExitFailure
+		}
+	}
+
+	if code == ExitOK {
+		s.logger.Infof("%s service is running", s.cfg.Name)
+		select {
+		case sig := <-sigCh:
+			s.logger.Infof("Received %v, gracefully shutting down", sig)
+		case err := <-s.failures:
+			s.logger.Errorf("Shutting down due to component failure: %v", err)
+			code = ExitFailure
+		case <-s.stop:
+			s.logger.Infof("Shutdown requested, gracefully shutting down")
+		}
+	}
+
+	s.cancel()
+	if stopCode := s.shutdown(components[:started]); code == ExitOK {
+		code = stopCode
+	}
+	s.logger.Infof("%s service was shut down (exit code %d)", s.cfg.Name, code)
+	return code
+}
+
+func (s *Service) watch(e *entry, w Watcher) {
+	err, ok := <-w.Err()
+	if !ok || err == nil {
+		return
+	}
+	// Failures that happen while the component is being stopped are expected
+	if !e.state.CompareAndSwap(int32(StateRunning), int32(StateFailed)) {
+		return
+	}
+	select {
+	case s.failures <- err:
+	default:
+	}
+}
+
+// shutdown stops the given components in reverse order, every component gets its own deadline
+// which is bounded by the deadline of the whole shutdown
+func (s *Service) shutdown(components []*entry) int {
+	code := ExitOK
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+
+	_ = s.runHooks(ctx, "shutdown", s.onShutdown)
+	for i := len(components) - 1; i >= 0; i-- {
+		e := components[i]
+		name := e.component.Name()
+		e.state.Store(int32(StateStopping))
+		stopCtx, stopCancel := context.WithTimeout(ctx, s.cfg.StopTimeout)
+		err := e.component.Stop(stopCtx)
+		stopCancel()
+		if err != nil {
+			e.state.Store(int32(StateFailed))
+			if errors.Is(err, context.DeadlineExceeded) {
+				s.logger.Errorf("Stopping %s exceeded its deadline", name)
+				code = ExitShutdownTimeout
+				continue
+			}
+			s.logger.Errorf("Error stopping %s: %v", name, err)
+			if code == ExitOK {
+				code = ExitFailure
+			}
+			continue
+		}
+		e.state.Store(int32(StateStopped))
+		s.logger.Infof("Stopped %s", name)
+	}
+	_ = s.runHooks(ctx, "stop", s.onStop)
+	return code
+}
+
+func (s *Service) runHooks(ctx context.Context, stage string, hooks []Hook) error {
+	for _, h := range hooks {
+		if err := h(ctx); err != nil {
+			s.logger.Errorf("Error running %s hook: %v", stage, err)
+			return err
+		}
+	}
+	return nil
+}
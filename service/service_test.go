@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(evt string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, evt)
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *recorder) component(name string, startErr error) Component {
+	return NewComponent(name, func(ctx context.Context) error {
+		r.add("start " + name)
+		return startErr
+	}, func(ctx context.Context) error {
+		r.add("stop " + name)
+		return nil
+	})
+}
+
+type failingComponent struct {
+	Component
+	errs chan error
+}
+
+func (fc *failingComponent) Err() <-chan error {
+	return fc.errs
+}
+
+func newTestService() *Service {
+	return New(Config{Name: "test", StopTimeout: 100 * time.Millisecond}, zap.NewNop().Sugar())
+}
+
+func TestRunStartsInOrderAndStopsInReverse(t *testing.T) {
+	rec := &recorder{}
+	svc := newTestService()
+	svc.Add(rec.component("db", nil))
+	svc.Add(rec.component("client", nil))
+	svc.Add(rec.component("server", nil))
+	svc.OnStart(func(ctx context.Context) error {
+		rec.add("started")
+		svc.Shutdown()
+		return nil
+	})
+	svc.OnShutdown(func(ctx context.Context) error {
+		rec.add("shutdown")
+		return nil
+	})
+	svc.OnStop(func(ctx context.Context) error {
+		rec.add("stopped")
+		return nil
+	})
+
+	if code := svc.Run(); code != ExitOK {
+		t.Errorf("Expected exit code %d, got %d", ExitOK, code)
+	}
+	expected := []string{"start db", "start client", "start server", "started", "shutdown", "stop server", "stop client", "stop db", "stopped"}
+	if got := rec.get(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected lifecycle %v, got %v", expected, got)
+	}
+	if svc.Context().Err() == nil {
+		t.Error("Expected service context to be cancelled after Run")
+	}
+	for name, st := range svc.Status() {
+		if st != StateStopped {
+			t.Errorf("Expected %s to be stopped, got %s", name, st)
+		}
+	}
+}
+
+func TestRunStopsStartedComponentsOnStartFailure(t *testing.T) {
+	rec := &recorder{}
+	svc := newTestService()
+	svc.Add(rec.component("db", nil))
+	svc.Add(rec.component("client", errors.New("boom")))
+	svc.Add(rec.component("server", nil))
+
+	if code := svc.Run(); code != ExitFailure {
+		t.Errorf("Expected exit code %d, got %d", ExitFailure, code)
+	}
+	expected := []string{"start db", "start client", "stop db"}
+	if got := rec.get(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected lifecycle %v, got %v", expected, got)
+	}
+	if svc.Healthy() {
+		t.Error("Expected service to be unhealthy after start failure")
+	}
+}
+
+func TestRunShutsDownOnComponentFailure(t *testing.T) {
+	rec := &recorder{}
+	svc := newTestService()
+	fc := &failingComponent{Component: rec.component("server", nil), errs: make(chan error, 1)}
+	svc.Add(rec.component("db", nil))
+	svc.Add(fc)
+	svc.OnStart(func(ctx context.Context) error {
+		fc.errs <- errors.New("connection reset")
+		return nil
+	})
+
+	if code := svc.Run(); code != ExitFailure {
+		t.Errorf("Expected exit code %d, got %d", ExitFailure, code)
+	}
+	expected := []string{"start db", "start server", "stop server", "stop db"}
+	if got := rec.get(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected lifecycle %v, got %v", expected, got)
+	}
+}
+
+func TestRunReportsStopDeadline(t *testing.T) {
+	rec := &recorder{}
+	svc := newTestService()
+	svc.Add(rec.component("db", nil))
+	svc.Add(NewComponent("worker", nil, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	svc.OnStart(func(ctx context.Context) error {
+		svc.Shutdown()
+		return nil
+	})
+
+	if code := svc.Run(); code != ExitShutdownTimeout {
+		t.Errorf("Expected exit code %d, got %d", ExitShutdownTimeout, code)
+	}
+	// The remaining components are still stopped after a deadline was exceeded
+	expected := []string{"start db", "stop db"}
+	if got := rec.get(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected lifecycle %v, got %v", expected, got)
+	}
+	if st := svc.Status()["worker"]; st != StateFailed {
+		t.Errorf("Expected worker to be failed, got %s", st)
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Exporters of TRACING_EXPORTER
+const (
+	TRACING_NONE   = "none"
+	TRACING_OTLP   = "otlp"
+	TRACING_STDOUT = "stdout"
+)
+
+// SetupTracing installs the tracer provider of TRACING_EXPORTER and the W3C trace context propagator as the globals of
+// OpenTelemetry. The OTLP exporter sends to OTEL_EXPORTER_OTLP_ENDPOINT over gRPC and takes the other standard
+// OTEL_EXPORTER_OTLP_* variables, TRACING_SAMPLE_RATIO samples a share of the traces that don't have a sampled parent.
+// Trace context is propagated even if no exporter is set. The returned component flushes the spans on stop, it
+// should be added first so that it is stopped last.
+func SetupTracing(name string, logger *zap.SugaredLogger) (Component, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warnf("OpenTelemetry: %v", err)
+	}))
+	ratio, err := strconv.ParseFloat(Getenv("TRACING_SAMPLE_RATIO", "1"), 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return nil, errors.New("TRACING_SAMPLE_RATIO must be a number between 0 and 1")
+	}
+	var exporter sdktrace.SpanExporter
+	switch kind := Getenv("TRACING_EXPORTER", TRACING_NONE); kind {
+	case TRACING_NONE:
+		return NewComponent("tracing", nil, nil), nil
+	case TRACING_OTLP:
+		// The connection is made lazily, the service starts while the collector is down
+		exporter, err = otlptracegrpc.New(context.Background())
+	case TRACING_STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown TRACING_EXPORTER %q", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create trace exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", name)))
+	if err != nil {
+		return nil, fmt.Errorf("create trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Infof("Exporting traces to %s", Getenv("TRACING_EXPORTER", TRACING_NONE))
+	return NewComponent("tracing", nil, provider.Shutdown), nil
+}
+
+// TraceLogger adds the trace and span id of the span in ctx to the log lines of the logger
+func TraceLogger(ctx context.Context, logger *zap.SugaredLogger) *zap.SugaredLogger {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return logger
+	}
+	return logger.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+}
+
+// untracedPaths are the probes and the metrics scraped every few seconds
+var untracedPaths = []string{"/metrics", "/health", "/live", "/ready"}
+
+// fiberCarrier reads and writes the trace context in the headers of a fiber request
+type fiberCarrier struct {
+	c *fiber.Ctx
+}
+
+func (fc fiberCarrier) Get(key string) string {
+	return fc.c.Get(key)
+}
+
+func (fc fiberCarrier) Set(key string, value string) {
+	fc.c.Request().Header.Set(key, value)
+}
+
+func (fc fiberCarrier) Keys() []string {
+	var keys []string
+	for k := range fc.c.GetReqHeaders() {
+		keys = append(keys, strings.ToLower(k))
+	}
+	return keys
+}
+
+// tracingMiddleware starts a server span for every request, continuing the trace of the caller.
+// Handlers find the span in c.UserContext().
+func tracingMiddleware() fiber.Handler {
+	tracer := otel.Tracer("github.com/mactavishz/kuerzen/service")
+	return func(c *fiber.Ctx) error {
+		for _, p := range untracedPaths {
+			if c.Path() == p {
+				return c.Next()
+			}
+		}
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), fiberCarrier{c})
+		ctx, span := tracer.Start(ctx, c.Method(), trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", c.Method()),
+			attribute.String("url.path", c.Path()),
+		))
+		defer span.End()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		if route := c.Route().Path; route != "" {
+			span.SetName(c.Method() + " " + route)
+			span.SetAttributes(attribute.String("http.route", route))
+		}
+		status := c.Response().StatusCode()
+		if err != nil {
+			// The error handler sets the status after the middlewares returned
+			status = fiber.StatusInternalServerError
+			var fe *fiber.Error
+			if errors.As(err, &fe) {
+				status = fe.Code
+			}
+			span.RecordError(err)
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, fmt.Sprintf("status %d", status))
+		}
+		return err
+	}
+}
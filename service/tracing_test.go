@@ -0,0 +1,69 @@
+package service
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	core, logs := observer.New(zap.InfoLevel)
+
+	app := fiber.New()
+	app.Use(tracingMiddleware())
+	app.Get("/api/v1/url/:shortURL", func(c *fiber.Ctx) error {
+		TraceLogger(c.UserContext(), zap.New(core).Sugar()).Info("redirect")
+		return c.SendStatus(fiber.StatusTemporaryRedirect)
+	})
+	app.Get("/fail", func(c *fiber.Ctx) error {
+		return fiber.ErrBadGateway
+	})
+	app.Get("/ready", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/api/v1/url/abc", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, err := app.Test(req); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if _, err := app.Test(httptest.NewRequest("GET", "/fail", nil)); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if _, err := app.Test(httptest.NewRequest("GET", "/ready", nil)); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans without the probe, got %d", len(spans))
+	}
+	redirect := spans[0]
+	if redirect.Name() != "GET /api/v1/url/:shortURL" || redirect.SpanKind() != trace.SpanKindServer {
+		t.Errorf("Unexpected span %s of kind %s", redirect.Name(), redirect.SpanKind())
+	}
+	if got := redirect.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the trace of the caller to be continued, got %s", got)
+	}
+	if got := redirect.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("Expected the span of the caller as parent, got %s", got)
+	}
+	if fail := spans[1]; fail.Status().Code.String() != "Error" {
+		t.Errorf("Expected the failed request to be an error, got %v", fail.Status())
+	}
+	fields := logs.All()[0].ContextMap()
+	if fields["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || fields["span_id"] != redirect.SpanContext().SpanID().String() {
+		t.Errorf("Expected the trace and span id in the log line, got %v", fields)
+	}
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mactavishz/kuerzen/analytics/grpc"
+	"github.com/mactavishz/kuerzen/analytics/live"
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+	store "github.com/mactavishz/kuerzen/store/url"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	MAX_EVENTS_SHORT_IDS = 100
+	// Comments are sent while no events arrive, to keep proxies from closing the connection and to notice gone clients
+	EVENTS_KEEPALIVE_INTERVAL = 15 * time.Second
+)
+
+// LiveEventResponse is the data of a server-sent event, it leaves out the client details of the analytics event
+type LiveEventResponse struct {
+	Type         string    `json:"type"` // creation or redirect
+	ShortID      string    `json:"short_id"`
+	URL          string    `json:"url"`
+	Success      bool      `json:"success"`
+	Time         time.Time `json:"time"`
+	ReferrerHost string    `json:"referrer_host,omitempty"`
+	Browser      string    `json:"browser,omitempty"`
+	OS           string    `json:"os,omitempty"`
+	Device       string    `json:"device,omitempty"`
+	BotClass     string    `json:"bot_class,omitempty"` // human, bot or suspected_bot
+}
+
+type EventsHandler struct {
+	ctx       context.Context // ends the streams when the service shuts down
+	urlStore  store.URLStore
+	analytics *grpc.AnalyticsGRPCClient
+	logger    *zap.SugaredLogger
+}
+
+func NewEventsHandler(ctx context.Context, urlStore store.URLStore, analytics *grpc.AnalyticsGRPCClient, logger *zap.SugaredLogger) *EventsHandler {
+	return &EventsHandler{
+		ctx:       ctx,
+		urlStore:  urlStore,
+		analytics: analytics,
+		logger:    logger,
+	}
+}
+
+// HandleEvents streams the events of short URLs as server-sent events.
+// The query parameter short_id takes a comma separated list of short IDs, owner selects the URLs of an owner
+// including the ones created during the stream, and type (creation or redirect) restricts the kind of events.
+// Without short_id and owner the events of all URLs are streamed. Events the analytics service drops because
+// the client is too slow are announced by a dropped event with their number.
+func (h *EventsHandler) HandleEvents(c *fiber.Ctx) error {
+	filter := live.Filter{Owner: c.Query("owner")}
+	if ids := c.Query("short_id"); ids != "" {
+		filter.ShortURLs = strings.Split(ids, ",")
+	}
+	if len(filter.ShortURLs) > MAX_EVENTS_SHORT_IDS {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": fmt.Sprintf("at most %d short IDs are allowed", MAX_EVENTS_SHORT_IDS)})
+	}
+	switch c.Query("type") {
+	case "":
+	case "creation":
+		filter.Creations = true
+	case "redirect":
+		filter.Redirects = true
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": "invalid type"})
+	}
+	// The analytics service only learns the owner of URLs created from now on
+	if filter.Owner != "" {
+		shortURLs, err := h.urlStore.ListShortURLs(c.UserContext(), filter.Owner)
+		if errors.Is(err, store.ErrUnavailable) {
+			h.logger.Warnf("failed to list short URLs: %v\n", err)
+			return storeUnavailable(c, err)
+		}
+		if err != nil {
+			h.logger.Errorf("failed to list short URLs: %v\n", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"msg": "failed to list short URLs"})
+		}
+		filter.ShortURLs = append(filter.ShortURLs, shortURLs...)
+	}
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	sub, err := h.analytics.SubscribeEvents(ctx, filter)
+	if err != nil {
+		cancel()
+		h.logger.Errorf("failed to subscribe to events: %v\n", err)
+		if status.Code(err) == codes.ResourceExhausted {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"msg": "too many subscribers"})
+		}
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"msg": "analytics service unavailable"})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	// Disables the response buffering of nginx
+	c.Set("X-Accel-Buffering", "no")
+	// The writer runs after the handler returned, it must not use c
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		h.stream(ctx, w, sub)
+	})
+	return nil
+}
+
+type liveMessage struct {
+	event   astore.Event
+	dropped int64
+}
+
+func (h *EventsHandler) stream(ctx context.Context, w *bufio.Writer, sub *grpc.EventSubscription) {
+	msgs := make(chan liveMessage)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			event, dropped, err := sub.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case msgs <- liveMessage{event, dropped}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(EVENTS_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	// Tells the client that the stream is open before the first event arrives
+	if err := writeComment(w, "subscribed"); err != nil {
+		return
+	}
+	for {
+		var err error
+		select {
+		case msg := <-msgs:
+			if msg.dropped > 0 {
+				err = writeEvent(w, "dropped", "", fiber.Map{"dropped": msg.dropped})
+			}
+			if err == nil {
+				err = writeLiveEvent(w, msg.event)
+			}
+		case <-keepalive.C:
+			err = writeComment(w, "keepalive")
+		case err := <-recvErr:
+			if status.Code(err) == codes.ResourceExhausted {
+				// The client fell behind for too long, it may reconnect
+				writeEvent(w, "error", "", fiber.Map{"msg": "too slow, events were dropped"})
+			} else if !errors.Is(err, context.Canceled) && status.Code(err) != codes.Canceled {
+				h.logger.Errorf("event subscription failed: %v\n", err)
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			// The client is gone
+			return
+		}
+	}
+}
+
+func writeLiveEvent(w *bufio.Writer, event astore.Event) error {
+	switch e := event.(type) {
+	case *astore.URLCreationEvent:
+		return writeEvent(w, "creation", e.EventID, LiveEventResponse{
+			Type:    "creation",
+			ShortID: e.ShortURL,
+			URL:     e.URL,
+			Success: e.Success,
+			Time:    e.Timestamp,
+		})
+	case *astore.URLRedirectEvent:
+		return writeEvent(w, "redirect", e.EventID, LiveEventResponse{
+			Type:         "redirect",
+			ShortID:      e.ShortURL,
+			URL:          e.LongURL,
+			Success:      e.Success,
+			Time:         e.Timestamp,
+			ReferrerHost: e.ReferrerHost,
+			Browser:      e.Browser,
+			OS:           e.OS,
+			Device:       e.Device,
+			BotClass:     e.BotClass,
+		})
+	default:
+		return nil
+	}
+}
+
+// writeEvent writes a server-sent event and flushes it to the client
+func writeEvent(w *bufio.Writer, name string, id string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "event: %s\n", name)
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", payload)
+	return w.Flush()
+}
+
+func writeComment(w *bufio.Writer, comment string) error {
+	fmt.Fprintf(w, ": %s\n\n", comment)
+	return w.Flush()
+}
@@ -1,19 +1,22 @@
 package api
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
-	"github.com/mactavishz/kuerzen/retries"
-
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/mactavishz/kuerzen/analytics/grpc"
+	"github.com/mactavishz/kuerzen/breaker"
+	"github.com/mactavishz/kuerzen/service"
 	"github.com/mactavishz/kuerzen/shortener/lib"
+	"github.com/mactavishz/kuerzen/shortener/relay"
+	"github.com/mactavishz/kuerzen/shortener/webhooks"
 	astore "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/mactavishz/kuerzen/store/outbox"
 	store "github.com/mactavishz/kuerzen/store/url"
 	"go.uber.org/zap"
 )
@@ -21,7 +24,8 @@ import (
 const SHORT_URL_LENGTH = 8
 
 type ShortenURLRequest struct {
-	URL string `json:"url" validate:"required,http_url,max=1024"`
+	URL   string `json:"url" validate:"required,http_url,max=1024"`
+	Owner string `json:"owner" validate:"max=64"` // Optional, groups the URLs of a client for subscribing to their events
 }
 
 type ShortenURLResponse struct {
@@ -31,19 +35,20 @@ type ShortenURLResponse struct {
 
 type ShortenHandler struct {
 	urlStore store.URLStore
-	client   *grpc.AnalyticsGRPCClient
+	events   *grpc.AnalyticsEventPublisher
 	logger   *zap.SugaredLogger
 }
 
-func NewShortenHandler(urlStore store.URLStore, client *grpc.AnalyticsGRPCClient, logger *zap.SugaredLogger) *ShortenHandler {
+func NewShortenHandler(urlStore store.URLStore, events *grpc.AnalyticsEventPublisher, logger *zap.SugaredLogger) *ShortenHandler {
 	return &ShortenHandler{
 		urlStore: urlStore,
-		client:   client,
+		events:   events,
 		logger:   logger,
 	}
 }
 
 func (h *ShortenHandler) HandleShortenURL(c *fiber.Ctx) error {
+	logger := service.TraceLogger(c.UserContext(), h.logger)
 	req := new(ShortenURLRequest)
 	evt := &astore.URLCreationEvent{
 		ServiceName: "shortener",
@@ -53,55 +58,75 @@ func (h *ShortenHandler) HandleShortenURL(c *fiber.Ctx) error {
 	}
 	err := c.BodyParser(req)
 	if err != nil {
-		h.logger.Infow("invalid request payload", "payload", string(c.Body()))
-		err = retries.Retry(h.client.SendURLCreationEvent(context.TODO(), evt)).Err
-		if err != nil {
-			h.logger.Errorf("failed to send event: %v\n", err)
-		}
+		logger.Infow("invalid request payload", "payload", string(c.Body()))
+		h.events.PublishURLCreationEvent(evt)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"msg": "invalid request payload",
 		})
 	}
 	evt.URL = req.URL
+	evt.Owner = req.Owner
 	validate := validator.New(validator.WithRequiredStructEnabled())
 	err = validate.Struct(req)
 	if err != nil {
-		h.logger.Infow("invalid url", "url", req.URL)
-		err = retries.Retry(h.client.SendURLCreationEvent(context.TODO(), evt)).Err
-		if err != nil {
-			h.logger.Errorf("failed to send event: %v\n", err)
-		}
+		logger.Infow("invalid url", "url", req.URL)
+		h.events.PublishURLCreationEvent(evt)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"msg": "invalid url",
 		})
 	}
 	shortURL := lib.ToShortURL(req.URL, SHORT_URL_LENGTH)
-	err = retries.Retry(h.urlStore.CreateShortURL(shortURL, req.URL, c.Context())).Err
+	// The event of a created short URL is written to the outbox with the URL, the relay delivers it once committed
+	created := *evt
+	created.Success = true
+	created.ShortURL = shortURL
+	msg, err := relay.URLCreationMessage(&created)
 	if err != nil {
-		evtErr := retries.Retry(h.client.SendURLCreationEvent(context.TODO(), evt)).Err
-		if evtErr != nil {
-			h.logger.Errorf("failed to send event: %v\n", evtErr)
+		logger.Errorf("failed to create short URL: %v\n", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"msg": "failed to create short URL",
+		})
+	}
+	messages := []outbox.Message{msg}
+	if req.Owner != "" {
+		// The webhooks of the owner are notified through the outbox as well
+		linkMsg, err := webhooks.LinkEventMessage(webhooks.LinkEvent{Type: webhooks.EVENT_LINK_CREATED, ShortID: shortURL, URL: req.URL, Owner: req.Owner, Time: created.Timestamp})
+		if err != nil {
+			logger.Errorf("failed to create short URL: %v\n", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"msg": "failed to create short URL",
+			})
 		}
+		messages = append(messages, linkMsg)
+	}
+	err = h.urlStore.CreateShortURL(c.UserContext(), shortURL, req.URL, req.Owner, messages...)
+	if err != nil {
+		h.events.PublishURLCreationEvent(evt)
 		if errors.Is(err, store.ErrDuplicateLongURL) {
-			h.logger.Infow("long URL already exists", "url", req.URL)
+			logger.Infow("long URL already exists", "url", req.URL)
 			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
 				"msg": "long URL already exists",
 			})
+		} else if errors.Is(err, store.ErrUnavailable) {
+			logger.Warnf("failed to create short URL: %v\n", err)
+			return storeUnavailable(c, err)
 		} else {
-			h.logger.Errorf("failed to create short URL: %v\n", err)
+			logger.Errorf("failed to create short URL: %v\n", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"msg": "failed to create short URL",
 			})
 		}
 	}
-	evt.Success = true
-	err = retries.Retry(h.client.SendURLCreationEvent(context.TODO(), evt)).Err
-	if err != nil {
-		h.logger.Errorf("failed to send event: %v\n", err)
-	}
-	h.logger.Infow("short URL created", "shortURL", shortURL, "longURL", req.URL)
+	logger.Infow("short URL created", "shortURL", shortURL, "longURL", req.URL)
 	return c.JSON(ShortenURLResponse{
 		URL:     fmt.Sprintf("%s/%s", os.Getenv("KUERZEN_HOST"), shortURL),
 		ShortID: shortURL,
 	})
 }
+
+// storeUnavailable answers a call the URL store didn't make because the database is down, the client may try again
+// once the breaker lets calls through
+func storeUnavailable(c *fiber.Ctx, err error) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(breaker.RetryAfterSeconds(err)))
+	return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"msg": "the database is currently unavailable"})
+}
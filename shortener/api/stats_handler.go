@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mactavishz/kuerzen/analytics/grpc"
+	"github.com/mactavishz/kuerzen/breaker"
+	"github.com/mactavishz/kuerzen/retries"
+	store "github.com/mactavishz/kuerzen/store/url"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DEFAULT_STATS_INTERVAL = 1 * time.Hour
+	DEFAULT_STATS_RANGE    = 7 * 24 * time.Hour
+	DEFAULT_STATS_LIMIT    = 10
+)
+
+type ClickCountResponse struct {
+	Time   time.Time `json:"time"`
+	Clicks int64     `json:"clicks"`
+}
+
+type ReferrerResponse struct {
+	Host   string `json:"host"`
+	Clicks int64  `json:"clicks"`
+}
+
+type DailyVisitorsResponse struct {
+	Day      time.Time `json:"day"`
+	Visitors int64     `json:"visitors"`
+}
+
+type LinkStatsResponse struct {
+	ShortID        string                  `json:"short_id"`
+	Clicks         int64                   `json:"clicks"`
+	UniqueVisitors int64                   `json:"unique_visitors"` // estimated, counted over all time like the clicks
+	DailyVisitors  []DailyVisitorsResponse `json:"daily_visitors"`  // estimated visitors of the days in range
+	FirstClick     *time.Time              `json:"first_click"`
+	LastClick      *time.Time              `json:"last_click"`
+	Interval       string                  `json:"interval"`
+	Series         []ClickCountResponse    `json:"series"`
+	TopReferrers   []ReferrerResponse      `json:"top_referrers"`
+}
+
+type StatsHandler struct {
+	urlStore  store.URLStore
+	analytics *grpc.AnalyticsGRPCClient
+	logger    *zap.SugaredLogger
+}
+
+func NewStatsHandler(urlStore store.URLStore, analytics *grpc.AnalyticsGRPCClient, logger *zap.SugaredLogger) *StatsHandler {
+	return &StatsHandler{
+		urlStore:  urlStore,
+		analytics: analytics,
+		logger:    logger,
+	}
+}
+
+// HandleLinkStats serves the click statistics of a short URL.
+// The optional query parameters interval and range (Go durations, e.g. 1h or 168h) control the click series,
+// limit controls the number of top referrers. The total number of clicks and the unique visitors are counted over all time,
+// the daily visitors are listed for the days in range.
+func (h *StatsHandler) HandleLinkStats(c *fiber.Ctx) error {
+	shortURL := c.Params("id")
+	interval, err := durationQuery(c, "interval", DEFAULT_STATS_INTERVAL)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": "invalid interval"})
+	}
+	since, err := durationQuery(c, "range", DEFAULT_STATS_RANGE)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": "invalid range"})
+	}
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(DEFAULT_STATS_LIMIT)))
+	if err != nil || limit <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": "invalid limit"})
+	}
+
+	_, err = h.urlStore.GetLongURL(c.UserContext(), shortURL)
+	if err != nil {
+		if errors.Is(err, store.ErrShortURLNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"msg": "short URL not found"})
+		}
+		if errors.Is(err, store.ErrUnavailable) {
+			h.logger.Warnf("failed to get long URL: %v\n", err)
+			return storeUnavailable(c, err)
+		}
+		h.logger.Errorf("failed to get long URL: %v\n", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"msg": "failed to get short URL"})
+	}
+
+	stats, visitors, err := h.analytics.GetLinkStats(c.UserContext(), shortURL, 0)
+	if err != nil {
+		return h.analyticsFailed(c, err)
+	}
+	series, err := h.analytics.GetClickSeries(c.UserContext(), shortURL, interval, since)
+	if err != nil {
+		return h.analyticsFailed(c, err)
+	}
+	referrers, err := h.analytics.TopReferrers(c.UserContext(), shortURL, since, limit)
+	if err != nil {
+		return h.analyticsFailed(c, err)
+	}
+
+	res := LinkStatsResponse{
+		ShortID:        shortURL,
+		Clicks:         stats.Clicks,
+		UniqueVisitors: visitors.Visitors,
+		DailyVisitors:  []DailyVisitorsResponse{},
+		Interval:       interval.String(),
+		Series:         make([]ClickCountResponse, len(series)),
+		TopReferrers:   make([]ReferrerResponse, len(referrers)),
+	}
+	if stats.Clicks > 0 {
+		res.FirstClick = &stats.FirstClick
+		res.LastClick = &stats.LastClick
+	}
+	from := time.Now().Add(-since)
+	for _, d := range visitors.Daily {
+		if d.Day.Add(24 * time.Hour).After(from) {
+			res.DailyVisitors = append(res.DailyVisitors, DailyVisitorsResponse{Day: d.Day, Visitors: d.Visitors})
+		}
+	}
+	for i, cc := range series {
+		res.Series[i] = ClickCountResponse{Time: cc.Time, Clicks: cc.Clicks}
+	}
+	for i, r := range referrers {
+		res.TopReferrers[i] = ReferrerResponse{Host: r.Key, Clicks: r.Clicks}
+	}
+	return c.JSON(res)
+}
+
+// analyticsFailed answers a failed analytics query with the status of its error, see analyticsStatus
+func (h *StatsHandler) analyticsFailed(c *fiber.Ctx, err error) error {
+	code, msg := analyticsStatus(err)
+	h.logger.Errorf("failed to query analytics: %v\n", err)
+	if _, ok := breaker.RetryAfter(err); ok {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(breaker.RetryAfterSeconds(err)))
+	}
+	return c.Status(code).JSON(fiber.Map{"msg": msg})
+}
+
+// analyticsStatus maps an error of the analytics client to a response. Queries the analytics service rejected are the
+// client's fault, only an unreachable or overloaded service makes the analytics unavailable.
+func analyticsStatus(err error) (int, string) {
+	if errors.Is(err, breaker.ErrOpen) || errors.Is(err, retries.ErrBudgetExhausted) || errors.Is(err, context.DeadlineExceeded) {
+		return fiber.StatusServiceUnavailable, "analytics are currently unavailable"
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		// The analytics service explains what is wrong with the query, e.g. a series with too many points
+		return fiber.StatusBadRequest, status.Convert(err).Message()
+	case codes.NotFound:
+		return fiber.StatusNotFound, "short URL not found"
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return fiber.StatusServiceUnavailable, "analytics are currently unavailable"
+	case codes.ResourceExhausted:
+		return fiber.StatusTooManyRequests, "too many analytics queries"
+	default:
+		return fiber.StatusInternalServerError, "failed to query analytics"
+	}
+}
+
+func durationQuery(c *fiber.Ctx, key string, fallback time.Duration) (time.Duration, error) {
+	v := c.Query(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, errors.New("duration must be at least one second")
+	}
+	return d, nil
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mactavishz/kuerzen/breaker"
+	"github.com/mactavishz/kuerzen/retries"
+	store "github.com/mactavishz/kuerzen/store/url"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAnalyticsStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{status.Error(codes.InvalidArgument, "range too long"), fiber.StatusBadRequest},
+		{status.Error(codes.NotFound, "unknown short URL"), fiber.StatusNotFound},
+		{status.Error(codes.Unavailable, "connection refused"), fiber.StatusServiceUnavailable},
+		{fmt.Errorf("%w: %w", retries.ErrBudgetExhausted, status.Error(codes.DeadlineExceeded, "timeout")), fiber.StatusServiceUnavailable},
+		{status.Error(codes.ResourceExhausted, "overloaded"), fiber.StatusTooManyRequests},
+		{breaker.ErrOpen, fiber.StatusServiceUnavailable},
+		{context.DeadlineExceeded, fiber.StatusServiceUnavailable},
+		{status.Error(codes.PermissionDenied, "not allowed"), fiber.StatusInternalServerError},
+	} {
+		if got, _ := analyticsStatus(tc.err); got != tc.want {
+			t.Errorf("Expected %d for %v, got %d", tc.want, tc.err, got)
+		}
+	}
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	err := fmt.Errorf("%w: %w", store.ErrUnavailable, &breaker.OpenError{Name: "postgres", RetryAfter: 1500 * time.Millisecond})
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		return storeUnavailable(c, err)
+	})
+	res, err := app.Test(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if res.StatusCode != fiber.StatusServiceUnavailable || res.Header.Get(fiber.HeaderRetryAfter) != "2" {
+		t.Errorf("Expected 503 with Retry-After 2, got %d with %q", res.StatusCode, res.Header.Get(fiber.HeaderRetryAfter))
+	}
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/mactavishz/kuerzen/shortener/webhooks"
+	wstore "github.com/mactavishz/kuerzen/store/webhooks"
+	"go.uber.org/zap"
+)
+
+const (
+	MAX_WEBHOOK_ENDPOINTS      = 10 // per owner
+	DEFAULT_DELIVERY_LOG_LIMIT = 50
+	MAX_DELIVERY_LOG_LIMIT     = 500
+)
+
+type CreateWebhookRequest struct {
+	Owner           string   `json:"owner" validate:"required,max=64"`
+	URL             string   `json:"url" validate:"required,http_url,max=1024"`
+	Events          []string `json:"events" validate:"required,min=1,max=4,unique"`
+	ClicksThreshold int64    `json:"clicks_threshold" validate:"min=0"` // required for link.clicks_threshold
+}
+
+type WebhookResponse struct {
+	ID              int64     `json:"id"`
+	Owner           string    `json:"owner"`
+	URL             string    `json:"url"`
+	Events          []string  `json:"events"`
+	ClicksThreshold int64     `json:"clicks_threshold,omitempty"`
+	Secret          string    `json:"secret,omitempty"` // only returned on creation
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type WebhookDeliveryResponse struct {
+	ID             int64           `json:"id"`
+	EventID        string          `json:"event_id"`
+	Event          string          `json:"event"`
+	Status         string          `json:"status"` // pending, delivered or failed
+	Attempts       int             `json:"attempts"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	FinishedAt     *time.Time      `json:"finished_at,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+type WebhooksHandler struct {
+	store  *wstore.PostgresStore
+	logger *zap.SugaredLogger
+}
+
+func NewWebhooksHandler(store *wstore.PostgresStore, logger *zap.SugaredLogger) *WebhooksHandler {
+	return &WebhooksHandler{
+		store:  store,
+		logger: logger,
+	}
+}
+
+func webhookResponse(e wstore.Endpoint) WebhookResponse {
+	return WebhookResponse{
+		ID:              e.ID,
+		Owner:           e.Owner,
+		URL:             e.URL,
+		Events:          e.Events,
+		ClicksThreshold: e.ClicksThreshold,
+		CreatedAt:       e.CreatedAt,
+	}
+}
+
+// HandleCreateWebhook registers an endpoint of an owner and returns it with the secret that signs its payloads
+func (h *WebhooksHandler) HandleCreateWebhook(c *fiber.Ctx) error {
+	req := new(CreateWebhookRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": "invalid request payload"})
+	}
+	validate := validator.New(validator.WithRequiredStructEnabled())
+	if err := validate.Struct(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": "invalid webhook"})
+	}
+	endpoint := wstore.Endpoint{Owner: req.Owner, URL: req.URL, Events: req.Events}
+	for _, e := range req.Events {
+		if !webhooks.ValidEvent(e) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": fmt.Sprintf("unknown event %q", e)})
+		}
+	}
+	if endpoint.Subscribes(webhooks.EVENT_LINK_CLICKS_THRESHOLD) {
+		if req.ClicksThreshold <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": "clicks_threshold is required for link.clicks_threshold"})
+		}
+		endpoint.ClicksThreshold = req.ClicksThreshold
+	}
+
+	existing, err := h.store.ListEndpoints(c.UserContext(), req.Owner)
+	if err != nil {
+		return h.failed(c, err)
+	}
+	if len(existing) >= MAX_WEBHOOK_ENDPOINTS {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"msg": fmt.Sprintf("at most %d webhooks are allowed per owner", MAX_WEBHOOK_ENDPOINTS)})
+	}
+	if endpoint.Secret, err = webhooks.NewSecret(); err != nil {
+		return h.failed(c, err)
+	}
+	if err := h.store.CreateEndpoint(c.UserContext(), &endpoint); err != nil {
+		return h.failed(c, err)
+	}
+	h.logger.Infow("webhook created", "id", endpoint.ID, "owner", endpoint.Owner, "url", endpoint.URL)
+	res := webhookResponse(endpoint)
+	res.Secret = endpoint.Secret
+	return c.Status(fiber.StatusCreated).JSON(res)
+}
+
+// HandleListWebhooks lists the endpoints of the owner given by the query parameter owner, without their secrets
+func (h *WebhooksHandler) HandleListWebhooks(c *fiber.Ctx) error {
+	owner := c.Query("owner")
+	if owner == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": "owner is required"})
+	}
+	endpoints, err := h.store.ListEndpoints(c.UserContext(), owner)
+	if err != nil {
+		return h.failed(c, err)
+	}
+	res := make([]WebhookResponse, len(endpoints))
+	for i, e := range endpoints {
+		res[i] = webhookResponse(e)
+	}
+	return c.JSON(res)
+}
+
+// HandleDeleteWebhook deletes an endpoint of the owner with its delivery log
+func (h *WebhooksHandler) HandleDeleteWebhook(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"msg": "webhook not found"})
+	}
+	err = h.store.DeleteEndpoint(c.UserContext(), c.Query("owner"), id)
+	if errors.Is(err, wstore.ErrEndpointNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"msg": "webhook not found"})
+	}
+	if err != nil {
+		return h.failed(c, err)
+	}
+	h.logger.Infow("webhook deleted", "id", id, "owner", c.Query("owner"))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleWebhookDeliveries serves the delivery log of an endpoint of the owner, newest first.
+// The optional query parameter limit bounds the number of deliveries.
+func (h *WebhooksHandler) HandleWebhookDeliveries(c *fiber.Ctx) error {
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(DEFAULT_DELIVERY_LOG_LIMIT)))
+	if err != nil || limit <= 0 || limit > MAX_DELIVERY_LOG_LIMIT {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"msg": "invalid limit"})
+	}
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"msg": "webhook not found"})
+	}
+	endpoint, err := h.store.GetEndpoint(c.UserContext(), c.Query("owner"), id)
+	if errors.Is(err, wstore.ErrEndpointNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"msg": "webhook not found"})
+	}
+	if err != nil {
+		return h.failed(c, err)
+	}
+	deliveries, err := h.store.Deliveries(c.UserContext(), endpoint.ID, limit)
+	if err != nil {
+		return h.failed(c, err)
+	}
+	res := make([]WebhookDeliveryResponse, len(deliveries))
+	for i, d := range deliveries {
+		res[i] = WebhookDeliveryResponse{
+			ID:             d.ID,
+			EventID:        d.EventID,
+			Event:          d.Event,
+			Status:         d.Status,
+			Attempts:       d.Attempts,
+			ResponseStatus: d.ResponseStatus,
+			LastError:      d.LastError,
+			CreatedAt:      d.CreatedAt,
+			FinishedAt:     d.FinishedAt,
+			Payload:        d.Payload,
+		}
+		if d.Status == wstore.STATUS_PENDING {
+			res[i].NextAttemptAt = &d.NextAttemptAt
+		}
+	}
+	return c.JSON(res)
+}
+
+func (h *WebhooksHandler) failed(c *fiber.Ctx, err error) error {
+	h.logger.Errorf("failed to access webhooks: %v\n", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"msg": "failed to access webhooks"})
+}
@@ -13,7 +13,9 @@ require (
 	github.com/mactavishz/kuerzen/middleware v0.0.0-20250625101943-5e567425023b
 	github.com/mactavishz/kuerzen/retries v0.0.0-20250709120248-51ccbc0a7a86
 	github.com/mactavishz/kuerzen/store v0.0.0-20250625101943-5e567425023b
+	github.com/prometheus/client_golang v1.22.0
 	go.uber.org/zap v1.27.0
+	google.golang.org/grpc v1.73.0
 )
 
 require (
@@ -44,7 +46,6 @@ require (
 	github.com/oapi-codegen/runtime v1.0.0 // indirect
 	github.com/power-devops/perfstat v0.0.0-20210106213030-5aafc221ea8c // indirect
 	github.com/pressly/goose/v3 v3.24.3 // indirect
-	github.com/prometheus/client_golang v1.22.0 // indirect
 	github.com/prometheus/client_model v0.6.2 // indirect
 	github.com/prometheus/common v0.65.0 // indirect
 	github.com/prometheus/procfs v0.16.1 // indirect
@@ -65,6 +66,5 @@ require (
 	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.25.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250324211829-b45e905df463 // indirect
-	google.golang.org/grpc v1.73.0 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
 )
@@ -2,107 +2,188 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
 	"time"
 
-	"github.com/ansrivas/fiberprometheus/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/timeout"
 	grpc "github.com/mactavishz/kuerzen/analytics/grpc"
-	"github.com/mactavishz/kuerzen/middleware/loadshed"
+	"github.com/mactavishz/kuerzen/breaker"
+	"github.com/mactavishz/kuerzen/retries"
+	"github.com/mactavishz/kuerzen/service"
+	"github.com/mactavishz/kuerzen/service/health"
 	"github.com/mactavishz/kuerzen/shortener/api"
-	database "github.com/mactavishz/kuerzen/store/db"
-	"github.com/mactavishz/kuerzen/store/migrations"
+	"github.com/mactavishz/kuerzen/shortener/relay"
+	"github.com/mactavishz/kuerzen/shortener/webhooks"
+	"github.com/mactavishz/kuerzen/store/outbox"
 	store "github.com/mactavishz/kuerzen/store/url"
-	"go.uber.org/zap"
+	wstore "github.com/mactavishz/kuerzen/store/webhooks"
 )
 
 const DEFAULT_PORT = "3000"
 
 func main() {
-	// We use sugar logger for better readability in development
-	logger := zap.Must(zap.NewProduction()).Sugar()
-	if os.Getenv("APP_ENV") == "development" || os.Getenv("APP_ENV") == "" {
-		logger = zap.Must(zap.NewDevelopment()).Sugar()
+	logger := service.NewLogger()
+	svc := service.New(service.Config{Name: "shortener"}, logger)
+	tracing, err := service.SetupTracing("shortener", logger)
+	if err != nil {
+		logger.Fatalf("Could not set up tracing: %v", err)
+	}
+	// Stopped last so that the spans of the shutdown are exported
+	svc.Add(tracing)
+	for _, dependency := range []string{"postgres", "analytics"} {
+		budgetCfg, err := retries.BudgetConfigFromEnv(dependency)
+		if err != nil {
+			logger.Fatalf("Invalid retry budget settings: %v", err)
+		}
+		retries.ConfigureBudget(dependency, budgetCfg)
 	}
-	defer logger.Sync()
-	db := database.NewDatabase(logger)
+	if err := retries.RegisterBudgetMetrics(nil); err != nil {
+		logger.Fatalf("Could not set up retry budget metrics: %v", err)
+	}
+	if err := breaker.RegisterMetrics(nil); err != nil {
+		logger.Fatalf("Could not set up circuit breaker metrics: %v", err)
+	}
+	newBreaker := func(name string) *breaker.Breaker {
+		cfg, err := breaker.ConfigFromEnv(name)
+		if err != nil {
+			logger.Fatalf("Invalid circuit breaker settings: %v", err)
+		}
+		return breaker.New(cfg, logger)
+	}
+	dbBreaker, analyticsBreaker := newBreaker("postgres"), newBreaker("analytics")
 
-	err := db.Open()
+	db, err := service.OpenDatabase(logger)
 	if err != nil {
-		logger.Fatalf("Could not connect to database: %v", err)
+		logger.Fatalf("Could not set up database: %v", err)
 	}
+	svc.Add(service.NewCloser("database", db.Close))
 
-	err = db.MigrateFS(migrations.FS, ".")
+	clientCfg, err := grpc.ClientConfigFromEnv("ANALYTICS_CLIENT_", "shortener")
 	if err != nil {
-		logger.Fatalf("Could not run database migrations: %v", err)
+		logger.Fatalf("Invalid analytics client settings: %v", err)
 	}
+	client, err := grpc.NewAnalyticsGRPCClient(os.Getenv("ANALYTICS_SERVICE_URL"), clientCfg, logger)
+	if err != nil {
+		logger.Fatalf("Could not set up grpc client: %v", err)
+	}
+	client = client.WithBreaker(analyticsBreaker)
+	svc.Add(service.NewCloser("analytics client", client.Close))
 
-	app := fiber.New(fiber.Config{
-		AppName:   "shortener",
-		BodyLimit: 1024 * 1024 * 1, // 1MB
-	})
+	dropPolicy, err := grpc.ParseDropPolicy(service.Getenv("ANALYTICS_DROP_POLICY", grpc.DropOldest.String()))
+	if err != nil {
+		logger.Fatalf("Invalid analytics drop policy: %v", err)
+	}
+	publisher, err := grpc.NewAnalyticsEventPublisher(client, grpc.PublisherConfig{DropPolicy: dropPolicy}, logger)
+	if err != nil {
+		logger.Fatalf("Could not set up analytics event publisher: %v", err)
+	}
+	// The publisher is stopped before the client, so that queued events are flushed over the still open connection
+	svc.Add(service.NewComponent("analytics publisher", publisher.Start, publisher.Close))
 
-	prometheus := fiberprometheus.New("shortener")
-	prometheus.RegisterAt(app, "/metrics")
-	prometheus.SetSkipPaths([]string{"/health"}) // Optional: Remove some paths from metrics
-	app.Use(prometheus.Middleware)
+	app, err := service.NewFiberApp(svc.Context(), service.FiberConfig{Name: "shortener"})
+	if err != nil {
+		logger.Fatalf("Could not set up http server: %v", err)
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	relayCfg, err := relayConfig()
+	if err != nil {
+		logger.Fatalf("Invalid outbox relay settings: %v", err)
+	}
+	outboxRelay, err := relay.New(relayCfg, outbox.NewPostgresOutbox(db.DB), relay.SendWith(client), logger)
+	if err != nil {
+		logger.Fatalf("Could not set up outbox relay: %v", err)
+	}
+	// The relay is stopped before the client and the database, messages it couldn't deliver stay in the outbox
+	svc.Add(service.NewComponent("outbox relay", outboxRelay.Start, outboxRelay.Stop))
 
-	loadshedMiddleware, err := loadshed.NewLoadSheddingMiddleware(ctx, loadshed.Config{
-		CPUThreshold: 0.9,
-		MemThreshold: 0.9,
-		Interval:     500 * time.Millisecond,
+	// Background jobs keep retrying for a while with the default policy, requests give up quickly
+	urlStore := store.NewPostgresURLStore(db.DB, logger).WithBreaker(dbBreaker)
+	app.Use(func(c *fiber.Ctx) error {
+		c.SetUserContext(retries.ContextWithPolicy(c.UserContext(), retries.InteractivePolicy))
+		return c.Next()
 	})
+
+	webhookStore := wstore.NewPostgresStore(db.DB)
+	outboxRelay.Handle(webhooks.TOPIC_LINK_EVENT, webhooks.FanOut(webhookStore))
+	dispatcherCfg, thresholdInterval, err := webhookConfig()
 	if err != nil {
-		logger.Fatalf("Could not set up load shedding middleware: %v", err)
+		logger.Fatalf("Invalid webhook settings: %v", err)
 	}
-	app.Use(loadshedMiddleware)
-
-	urlStore := store.NewPostgresURLStore(db.DB, logger)
-	client, err := grpc.NewAnalyticsGRPCClient(os.Getenv("ANALYTICS_SERVICE_URL"), logger)
+	dispatcher, err := webhooks.NewDispatcher(dispatcherCfg, webhookStore, logger)
 	if err != nil {
-		logger.Fatalf("Could not set up grpc client: %v", err)
+		logger.Fatalf("Could not set up webhook dispatcher: %v", err)
 	}
-	defer func() {
-		if err := client.Close(); err != nil {
-			logger.Errorf("Error closing grpc client: %v", err)
-		}
-	}()
-	defer func() {
-		if err := db.Close(); err != nil {
-			logger.Errorf("Error closing database connection: %v", err)
-		}
-	}()
-	handler := api.NewShortenHandler(urlStore, client, logger)
+	svc.Add(service.NewComponent("webhook dispatcher", dispatcher.Start, dispatcher.Stop))
+	watcher := webhooks.NewThresholdWatcher(thresholdInterval, webhookStore, urlStore, webhooks.ClicksWith(client), logger)
+	svc.Add(service.NewComponent("webhook threshold watcher", watcher.Start, watcher.Stop))
+
+	handler := api.NewShortenHandler(urlStore, publisher, logger)
 
 	app.Post("/api/v1/url/shorten", timeout.NewWithContext(handler.HandleShortenURL, 3*time.Second))
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"status": "healthy"})
+
+	statsHandler := api.NewStatsHandler(urlStore, client, logger)
+	app.Get("/api/v1/url/:id/stats", timeout.NewWithContext(statsHandler.HandleLinkStats, 5*time.Second))
+
+	webhooksHandler := api.NewWebhooksHandler(webhookStore, logger)
+	app.Post("/api/v1/webhooks", timeout.NewWithContext(webhooksHandler.HandleCreateWebhook, 3*time.Second))
+	app.Get("/api/v1/webhooks", timeout.NewWithContext(webhooksHandler.HandleListWebhooks, 3*time.Second))
+	app.Delete("/api/v1/webhooks/:id", timeout.NewWithContext(webhooksHandler.HandleDeleteWebhook, 3*time.Second))
+	app.Get("/api/v1/webhooks/:id/deliveries", timeout.NewWithContext(webhooksHandler.HandleWebhookDeliveries, 3*time.Second))
+
+	// Event streams are long-lived, they end when the client disconnects or the service shuts down
+	eventsHandler := api.NewEventsHandler(svc.Context(), urlStore, client, logger)
+	app.Get("/api/v1/events", eventsHandler.HandleEvents)
+
+	registry := health.NewRegistry(health.DEFAULT_CACHE_TTL)
+	registry.Register(health.Dependency{Name: "database", Checker: health.PingDB(db.DB), Critical: true, Breaker: dbBreaker})
+	// Events are best effort, the service can still shorten URLs while analytics is down
+	registry.Register(health.Dependency{Name: "analytics", Checker: health.CheckerFunc(client.CheckConnectivity), Breaker: analyticsBreaker})
+	service.RegisterHealthRoutes(app, svc, registry)
+
+	port := service.Getenv("SHORTENER_PORT", DEFAULT_PORT)
+	svc.Add(service.NewFiberServer("http server", app, ":"+port))
+	svc.OnStart(func(ctx context.Context) error {
+		logger.Infof("Shortener service listening on port :%s", port)
+		return nil
 	})
+	os.Exit(svc.Run())
+}
 
-	port := os.Getenv("SHORTENER_PORT")
-	if len(port) == 0 {
-		port = DEFAULT_PORT
+// relayConfig reads the settings of the outbox relay
+func relayConfig() (relay.Config, error) {
+	var cfg relay.Config
+	var err error
+	if cfg.Interval, err = time.ParseDuration(service.Getenv("OUTBOX_RELAY_INTERVAL", relay.DEFAULT_INTERVAL.String())); err != nil {
+		return cfg, fmt.Errorf("OUTBOX_RELAY_INTERVAL: %w", err)
 	}
-	// Listen from a different goroutine
-	go func() {
-		if err := app.Listen(":" + port); err != nil {
-			logger.Panic(err)
-		}
-	}()
-	logger.Infof("Shortener service listening on port :%s", port)
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	if cfg.BatchSize, err = strconv.Atoi(service.Getenv("OUTBOX_RELAY_BATCH_SIZE", strconv.Itoa(relay.DEFAULT_BATCH_SIZE))); err != nil {
+		return cfg, fmt.Errorf("OUTBOX_RELAY_BATCH_SIZE: %w", err)
+	}
+	if cfg.Retention, err = time.ParseDuration(service.Getenv("OUTBOX_RETENTION", relay.DEFAULT_RETENTION.String())); err != nil {
+		return cfg, fmt.Errorf("OUTBOX_RETENTION: %w", err)
+	}
+	return cfg, nil
+}
 
-	<-c
-	logger.Infof("Gracefully shutting down")
-	if err := app.Shutdown(); err != nil {
-		logger.Infof("Error shutting down: %v", err)
+// webhookConfig reads the settings of the webhook dispatcher and the interval of the click threshold checks
+func webhookConfig() (webhooks.DispatcherConfig, time.Duration, error) {
+	var cfg webhooks.DispatcherConfig
+	var err error
+	if cfg.Interval, err = time.ParseDuration(service.Getenv("WEBHOOK_DISPATCH_INTERVAL", webhooks.DEFAULT_DISPATCH_INTERVAL.String())); err != nil {
+		return cfg, 0, fmt.Errorf("WEBHOOK_DISPATCH_INTERVAL: %w", err)
+	}
+	if cfg.BatchSize, err = strconv.Atoi(service.Getenv("WEBHOOK_DISPATCH_BATCH_SIZE", strconv.Itoa(webhooks.DEFAULT_DISPATCH_BATCH))); err != nil {
+		return cfg, 0, fmt.Errorf("WEBHOOK_DISPATCH_BATCH_SIZE: %w", err)
+	}
+	if cfg.Retention, err = time.ParseDuration(service.Getenv("WEBHOOK_DELIVERY_RETENTION", webhooks.DEFAULT_DELIVERY_LOG_TTL.String())); err != nil {
+		return cfg, 0, fmt.Errorf("WEBHOOK_DELIVERY_RETENTION: %w", err)
+	}
+	interval, err := time.ParseDuration(service.Getenv("WEBHOOK_THRESHOLD_INTERVAL", webhooks.DEFAULT_THRESHOLD_INTERVAL.String()))
+	if err != nil {
+		return cfg, 0, fmt.Errorf("WEBHOOK_THRESHOLD_INTERVAL: %w", err)
 	}
-	logger.Infof("Server was gracefully shut down")
+	return cfg, interval, nil
 }
@@ -0,0 +1,288 @@
+// Package relay forwards the messages of the transactional outbox to the analytics service, and the messages of other
+// topics to their handlers. Messages are delivered at least once: a message whose delivery can't be recorded is
+// delivered again, the analytics service recognizes the duplicate by its event id. Several relays, e.g. of several
+// replicas of the shortener, can run at once.
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mactavishz/kuerzen/analytics/grpc"
+	"github.com/mactavishz/kuerzen/retries"
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/mactavishz/kuerzen/store/outbox"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_INTERVAL   = time.Second
+	DEFAULT_BATCH_SIZE = 100
+	DEFAULT_RETENTION  = 24 * time.Hour
+	// Bounds a delivery, the messages of a batch stay locked while it is delivered
+	DELIVERY_TIMEOUT = 10 * time.Second
+	CLEANUP_INTERVAL = 10 * time.Minute
+)
+
+// DeliveryPolicy retries the calls of a delivery. The last attempt starts within 4 seconds, so that it ends before
+// DELIVERY_TIMEOUT and the delivery fails by itself rather than run out of time.
+var DeliveryPolicy = retries.Policy{
+	MaxAttempts:    3,
+	MaxElapsedTime: 4 * time.Second,
+	Base:           100 * time.Millisecond,
+	Cap:            time.Second,
+	Jitter:         retries.DecorrelatedJitter,
+}
+
+// TOPIC_URL_CREATION is the topic of the outbox messages that hold a creation event as JSON
+const TOPIC_URL_CREATION = "analytics.url_creation"
+
+var ErrRejected = errors.New("rejected by the analytics service")
+
+// Outbox is implemented by outbox.PostgresOutbox
+type Outbox interface {
+	Deliver(ctx context.Context, limit int, deliver outbox.DeliverFunc) (int, error)
+	DeleteDelivered(ctx context.Context, before time.Time) (int64, error)
+	Pending(ctx context.Context) (int64, error)
+}
+
+// SendFunc sends a batch of events and returns the offsets of the events the receiver rejected
+type SendFunc func(ctx context.Context, events []astore.Event) (rejected []int32, err error)
+
+// SendWith sends the events with the client, retrying with the policy of the delivery
+func SendWith(client *grpc.AnalyticsGRPCClient) SendFunc {
+	return func(ctx context.Context, events []astore.Event) ([]int32, error) {
+		return client.SendEvents(ctx, events)
+	}
+}
+
+// URLCreationMessage encodes a creation event as an outbox message
+func URLCreationMessage(evt *astore.URLCreationEvent) (outbox.Message, error) {
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return outbox.Message{}, fmt.Errorf("encode creation event: %w", err)
+	}
+	return outbox.Message{Topic: TOPIC_URL_CREATION, Payload: payload}, nil
+}
+
+type Config struct {
+	Interval   time.Duration // Delay between runs, a run delivers until the outbox has no due messages left
+	BatchSize  int
+	Retention  time.Duration // Delivered messages are deleted after Retention
+	Registerer prometheus.Registerer
+}
+
+type metrics struct {
+	messages *prometheus.CounterVec
+	pending  prometheus.Gauge
+}
+
+type Relay struct {
+	cfg         Config
+	outbox      Outbox
+	send        SendFunc
+	handlers    map[string]outbox.DeliverFunc
+	logger      *zap.SugaredLogger
+	metrics     metrics
+	now         func() time.Time
+	lastCleanup time.Time
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+func New(cfg Config, box Outbox, send SendFunc, logger *zap.SugaredLogger) (*Relay, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DEFAULT_INTERVAL
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DEFAULT_BATCH_SIZE
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = DEFAULT_RETENTION
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	r := &Relay{
+		cfg:      cfg,
+		outbox:   box,
+		send:     send,
+		handlers: make(map[string]outbox.DeliverFunc),
+		logger:   logger,
+		now:      time.Now,
+		metrics: metrics{
+			messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "outbox_relay_messages_total",
+				Help: "Number of outbox messages the relay tried to deliver.",
+			}, []string{"result"}),
+			pending: prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "outbox_relay_pending_messages",
+				Help: "Number of outbox messages that weren't delivered yet, as of the last run of the relay.",
+			}),
+		},
+	}
+	for _, c := range []prometheus.Collector{r.metrics.messages, r.metrics.pending} {
+		if err := cfg.Registerer.Register(c); err != nil {
+			return nil, fmt.Errorf("register relay metrics: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// Handle delivers the messages of the topic with the handler instead of sending them to the analytics service. It has to
+// be called before the relay is started. A failing handler only fails the messages of its topic.
+func (r *Relay) Handle(topic string, deliver outbox.DeliverFunc) {
+	r.handlers[topic] = deliver
+}
+
+// Start runs the relay now and then every interval until it is stopped or ctx is cancelled
+func (r *Relay) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go r.loop(ctx)
+	return nil
+}
+
+// Stop cancels the current delivery, its messages are delivered again by the next run of any relay
+func (r *Relay) Stop(ctx context.Context) error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stop outbox relay: %w", ctx.Err())
+	}
+}
+
+func (r *Relay) loop(ctx context.Context) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Run(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Errorf("Failed to relay outbox messages: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Run delivers the due messages batch by batch and deletes the delivered messages past the retention
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		var rejected, failed int
+		deliverCtx, cancel := context.WithTimeout(retries.ContextWithPolicy(ctx, DeliveryPolicy), DELIVERY_TIMEOUT)
+		n, err := r.outbox.Deliver(deliverCtx, r.cfg.BatchSize, func(ctx context.Context, messages []outbox.Message) (map[int64]error, error) {
+			res, err := r.deliver(ctx, messages)
+			rejected = len(res)
+			return res, err
+		})
+		cancel()
+		var batchErr *outbox.BatchError
+		switch {
+		case errors.As(err, &batchErr):
+			failed = len(batchErr.Failed)
+		case err != nil:
+			failed, rejected = n, 0
+		}
+		r.metrics.messages.WithLabelValues("failed").Add(float64(failed))
+		r.metrics.messages.WithLabelValues("rejected").Add(float64(rejected))
+		r.metrics.messages.WithLabelValues("delivered").Add(float64(n - rejected - failed))
+		if err != nil {
+			return err
+		}
+		if n < r.cfg.BatchSize {
+			break
+		}
+	}
+	if pending, err := r.outbox.Pending(ctx); err == nil {
+		r.metrics.pending.Set(float64(pending))
+	}
+	if now := r.now(); now.Sub(r.lastCleanup) >= CLEANUP_INTERVAL {
+		deleted, err := r.outbox.DeleteDelivered(ctx, now.Add(-r.cfg.Retention))
+		if err != nil {
+			return err
+		}
+		r.lastCleanup = now
+		if deleted > 0 {
+			r.logger.Infof("Deleted %d delivered outbox messages", deleted)
+		}
+	}
+	return nil
+}
+
+// deliver passes the messages of handled topics to their handlers, decodes the other messages into events and sends
+// them in one batch. Messages that can't be decoded are rejected. The id of a message identifies its event, so that
+// the analytics service drops redeliveries. The handlers and the analytics service fail independently, a failure
+// fails only the messages passed to it with an *outbox.BatchError.
+func (r *Relay) deliver(ctx context.Context, messages []outbox.Message) (map[int64]error, error) {
+	rejected := make(map[int64]error)
+	events := make([]astore.Event, 0, len(messages))
+	ids := make([]int64, 0, len(messages))
+	handled := make(map[string][]outbox.Message)
+	for _, m := range messages {
+		if _, ok := r.handlers[m.Topic]; ok {
+			handled[m.Topic] = append(handled[m.Topic], m)
+			continue
+		}
+		if m.Topic != TOPIC_URL_CREATION {
+			rejected[m.ID] = fmt.Errorf("unknown topic %q", m.Topic)
+			continue
+		}
+		evt := &astore.URLCreationEvent{}
+		if err := json.Unmarshal(m.Payload, evt); err != nil {
+			rejected[m.ID] = fmt.Errorf("decode creation event: %w", err)
+			continue
+		}
+		if evt.EventID == "" {
+			evt.EventID = fmt.Sprintf("outbox-%d", m.ID)
+		}
+		events = append(events, evt)
+		ids = append(ids, m.ID)
+	}
+	failed := make(map[int64]error)
+	for topic, batch := range handled {
+		res, err := r.handlers[topic](ctx, batch)
+		if err != nil {
+			err = fmt.Errorf("deliver %s messages: %w", topic, err)
+			for _, m := range batch {
+				failed[m.ID] = err
+			}
+			continue
+		}
+		for id, err := range res {
+			rejected[id] = err
+		}
+	}
+	if len(events) > 0 {
+		offsets, err := r.send(ctx, events)
+		if err != nil {
+			for _, id := range ids {
+				failed[id] = err
+			}
+		}
+		for _, offset := range offsets {
+			if int(offset) < len(ids) {
+				rejected[ids[offset]] = ErrRejected
+			}
+		}
+	}
+	for id, err := range rejected {
+		r.logger.Warnw("Outbox message rejected", "id", id, "error", err)
+	}
+	if len(failed) > 0 {
+		return rejected, &outbox.BatchError{Failed: failed}
+	}
+	return rejected, nil
+}
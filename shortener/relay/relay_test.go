@@ -0,0 +1,192 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	astore "github.com/mactavishz/kuerzen/store/analytics"
+	"github.com/mactavishz/kuerzen/store/outbox"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// memoryOutbox delivers its messages in batches, delivered messages and their rejections are kept. Failed messages
+// stay pending.
+type memoryOutbox struct {
+	pending   []outbox.Message
+	delivered []outbox.Message
+	rejected  map[int64]error
+	deleted   time.Time
+}
+
+func (o *memoryOutbox) Deliver(ctx context.Context, limit int, deliver outbox.DeliverFunc) (int, error) {
+	batch := o.pending[:min(limit, len(o.pending))]
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	rejected, err := deliver(ctx, batch)
+	var batchErr *outbox.BatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		return len(batch), err
+	}
+	var failed []outbox.Message
+	for _, m := range batch {
+		if batchErr != nil && batchErr.Failed[m.ID] != nil {
+			failed = append(failed, m)
+			continue
+		}
+		o.delivered = append(o.delivered, m)
+	}
+	o.pending = append(failed, o.pending[len(batch):]...)
+	for id, err := range rejected {
+		o.rejected[id] = err
+	}
+	return len(batch), err
+}
+
+func (o *memoryOutbox) DeleteDelivered(ctx context.Context, before time.Time) (int64, error) {
+	o.deleted = before
+	return 0, nil
+}
+
+func (o *memoryOutbox) Pending(ctx context.Context) (int64, error) {
+	return int64(len(o.pending)), nil
+}
+
+func creationMessage(t *testing.T, id int64, url string) outbox.Message {
+	m, err := URLCreationMessage(&astore.URLCreationEvent{ServiceName: "shortener", URL: url, Success: true, Timestamp: time.Now()})
+	if err != nil {
+		t.Fatalf("URLCreationMessage failed: %v", err)
+	}
+	m.ID = id
+	return m
+}
+
+func TestRun(t *testing.T) {
+	box := &memoryOutbox{rejected: make(map[int64]error)}
+	for i := range int64(5) {
+		box.pending = append(box.pending, creationMessage(t, i+1, "https://example.com"))
+	}
+	box.pending = append(box.pending,
+		outbox.Message{ID: 6, Topic: "unknown"},
+		outbox.Message{ID: 7, Topic: TOPIC_URL_CREATION, Payload: []byte("{")},
+		creationMessage(t, 8, "https://example.com/rejected"))
+
+	var sent []astore.Event
+	send := func(ctx context.Context, events []astore.Event) ([]int32, error) {
+		sent = append(sent, events...)
+		for i, e := range events {
+			if e.(*astore.URLCreationEvent).URL == "https://example.com/rejected" {
+				return []int32{int32(i)}, nil
+			}
+		}
+		return nil, nil
+	}
+	r, err := New(Config{BatchSize: 3, Retention: time.Hour, Registerer: prometheus.NewRegistry()}, box, send, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(box.pending) != 0 || len(box.delivered) != 8 {
+		t.Errorf("Expected all messages to be delivered, %d are pending", len(box.pending))
+	}
+	if len(sent) != 6 {
+		t.Errorf("Expected 6 events to be sent, got %d", len(sent))
+	}
+	if id := sent[0].(*astore.URLCreationEvent).EventID; id != "outbox-1" {
+		t.Errorf("Expected the event id to be derived from the message id, got %q", id)
+	}
+	for _, id := range []int64{6, 7} {
+		if box.rejected[id] == nil {
+			t.Errorf("Expected message %d to be rejected", id)
+		}
+	}
+	if !errors.Is(box.rejected[8], ErrRejected) {
+		t.Errorf("Expected message 8 to be rejected by the receiver, got %v", box.rejected[8])
+	}
+	if box.deleted.IsZero() || time.Since(box.deleted) < time.Hour {
+		t.Errorf("Expected the messages delivered an hour ago to be deleted, got %v", box.deleted)
+	}
+}
+
+func TestRunKeepsFailedBatches(t *testing.T) {
+	box := &memoryOutbox{pending: []outbox.Message{creationMessage(t, 1, "https://example.com")}, rejected: make(map[int64]error)}
+	send := func(ctx context.Context, events []astore.Event) ([]int32, error) {
+		return nil, errors.New("unavailable")
+	}
+	r, err := New(Config{Registerer: prometheus.NewRegistry()}, box, send, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := r.Run(context.Background()); err == nil {
+		t.Errorf("Expected the failed delivery to be reported")
+	}
+	if len(box.pending) != 1 {
+		t.Errorf("Expected the message to stay pending")
+	}
+}
+
+func TestRunHandlesTopics(t *testing.T) {
+	box := &memoryOutbox{pending: []outbox.Message{
+		creationMessage(t, 1, "https://example.com"),
+		{ID: 2, Topic: "webhooks"},
+		{ID: 3, Topic: "webhooks"},
+	}, rejected: make(map[int64]error)}
+	var sent []astore.Event
+	send := func(ctx context.Context, events []astore.Event) ([]int32, error) {
+		sent = append(sent, events...)
+		return nil, nil
+	}
+	r, err := New(Config{Registerer: prometheus.NewRegistry()}, box, send, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	var handled []int64
+	r.Handle("webhooks", func(ctx context.Context, messages []outbox.Message) (map[int64]error, error) {
+		for _, m := range messages {
+			handled = append(handled, m.ID)
+		}
+		return map[int64]error{3: errors.New("invalid")}, nil
+	})
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(sent) != 1 || len(handled) != 2 {
+		t.Errorf("Expected 1 sent and 2 handled messages, got %d and %v", len(sent), handled)
+	}
+	if box.rejected[3] == nil || box.rejected[2] != nil {
+		t.Errorf("Expected only the rejection of the handler, got %v", box.rejected)
+	}
+}
+
+func TestRunFailsOnlyTheMessagesOfAFailingHandler(t *testing.T) {
+	box := &memoryOutbox{pending: []outbox.Message{
+		creationMessage(t, 1, "https://example.com"),
+		{ID: 2, Topic: "webhooks"},
+	}, rejected: make(map[int64]error)}
+	var sent []astore.Event
+	send := func(ctx context.Context, events []astore.Event) ([]int32, error) {
+		sent = append(sent, events...)
+		return nil, nil
+	}
+	r, err := New(Config{Registerer: prometheus.NewRegistry()}, box, send, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	r.Handle("webhooks", func(ctx context.Context, messages []outbox.Message) (map[int64]error, error) {
+		return nil, errors.New("unavailable")
+	})
+	if err := r.Run(context.Background()); err == nil {
+		t.Errorf("Expected the failed handler to be reported")
+	}
+	if len(sent) != 1 || len(box.delivered) != 1 || box.delivered[0].ID != 1 {
+		t.Errorf("Expected the creation event to be delivered, got %d sent and %v", len(sent), box.delivered)
+	}
+	if len(box.pending) != 1 || box.pending[0].ID != 2 {
+		t.Errorf("Expected only the message of the handler to stay pending, got %v", box.pending)
+	}
+}
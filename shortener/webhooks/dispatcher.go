@@ -0,0 +1,263 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mactavishz/kuerzen/retries"
+	wstore "github.com/mactavishz/kuerzen/store/webhooks"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_DISPATCH_INTERVAL = time.Second
+	DEFAULT_DISPATCH_BATCH    = 20
+	DEFAULT_DELIVERY_LOG_TTL  = 7 * 24 * time.Hour
+	// Bounds a single request to an endpoint
+	ATTEMPT_TIMEOUT = 5 * time.Second
+	// Bounds the requests of a batch including the retries, the deliveries of a batch stay locked while they are sent
+	DISPATCH_TIMEOUT = 30 * time.Second
+	// Bounds claiming a batch and recording its results on top of the requests, so that requests that used up
+	// DISPATCH_TIMEOUT are still recorded
+	RECORD_TIMEOUT   = 10 * time.Second
+	CLEANUP_INTERVAL = 10 * time.Minute
+)
+
+// DispatchPolicy retries the requests of a delivery. The last attempt starts at least ATTEMPT_TIMEOUT before
+// DISPATCH_TIMEOUT ends, so that it isn't cut short by the deadline of the batch.
+var DispatchPolicy = retries.Policy{
+	MaxAttempts:    6,
+	MaxElapsedTime: 20 * time.Second,
+	Base:           100 * time.Millisecond,
+	Cap:            5 * time.Second,
+	Jitter:         retries.DecorrelatedJitter,
+}
+
+type DispatcherConfig struct {
+	Interval   time.Duration // Delay between runs, a run sends until no deliveries are due
+	BatchSize  int           // Deliveries sent concurrently
+	Retention  time.Duration // Delivered and failed deliveries are kept in the log for Retention
+	Client     *http.Client  // Redirects aren't followed, a client without a timeout is bounded by ATTEMPT_TIMEOUT
+	Registerer prometheus.Registerer
+}
+
+// Dispatcher sends the queued deliveries to the endpoints. Failed requests are retried right away with the retries
+// module, deliveries whose retries fail are attempted again by a later run with a backoff, until they fail for good
+// after webhooks.MAX_ATTEMPTS runs. Several dispatchers can run at once.
+type Dispatcher struct {
+	cfg         DispatcherConfig
+	store       Store
+	logger      *zap.SugaredLogger
+	deliveries  *prometheus.CounterVec
+	now         func() time.Time
+	timeout     time.Duration // DISPATCH_TIMEOUT, for tests
+	lastCleanup time.Time
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+func NewDispatcher(cfg DispatcherConfig, store Store, logger *zap.SugaredLogger) (*Dispatcher, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DEFAULT_DISPATCH_INTERVAL
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DEFAULT_DISPATCH_BATCH
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = DEFAULT_DELIVERY_LOG_TTL
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{}
+	}
+	client := *cfg.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	cfg.Client = &client
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	d := &Dispatcher{
+		cfg:     cfg,
+		store:   store,
+		logger:  logger,
+		now:     time.Now,
+		timeout: DISPATCH_TIMEOUT,
+		deliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_deliveries_total",
+			Help: "Number of webhook delivery attempts by result (delivered, retry or failed).",
+		}, []string{"result"}),
+	}
+	if err := cfg.Registerer.Register(d.deliveries); err != nil {
+		return nil, fmt.Errorf("register webhook metrics: %w", err)
+	}
+	return d, nil
+}
+
+// Start runs the dispatcher now and then every interval until it is stopped or ctx is cancelled
+func (d *Dispatcher) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	d.cancel = cancel
+	d.done = make(chan struct{})
+	go d.loop(ctx)
+	return nil
+}
+
+// Stop cancels the requests of the current batch, their deliveries are recorded as failed and sent again with a backoff
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	if d.cancel == nil {
+		return nil
+	}
+	d.cancel()
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stop webhook dispatcher: %w", ctx.Err())
+	}
+}
+
+func (d *Dispatcher) loop(ctx context.Context) {
+	defer close(d.done)
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Run(ctx); err != nil && ctx.Err() == nil {
+			d.logger.Errorf("Failed to dispatch webhooks: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Run sends the due deliveries batch by batch and deletes the deliveries past the retention from the log. The requests
+// of a batch end with ctx or after DISPATCH_TIMEOUT, their results are recorded on a context of their own: a batch
+// that isn't recorded would be sent again, and the failed deliveries wouldn't back off.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	send := func(_ context.Context, deliveries []wstore.Delivery) []wstore.Result {
+		sendCtx, cancel := context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+		return d.send(sendCtx, deliveries)
+	}
+	for {
+		storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.timeout+RECORD_TIMEOUT)
+		n, err := d.store.Deliver(storeCtx, d.cfg.BatchSize, send)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if n < d.cfg.BatchSize {
+			break
+		}
+	}
+	if now := d.now(); now.Sub(d.lastCleanup) >= CLEANUP_INTERVAL {
+		deleted, err := d.store.DeleteFinished(ctx, now.Add(-d.cfg.Retention))
+		if err != nil {
+			return err
+		}
+		d.lastCleanup = now
+		if deleted > 0 {
+			d.logger.Infof("Deleted %d finished webhook deliveries", deleted)
+		}
+	}
+	return nil
+}
+
+// send sends the deliveries concurrently
+func (d *Dispatcher) send(ctx context.Context, deliveries []wstore.Delivery) []wstore.Result {
+	results := make([]wstore.Result, len(deliveries))
+	var wg sync.WaitGroup
+	for i, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = d.deliver(ctx, delivery)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// errStatus is the error of a response that isn't a 2xx
+type errStatus struct {
+	code int
+}
+
+func (e errStatus) Error() string {
+	return "endpoint responded with status " + strconv.Itoa(e.code)
+}
+
+// deliver sends a delivery, retrying failed requests until the retries are exhausted or the context ends
+func (d *Dispatcher) deliver(ctx context.Context, delivery wstore.Delivery) wstore.Result {
+	res := wstore.Result{ID: delivery.ID}
+	_, err := retries.Do(ctx, DispatchPolicy, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, d.post(ctx, delivery, &res)
+	})
+	switch {
+	case err == nil:
+		d.deliveries.WithLabelValues("delivered").Inc()
+	case delivery.Attempts+1 >= wstore.MAX_ATTEMPTS:
+		d.deliveries.WithLabelValues("failed").Inc()
+		d.logger.Warnw("Webhook delivery failed", "delivery", delivery.ID, "endpoint", delivery.EndpointID, "error", res.Err)
+	default:
+		d.deliveries.WithLabelValues("retry").Inc()
+		d.logger.Infow("Webhook delivery will be retried", "delivery", delivery.ID, "endpoint", delivery.EndpointID, "error", res.Err)
+	}
+	return res
+}
+
+// post sends a single request with a fresh signature and records the outcome in res, which keeps the outcome of the
+// last request if the context ends during a backoff. Failed requests are transient unless the status says that
+// they fail for good, see retryableStatus. The response body is discarded.
+func (d *Dispatcher) post(ctx context.Context, delivery wstore.Delivery, res *wstore.Result) error {
+	reqCtx, cancel := context.WithTimeout(ctx, ATTEMPT_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		// The URL was validated on registration
+		res.Err = fmt.Errorf("create request: %w", err)
+		res.Permanent = true
+		return res.Err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kuerzen-webhooks/1")
+	req.Header.Set(HEADER_EVENT, delivery.Event)
+	req.Header.Set(HEADER_EVENT_ID, delivery.EventID)
+	req.Header.Set(HEADER_DELIVERY, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HEADER_SIGNATURE, Sign(delivery.Secret, d.now(), delivery.Payload))
+	resp, err := d.cfg.Client.Do(req)
+	if err != nil {
+		res.ResponseStatus = 0
+		res.Err = err
+		return retries.Transient(err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	res.ResponseStatus = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		res.Err = errStatus{resp.StatusCode}
+		if !retryableStatus(resp.StatusCode) {
+			res.Permanent = true
+			return res.Err
+		}
+		return retries.Transient(res.Err)
+	}
+	res.Err = nil
+	return nil
+}
+
+// retryableStatus reports whether a request that failed with the status may succeed later. Other client errors, e.g.
+// 404 or 410 of a removed endpoint, fail the delivery for good, and so do redirects, which aren't followed.
+func retryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
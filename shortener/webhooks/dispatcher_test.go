@@ -0,0 +1,190 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	wstore "github.com/mactavishz/kuerzen/store/webhooks"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func newTestDispatcher(t *testing.T, s *memoryStore) *Dispatcher {
+	d, err := NewDispatcher(DispatcherConfig{Registerer: prometheus.NewRegistry()}, s, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatalf("NewDispatcher failed: %v", err)
+	}
+	return d
+}
+
+func queue(t *testing.T, s *memoryStore, url string) {
+	s.endpoints = append(s.endpoints, wstore.Endpoint{ID: 1, Owner: "crm", URL: url, Secret: "whsec_test", Events: []string{EVENT_LINK_CREATED}})
+	d, err := delivery(s.endpoints[0], "outbox-1", LinkEvent{Type: EVENT_LINK_CREATED, ShortID: "abc", Owner: "crm", Time: time.Now()})
+	if err != nil {
+		t.Fatalf("delivery failed: %v", err)
+	}
+	s.Enqueue(context.Background(), d)
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	var requests atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify("whsec_test", r.Header.Get(HEADER_SIGNATURE), body, time.Minute, time.Now()); err != nil {
+			t.Errorf("Expected a valid signature, got %v", err)
+		}
+		if r.Header.Get(HEADER_EVENT) != EVENT_LINK_CREATED || r.Header.Get(HEADER_EVENT_ID) != "outbox-1" || r.Header.Get(HEADER_DELIVERY) != "1" {
+			t.Errorf("Unexpected headers %v", r.Header)
+		}
+		// The first request fails and is retried right away
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	s := &memoryStore{}
+	queue(t, s, receiver.URL)
+	if err := newTestDispatcher(t, s).Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	d := s.deliveries[0]
+	if d.Status != wstore.STATUS_DELIVERED || d.ResponseStatus != http.StatusNoContent || requests.Load() != 2 {
+		t.Errorf("Expected the delivery to succeed on the second request, got %s with %d after %d requests", d.Status, d.ResponseStatus, requests.Load())
+	}
+}
+
+func TestDispatcherKeepsFailedDeliveries(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	s := &memoryStore{}
+	queue(t, s, receiver.URL)
+	dispatcher := newTestDispatcher(t, s)
+	// The deadline ends the retries of the run, the delivery is attempted again by a later run
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := dispatcher.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	d := s.deliveries[0]
+	if d.Status != "scheduled" || d.Attempts != 1 || d.ResponseStatus != http.StatusInternalServerError || d.LastError == "" {
+		t.Errorf("Expected the delivery to be attempted again, got %+v", d)
+	}
+
+	// The last attempt fails the delivery for good
+	s.deliveries[0].Status = wstore.STATUS_PENDING
+	s.deliveries[0].Attempts = wstore.MAX_ATTEMPTS - 1
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := dispatcher.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if d := s.deliveries[0]; d.Status != wstore.STATUS_FAILED {
+		t.Errorf("Expected the delivery to fail, got %s", d.Status)
+	}
+}
+
+func TestDispatcherFailsFastOnClientErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		requests  int32
+		permanent bool
+	}{
+		{http.StatusBadRequest, 1, true},
+		{http.StatusNotFound, 1, true},
+		{http.StatusGone, 1, true},
+		{http.StatusMovedPermanently, 1, true},
+		{http.StatusRequestTimeout, 2, false},
+		{http.StatusTooManyRequests, 2, false},
+		{http.StatusBadGateway, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			var requests atomic.Int32
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Retried requests succeed
+				if requests.Add(1) == 1 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer receiver.Close()
+
+			s := &memoryStore{}
+			queue(t, s, receiver.URL)
+			if err := newTestDispatcher(t, s).Run(context.Background()); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			d := s.deliveries[0]
+			if requests.Load() != tt.requests || (d.Status == wstore.STATUS_FAILED) != tt.permanent {
+				t.Errorf("Expected %d requests and permanent %v, got %d requests and %s", tt.requests, tt.permanent, requests.Load(), d.Status)
+			}
+		})
+	}
+}
+
+func TestDispatcherStopsWithTheStartContext(t *testing.T) {
+	d := newTestDispatcher(t, &memoryStore{})
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := d.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	cancel()
+	select {
+	case <-d.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the dispatcher to stop once the context of Start is cancelled")
+	}
+}
+
+func TestDispatcherRecordsBatchesThatRanOutOfTime(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer healthy.Close()
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer hanging.Close()
+	defer close(release)
+
+	s := &memoryStore{}
+	for i, url := range []string{healthy.URL, hanging.URL, healthy.URL} {
+		e := wstore.Endpoint{ID: int64(i + 1), Owner: "crm", URL: url, Secret: "whsec_test", Events: []string{EVENT_LINK_CREATED}}
+		s.endpoints = append(s.endpoints, e)
+		d, err := delivery(e, "outbox-1", LinkEvent{Type: EVENT_LINK_CREATED, ShortID: "abc", Owner: "crm", Time: time.Now()})
+		if err != nil {
+			t.Fatalf("delivery failed: %v", err)
+		}
+		s.Enqueue(context.Background(), d)
+	}
+	dispatcher := newTestDispatcher(t, s)
+	// The hanging endpoint uses up the time of the batch
+	dispatcher.timeout = 200 * time.Millisecond
+	if err := dispatcher.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, i := range []int{0, 2} {
+		if d := s.deliveries[i]; d.Status != wstore.STATUS_DELIVERED {
+			t.Errorf("Expected the delivery to the healthy endpoint to be delivered, got %+v", d)
+		}
+	}
+	if d := s.deliveries[1]; d.Status != "scheduled" || d.Attempts != 1 || d.LastError == "" {
+		t.Errorf("Expected the delivery to the hanging endpoint to be attempted again, got %+v", d)
+	}
+}
@@ -0,0 +1,142 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mactavishz/kuerzen/analytics/grpc"
+	store "github.com/mactavishz/kuerzen/store/url"
+	"go.uber.org/zap"
+)
+
+const DEFAULT_THRESHOLD_INTERVAL = time.Minute
+
+// ClicksFunc returns the number of clicks of a short URL
+type ClicksFunc func(ctx context.Context, shortURL string) (int64, error)
+
+// ClicksWith queries the clicks from the analytics service
+func ClicksWith(client *grpc.AnalyticsGRPCClient) ClicksFunc {
+	return func(ctx context.Context, shortURL string) (int64, error) {
+		stats, _, err := client.GetLinkStats(ctx, shortURL, 0)
+		if err != nil {
+			return 0, err
+		}
+		return stats.Clicks, nil
+	}
+}
+
+// ThresholdWatcher queues link.clicks_threshold events. Every interval it compares the clicks of the short URLs of the
+// owners with subscribed endpoints to the thresholds of the endpoints. A crossed threshold is announced once per
+// endpoint and short URL, several watchers can run at once.
+type ThresholdWatcher struct {
+	interval time.Duration
+	store    Store
+	urlStore store.URLStore
+	clicks   ClicksFunc
+	logger   *zap.SugaredLogger
+	now      func() time.Time
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func NewThresholdWatcher(interval time.Duration, webhookStore Store, urlStore store.URLStore, clicks ClicksFunc, logger *zap.SugaredLogger) *ThresholdWatcher {
+	if interval <= 0 {
+		interval = DEFAULT_THRESHOLD_INTERVAL
+	}
+	return &ThresholdWatcher{
+		interval: interval,
+		store:    webhookStore,
+		urlStore: urlStore,
+		clicks:   clicks,
+		logger:   logger,
+		now:      time.Now,
+	}
+}
+
+// Start runs the watcher every interval until it is stopped or ctx is cancelled
+func (w *ThresholdWatcher) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	w.cancel = cancel
+	w.done = make(chan struct{})
+	go w.loop(ctx)
+	return nil
+}
+
+func (w *ThresholdWatcher) Stop(ctx context.Context) error {
+	if w.cancel == nil {
+		return nil
+	}
+	w.cancel()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stop webhook threshold watcher: %w", ctx.Err())
+	}
+}
+
+func (w *ThresholdWatcher) loop(ctx context.Context) {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := w.Run(ctx); err != nil && ctx.Err() == nil {
+			w.logger.Errorf("Failed to check webhook click thresholds: %v", err)
+		}
+	}
+}
+
+// Run queues the events of the thresholds crossed since the last run. The clicks of a short URL are only queried
+// while an endpoint of its owner waits for its threshold.
+func (w *ThresholdWatcher) Run(ctx context.Context) error {
+	endpoints, crossed, err := w.store.ThresholdEndpoints(ctx, EVENT_LINK_CLICKS_THRESHOLD)
+	if err != nil {
+		return err
+	}
+	owners := make(map[string][]int)
+	var order []string
+	for i, e := range endpoints {
+		if owners[e.Owner] == nil {
+			order = append(order, e.Owner)
+		}
+		owners[e.Owner] = append(owners[e.Owner], i)
+	}
+	for _, owner := range order {
+		shortURLs, err := w.urlStore.ListShortURLs(ctx, owner)
+		if err != nil {
+			return fmt.Errorf("list short URLs of %s: %w", owner, err)
+		}
+		for _, shortURL := range shortURLs {
+			clicks := int64(-1)
+			for _, i := range owners[owner] {
+				e := endpoints[i]
+				if crossed[e.ID][shortURL] {
+					continue
+				}
+				if clicks < 0 {
+					if clicks, err = w.clicks(ctx, shortURL); err != nil {
+						return fmt.Errorf("get clicks of %s: %w", shortURL, err)
+					}
+				}
+				if clicks < e.ClicksThreshold {
+					continue
+				}
+				evt := LinkEvent{Type: EVENT_LINK_CLICKS_THRESHOLD, ShortID: shortURL, Owner: owner, Time: w.now(), Clicks: clicks, Threshold: e.ClicksThreshold}
+				d, err := delivery(e, fmt.Sprintf("clicks-%s-%d", shortURL, e.ClicksThreshold), evt)
+				if err != nil {
+					return err
+				}
+				if _, err := w.store.EnqueueThreshold(ctx, d, shortURL, e.ClicksThreshold); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
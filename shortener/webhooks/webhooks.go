@@ -0,0 +1,193 @@
+// Package webhooks sends the events of links to the webhook endpoints registered by their owners. Events are queued
+// per endpoint in Postgres and sent by the dispatcher as signed JSON payloads, see Sign for the signature.
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mactavishz/kuerzen/store/outbox"
+	wstore "github.com/mactavishz/kuerzen/store/webhooks"
+)
+
+const (
+	EVENT_LINK_CREATED          = "link.created"
+	EVENT_LINK_CLICKS_THRESHOLD = "link.clicks_threshold"
+)
+
+// EVENTS are the events endpoints can subscribe to, URLs can't be updated or deleted yet so there are no events for it
+var EVENTS = []string{EVENT_LINK_CREATED, EVENT_LINK_CLICKS_THRESHOLD}
+
+const (
+	HEADER_SIGNATURE = "Kuerzen-Signature"
+	HEADER_EVENT     = "Kuerzen-Event"
+	HEADER_EVENT_ID  = "Kuerzen-Event-Id"
+	HEADER_DELIVERY  = "Kuerzen-Delivery"
+)
+
+// TOPIC_LINK_EVENT is the topic of the outbox messages that hold a LinkEvent as JSON
+const TOPIC_LINK_EVENT = "webhooks.link_event"
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Payload is the body of a webhook request
+type Payload struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      LinkEvent `json:"data"`
+}
+
+// LinkEvent describes the change of a link, Clicks and Threshold are set for link.clicks_threshold
+type LinkEvent struct {
+	Type      string    `json:"-"`
+	ShortID   string    `json:"short_id"`
+	URL       string    `json:"url,omitempty"`
+	Owner     string    `json:"owner"`
+	Time      time.Time `json:"-"`
+	Clicks    int64     `json:"clicks,omitempty"`
+	Threshold int64     `json:"threshold,omitempty"`
+}
+
+// outboxEvent is the encoding of a LinkEvent in the outbox
+type outboxEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	LinkEvent
+}
+
+// ValidEvent reports whether endpoints can subscribe to the event
+func ValidEvent(event string) bool {
+	for _, e := range EVENTS {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSecret returns a random secret for signing the payloads of an endpoint
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature header of a payload sent at the time: t=<unix seconds>,v1=<signature>, where the
+// signature is the hex encoded HMAC-SHA256 of "<unix seconds>.<payload>" keyed with the secret of the endpoint.
+// Receivers should reject signatures of old timestamps to prevent replays.
+func Sign(secret string, t time.Time, payload []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + signature(secret, ts, payload)
+}
+
+func signature(secret string, ts string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header created by Sign, signatures older than the tolerance are rejected
+func Verify(secret string, header string, payload []byte, tolerance time.Duration, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: timestamp out of tolerance", ErrInvalidSignature)
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, ts, payload))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// LinkEventMessage encodes a link event as an outbox message, it is written in the transaction of the change
+func LinkEventMessage(evt LinkEvent) (outbox.Message, error) {
+	payload, err := json.Marshal(outboxEvent{Type: evt.Type, Time: evt.Time, LinkEvent: evt})
+	if err != nil {
+		return outbox.Message{}, fmt.Errorf("encode link event: %w", err)
+	}
+	return outbox.Message{Topic: TOPIC_LINK_EVENT, Payload: payload}, nil
+}
+
+// delivery builds the delivery of an event to an endpoint
+func delivery(endpoint wstore.Endpoint, eventID string, evt LinkEvent) (wstore.Delivery, error) {
+	payload, err := json.Marshal(Payload{ID: eventID, Type: evt.Type, CreatedAt: evt.Time.UTC(), Data: evt})
+	if err != nil {
+		return wstore.Delivery{}, fmt.Errorf("encode webhook payload: %w", err)
+	}
+	return wstore.Delivery{EndpointID: endpoint.ID, EventID: eventID, Event: evt.Type, Payload: payload}, nil
+}
+
+// Store is implemented by webhooks.PostgresStore of the store module
+type Store interface {
+	Subscribers(ctx context.Context, owner string, event string) ([]wstore.Endpoint, error)
+	Enqueue(ctx context.Context, deliveries ...wstore.Delivery) error
+	ThresholdEndpoints(ctx context.Context, event string) ([]wstore.Endpoint, map[int64]map[string]bool, error)
+	EnqueueThreshold(ctx context.Context, d wstore.Delivery, shortURL string, threshold int64) (bool, error)
+	Deliver(ctx context.Context, limit int, deliver wstore.DeliverFunc) (int, error)
+	DeleteFinished(ctx context.Context, before time.Time) (int64, error)
+}
+
+// FanOut returns the handler of the outbox relay for link events: it queues a delivery of every event to each endpoint
+// of the owner that is subscribed to it. The event id is derived from the message id, so redelivered messages are
+// queued once.
+func FanOut(store Store) outbox.DeliverFunc {
+	return func(ctx context.Context, messages []outbox.Message) (map[int64]error, error) {
+		rejected := make(map[int64]error)
+		var deliveries []wstore.Delivery
+		for _, m := range messages {
+			var e outboxEvent
+			if err := json.Unmarshal(m.Payload, &e); err != nil {
+				rejected[m.ID] = fmt.Errorf("decode link event: %w", err)
+				continue
+			}
+			evt := e.LinkEvent
+			evt.Type, evt.Time = e.Type, e.Time
+			if evt.Owner == "" {
+				continue
+			}
+			endpoints, err := store.Subscribers(ctx, evt.Owner, evt.Type)
+			if err != nil {
+				return nil, err
+			}
+			for _, endpoint := range endpoints {
+				d, err := delivery(endpoint, fmt.Sprintf("outbox-%d", m.ID), evt)
+				if err != nil {
+					return nil, err
+				}
+				deliveries = append(deliveries, d)
+			}
+		}
+		if len(deliveries) > 0 {
+			if err := store.Enqueue(ctx, deliveries...); err != nil {
+				return nil, err
+			}
+		}
+		return rejected, nil
+	}
+}
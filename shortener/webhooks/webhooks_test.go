@@ -0,0 +1,243 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mactavishz/kuerzen/store/outbox"
+	wstore "github.com/mactavishz/kuerzen/store/webhooks"
+	"go.uber.org/zap"
+)
+
+// memoryStore keeps the endpoints and deliveries in memory and records the results like the Postgres store
+type memoryStore struct {
+	endpoints  []wstore.Endpoint
+	deliveries []wstore.Delivery
+	thresholds map[string]bool
+}
+
+func (s *memoryStore) Subscribers(ctx context.Context, owner string, event string) ([]wstore.Endpoint, error) {
+	var endpoints []wstore.Endpoint
+	for _, e := range s.endpoints {
+		if e.Owner == owner && e.Subscribes(event) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints, nil
+}
+
+func (s *memoryStore) Enqueue(ctx context.Context, deliveries ...wstore.Delivery) error {
+	for _, d := range deliveries {
+		if s.queued(d) {
+			continue
+		}
+		for _, e := range s.endpoints {
+			if e.ID == d.EndpointID {
+				d.URL, d.Secret = e.URL, e.Secret
+			}
+		}
+		d.ID = int64(len(s.deliveries) + 1)
+		d.Status = wstore.STATUS_PENDING
+		s.deliveries = append(s.deliveries, d)
+	}
+	return nil
+}
+
+func (s *memoryStore) queued(d wstore.Delivery) bool {
+	for _, q := range s.deliveries {
+		if q.EndpointID == d.EndpointID && q.EventID == d.EventID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) ThresholdEndpoints(ctx context.Context, event string) ([]wstore.Endpoint, map[int64]map[string]bool, error) {
+	var endpoints []wstore.Endpoint
+	crossed := make(map[int64]map[string]bool)
+	for _, e := range s.endpoints {
+		if e.Subscribes(event) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	for _, d := range s.deliveries {
+		if d.Event == event {
+			if crossed[d.EndpointID] == nil {
+				crossed[d.EndpointID] = make(map[string]bool)
+			}
+			var p Payload
+			json.Unmarshal(d.Payload, &p)
+			crossed[d.EndpointID][p.Data.ShortID] = true
+		}
+	}
+	return endpoints, crossed, nil
+}
+
+func (s *memoryStore) EnqueueThreshold(ctx context.Context, d wstore.Delivery, shortURL string, threshold int64) (bool, error) {
+	if s.queued(d) {
+		return false, nil
+	}
+	return true, s.Enqueue(ctx, d)
+}
+
+func (s *memoryStore) Deliver(ctx context.Context, limit int, deliver wstore.DeliverFunc) (int, error) {
+	var claimed []wstore.Delivery
+	for _, d := range s.deliveries {
+		if d.Status == wstore.STATUS_PENDING && len(claimed) < limit {
+			claimed = append(claimed, d)
+		}
+	}
+	if len(claimed) == 0 {
+		return 0, nil
+	}
+	results := deliver(ctx, claimed)
+	// The transaction of the Postgres store rolls back once ctx ended
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	for _, r := range results {
+		d := &s.deliveries[r.ID-1]
+		d.Attempts++
+		d.ResponseStatus = r.ResponseStatus
+		switch {
+		case r.Err == nil:
+			d.Status = wstore.STATUS_DELIVERED
+		case r.Permanent || d.Attempts >= wstore.MAX_ATTEMPTS:
+			d.Status, d.LastError = wstore.STATUS_FAILED, r.Err.Error()
+		default:
+			// Due again only in the next test
+			d.Status, d.LastError = "scheduled", r.Err.Error()
+		}
+	}
+	return len(claimed), nil
+}
+
+func (s *memoryStore) DeleteFinished(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+type memoryURLStore struct {
+	shortURLs map[string][]string
+}
+
+func (s *memoryURLStore) CreateShortURL(context.Context, string, string, string, ...outbox.Message) error {
+	return nil
+}
+
+func (s *memoryURLStore) GetLongURL(context.Context, string) (string, error) {
+	return "", nil
+}
+
+func (s *memoryURLStore) ListShortURLs(ctx context.Context, owner string) ([]string, error) {
+	return s.shortURLs[owner], nil
+}
+
+func TestValidEvent(t *testing.T) {
+	for _, e := range []string{EVENT_LINK_CREATED, EVENT_LINK_CLICKS_THRESHOLD} {
+		if !ValidEvent(e) {
+			t.Errorf("Expected %s to be valid", e)
+		}
+	}
+	for _, e := range []string{"link.updated", "link.deleted", ""} {
+		if ValidEvent(e) {
+			t.Errorf("Expected %q to be rejected", e)
+		}
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payload := []byte(`{"type":"link.created"}`)
+	header := Sign("secret", now, payload)
+	if err := Verify("secret", header, payload, time.Minute, now.Add(30*time.Second)); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		payload []byte
+		now     time.Time
+	}{
+		{"wrong secret", "other", header, payload, now},
+		{"changed payload", "secret", header, []byte(`{"type":"link.deleted"}`), now},
+		{"replayed", "secret", header, payload, now.Add(time.Hour)},
+		{"malformed", "secret", "v1=abc", payload, now},
+	}
+	for _, tt := range tests {
+		if err := Verify(tt.secret, tt.header, tt.payload, time.Minute, tt.now); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: expected an invalid signature, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	s := &memoryStore{endpoints: []wstore.Endpoint{
+		{ID: 1, Owner: "crm", Events: []string{EVENT_LINK_CREATED}},
+		{ID: 2, Owner: "crm", Events: []string{EVENT_LINK_CLICKS_THRESHOLD}},
+		{ID: 3, Owner: "other", Events: []string{EVENT_LINK_CREATED}},
+	}}
+	msg, err := LinkEventMessage(LinkEvent{Type: EVENT_LINK_CREATED, ShortID: "abc", URL: "https://example.com", Owner: "crm", Time: time.Now()})
+	if err != nil {
+		t.Fatalf("LinkEventMessage failed: %v", err)
+	}
+	msg.ID = 7
+	fanOut := FanOut(s)
+	for range 2 {
+		rejected, err := fanOut(context.Background(), []outbox.Message{msg, {ID: 8, Topic: TOPIC_LINK_EVENT, Payload: []byte("{")}})
+		if err != nil {
+			t.Fatalf("FanOut failed: %v", err)
+		}
+		if len(rejected) != 1 || rejected[8] == nil {
+			t.Errorf("Expected the malformed message to be rejected, got %v", rejected)
+		}
+	}
+	if len(s.deliveries) != 1 || s.deliveries[0].EndpointID != 1 || s.deliveries[0].EventID != "outbox-7" {
+		t.Fatalf("Expected one delivery to the subscribed endpoint, got %+v", s.deliveries)
+	}
+	var p Payload
+	if err := json.Unmarshal(s.deliveries[0].Payload, &p); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if p.ID != "outbox-7" || p.Type != EVENT_LINK_CREATED || p.Data.ShortID != "abc" || p.Data.URL != "https://example.com" {
+		t.Errorf("Unexpected payload %+v", p)
+	}
+}
+
+func TestThresholdWatcher(t *testing.T) {
+	s := &memoryStore{endpoints: []wstore.Endpoint{
+		{ID: 1, Owner: "crm", Events: []string{EVENT_LINK_CLICKS_THRESHOLD}, ClicksThreshold: 1000},
+		{ID: 2, Owner: "crm", Events: []string{EVENT_LINK_CLICKS_THRESHOLD}, ClicksThreshold: 10},
+	}}
+	urls := &memoryURLStore{shortURLs: map[string][]string{"crm": {"a", "b"}}}
+	clicks := map[string]int64{"a": 1200, "b": 5}
+	var queries int
+	w := NewThresholdWatcher(time.Minute, s, urls, func(ctx context.Context, shortURL string) (int64, error) {
+		queries++
+		return clicks[shortURL], nil
+	}, zap.NewNop().Sugar())
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(s.deliveries) != 2 || queries != 2 {
+		t.Fatalf("Expected both endpoints to be notified about a, got %d deliveries after %d queries", len(s.deliveries), queries)
+	}
+	var p Payload
+	json.Unmarshal(s.deliveries[0].Payload, &p)
+	if p.Data.ShortID != "a" || p.Data.Clicks != 1200 || p.Data.Threshold != 1000 {
+		t.Errorf("Unexpected payload %+v", p.Data)
+	}
+
+	// Crossed thresholds are announced once, only b is queried again
+	queries = 0
+	clicks["b"] = 10
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(s.deliveries) != 3 || s.deliveries[2].EndpointID != 2 || queries != 1 {
+		t.Errorf("Expected only endpoint 2 to be notified about b, got %d deliveries after %d queries", len(s.deliveries), queries)
+	}
+}
@@ -0,0 +1,259 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mactavishz/kuerzen/store/analytics/hll"
+)
+
+// LinkStats summarizes the clicks of a short URL, see URLRedirectEvent.IsClick
+type LinkStats struct {
+	ShortURL   string
+	Clicks     int64
+	FirstClick time.Time // zero if the short URL was never clicked
+	LastClick  time.Time
+}
+
+// ClickCount is the number of clicks in the interval ending at Time
+type ClickCount struct {
+	Time   time.Time
+	Clicks int64
+}
+
+// RankEntry is an entry of a top-N list, e.g. a short URL or a referrer host
+type RankEntry struct {
+	Key    string
+	Clicks int64
+}
+
+// VisitorStats estimates the distinct visitors of a short URL from HyperLogLog sketches of the visitor fingerprints.
+// The sketches are kept per UTC day, so the time range of a query is extended to the start of its first day.
+type VisitorStats struct {
+	ShortURL string
+	Visitors int64           // distinct visitors of the whole time range, visitors of several days count once
+	Daily    []DailyVisitors // days with visitors, oldest first
+}
+
+type DailyVisitors struct {
+	Day      time.Time // start of the UTC day
+	Visitors int64
+}
+
+// AnalyticsReader answers queries about recorded redirect events.
+// since limits a query to the events of the last since duration, 0 means all events.
+type AnalyticsReader interface {
+	GetLinkStats(ctx context.Context, shortURL string, since time.Duration) (*LinkStats, error)
+	GetClickSeries(ctx context.Context, shortURL string, interval time.Duration, since time.Duration) ([]ClickCount, error)
+	TopLinks(ctx context.Context, since time.Duration, limit int) ([]RankEntry, error)
+	// TopReferrers ranks the referrer hosts of a short URL, or of all short URLs if shortURL is empty
+	TopReferrers(ctx context.Context, shortURL string, since time.Duration, limit int) ([]RankEntry, error)
+	GetVisitorStats(ctx context.Context, shortURL string, since time.Duration) (*VisitorStats, error)
+}
+
+func (ias *InfluxDBAnalyticsStore) GetLinkStats(ctx context.Context, shortURL string, since time.Duration) (*LinkStats, error) {
+	q := ias.clicksQuery(shortURL, since) + `
+  |> group()
+  |> keep(columns: ["_time"])
+  |> sort(columns: ["_time"])
+  |> reduce(
+      identity: {clicks: 0, first: 0, last: 0},
+      fn: (r, accumulator) => ({
+        clicks: accumulator.clicks + 1,
+        first: if accumulator.clicks == 0 then int(v: r._time) else accumulator.first,
+        last: int(v: r._time),
+      }),
+    )`
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("query link stats: %w", err)
+	}
+	defer result.Close()
+	stats := &LinkStats{ShortURL: shortURL}
+	// A short URL without clicks yields no record at all
+	if result.Next() {
+		r := result.Record()
+		stats.Clicks = toInt64(r.ValueByKey("clicks"))
+		stats.FirstClick = time.Unix(0, toInt64(r.ValueByKey("first")))
+		stats.LastClick = time.Unix(0, toInt64(r.ValueByKey("last")))
+	}
+	return stats, result.Err()
+}
+
+func (ias *InfluxDBAnalyticsStore) GetClickSeries(ctx context.Context, shortURL string, interval time.Duration, since time.Duration) ([]ClickCount, error) {
+	q := ias.clicksQuery(shortURL, since) + fmt.Sprintf(`
+  |> group()
+  |> keep(columns: ["_start", "_stop", "_time", "short_url"])
+  |> aggregateWindow(every: %s, fn: count, column: "short_url", createEmpty: true)`, fluxDuration(interval))
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("query click series: %w", err)
+	}
+	defer result.Close()
+	var series []ClickCount
+	for result.Next() {
+		r := result.Record()
+		series = append(series, ClickCount{Time: r.Time(), Clicks: toInt64(r.ValueByKey("short_url"))})
+	}
+	return series, result.Err()
+}
+
+func (ias *InfluxDBAnalyticsStore) TopLinks(ctx context.Context, since time.Duration, limit int) ([]RankEntry, error) {
+	return ias.rank(ctx, ias.clicksQuery("", since), "short_url", limit)
+}
+
+func (ias *InfluxDBAnalyticsStore) TopReferrers(ctx context.Context, shortURL string, since time.Duration, limit int) ([]RankEntry, error) {
+	q := ias.clicksQuery(shortURL, since) + `
+  |> filter(fn: (r) => exists r.referrer_host)`
+	return ias.rank(ctx, q, "referrer_host", limit)
+}
+
+// rank counts the clicks of q per value of column and returns the limit values with the most clicks
+func (ias *InfluxDBAnalyticsStore) rank(ctx context.Context, q string, column string, limit int) ([]RankEntry, error) {
+	q += fmt.Sprintf(`
+  |> keep(columns: [%[1]s, "success"])
+  |> group(columns: [%[1]s])
+  |> count(column: "success")
+  |> group()
+  |> sort(columns: ["success"], desc: true)
+  |> limit(n: %[2]d)`, fluxString(column), limit)
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("query top %s: %w", column, err)
+	}
+	defer result.Close()
+	counts := make(map[string]int64)
+	for result.Next() {
+		r := result.Record()
+		key, _ := r.ValueByKey(column).(string)
+		counts[key] = toInt64(r.ValueByKey("success"))
+	}
+	// Flux doesn't order ties, rank again to order them by key like the other backends
+	return rankCounts(counts, limit), result.Err()
+}
+
+// fluxHuman is the Flux predicate of the redirects that aren't bot traffic, see URLRedirectEvent.IsClick
+const fluxHuman = `(not exists r.bot_class or (r.bot_class != "` + BOT_CLASS_BOT + `" and r.bot_class != "` + BOT_CLASS_SUSPECTED + `"))`
+
+// clicksQuery selects the clicks, one row per event with the fields as columns
+func (ias *InfluxDBAnalyticsStore) clicksQuery(shortURL string, since time.Duration) string {
+	q := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s)
+  |> filter(fn: (r) => r._measurement == %s and (r._field == "short_url" or r._field == "success"))
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> filter(fn: (r) => r.success == true and `+fluxHuman, fluxString(ias.bucket), fluxStart(since), fluxString(URL_REDIRECT_MEASUREMENT))
+	if shortURL != "" {
+		q += " and r.short_url == " + fluxString(shortURL)
+	}
+	return q + ")"
+}
+
+var fluxEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// fluxString quotes s as a Flux string literal
+func fluxString(s string) string {
+	return `"` + fluxEscaper.Replace(s) + `"`
+}
+
+func fluxDuration(d time.Duration) string {
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
+
+func fluxStart(since time.Duration) string {
+	if since <= 0 {
+		return "0"
+	}
+	return "-" + fluxDuration(since)
+}
+
+func toInt64(v any) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case uint64:
+		return int64(n)
+	case float64:
+		return int64(n)
+	default:
+		return 0
+	}
+}
+
+// windowStart returns the start of the series window containing t.
+// Windows are aligned to multiples of interval since the Unix epoch, like the windows of Flux' aggregateWindow.
+func windowStart(t time.Time, interval time.Duration) int64 {
+	ns := t.UnixNano()
+	start := ns - ns%int64(interval)
+	if ns < 0 && ns%int64(interval) != 0 {
+		start -= int64(interval)
+	}
+	return start
+}
+
+// buildSeries turns click counts per window start into a series over [now-since, now), windows without clicks are included with 0 clicks.
+// The time of each point is the end of its window, the last window ends now.
+func buildSeries(counts map[int64]int64, now time.Time, interval time.Duration, since time.Duration) []ClickCount {
+	var series []ClickCount
+	for start := windowStart(now.Add(-since), interval); start < now.UnixNano(); start += int64(interval) {
+		end := time.Unix(0, start+int64(interval))
+		if end.After(now) {
+			end = now
+		}
+		series = append(series, ClickCount{Time: end.UTC(), Clicks: counts[start]})
+	}
+	return series
+}
+
+// visitorsFrom returns the start of the first day of a visitor query, zero for all time
+func visitorsFrom(now time.Time, since time.Duration) time.Time {
+	if since <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, windowStart(now.Add(-since), 24*time.Hour)).UTC()
+}
+
+// addVisitor adds a visitor to the sketch of the day of t, sketches are keyed by the start of their day
+func addVisitor(sketches map[int64]*hll.Sketch, t time.Time, visitorID string) {
+	if visitorID == "" {
+		return
+	}
+	day := windowStart(t, 24*time.Hour)
+	if sketches[day] == nil {
+		sketches[day] = hll.New()
+	}
+	sketches[day].Add(visitorID)
+}
+
+// newVisitorStats estimates the visitors per day and of all days by merging the daily sketches
+func newVisitorStats(shortURL string, sketches map[int64]*hll.Sketch) *VisitorStats {
+	stats := &VisitorStats{ShortURL: shortURL, Daily: make([]DailyVisitors, 0, len(sketches))}
+	total := hll.New()
+	for day, sketch := range sketches {
+		total.Merge(sketch)
+		stats.Daily = append(stats.Daily, DailyVisitors{Day: time.Unix(0, day).UTC(), Visitors: sketch.Estimate()})
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool { return stats.Daily[i].Day.Before(stats.Daily[j].Day) })
+	stats.Visitors = total.Estimate()
+	return stats
+}
+
+// rankCounts returns the limit keys with the most clicks, ties are ordered by key
+func rankCounts(counts map[string]int64, limit int) []RankEntry {
+	entries := make([]RankEntry, 0, len(counts))
+	for k, c := range counts {
+		entries = append(entries, RankEntry{Key: k, Clicks: c})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Clicks != entries[j].Clicks {
+			return entries[i].Clicks > entries[j].Clicks
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
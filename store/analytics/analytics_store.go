@@ -1,72 +1,222 @@
 package analytics
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	influxAPI "github.com/influxdata/influxdb-client-go/v2/api"
+	influxHTTP "github.com/influxdata/influxdb-client-go/v2/api/http"
 	influxAPIWrite "github.com/influxdata/influxdb-client-go/v2/api/write"
 )
 
 const URL_CREATION_MEASUREMENT = "EventURLCreation"
 const URL_REDIRECT_MEASUREMENT = "EventURLRedirect"
 
+// Traffic classes of redirect events, see URLRedirectEvent.BotClass
+const (
+	BOT_CLASS_HUMAN     = "human"
+	BOT_CLASS_BOT       = "bot"           // known crawlers, link unfurlers and scanners
+	BOT_CLASS_SUSPECTED = "suspected_bot" // unknown clients that behave like bots
+)
+
 type tags map[string]string
 type fields map[string]any
 
 type URLCreationEvent struct {
-	ServiceName string
-	URL         string
-	APIVer      int32
-	Success     bool
-	Timestamp   time.Time
+	EventID     string    `json:"event_id,omitempty"` // Set by the client, duplicates of an event share it
+	ServiceName string    `json:"service"`
+	URL         string    `json:"url"`
+	ShortURL    string    `json:"short_url,omitempty"` // The created short URL, empty if the creation failed
+	Owner       string    `json:"owner,omitempty"`     // Declared by the client that shortened the URL
+	APIVer      int32     `json:"api_ver"`
+	Success     bool      `json:"success"`
+	Timestamp   time.Time `json:"time"`
 }
 
 type URLRedirectEvent struct {
-	ServiceName string
-	ShortURL    string
-	LongURL     string
-	APIVer      int32
-	Success     bool
-	Timestamp   time.Time
+	EventID     string    `json:"event_id,omitempty"` // Set by the client, duplicates of an event share it
+	ServiceName string    `json:"service"`
+	ShortURL    string    `json:"short_url"`
+	LongURL     string    `json:"long_url"`
+	APIVer      int32     `json:"api_ver"`
+	Success     bool      `json:"success"`
+	Timestamp   time.Time `json:"time"`
+	// Click context, empty when unknown or dropped for privacy reasons
+	ReferrerHost   string        `json:"referrer_host,omitempty"`
+	Browser        string        `json:"browser,omitempty"`
+	OS             string        `json:"os,omitempty"`
+	Device         string        `json:"device,omitempty"`
+	AcceptLanguage string        `json:"accept_language,omitempty"`
+	IP             string        `json:"ip,omitempty"`        // truncated or hashed peer address
+	ClientIP       string        `json:"client_ip,omitempty"` // truncated or hashed client address derived from X-Forwarded-For
+	CacheTier      string        `json:"cache_tier,omitempty"`
+	VisitorID      string        `json:"visitor_id,omitempty"` // salted fingerprint of the visitor, for estimating unique visitors
+	Latency        time.Duration `json:"latency,omitempty"`
+	BotClass       string        `json:"bot_class,omitempty"` // empty for events of redirectors that don't classify, counted as human
+}
+
+// IsClick reports whether the event counts as a click: a successful redirect that isn't bot traffic
+func (e *URLRedirectEvent) IsClick() bool {
+	return e.Success && e.BotClass != BOT_CLASS_BOT && e.BotClass != BOT_CLASS_SUSPECTED
+}
+
+// Event is either a *URLCreationEvent or a *URLRedirectEvent
+type Event interface {
+	isEvent()
 }
 
+func (*URLCreationEvent) isEvent() {}
+func (*URLRedirectEvent) isEvent() {}
+
 type AnalyticsStore interface {
 	WriteURLCreationEvent(*URLCreationEvent)
 	WriteURLRedirectEvent(*URLRedirectEvent)
+	// WriteEvents writes a batch of events of mixed types and returns once the store confirmed them. An error means
+	// that none of the events can be counted on, the caller has to write them again.
+	WriteEvents(ctx context.Context, events []Event) error
 	Errors() <-chan error
+	Ping(ctx context.Context) error
 	Flush()
 	Close()
 }
 
+// AnalyticsBackend is a store that can also answer queries, every backend of the analytics service implements it
+type AnalyticsBackend interface {
+	AnalyticsStore
+	AnalyticsReader
+}
+
 type InfluxDBAnalyticsStore struct {
 	client   influxdb2.Client
 	writeAPI influxAPI.WriteAPI
+	queryAPI influxAPI.QueryAPI
+	org      string
+	bucket   string
+
+	writeFailedMu sync.Mutex
+	writeFailed   func(batch string, err error) bool
+
+	rollupMu          sync.Mutex
+	rollupBucket      string
+	rollupBucketReady bool
+
+	sketchMu     sync.Mutex // Serializes the merges into the visitor sketches of the process
+	sketchWriter string
 }
 
 func NewInfluxDBAnalyticsStore(client influxdb2.Client, org string, bucket string) *InfluxDBAnalyticsStore {
 	api := client.WriteAPI(org, bucket)
 	return &InfluxDBAnalyticsStore{
-		client:   client,
-		writeAPI: api,
+		client:       client,
+		writeAPI:     api,
+		queryAPI:     client.QueryAPI(org),
+		org:          org,
+		bucket:       bucket,
+		rollupBucket: bucket + ROLLUP_BUCKET_SUFFIX,
+		sketchWriter: sketchWriter(),
 	}
 }
 
 func (ias *InfluxDBAnalyticsStore) WriteURLRedirectEvent(event *URLRedirectEvent) {
+	ias.writeAPI.WritePoint(redirectPoint(event))
+}
+
+func (ias *InfluxDBAnalyticsStore) WriteURLCreationEvent(event *URLCreationEvent) {
+	ias.writeAPI.WritePoint(creationPoint(event))
+}
+
+// WriteEvents writes the batch with a single blocking request. If InfluxDB fails to take it, the batch is handed to the
+// write failed callback instead, and counts as written once the callback took it over.
+func (ias *InfluxDBAnalyticsStore) WriteEvents(ctx context.Context, events []Event) error {
+	var sb strings.Builder
+	precision := ias.client.Options().WriteOptions().Precision()
+	for _, event := range events {
+		switch e := event.(type) {
+		case *URLCreationEvent:
+			influxAPIWrite.PointToLineProtocolBuffer(creationPoint(e), &sb, precision)
+		case *URLRedirectEvent:
+			influxAPIWrite.PointToLineProtocolBuffer(redirectPoint(e), &sb, precision)
+		}
+	}
+	if sb.Len() == 0 {
+		return nil
+	}
+	batch := sb.String()
+	err := ias.WriteBatch(ctx, batch)
+	if err == nil || errors.Is(err, ErrWriteRejected) {
+		return err
+	}
+	ias.writeFailedMu.Lock()
+	cb := ias.writeFailed
+	ias.writeFailedMu.Unlock()
+	if cb != nil && !cb(batch, err) {
+		return nil
+	}
+	return fmt.Errorf("write %d events: %w", len(events), err)
+}
+
+// addEventID stores the event id as a field, as a tag it would make every event a series of its own. A duplicate of an
+// event has the same tags and time and overwrites it. Distinct events of the same microsecond keep apart because the
+// sub-microsecond part of the time is taken from the id, the timestamps of the clients have microseconds at most.
+func addEventID(f fields, eventID string, ts time.Time) time.Time {
+	if eventID == "" {
+		return ts
+	}
+	f["event_id"] = eventID
+	h := fnv.New32a()
+	h.Write([]byte(eventID))
+	return ts.Truncate(time.Microsecond).Add(time.Duration(h.Sum32() % 1000))
+}
+
+// The short URL is also a tag named link, so that the events of a short URL can be deleted by a single predicate.
+// It stays a field as well, the queries select the events by field and the points written before have no such tag.
+func redirectPoint(event *URLRedirectEvent) *influxAPIWrite.Point {
 	t := tags{
 		"service": event.ServiceName,
 	}
+	// Low cardinality dimensions are tags so that they can be grouped by, empty tags are not allowed by InfluxDB
+	for k, v := range map[string]string{
+		"link":          event.ShortURL,
+		"referrer_host": event.ReferrerHost,
+		"browser":       event.Browser,
+		"os":            event.OS,
+		"device":        event.Device,
+		"cache_tier":    event.CacheTier,
+		"bot_class":     event.BotClass,
+	} {
+		if v != "" {
+			t[k] = v
+		}
+	}
 	f := fields{
-		"short_url": event.ShortURL,
-		"long_url":  event.LongURL,
-		"api_ver":   event.APIVer,
-		"success":   event.Success,
+		"short_url":  event.ShortURL,
+		"long_url":   event.LongURL,
+		"api_ver":    event.APIVer,
+		"success":    event.Success,
+		"latency_us": event.Latency.Microseconds(),
+	}
+	for k, v := range map[string]string{
+		"accept_language": event.AcceptLanguage,
+		"ip":              event.IP,
+		"client_ip":       event.ClientIP,
+		"visitor_id":      event.VisitorID,
+	} {
+		if v != "" {
+			f[k] = v
+		}
 	}
-	point := influxAPIWrite.NewPoint(URL_REDIRECT_MEASUREMENT, t, f, event.Timestamp)
-	ias.writeAPI.WritePoint(point)
+	ts := addEventID(f, event.EventID, event.Timestamp)
+	return influxAPIWrite.NewPoint(URL_REDIRECT_MEASUREMENT, t, f, ts)
 }
 
-func (ias *InfluxDBAnalyticsStore) WriteURLCreationEvent(event *URLCreationEvent) {
+func creationPoint(event *URLCreationEvent) *influxAPIWrite.Point {
 	t := tags{
 		"service": event.ServiceName,
 	}
@@ -75,14 +225,67 @@ func (ias *InfluxDBAnalyticsStore) WriteURLCreationEvent(event *URLCreationEvent
 		"api_ver": event.APIVer,
 		"success": event.Success,
 	}
-	point := influxAPIWrite.NewPoint(URL_CREATION_MEASUREMENT, t, f, event.Timestamp)
-	ias.writeAPI.WritePoint(point)
+	if event.ShortURL != "" {
+		t["link"] = event.ShortURL
+		f["short_url"] = event.ShortURL
+	}
+	if event.Owner != "" {
+		f["owner"] = event.Owner
+	}
+	ts := addEventID(f, event.EventID, event.Timestamp)
+	return influxAPIWrite.NewPoint(URL_CREATION_MEASUREMENT, t, f, ts)
+}
+
+// ErrWriteRejected marks writes that InfluxDB refused for good, e.g. because a point is malformed, retrying them is pointless
+var ErrWriteRejected = errors.New("influxdb rejected the write")
+
+// SetWriteFailedCallback registers cb for batches of line protocol the background writer or WriteEvents failed to
+// write. If cb returns false it took the batch over, otherwise the writer keeps retrying it in memory and WriteEvents
+// fails. Errors of batches that can't be written at all wrap ErrWriteRejected.
+func (ias *InfluxDBAnalyticsStore) SetWriteFailedCallback(cb func(batch string, err error) bool) {
+	ias.writeFailedMu.Lock()
+	ias.writeFailed = cb
+	ias.writeFailedMu.Unlock()
+	ias.writeAPI.SetWriteFailedCallback(func(batch string, err influxHTTP.Error, retryAttempts uint) bool {
+		return cb(batch, classifyWriteError(&err))
+	})
+}
+
+// WriteBatch synchronously writes a batch of line protocol, e.g. a batch passed to the write failed callback before,
+// and merges the visitors of its clicks into the daily visitor sketches. A batch whose sketches failed to merge has to
+// be written again as a whole.
+func (ias *InfluxDBAnalyticsStore) WriteBatch(ctx context.Context, batch string) error {
+	if err := ias.client.WriteAPIBlocking(ias.org, ias.bucket).WriteRecord(ctx, batch); err != nil {
+		return classifyWriteError(err)
+	}
+	return ias.mergeVisitorSketches(ctx, batch)
+}
+
+// classifyWriteError wraps client errors other than rate limiting with ErrWriteRejected
+func classifyWriteError(err error) error {
+	var httpErr *influxHTTP.Error
+	if errors.As(err, &httpErr) && httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 && httpErr.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %w", ErrWriteRejected, err)
+	}
+	return err
 }
 
 func (ias *InfluxDBAnalyticsStore) Errors() <-chan error {
 	return ias.writeAPI.Errors()
 }
 
+// Ping checks whether the InfluxDB server is reachable
+func (ias *InfluxDBAnalyticsStore) Ping(ctx context.Context) error {
+	ok, err := ias.client.Ping(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("influxdb is not ready")
+	}
+	return nil
+}
+
 func (ias *InfluxDBAnalyticsStore) Flush() {
 	ias.writeAPI.Flush()
 }
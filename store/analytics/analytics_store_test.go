@@ -0,0 +1,109 @@
+package analytics
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	influxAPIWrite "github.com/influxdata/influxdb-client-go/v2/api/write"
+	protocol "github.com/influxdata/line-protocol"
+)
+
+func TestPointsKeepEventIDOutOfTags(t *testing.T) {
+	ts := time.UnixMicro(1700000000123456)
+	redirect := func(id string) *URLRedirectEvent {
+		return &URLRedirectEvent{EventID: id, ServiceName: "redirector", ShortURL: "a", Success: true, Timestamp: ts, Browser: "Firefox"}
+	}
+	p := redirectPoint(redirect("e1"))
+	for _, tag := range p.TagList() {
+		if tag.Key == "event_id" {
+			t.Fatalf("Expected the event id not to be a tag")
+		}
+	}
+	hasField := false
+	for _, f := range p.FieldList() {
+		hasField = hasField || f.Key == "event_id" && f.Value == "e1"
+	}
+	if !hasField {
+		t.Errorf("Expected the event id to be a field")
+	}
+	if !p.Time().Truncate(time.Microsecond).Equal(ts) {
+		t.Errorf("Expected the time to stay within the microsecond, got %v", p.Time())
+	}
+	// A duplicate overwrites the point, another event of the same microsecond doesn't
+	if !redirectPoint(redirect("e1")).Time().Equal(p.Time()) {
+		t.Errorf("Expected a duplicate to have the same time")
+	}
+	if redirectPoint(redirect("e2")).Time().Equal(p.Time()) {
+		t.Errorf("Expected distinct events to have distinct times")
+	}
+	if !creationPoint(&URLCreationEvent{ServiceName: "shortener", Timestamp: ts}).Time().Equal(ts) {
+		t.Errorf("Expected events without an id to keep their time")
+	}
+}
+
+func TestLinesOfShortURLs(t *testing.T) {
+	line := func(p *influxAPIWrite.Point) string {
+		var sb strings.Builder
+		influxAPIWrite.PointToLineProtocolBuffer(p, &sb, time.Nanosecond)
+		return strings.TrimSuffix(sb.String(), "\n")
+	}
+	ts := time.Unix(1700000000, 0)
+	match := LinesOfShortURLs([]string{"a", `b "c"`})
+	for _, tc := range []struct {
+		line string
+		want bool
+	}{
+		{line(redirectPoint(&URLRedirectEvent{ServiceName: "redirector", ShortURL: "a", Timestamp: ts})), true},
+		{line(creationPoint(&URLCreationEvent{ServiceName: "shortener", ShortURL: `b "c"`, Timestamp: ts})), true},
+		{line(redirectPoint(&URLRedirectEvent{ServiceName: "redirector", ShortURL: "ab", Timestamp: ts})), false},
+		{line(creationPoint(&URLCreationEvent{ServiceName: "shortener", Timestamp: ts})), false},
+		// Written before the link tag was added
+		{`EventURLRedirect,service=redirector short_url="a",success=true 1700000000000000000`, true},
+		{`other,link=a short_url="a" 1700000000000000000`, false},
+		{`not line protocol`, false},
+	} {
+		if got := match(tc.line); got != tc.want {
+			t.Errorf("Expected %v for %q, got %v", tc.want, tc.line, got)
+		}
+	}
+}
+
+func TestPointsTagTheLink(t *testing.T) {
+	p := redirectPoint(&URLRedirectEvent{ServiceName: "redirector", ShortURL: "a"})
+	if !slices.ContainsFunc(p.TagList(), func(tag *protocol.Tag) bool { return tag.Key == "link" && tag.Value == "a" }) {
+		t.Errorf("Expected the short URL as link tag, got %v", p.TagList())
+	}
+	p = creationPoint(&URLCreationEvent{ServiceName: "shortener"})
+	if slices.ContainsFunc(p.TagList(), func(tag *protocol.Tag) bool { return tag.Key == "link" }) {
+		t.Errorf("Expected no link tag without a short URL")
+	}
+}
+
+func TestVisitorsOfBatch(t *testing.T) {
+	day := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	var sb strings.Builder
+	for _, e := range []*URLRedirectEvent{
+		{ShortURL: "a", Success: true, VisitorID: "v1", Timestamp: day.Add(time.Hour)},
+		{ShortURL: "a", Success: true, VisitorID: "v1", Timestamp: day.Add(2 * time.Hour)},
+		{ShortURL: "a", Success: true, VisitorID: "v2", Timestamp: day.Add(25 * time.Hour)},
+		{ShortURL: "a", Success: false, VisitorID: "v3", Timestamp: day.Add(time.Hour)},
+		{ShortURL: "a", Success: true, VisitorID: "v4", BotClass: BOT_CLASS_BOT, Timestamp: day.Add(time.Hour)},
+		{ShortURL: "b", Success: true, Timestamp: day.Add(time.Hour)},
+	} {
+		e.ServiceName = "redirector"
+		influxAPIWrite.PointToLineProtocolBuffer(redirectPoint(e), &sb, time.Microsecond)
+	}
+	influxAPIWrite.PointToLineProtocolBuffer(creationPoint(&URLCreationEvent{ServiceName: "shortener", ShortURL: "c", Timestamp: day}), &sb, time.Microsecond)
+	sb.WriteString("not line protocol\n")
+
+	sketches := visitorsOfBatch(sb.String(), time.Microsecond)
+	if len(sketches) != 1 || len(sketches["a"]) != 2 {
+		t.Fatalf("Expected sketches of two days of a, got %v", sketches)
+	}
+	first, second := sketches["a"][day.UnixNano()], sketches["a"][day.Add(24*time.Hour).UnixNano()]
+	if first == nil || first.Estimate() != 1 || second == nil || second.Estimate() != 1 {
+		t.Errorf("Expected a visitor per day without failed redirects and bots")
+	}
+}
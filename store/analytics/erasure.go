@@ -0,0 +1,195 @@
+package analytics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// ErasableStore is implemented by the stores that can erase the analytics of short URLs
+type ErasableStore interface {
+	// ShortURLsOfOwner returns the short URLs whose creation events name the owner.
+	// Creation events recorded before owners were recorded name no owner, their short URLs have to be given explicitly.
+	ShortURLsOfOwner(ctx context.Context, owner string) ([]string, error)
+	// PurgeLinks deletes the creation and redirect events and the rollups of the short URLs
+	PurgeLinks(ctx context.Context, shortURLs []string) error
+	// AnonymizeRedirects clears the addresses, the browser, OS and device and the visitor fingerprint
+	// of the redirect events in [from, to). A zero from anonymizes all events before to.
+	AnonymizeRedirects(ctx context.Context, from time.Time, to time.Time) error
+}
+
+// anonymize clears the fields of a redirect event that are derived from the address or the User-Agent of the visitor
+func anonymize(e *URLRedirectEvent) {
+	e.IP = ""
+	e.ClientIP = ""
+	e.Browser = ""
+	e.OS = ""
+	e.Device = ""
+	e.VisitorID = ""
+}
+
+func isAnonymous(e *URLRedirectEvent) bool {
+	return e.IP == "" && e.ClientIP == "" && e.Browser == "" && e.OS == "" && e.Device == "" && e.VisitorID == ""
+}
+
+func (ms *MemoryAnalyticsStore) ShortURLsOfOwner(ctx context.Context, owner string) ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var shortURLs []string
+	for _, e := range ms.creations {
+		if e.Owner == owner && e.ShortURL != "" && !slices.Contains(shortURLs, e.ShortURL) {
+			shortURLs = append(shortURLs, e.ShortURL)
+		}
+	}
+	return shortURLs, nil
+}
+
+func (ms *MemoryAnalyticsStore) PurgeLinks(ctx context.Context, shortURLs []string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.creations = slices.DeleteFunc(ms.creations, func(e *URLCreationEvent) bool {
+		return e.ShortURL != "" && slices.Contains(shortURLs, e.ShortURL)
+	})
+	ms.redirects = slices.DeleteFunc(ms.redirects, func(e *URLRedirectEvent) bool {
+		return slices.Contains(shortURLs, e.ShortURL)
+	})
+	for _, rollups := range ms.rollups {
+		for k := range rollups {
+			if slices.Contains(shortURLs, k.shortURL) {
+				delete(rollups, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryAnalyticsStore) AnonymizeRedirects(ctx context.Context, from time.Time, to time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, e := range ms.redirects {
+		if !e.Timestamp.Before(from) && e.Timestamp.Before(to) && !isAnonymous(e) {
+			// Events may still be referenced by their writer, the anonymized event is a copy
+			c := *e
+			anonymize(&c)
+			ms.redirects[i] = &c
+		}
+	}
+	return nil
+}
+
+// PurgeLinks removes the events of the short URLs from the logs and from memory
+func (fs *FileAnalyticsStore) PurgeLinks(ctx context.Context, shortURLs []string) error {
+	err := fs.rewriteLogs(func(rec *fileRecord) bool {
+		switch {
+		case rec.Creation != nil:
+			return rec.Creation.ShortURL == "" || !slices.Contains(shortURLs, rec.Creation.ShortURL)
+		case rec.Redirect != nil:
+			return !slices.Contains(shortURLs, rec.Redirect.ShortURL)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return fs.MemoryAnalyticsStore.PurgeLinks(ctx, shortURLs)
+}
+
+// AnonymizeRedirects anonymizes the events in the logs and in memory
+func (fs *FileAnalyticsStore) AnonymizeRedirects(ctx context.Context, from time.Time, to time.Time) error {
+	err := fs.rewriteLogs(func(rec *fileRecord) bool {
+		if e := rec.Redirect; e != nil && !e.Timestamp.Before(from) && e.Timestamp.Before(to) {
+			anonymize(e)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return fs.MemoryAnalyticsStore.AnonymizeRedirects(ctx, from, to)
+}
+
+// rewriteLogs passes the records of all logs to fn, which may modify them, and drops the records for which it
+// returns false. Writes wait until all logs are rewritten.
+func (fs *FileAnalyticsStore) rewriteLogs(fn func(rec *fileRecord) bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return errors.New("file store is closed")
+	}
+	if err := fs.writer.Flush(); err != nil {
+		return fmt.Errorf("write events: %w", err)
+	}
+	// The current log is replaced as well, it is reopened afterwards
+	if err := fs.file.Close(); err != nil {
+		return fmt.Errorf("close log: %w", err)
+	}
+	fs.file = nil
+	logs, err := fs.rotatedLogs()
+	if err == nil {
+		for _, name := range append(logs, currentLogName) {
+			if err = rewriteLog(filepath.Join(fs.cfg.Dir, name), fn); err != nil {
+				break
+			}
+		}
+	}
+	if openErr := fs.openCurrent(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// rewriteLog writes the kept records of a log to a temporary file, which then replaces the log.
+// Lines that can't be decoded are kept as they are.
+func rewriteLog(path string, fn func(rec *fileRecord) bool) error {
+	in, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	defer in.Close()
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("create log: %w", err)
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var rec fileRecord
+		if err := json.Unmarshal(line, &rec); err == nil {
+			if !fn(&rec) {
+				continue
+			}
+			if line, err = json.Marshal(rec); err != nil {
+				return fmt.Errorf("encode event: %w", err)
+			}
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read log %s: %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write log %s: %w", tmp, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("sync log %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replace log %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package analytics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_FILE_SIZE = 64 << 20 // 64 MiB
+	DEFAULT_MAX_FILES     = 10
+
+	currentLogName   = "events.jsonl"
+	rotatedLogPrefix = "events-"
+	rotatedLogSuffix = ".jsonl"
+	rotatedLogLayout = "20060102T150405.000000000"
+)
+
+type FileStoreConfig struct {
+	Dir         string
+	MaxFileSize int64 // The current log is rotated once it grows beyond MaxFileSize bytes
+	MaxFiles    int   // Number of rotated logs that are kept, older logs are deleted
+}
+
+// fileRecord is a single line of the log
+type fileRecord struct {
+	Creation *URLCreationEvent `json:"creation,omitempty"`
+	Redirect *URLRedirectEvent `json:"redirect,omitempty"`
+}
+
+// FileAnalyticsStore appends events as JSON lines to a log file, which is rotated by size.
+// Queries are answered from memory, the logs are replayed into memory when the store is opened.
+// Events of deleted logs are only queryable until the store is reopened.
+// Rollups are kept in memory as well, expired events are only removed from memory and are replayed when the store is reopened.
+type FileAnalyticsStore struct {
+	*MemoryAnalyticsStore
+	cfg    FileStoreConfig
+	mu     sync.Mutex // guards file, writer and size
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	errors chan error
+}
+
+func NewFileAnalyticsStore(cfg FileStoreConfig) (*FileAnalyticsStore, error) {
+	if cfg.MaxFileSize <= 0 {
+		cfg.MaxFileSize = DEFAULT_MAX_FILE_SIZE
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = DEFAULT_MAX_FILES
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create log directory: %w", err)
+	}
+	fs := &FileAnalyticsStore{
+		MemoryAnalyticsStore: NewMemoryAnalyticsStore(),
+		cfg:                  cfg,
+		errors:               make(chan error, 100),
+	}
+	logs, err := fs.rotatedLogs()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range append(logs, currentLogName) {
+		if err := fs.replay(filepath.Join(cfg.Dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	if err := fs.openCurrent(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// replay loads the events of a log into memory. Lines that can't be decoded, e.g. a line torn by a crash, are skipped.
+func (fs *FileAnalyticsStore) replay(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	var events []Event
+	for scanner.Scan() {
+		var rec fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		switch {
+		case rec.Creation != nil:
+			events = append(events, rec.Creation)
+		case rec.Redirect != nil:
+			events = append(events, rec.Redirect)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read log %s: %w", path, err)
+	}
+	fs.MemoryAnalyticsStore.WriteEvents(context.Background(), events)
+	return nil
+}
+
+// rotatedLogs returns the names of the rotated logs, oldest first
+func (fs *FileAnalyticsStore) rotatedLogs() ([]string, error) {
+	entries, err := os.ReadDir(fs.cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("read log directory: %w", err)
+	}
+	var logs []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), rotatedLogPrefix) && strings.HasSuffix(e.Name(), rotatedLogSuffix) {
+			logs = append(logs, e.Name())
+		}
+	}
+	// The timestamp layout sorts lexically
+	sort.Strings(logs)
+	return logs, nil
+}
+
+func (fs *FileAnalyticsStore) openCurrent() error {
+	f, err := os.OpenFile(filepath.Join(fs.cfg.Dir, currentLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat log: %w", err)
+	}
+	fs.file = f
+	fs.writer = bufio.NewWriter(f)
+	fs.size = info.Size()
+	return nil
+}
+
+// WriteURLCreationEvent appends the event right away, failures are reported on the errors channel
+func (fs *FileAnalyticsStore) WriteURLCreationEvent(event *URLCreationEvent) {
+	if err := fs.WriteEvents(context.Background(), []Event{event}); err != nil {
+		fs.reportError(err)
+	}
+}
+
+// WriteURLRedirectEvent appends the event right away, failures are reported on the errors channel
+func (fs *FileAnalyticsStore) WriteURLRedirectEvent(event *URLRedirectEvent) {
+	if err := fs.WriteEvents(context.Background(), []Event{event}); err != nil {
+		fs.reportError(err)
+	}
+}
+
+// WriteEvents appends the batch to the log. If it fails, the events before the failing one may have been written and
+// are recorded again when the caller retries the batch.
+func (fs *FileAnalyticsStore) WriteEvents(ctx context.Context, events []Event) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return errors.New("write to closed file store")
+	}
+	written := make([]Event, 0, len(events))
+	var err error
+	for _, event := range events {
+		var rec fileRecord
+		switch e := event.(type) {
+		case *URLCreationEvent:
+			rec.Creation = e
+		case *URLRedirectEvent:
+			rec.Redirect = e
+		default:
+			continue
+		}
+		var line []byte
+		line, err = json.Marshal(rec)
+		if err != nil {
+			err = fmt.Errorf("encode event: %w", err)
+			break
+		}
+		var n int
+		n, err = fs.writer.Write(append(line, '\n'))
+		fs.size += int64(n)
+		if err != nil {
+			err = fmt.Errorf("write event: %w", err)
+			break
+		}
+		written = append(written, event)
+	}
+	// Hand the batch to the OS right away so that readers of the log see it, Flush additionally syncs it to disk
+	if flushErr := fs.writer.Flush(); err == nil && flushErr != nil {
+		err = fmt.Errorf("write events: %w", flushErr)
+	}
+	if err != nil {
+		return err
+	}
+	fs.MemoryAnalyticsStore.WriteEvents(ctx, written)
+	if fs.size >= fs.cfg.MaxFileSize {
+		if err := fs.rotate(); err != nil {
+			// The events are written, only the next batch goes to the full log
+			fs.reportError(err)
+		}
+	}
+	return nil
+}
+
+// rotate renames the current log and starts a new one, then deletes the oldest logs beyond MaxFiles
+func (fs *FileAnalyticsStore) rotate() error {
+	if err := fs.file.Sync(); err != nil {
+		return fmt.Errorf("sync log: %w", err)
+	}
+	if err := fs.file.Close(); err != nil {
+		return fmt.Errorf("close log: %w", err)
+	}
+	fs.file = nil
+	rotated := rotatedLogPrefix + time.Now().UTC().Format(rotatedLogLayout) + rotatedLogSuffix
+	renameErr := os.Rename(filepath.Join(fs.cfg.Dir, currentLogName), filepath.Join(fs.cfg.Dir, rotated))
+	// Reopen the log even if the rename failed, so that writes go on
+	if err := fs.openCurrent(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("rotate log: %w", renameErr)
+	}
+	logs, err := fs.rotatedLogs()
+	if err != nil {
+		return err
+	}
+	for len(logs) > fs.cfg.MaxFiles {
+		if err := os.Remove(filepath.Join(fs.cfg.Dir, logs[0])); err != nil {
+			return fmt.Errorf("delete log: %w", err)
+		}
+		logs = logs[1:]
+	}
+	return nil
+}
+
+// reportError passes err to the errors channel without blocking the writer, errors are dropped if nobody reads them
+func (fs *FileAnalyticsStore) reportError(err error) {
+	select {
+	case fs.errors <- err:
+	default:
+	}
+}
+
+func (fs *FileAnalyticsStore) Errors() <-chan error {
+	return fs.errors
+}
+
+func (fs *FileAnalyticsStore) Ping(ctx context.Context) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return errors.New("file store is closed")
+	}
+	return nil
+}
+
+// Flush syncs the current log to disk
+func (fs *FileAnalyticsStore) Flush() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return
+	}
+	if err := fs.file.Sync(); err != nil {
+		fs.reportError(fmt.Errorf("sync log: %w", err))
+	}
+}
+
+func (fs *FileAnalyticsStore) Close() {
+	fs.Flush()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return
+	}
+	if err := fs.file.Close(); err != nil {
+		fs.reportError(fmt.Errorf("close log: %w", err))
+	}
+	fs.file = nil
+}
@@ -0,0 +1,109 @@
+// Package hll implements HyperLogLog sketches to estimate the number of distinct visitors.
+// Sketches of disjoint time ranges can be merged into the sketch of the whole range.
+package hll
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// PRECISION bits of the hash select the register, the standard error of the estimate is 1.04 / sqrt(2^PRECISION), about 1.6%
+	PRECISION = 12
+	REGISTERS = 1 << PRECISION
+
+	formatVersion = 1
+)
+
+var ErrInvalidSketch = errors.New("invalid sketch")
+
+// Sketch is a dense HyperLogLog sketch, the zero value is an empty sketch
+type Sketch struct {
+	registers [REGISTERS]uint8
+}
+
+func New() *Sketch {
+	return &Sketch{}
+}
+
+// Add adds an item, e.g. a visitor fingerprint
+func (s *Sketch) Add(item string) {
+	h := hash(item)
+	idx := h >> (64 - PRECISION)
+	// Position of the first set bit of the remaining bits, the sentinel bit caps it at 64 - PRECISION + 1
+	rank := uint8(bits.LeadingZeros64(h<<PRECISION|1<<(PRECISION-1)) + 1)
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// Merge adds all items of o to s
+func (s *Sketch) Merge(o *Sketch) {
+	for i, r := range o.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+}
+
+// Empty reports whether no item was added
+func (s *Sketch) Empty() bool {
+	for _, r := range s.registers {
+		if r != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Estimate returns the estimated number of distinct items
+func (s *Sketch) Estimate() int64 {
+	const m = float64(REGISTERS)
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// Linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 2+REGISTERS)
+	data[0] = formatVersion
+	data[1] = PRECISION
+	copy(data[2:], s.registers[:])
+	return data, nil
+}
+
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) != 2+REGISTERS || data[0] != formatVersion || data[1] != PRECISION {
+		return ErrInvalidSketch
+	}
+	copy(s.registers[:], data[2:])
+	return nil
+}
+
+// hash is stable across processes, so that persisted sketches can be merged with new ones
+func hash(item string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	// FNV mixes the last bytes poorly, the finalizer of splitmix64 spreads them over all bits
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
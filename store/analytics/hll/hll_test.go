@@ -0,0 +1,53 @@
+package hll
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		s := New()
+		for i := range n {
+			s.Add(fmt.Sprintf("visitor-%d", i))
+			// Repeated items don't change the estimate
+			s.Add(fmt.Sprintf("visitor-%d", i))
+		}
+		got := s.Estimate()
+		if diff := math.Abs(float64(got) - float64(n)); diff > 0.05*float64(n) {
+			t.Errorf("Expected about %d distinct items, got %d", n, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+	for i := range 2000 {
+		a.Add(fmt.Sprintf("visitor-%d", i))
+		b.Add(fmt.Sprintf("visitor-%d", i+1000))
+	}
+	a.Merge(b)
+	if got := a.Estimate(); math.Abs(float64(got)-3000) > 150 {
+		t.Errorf("Expected about 3000 distinct items after merging, got %d", got)
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	s := New()
+	s.Add("visitor")
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	var got Sketch
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if got != *s {
+		t.Error("Expected the same sketch after a round trip")
+	}
+	if err := got.UnmarshalBinary(data[1:]); err != ErrInvalidSketch {
+		t.Errorf("Expected ErrInvalidSketch for truncated data, got %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	influxAPIWrite "github.com/influxdata/influxdb-client-go/v2/api/write"
+	protocol "github.com/influxdata/line-protocol"
+)
+
+// Short URLs per purge query, keeps the Flux sets short
+const INFLUX_PURGE_CHUNK_SIZE = 100
+
+// The browser, OS and device tags of the redirect points are dropped by the anonymization, see redirectPoint
+var (
+	anonymizedTagKeys = []string{"browser", "os", "device"}
+	anonymizedFields  = []string{"ip", "client_ip", "visitor_id"}
+)
+
+func (ias *InfluxDBAnalyticsStore) ShortURLsOfOwner(ctx context.Context, owner string) ([]string, error) {
+	q := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: 0)
+  |> filter(fn: (r) => r._measurement == %s and (r._field == "short_url" or r._field == "owner"))
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> filter(fn: (r) => r.owner == %s and exists r.short_url)
+  |> group()
+  |> distinct(column: "short_url")`, fluxString(ias.bucket), fluxString(URL_CREATION_MEASUREMENT), fluxString(owner))
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("query short URLs of owner: %w", err)
+	}
+	defer result.Close()
+	var shortURLs []string
+	for result.Next() {
+		if shortURL, ok := result.Record().Value().(string); ok && shortURL != "" {
+			shortURLs = append(shortURLs, shortURL)
+		}
+	}
+	return shortURLs, result.Err()
+}
+
+// PurgeLinks deletes the events and rollups of the short URLs with one delete per short URL and measurement, the
+// events are selected by their link tag. Points written before the tag was added are only found by their short_url
+// field, the delete API can't select them by it: they are deleted point by point.
+func (ias *InfluxDBAnalyticsStore) PurgeLinks(ctx context.Context, shortURLs []string) error {
+	bucket, err := ias.ensureRollupBucket(ctx)
+	if err != nil {
+		return err
+	}
+	for _, shortURL := range shortURLs {
+		for _, d := range []struct{ bucket, measurement, tag string }{
+			{ias.bucket, URL_CREATION_MEASUREMENT, "link"},
+			{ias.bucket, URL_REDIRECT_MEASUREMENT, "link"},
+			{bucket, ROLLUP_MEASUREMENT, "short_url"},
+			{bucket, VISITOR_SKETCH_MEASUREMENT, "short_url"},
+		} {
+			err := ias.client.DeleteAPI().DeleteWithName(ctx, ias.org, d.bucket, time.Unix(0, 0), time.Now(),
+				fmt.Sprintf("_measurement=%s AND %s=%s", fluxString(d.measurement), d.tag, fluxString(shortURL)))
+			if err != nil {
+				return fmt.Errorf("purge %s of %s: %w", d.measurement, shortURL, err)
+			}
+		}
+	}
+	for chunk := range chunks(shortURLs, INFLUX_PURGE_CHUNK_SIZE) {
+		set := make([]string, len(chunk))
+		for i, shortURL := range chunk {
+			set[i] = fluxString(shortURL)
+		}
+		q := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: 0)
+  |> filter(fn: (r) => (r._measurement == %s or r._measurement == %s) and r._field == "short_url" and not exists r.link)
+  |> filter(fn: (r) => contains(value: r._value, set: [%s]))`,
+			fluxString(ias.bucket), fluxString(URL_CREATION_MEASUREMENT), fluxString(URL_REDIRECT_MEASUREMENT), strings.Join(set, ", "))
+		if err := ias.deletePoints(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LinesOfShortURLs matches lines of line protocol with events of the short URLs, e.g. to drop them from the dead-letter
+// queue during a purge. Lines that can't be parsed don't match.
+func LinesOfShortURLs(shortURLs []string) func(line string) bool {
+	set := make(map[string]bool, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		set[shortURL] = true
+	}
+	parser := protocol.NewParser(protocol.NewMetricHandler())
+	return func(line string) bool {
+		metrics, err := parser.Parse([]byte(line))
+		if err != nil || len(metrics) != 1 {
+			return false
+		}
+		m := metrics[0]
+		if m.Name() != URL_CREATION_MEASUREMENT && m.Name() != URL_REDIRECT_MEASUREMENT {
+			return false
+		}
+		for _, f := range m.FieldList() {
+			if f.Key == "short_url" {
+				s, ok := f.Value.(string)
+				return ok && set[s]
+			}
+		}
+		return false
+	}
+}
+
+// deletePoints deletes the points of the rows of the query one by one, one row per point
+func (ias *InfluxDBAnalyticsStore) deletePoints(ctx context.Context, q string) error {
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return fmt.Errorf("query points: %w", err)
+	}
+	defer result.Close()
+	for result.Next() {
+		r := result.Record()
+		predicate := []string{"_measurement=" + fluxString(r.Measurement())}
+		for k, v := range r.Values() {
+			if s, ok := v.(string); ok && !strings.HasPrefix(k, "_") && k != "result" && k != "table" {
+				predicate = append(predicate, k+"="+fluxString(s))
+			}
+		}
+		// Start and stop of a delete are inclusive
+		err := ias.client.DeleteAPI().DeleteWithName(ctx, ias.org, ias.bucket, r.Time(), r.Time(), strings.Join(predicate, " AND "))
+		if err != nil {
+			return fmt.Errorf("delete point: %w", err)
+		}
+	}
+	if err := result.Err(); err != nil {
+		return fmt.Errorf("query points: %w", err)
+	}
+	return nil
+}
+
+// AnonymizeRedirects rewrites the points that aren't anonymous yet. InfluxDB can't remove fields and tags of a point:
+// points with browser, OS or device tags are written again without them and with a new series, then the original
+// series are deleted by tag. The address and fingerprint fields of the other points are overwritten by empty strings.
+func (ias *InfluxDBAnalyticsStore) AnonymizeRedirects(ctx context.Context, from time.Time, to time.Time) error {
+	q := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> filter(fn: (r) => exists r.browser or exists r.os or exists r.device or
+    (exists r.ip and r.ip != "") or (exists r.client_ip and r.client_ip != "") or (exists r.visitor_id and r.visitor_id != ""))`,
+		fluxString(ias.bucket), fluxTime(from), fluxTime(to), fluxString(URL_REDIRECT_MEASUREMENT))
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return fmt.Errorf("query redirects: %w", err)
+	}
+	defer result.Close()
+	writer := ias.client.WriteAPIBlocking(ias.org, ias.bucket)
+	points := make([]*influxAPIWrite.Point, 0, ROLLUP_WRITE_CHUNK_SIZE)
+	write := func() error {
+		if len(points) == 0 {
+			return nil
+		}
+		if err := writer.WritePoint(ctx, points...); err != nil {
+			return fmt.Errorf("write anonymized redirects: %w", err)
+		}
+		points = points[:0]
+		return nil
+	}
+	// The series with tags that are dropped, they are deleted once their points are written again.
+	// Events of the range that arrive in between would be deleted as well, the range is expected to be long past.
+	series := make(map[string]bool)
+	for result.Next() {
+		r := result.Record()
+		// The tags are the group key, the pivoted fields aren't. Points written before the event id became a field
+		// have it as a tag and keep it.
+		isTag := make(map[string]bool)
+		for _, c := range result.TableMetadata().Columns() {
+			isTag[c.Name()] = c.IsGroup()
+		}
+		t, f := tags{}, fields{}
+		moved := false
+		for k, v := range r.Values() {
+			s, _ := v.(string)
+			switch {
+			case strings.HasPrefix(k, "_") || k == "result" || k == "table" || v == nil:
+			case slices.Contains(anonymizedTagKeys, k):
+				series[k+"="+fluxString(s)] = true
+				moved = true
+			case isTag[k]:
+				t[k] = s
+			case slices.Contains(anonymizedFields, k):
+				f[k] = ""
+			default:
+				f[k] = v
+			}
+		}
+		// A point that moves to a new series is written without the fields, the others overwrite them
+		if moved {
+			for _, k := range anonymizedFields {
+				delete(f, k)
+			}
+		}
+		points = append(points, influxAPIWrite.NewPoint(URL_REDIRECT_MEASUREMENT, t, f, r.Time()))
+		if len(points) == cap(points) {
+			if err := write(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := result.Err(); err != nil {
+		return fmt.Errorf("query redirects: %w", err)
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	start := from
+	if start.Before(time.Unix(0, 0)) {
+		start = time.Unix(0, 0)
+	}
+	for predicate := range series {
+		err := ias.client.DeleteAPI().DeleteWithName(ctx, ias.org, ias.bucket, start, to.Add(-time.Nanosecond),
+			fmt.Sprintf("_measurement=%s AND %s", fluxString(URL_REDIRECT_MEASUREMENT), predicate))
+		if err != nil {
+			return fmt.Errorf("delete redirects with %s: %w", predicate, err)
+		}
+	}
+	return nil
+}
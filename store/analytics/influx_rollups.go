@@ -0,0 +1,274 @@
+package analytics
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	influxAPIWrite "github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/mactavishz/kuerzen/store/analytics/hll"
+)
+
+const (
+	ROLLUP_MEASUREMENT           = "ClickRollup"
+	ROLLUP_WATERMARK_MEASUREMENT = "RollupWatermark"
+	// The rollups are kept in a bucket of their own, named after the event bucket unless set by SetRollupBucket
+	ROLLUP_BUCKET_SUFFIX = "_rollups"
+	// Points written to InfluxDB per request
+	ROLLUP_WRITE_CHUNK_SIZE = 5000
+)
+
+// SetRollupBucket sets the bucket of the rollups, it is created on first use if it doesn't exist
+func (ias *InfluxDBAnalyticsStore) SetRollupBucket(bucket string) {
+	ias.rollupMu.Lock()
+	defer ias.rollupMu.Unlock()
+	ias.rollupBucket = bucket
+	ias.rollupBucketReady = false
+}
+
+// ensureRollupBucket creates the rollup bucket unless it is known to exist and returns its name
+func (ias *InfluxDBAnalyticsStore) ensureRollupBucket(ctx context.Context) (string, error) {
+	ias.rollupMu.Lock()
+	defer ias.rollupMu.Unlock()
+	if ias.rollupBucketReady {
+		return ias.rollupBucket, nil
+	}
+	if _, err := ias.client.BucketsAPI().FindBucketByName(ctx, ias.rollupBucket); err != nil {
+		org, err := ias.client.OrganizationsAPI().FindOrganizationByName(ctx, ias.org)
+		if err != nil {
+			return "", fmt.Errorf("find organization %s: %w", ias.org, err)
+		}
+		// The rollup job expires the rollups, the bucket keeps them forever
+		if _, err := ias.client.BucketsAPI().CreateBucketWithName(ctx, org, ias.rollupBucket); err != nil {
+			return "", fmt.Errorf("create rollup bucket %s: %w", ias.rollupBucket, err)
+		}
+	}
+	ias.rollupBucketReady = true
+	return ias.rollupBucket, nil
+}
+
+func (ias *InfluxDBAnalyticsStore) ScanRedirects(ctx context.Context, shortURL string, from time.Time, to time.Time, fn func(*URLRedirectEvent)) error {
+	q := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and (r._field == "short_url" or r._field == "success" or r._field == "visitor_id"))
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`,
+		fluxString(ias.bucket), fluxTime(from), fluxTime(to), fluxString(URL_REDIRECT_MEASUREMENT))
+	if shortURL != "" {
+		q += `
+  |> filter(fn: (r) => r.short_url == ` + fluxString(shortURL) + ")"
+	}
+	q += `
+  |> keep(columns: ["_time", "short_url", "success", "visitor_id", "bot_class", "referrer_host"])`
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return fmt.Errorf("query redirects: %w", err)
+	}
+	defer result.Close()
+	for result.Next() {
+		r := result.Record()
+		e := &URLRedirectEvent{Timestamp: r.Time()}
+		e.ShortURL, _ = r.ValueByKey("short_url").(string)
+		e.Success, _ = r.ValueByKey("success").(bool)
+		e.VisitorID, _ = r.ValueByKey("visitor_id").(string)
+		e.BotClass, _ = r.ValueByKey("bot_class").(string)
+		e.ReferrerHost, _ = r.ValueByKey("referrer_host").(string)
+		fn(e)
+	}
+	return result.Err()
+}
+
+func (ias *InfluxDBAnalyticsStore) WriteRollups(ctx context.Context, resolution time.Duration, to time.Time, rollups []Rollup) error {
+	bucket, err := ias.ensureRollupBucket(ctx)
+	if err != nil {
+		return err
+	}
+	points := make([]*influxAPIWrite.Point, 0, len(rollups)+1)
+	for _, r := range rollups {
+		f := fields{
+			"clicks":   r.Clicks,
+			"failures": r.Failures,
+		}
+		if r.Clicks > 0 {
+			f["first_click"] = r.FirstClick.UnixNano()
+			f["last_click"] = r.LastClick.UnixNano()
+		}
+		if r.Visitors != nil && !r.Visitors.Empty() {
+			data, _ := r.Visitors.MarshalBinary()
+			f["visitors"] = base64.StdEncoding.EncodeToString(data)
+		}
+		if len(r.Referrers) > 0 {
+			data, _ := json.Marshal(r.Referrers)
+			f["referrers"] = string(data)
+		}
+		// Points of the same series and time overwrite each other, rewriting a bucket replaces it
+		t := tags{"short_url": r.ShortURL, "resolution": resolution.String()}
+		points = append(points, influxAPIWrite.NewPoint(ROLLUP_MEASUREMENT, t, f, r.Bucket))
+	}
+	// The watermark is written last, rollups written before a failure are rewritten by the next run
+	points = append(points, influxAPIWrite.NewPoint(ROLLUP_WATERMARK_MEASUREMENT, tags{"resolution": resolution.String()},
+		fields{"until": to.UnixNano()}, to))
+	writer := ias.client.WriteAPIBlocking(ias.org, bucket)
+	for chunk := range chunks(points, ROLLUP_WRITE_CHUNK_SIZE) {
+		if err := writer.WritePoint(ctx, chunk...); err != nil {
+			return fmt.Errorf("write rollups: %w", err)
+		}
+	}
+	return nil
+}
+
+func (ias *InfluxDBAnalyticsStore) RolledUpUntil(ctx context.Context, resolution time.Duration) (time.Time, error) {
+	bucket, err := ias.ensureRollupBucket(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	q := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: 0)
+  |> filter(fn: (r) => r._measurement == %s and r.resolution == %s and r._field == "until")
+  |> last()`, fluxString(bucket), fluxString(ROLLUP_WATERMARK_MEASUREMENT), fluxString(resolution.String()))
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query rollup watermark: %w", err)
+	}
+	defer result.Close()
+	var until time.Time
+	if result.Next() {
+		until = time.Unix(0, toInt64(result.Record().Value())).UTC()
+	}
+	return until, result.Err()
+}
+
+func (ias *InfluxDBAnalyticsStore) Oldest(ctx context.Context, resolution time.Duration) (time.Time, error) {
+	bucket, filter := ias.bucket, fmt.Sprintf(`r._measurement == %s and r._field == "success"`, fluxString(URL_REDIRECT_MEASUREMENT))
+	if resolution != 0 {
+		var err error
+		if bucket, err = ias.ensureRollupBucket(ctx); err != nil {
+			return time.Time{}, err
+		}
+		filter = fmt.Sprintf(`r._measurement == %s and r.resolution == %s and r._field == "clicks"`,
+			fluxString(ROLLUP_MEASUREMENT), fluxString(resolution.String()))
+	}
+	// The first point of every series, then the earliest of them
+	q := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: 0)
+  |> filter(fn: (r) => %s)
+  |> first()
+  |> group()
+  |> sort(columns: ["_time"])
+  |> limit(n: 1)`, fluxString(bucket), filter)
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query oldest data: %w", err)
+	}
+	defer result.Close()
+	var oldest time.Time
+	if result.Next() {
+		oldest = result.Record().Time().UTC()
+	}
+	return oldest, result.Err()
+}
+
+func (ias *InfluxDBAnalyticsStore) ReadRollups(ctx context.Context, resolution time.Duration, q RollupQuery) ([]Rollup, error) {
+	bucket, err := ias.ensureRollupBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter := fmt.Sprintf("r._measurement == %s and r.resolution == %s", fluxString(ROLLUP_MEASUREMENT), fluxString(resolution.String()))
+	if q.ShortURL != "" {
+		filter += " and r.short_url == " + fluxString(q.ShortURL)
+	}
+	if !q.Visitors {
+		filter += ` and r._field != "visitors"`
+	}
+	if !q.Referrers {
+		filter += ` and r._field != "referrers"`
+	}
+	query := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => %s)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`, fluxString(bucket), fluxTime(q.From), fluxTime(q.To), filter)
+	result, err := ias.queryAPI.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("query rollups: %w", err)
+	}
+	defer result.Close()
+	var rollups []Rollup
+	for result.Next() {
+		rec := result.Record()
+		r := Rollup{
+			Bucket:   rec.Time().UTC(),
+			Clicks:   toInt64(rec.ValueByKey("clicks")),
+			Failures: toInt64(rec.ValueByKey("failures")),
+		}
+		r.ShortURL, _ = rec.ValueByKey("short_url").(string)
+		if r.Clicks > 0 {
+			r.FirstClick = time.Unix(0, toInt64(rec.ValueByKey("first_click")))
+			r.LastClick = time.Unix(0, toInt64(rec.ValueByKey("last_click")))
+		}
+		if q.Visitors {
+			r.Visitors = hll.New()
+			if encoded, ok := rec.ValueByKey("visitors").(string); ok {
+				data, err := base64.StdEncoding.DecodeString(encoded)
+				if err == nil {
+					err = r.Visitors.UnmarshalBinary(data)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("decode visitors of %s at %s: %w", r.ShortURL, r.Bucket.Format(time.RFC3339), err)
+				}
+			}
+		}
+		if q.Referrers {
+			r.Referrers = make(map[string]int64)
+			if encoded, ok := rec.ValueByKey("referrers").(string); ok {
+				if err := json.Unmarshal([]byte(encoded), &r.Referrers); err != nil {
+					return nil, fmt.Errorf("decode referrers of %s at %s: %w", r.ShortURL, r.Bucket.Format(time.RFC3339), err)
+				}
+			}
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, result.Err()
+}
+
+// ExpireRedirects deletes the redirect events before the time, creation events are kept. The daily visitor sketches
+// that are maintained on write expire with the events.
+func (ias *InfluxDBAnalyticsStore) ExpireRedirects(ctx context.Context, before time.Time) error {
+	bucket, err := ias.ensureRollupBucket(ctx)
+	if err != nil {
+		return err
+	}
+	for _, d := range []struct{ bucket, measurement string }{
+		{ias.bucket, URL_REDIRECT_MEASUREMENT},
+		{bucket, VISITOR_SKETCH_MEASUREMENT},
+	} {
+		// The stop of a delete is inclusive
+		err := ias.client.DeleteAPI().DeleteWithName(ctx, ias.org, d.bucket, time.Unix(0, 0), before.Add(-time.Nanosecond),
+			fmt.Sprintf("_measurement=%s", fluxString(d.measurement)))
+		if err != nil {
+			return fmt.Errorf("expire %s: %w", d.measurement, err)
+		}
+	}
+	return nil
+}
+
+func (ias *InfluxDBAnalyticsStore) ExpireRollups(ctx context.Context, resolution time.Duration, before time.Time) error {
+	bucket, err := ias.ensureRollupBucket(ctx)
+	if err != nil {
+		return err
+	}
+	err = ias.client.DeleteAPI().DeleteWithName(ctx, ias.org, bucket, time.Unix(0, 0), before.Add(-time.Nanosecond),
+		fmt.Sprintf("_measurement=%s AND resolution=%s", fluxString(ROLLUP_MEASUREMENT), fluxString(resolution.String())))
+	if err != nil {
+		return fmt.Errorf("expire rollups: %w", err)
+	}
+	return nil
+}
+
+// fluxTime formats t as a Flux time literal, times before the Unix epoch become the epoch
+func fluxTime(t time.Time) string {
+	if t.Before(time.Unix(0, 0)) {
+		return "0"
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,186 @@
+package analytics
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	influxAPIWrite "github.com/influxdata/influxdb-client-go/v2/api/write"
+	protocol "github.com/influxdata/line-protocol"
+	"github.com/mactavishz/kuerzen/store/analytics/hll"
+)
+
+const (
+	VISITOR_SKETCH_MEASUREMENT = "VisitorSketch"
+	// Short URLs per query of the stored sketches, keeps the Flux sets short
+	VISITOR_SKETCH_CHUNK_SIZE = 100
+)
+
+// sketchWriter tells the analytics processes apart, each merges into sketches of its own so that concurrent merges
+// of several processes don't overwrite each other. The queries merge the sketches of all processes.
+func sketchWriter() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// mergeVisitorSketches merges the visitors of the clicks in a batch of line protocol into the daily sketches in the
+// rollup bucket, like the Postgres store does on write. Merging a visitor twice changes nothing, so batches that
+// are written again, e.g. from the dead-letter queue, don't count twice.
+func (ias *InfluxDBAnalyticsStore) mergeVisitorSketches(ctx context.Context, batch string) error {
+	sketches := visitorsOfBatch(batch, ias.client.Options().WriteOptions().Precision())
+	if len(sketches) == 0 {
+		return nil
+	}
+	bucket, err := ias.ensureRollupBucket(ctx)
+	if err != nil {
+		return err
+	}
+	ias.sketchMu.Lock()
+	defer ias.sketchMu.Unlock()
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, days := range sketches {
+		for day := range days {
+			first, last = min(first, day), max(last, day)
+		}
+	}
+	shortURLs := slices.Sorted(maps.Keys(sketches))
+	var points []*influxAPIWrite.Point
+	for chunk := range chunks(shortURLs, VISITOR_SKETCH_CHUNK_SIZE) {
+		set := make([]string, len(chunk))
+		for i, shortURL := range chunk {
+			set[i] = fluxString(shortURL)
+		}
+		filter := fmt.Sprintf("r.writer == %s and contains(value: r.short_url, set: [%s])", fluxString(ias.sketchWriter), strings.Join(set, ", "))
+		err := ias.readVisitorSketches(ctx, bucket, filter, time.Unix(0, first), time.Unix(0, last).Add(RESOLUTION_DAY),
+			func(shortURL string, day int64, stored *hll.Sketch) {
+				if sketch := sketches[shortURL][day]; sketch != nil {
+					sketch.Merge(stored)
+				}
+			})
+		if err != nil {
+			return err
+		}
+		for _, shortURL := range chunk {
+			for day, sketch := range sketches[shortURL] {
+				data, _ := sketch.MarshalBinary()
+				points = append(points, influxAPIWrite.NewPoint(VISITOR_SKETCH_MEASUREMENT,
+					tags{"short_url": shortURL, "writer": ias.sketchWriter},
+					fields{"visitors": base64.StdEncoding.EncodeToString(data)}, time.Unix(0, day)))
+			}
+		}
+	}
+	writer := ias.client.WriteAPIBlocking(ias.org, bucket)
+	for chunk := range chunks(points, ROLLUP_WRITE_CHUNK_SIZE) {
+		if err := writer.WritePoint(ctx, chunk...); err != nil {
+			return fmt.Errorf("write visitor sketches: %w", err)
+		}
+	}
+	return nil
+}
+
+// readVisitorSketches calls fn for the stored sketches of the days in [from, to) that match the Flux predicate
+func (ias *InfluxDBAnalyticsStore) readVisitorSketches(ctx context.Context, bucket string, filter string, from time.Time, to time.Time,
+	fn func(shortURL string, day int64, sketch *hll.Sketch)) error {
+	q := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and r._field == "visitors" and %s)`,
+		fluxString(bucket), fluxTime(from), fluxTime(to), fluxString(VISITOR_SKETCH_MEASUREMENT), filter)
+	result, err := ias.queryAPI.Query(ctx, q)
+	if err != nil {
+		return fmt.Errorf("query visitor sketches: %w", err)
+	}
+	defer result.Close()
+	for result.Next() {
+		r := result.Record()
+		shortURL, _ := r.ValueByKey("short_url").(string)
+		encoded, _ := r.Value().(string)
+		sketch := hll.New()
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			err = sketch.UnmarshalBinary(data)
+		}
+		if err != nil {
+			return fmt.Errorf("decode visitor sketch of %s at %s: %w", shortURL, r.Time().Format(time.DateOnly), err)
+		}
+		fn(shortURL, r.Time().UnixNano(), sketch)
+	}
+	if err := result.Err(); err != nil {
+		return fmt.Errorf("query visitor sketches: %w", err)
+	}
+	return nil
+}
+
+// visitorsOfBatch builds the daily sketches of the clicks in a batch of line protocol per short URL, lines that
+// can't be parsed are skipped
+func visitorsOfBatch(batch string, precision time.Duration) map[string]map[int64]*hll.Sketch {
+	handler := protocol.NewMetricHandler()
+	handler.SetTimePrecision(precision)
+	parser := protocol.NewParser(handler)
+	sketches := make(map[string]map[int64]*hll.Sketch)
+	for line := range strings.Lines(batch) {
+		metrics, err := parser.Parse([]byte(line))
+		if err != nil || len(metrics) != 1 || metrics[0].Name() != URL_REDIRECT_MEASUREMENT {
+			continue
+		}
+		m := metrics[0]
+		e := URLRedirectEvent{Timestamp: m.Time()}
+		for _, t := range m.TagList() {
+			if t.Key == "bot_class" {
+				e.BotClass = t.Value
+			}
+		}
+		for _, f := range m.FieldList() {
+			switch f.Key {
+			case "short_url":
+				e.ShortURL, _ = f.Value.(string)
+			case "success":
+				e.Success, _ = f.Value.(bool)
+			case "visitor_id":
+				e.VisitorID, _ = f.Value.(string)
+			}
+		}
+		if !e.IsClick() || e.ShortURL == "" || e.VisitorID == "" {
+			continue
+		}
+		if sketches[e.ShortURL] == nil {
+			sketches[e.ShortURL] = make(map[int64]*hll.Sketch)
+		}
+		addVisitor(sketches[e.ShortURL], e.Timestamp, e.VisitorID)
+	}
+	return sketches
+}
+
+// GetVisitorStats reads the daily sketches that mergeVisitorSketches maintains, the fingerprints of the events may
+// be anonymized already
+func (ias *InfluxDBAnalyticsStore) GetVisitorStats(ctx context.Context, shortURL string, since time.Duration) (*VisitorStats, error) {
+	bucket, err := ias.ensureRollupBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sketches := make(map[int64]*hll.Sketch)
+	err = ias.readVisitorSketches(ctx, bucket, "r.short_url == "+fluxString(shortURL), visitorsFrom(now, since), now.Add(RESOLUTION_DAY),
+		func(_ string, day int64, sketch *hll.Sketch) {
+			// One sketch per process and day
+			if sketches[day] == nil {
+				sketches[day] = hll.New()
+			}
+			sketches[day].Merge(sketch)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return newVisitorStats(shortURL, sketches), nil
+}
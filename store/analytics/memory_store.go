@@ -0,0 +1,231 @@
+package analytics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mactavishz/kuerzen/store/analytics/hll"
+)
+
+// MemoryAnalyticsStore keeps all events in memory, it is meant for tests and small single instance deployments
+type MemoryAnalyticsStore struct {
+	mu        sync.RWMutex
+	creations []*URLCreationEvent
+	redirects []*URLRedirectEvent
+	rollups   map[time.Duration]map[rollupKey]Rollup
+	rolledUp  map[time.Duration]time.Time // watermarks of the rollups
+	errors    chan error
+	now       func() time.Time
+}
+
+func NewMemoryAnalyticsStore() *MemoryAnalyticsStore {
+	return &MemoryAnalyticsStore{
+		rollups:  make(map[time.Duration]map[rollupKey]Rollup),
+		rolledUp: make(map[time.Duration]time.Time),
+		errors:   make(chan error),
+		now:      time.Now,
+	}
+}
+
+func (ms *MemoryAnalyticsStore) WriteURLCreationEvent(event *URLCreationEvent) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.creations = append(ms.creations, event)
+}
+
+func (ms *MemoryAnalyticsStore) WriteURLRedirectEvent(event *URLRedirectEvent) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.redirects = append(ms.redirects, event)
+}
+
+// WriteEvents keeps the events in memory, it never fails
+func (ms *MemoryAnalyticsStore) WriteEvents(ctx context.Context, events []Event) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, event := range events {
+		switch e := event.(type) {
+		case *URLCreationEvent:
+			ms.creations = append(ms.creations, e)
+		case *URLRedirectEvent:
+			ms.redirects = append(ms.redirects, e)
+		}
+	}
+	return nil
+}
+
+// Errors returns a channel that never receives, writes to memory can't fail
+func (ms *MemoryAnalyticsStore) Errors() <-chan error {
+	return ms.errors
+}
+
+func (ms *MemoryAnalyticsStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (ms *MemoryAnalyticsStore) Flush() {}
+
+func (ms *MemoryAnalyticsStore) Close() {}
+
+// clicks calls fn for every click (see URLRedirectEvent.IsClick) of shortURL (or of all short URLs if it is empty) of the last since duration
+func (ms *MemoryAnalyticsStore) clicks(shortURL string, since time.Duration, fn func(*URLRedirectEvent)) {
+	var from time.Time
+	if since > 0 {
+		from = ms.now().Add(-since)
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, e := range ms.redirects {
+		if !e.IsClick() || (shortURL != "" && e.ShortURL != shortURL) || e.Timestamp.Before(from) {
+			continue
+		}
+		fn(e)
+	}
+}
+
+func (ms *MemoryAnalyticsStore) GetLinkStats(ctx context.Context, shortURL string, since time.Duration) (*LinkStats, error) {
+	stats := &LinkStats{ShortURL: shortURL}
+	ms.clicks(shortURL, since, func(e *URLRedirectEvent) {
+		if stats.Clicks == 0 || e.Timestamp.Before(stats.FirstClick) {
+			stats.FirstClick = e.Timestamp
+		}
+		if stats.Clicks == 0 || e.Timestamp.After(stats.LastClick) {
+			stats.LastClick = e.Timestamp
+		}
+		stats.Clicks++
+	})
+	return stats, nil
+}
+
+func (ms *MemoryAnalyticsStore) GetClickSeries(ctx context.Context, shortURL string, interval time.Duration, since time.Duration) ([]ClickCount, error) {
+	counts := make(map[int64]int64)
+	ms.clicks(shortURL, since, func(e *URLRedirectEvent) {
+		counts[windowStart(e.Timestamp, interval)]++
+	})
+	return buildSeries(counts, ms.now(), interval, since), nil
+}
+
+func (ms *MemoryAnalyticsStore) TopLinks(ctx context.Context, since time.Duration, limit int) ([]RankEntry, error) {
+	counts := make(map[string]int64)
+	ms.clicks("", since, func(e *URLRedirectEvent) {
+		counts[e.ShortURL]++
+	})
+	return rankCounts(counts, limit), nil
+}
+
+func (ms *MemoryAnalyticsStore) TopReferrers(ctx context.Context, shortURL string, since time.Duration, limit int) ([]RankEntry, error) {
+	counts := make(map[string]int64)
+	ms.clicks(shortURL, since, func(e *URLRedirectEvent) {
+		if e.ReferrerHost != "" {
+			counts[e.ReferrerHost]++
+		}
+	})
+	return rankCounts(counts, limit), nil
+}
+
+func (ms *MemoryAnalyticsStore) GetVisitorStats(ctx context.Context, shortURL string, since time.Duration) (*VisitorStats, error) {
+	now := ms.now()
+	var daily time.Duration
+	if from := visitorsFrom(now, since); !from.IsZero() {
+		daily = now.Sub(from)
+	}
+	sketches := make(map[int64]*hll.Sketch)
+	ms.clicks(shortURL, daily, func(e *URLRedirectEvent) {
+		addVisitor(sketches, e.Timestamp, e.VisitorID)
+	})
+	return newVisitorStats(shortURL, sketches), nil
+}
+
+func (ms *MemoryAnalyticsStore) ScanRedirects(ctx context.Context, shortURL string, from time.Time, to time.Time, fn func(*URLRedirectEvent)) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, e := range ms.redirects {
+		if (shortURL == "" || e.ShortURL == shortURL) && !e.Timestamp.Before(from) && e.Timestamp.Before(to) {
+			fn(e)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryAnalyticsStore) WriteRollups(ctx context.Context, resolution time.Duration, to time.Time, rollups []Rollup) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.rollups[resolution] == nil {
+		ms.rollups[resolution] = make(map[rollupKey]Rollup)
+	}
+	for _, r := range rollups {
+		ms.rollups[resolution][rollupKey{shortURL: r.ShortURL, bucket: r.Bucket.UTC()}] = r
+	}
+	ms.rolledUp[resolution] = to
+	return nil
+}
+
+func (ms *MemoryAnalyticsStore) RolledUpUntil(ctx context.Context, resolution time.Duration) (time.Time, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.rolledUp[resolution], nil
+}
+
+func (ms *MemoryAnalyticsStore) Oldest(ctx context.Context, resolution time.Duration) (time.Time, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var oldest time.Time
+	if resolution == 0 {
+		for _, e := range ms.redirects {
+			if oldest.IsZero() || e.Timestamp.Before(oldest) {
+				oldest = e.Timestamp
+			}
+		}
+		return oldest, nil
+	}
+	for k := range ms.rollups[resolution] {
+		if oldest.IsZero() || k.bucket.Before(oldest) {
+			oldest = k.bucket
+		}
+	}
+	return oldest, nil
+}
+
+func (ms *MemoryAnalyticsStore) ReadRollups(ctx context.Context, resolution time.Duration, q RollupQuery) ([]Rollup, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var rollups []Rollup
+	for k, r := range ms.rollups[resolution] {
+		if (q.ShortURL == "" || k.shortURL == q.ShortURL) && !k.bucket.Before(q.From) && k.bucket.Before(q.To) {
+			if !q.Visitors {
+				r.Visitors = nil
+			}
+			if !q.Referrers {
+				r.Referrers = nil
+			}
+			rollups = append(rollups, r)
+		}
+	}
+	return rollups, nil
+}
+
+func (ms *MemoryAnalyticsStore) ExpireRedirects(ctx context.Context, before time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	kept := ms.redirects[:0]
+	for _, e := range ms.redirects {
+		if !e.Timestamp.Before(before) {
+			kept = append(kept, e)
+		}
+	}
+	clear(ms.redirects[len(kept):])
+	ms.redirects = kept
+	return nil
+}
+
+func (ms *MemoryAnalyticsStore) ExpireRollups(ctx context.Context, resolution time.Duration, before time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for k := range ms.rollups[resolution] {
+		if k.bucket.Before(before) {
+			delete(ms.rollups[resolution], k)
+		}
+	}
+	return nil
+}
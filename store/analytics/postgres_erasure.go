@@ -0,0 +1,62 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+func (ps *PostgresAnalyticsStore) ShortURLsOfOwner(ctx context.Context, owner string) ([]string, error) {
+	rows, err := ps.db.QueryContext(ctx, `
+	SELECT DISTINCT short_url FROM analytics_creation_events WHERE owner = $1 AND short_url <> ''
+	`, owner)
+	if err != nil {
+		return nil, fmt.Errorf("query short URLs of owner: %w", err)
+	}
+	defer rows.Close()
+	var shortURLs []string
+	for rows.Next() {
+		var shortURL string
+		if err := rows.Scan(&shortURL); err != nil {
+			return nil, fmt.Errorf("scan short URLs of owner: %w", err)
+		}
+		shortURLs = append(shortURLs, shortURL)
+	}
+	return shortURLs, rows.Err()
+}
+
+// PurgeLinks deletes the events, the click rollups maintained on write, the visitor sketches and the rollups
+// of the rollup job of the short URLs in a single transaction
+func (ps *PostgresAnalyticsStore) PurgeLinks(ctx context.Context, shortURLs []string) error {
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	for _, table := range []string{
+		"analytics_creation_events",
+		"analytics_redirect_events",
+		"analytics_click_rollups",
+		"analytics_visitor_sketches",
+		"analytics_rollups",
+	} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE short_url = ANY($1)", shortURLs); err != nil {
+			return fmt.Errorf("purge %s: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func (ps *PostgresAnalyticsStore) AnonymizeRedirects(ctx context.Context, from time.Time, to time.Time) error {
+	_, err := ps.db.ExecContext(ctx, `
+	UPDATE analytics_redirect_events SET ip = '', client_ip = '', browser = '', os = '', device = '', visitor_id = ''
+	WHERE time >= $1 AND time < $2 AND (ip <> '' OR client_ip <> '' OR browser <> '' OR os <> '' OR device <> '' OR visitor_id <> '')
+	`, from, to)
+	if err != nil {
+		return fmt.Errorf("anonymize redirects: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mactavishz/kuerzen/store/analytics/hll"
+)
+
+func (ps *PostgresAnalyticsStore) ScanRedirects(ctx context.Context, shortURL string, from time.Time, to time.Time, fn func(*URLRedirectEvent)) error {
+	rows, err := ps.db.QueryContext(ctx, `
+	SELECT short_url, success, time, visitor_id, bot_class, referrer_host FROM analytics_redirect_events
+	WHERE time >= $1 AND time < $2 AND ($3 = '' OR short_url = $3)
+	`, from, to, shortURL)
+	if err != nil {
+		return fmt.Errorf("query redirects: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e URLRedirectEvent
+		if err := rows.Scan(&e.ShortURL, &e.Success, &e.Timestamp, &e.VisitorID, &e.BotClass, &e.ReferrerHost); err != nil {
+			return fmt.Errorf("scan redirects: %w", err)
+		}
+		fn(&e)
+	}
+	return rows.Err()
+}
+
+func (ps *PostgresAnalyticsStore) WriteRollups(ctx context.Context, resolution time.Duration, to time.Time, rollups []Rollup) error {
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	seconds := int64(resolution / time.Second)
+	for chunk := range chunks(rollups, POSTGRES_INSERT_CHUNK_SIZE) {
+		rows := make([][]any, len(chunk))
+		for i, r := range chunk {
+			var visitors []byte
+			if r.Visitors != nil && !r.Visitors.Empty() {
+				visitors, _ = r.Visitors.MarshalBinary()
+			}
+			var referrers []byte
+			if len(r.Referrers) > 0 {
+				referrers, _ = json.Marshal(r.Referrers)
+			}
+			rows[i] = []any{seconds, r.ShortURL, r.Bucket, r.Clicks, r.Failures, nullTime(r.FirstClick), nullTime(r.LastClick), visitors, referrers}
+		}
+		err := insertRows(ctx, tx, "analytics_rollups (resolution_seconds, short_url, bucket, clicks, failures, first_click, last_click, visitors, referrers)", rows,
+			`ON CONFLICT (resolution_seconds, short_url, bucket) DO UPDATE SET clicks = EXCLUDED.clicks, failures = EXCLUDED.failures,
+			first_click = EXCLUDED.first_click, last_click = EXCLUDED.last_click, visitors = EXCLUDED.visitors, referrers = EXCLUDED.referrers`)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO analytics_rollup_watermarks (resolution_seconds, rolled_up_until) VALUES ($1, $2)
+	ON CONFLICT (resolution_seconds) DO UPDATE SET rolled_up_until = EXCLUDED.rolled_up_until`, seconds, to)
+	if err != nil {
+		return fmt.Errorf("update rollup watermark: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+func (ps *PostgresAnalyticsStore) RolledUpUntil(ctx context.Context, resolution time.Duration) (time.Time, error) {
+	var until time.Time
+	err := ps.db.QueryRowContext(ctx, `SELECT rolled_up_until FROM analytics_rollup_watermarks WHERE resolution_seconds = $1`,
+		int64(resolution/time.Second)).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query rollup watermark: %w", err)
+	}
+	return until, nil
+}
+
+func (ps *PostgresAnalyticsStore) Oldest(ctx context.Context, resolution time.Duration) (time.Time, error) {
+	var oldest sql.NullTime
+	var err error
+	if resolution == 0 {
+		err = ps.db.QueryRowContext(ctx, `SELECT min(time) FROM analytics_redirect_events`).Scan(&oldest)
+	} else {
+		err = ps.db.QueryRowContext(ctx, `SELECT min(bucket) FROM analytics_rollups WHERE resolution_seconds = $1`,
+			int64(resolution/time.Second)).Scan(&oldest)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("query oldest data: %w", err)
+	}
+	return oldest.Time, nil
+}
+
+func (ps *PostgresAnalyticsStore) ReadRollups(ctx context.Context, resolution time.Duration, q RollupQuery) ([]Rollup, error) {
+	rows, err := ps.db.QueryContext(ctx, `
+	SELECT short_url, bucket, clicks, failures, first_click, last_click, CASE WHEN $5 THEN visitors END, CASE WHEN $6 THEN referrers END
+	FROM analytics_rollups
+	WHERE resolution_seconds = $1 AND bucket >= $2 AND bucket < $3 AND ($4 = '' OR short_url = $4)
+	`, int64(resolution/time.Second), q.From, q.To, q.ShortURL, q.Visitors, q.Referrers)
+	if err != nil {
+		return nil, fmt.Errorf("query rollups: %w", err)
+	}
+	defer rows.Close()
+	var rollups []Rollup
+	for rows.Next() {
+		var r Rollup
+		var first, last sql.NullTime
+		var visitors, referrers []byte
+		if err := rows.Scan(&r.ShortURL, &r.Bucket, &r.Clicks, &r.Failures, &first, &last, &visitors, &referrers); err != nil {
+			return nil, fmt.Errorf("scan rollups: %w", err)
+		}
+		r.FirstClick, r.LastClick = first.Time, last.Time
+		if q.Visitors {
+			r.Visitors = hll.New()
+			if visitors != nil {
+				if err := r.Visitors.UnmarshalBinary(visitors); err != nil {
+					return nil, fmt.Errorf("decode visitors of %s at %s: %w", r.ShortURL, r.Bucket.Format(time.RFC3339), err)
+				}
+			}
+		}
+		if q.Referrers {
+			r.Referrers = make(map[string]int64)
+			if referrers != nil {
+				if err := json.Unmarshal(referrers, &r.Referrers); err != nil {
+					return nil, fmt.Errorf("decode referrers of %s at %s: %w", r.ShortURL, r.Bucket.Format(time.RFC3339), err)
+				}
+			}
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, rows.Err()
+}
+
+// ExpireRedirects drops the monthly partitions that end before the time and deletes the remaining expired rows.
+// The hourly click rollups and the daily visitor sketches that are maintained on write expire with the events.
+func (ps *PostgresAnalyticsStore) ExpireRedirects(ctx context.Context, before time.Time) error {
+	rows, err := ps.db.QueryContext(ctx, `
+	SELECT child.relname FROM pg_inherits
+	JOIN pg_class child ON child.oid = pg_inherits.inhrelid
+	JOIN pg_class parent ON parent.oid = pg_inherits.inhparent
+	WHERE parent.relname = 'analytics_redirect_events'
+	`)
+	if err != nil {
+		return fmt.Errorf("list partitions: %w", err)
+	}
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan partitions: %w", err)
+		}
+		var year, month int
+		if _, err := fmt.Sscanf(name, "analytics_redirect_events_y%04dm%02d", &year, &month); err != nil {
+			continue
+		}
+		if end := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC); !end.After(before) {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("list partitions: %w", err)
+	}
+	for _, name := range expired {
+		if _, err := ps.db.ExecContext(ctx, "DROP TABLE IF EXISTS "+name); err != nil {
+			return fmt.Errorf("drop partition %s: %w", name, err)
+		}
+		ps.mu.Lock()
+		delete(ps.partitions, name)
+		ps.mu.Unlock()
+	}
+	for _, q := range []string{
+		`DELETE FROM analytics_redirect_events WHERE time < $1`,
+		`DELETE FROM analytics_click_rollups WHERE bucket < $1`,
+		`DELETE FROM analytics_visitor_sketches WHERE day < $1`,
+	} {
+		if _, err := ps.db.ExecContext(ctx, q, before); err != nil {
+			return fmt.Errorf("expire redirects: %w", err)
+		}
+	}
+	return nil
+}
+
+func (ps *PostgresAnalyticsStore) ExpireRollups(ctx context.Context, resolution time.Duration, before time.Time) error {
+	_, err := ps.db.ExecContext(ctx, `DELETE FROM analytics_rollups WHERE resolution_seconds = $1 AND bucket < $2`,
+		int64(resolution/time.Second), before)
+	if err != nil {
+		return fmt.Errorf("expire rollups: %w", err)
+	}
+	return nil
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
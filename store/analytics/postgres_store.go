@@ -0,0 +1,436 @@
+package analytics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mactavishz/kuerzen/store/analytics/hll"
+)
+
+const (
+	// Rows per INSERT statement, keeps the number of parameters well below the limit of Postgres
+	POSTGRES_INSERT_CHUNK_SIZE = 1000
+	POSTGRES_WRITE_TIMEOUT     = 10 * time.Second
+)
+
+// postgresClick is the condition of the redirect events that count as clicks, see URLRedirectEvent.IsClick
+const postgresClick = "success AND bot_class NOT IN ('" + BOT_CLASS_BOT + "', '" + BOT_CLASS_SUSPECTED + "')"
+
+// PostgresAnalyticsStore writes events to monthly partitions of the event tables of the URL database
+// (see migrations/000002_analytics.sql) and maintains hourly click rollups in the same transaction.
+type PostgresAnalyticsStore struct {
+	db         *sql.DB
+	errors     chan error
+	mu         sync.Mutex
+	partitions map[string]bool // partitions known to exist
+	now        func() time.Time
+}
+
+func NewPostgresAnalyticsStore(db *sql.DB) *PostgresAnalyticsStore {
+	return &PostgresAnalyticsStore{
+		db:         db,
+		errors:     make(chan error, 100),
+		partitions: make(map[string]bool),
+		now:        time.Now,
+	}
+}
+
+// WriteURLCreationEvent writes the event right away, failures are reported on the errors channel
+func (ps *PostgresAnalyticsStore) WriteURLCreationEvent(event *URLCreationEvent) {
+	ps.WriteEvents(context.Background(), []Event{event})
+}
+
+// WriteURLRedirectEvent writes the event right away, failures are reported on the errors channel
+func (ps *PostgresAnalyticsStore) WriteURLRedirectEvent(event *URLRedirectEvent) {
+	ps.WriteEvents(context.Background(), []Event{event})
+}
+
+// WriteEvents writes the whole batch in a single transaction. Failures are also reported on the errors channel.
+func (ps *PostgresAnalyticsStore) WriteEvents(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, POSTGRES_WRITE_TIMEOUT)
+	defer cancel()
+	if err := ps.writeEvents(ctx, events); err != nil {
+		err = fmt.Errorf("write %d events: %w", len(events), err)
+		ps.reportError(err)
+		return err
+	}
+	return nil
+}
+
+func (ps *PostgresAnalyticsStore) writeEvents(ctx context.Context, events []Event) error {
+	var creations []*URLCreationEvent
+	var redirects []*URLRedirectEvent
+	for _, event := range events {
+		switch e := event.(type) {
+		case *URLCreationEvent:
+			creations = append(creations, e)
+			if err := ps.ensurePartition(ctx, "analytics_creation_events", e.Timestamp); err != nil {
+				return err
+			}
+		case *URLRedirectEvent:
+			redirects = append(redirects, e)
+			if err := ps.ensurePartition(ctx, "analytics_redirect_events", e.Timestamp); err != nil {
+				return err
+			}
+		}
+	}
+
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	for chunk := range chunks(creations, POSTGRES_INSERT_CHUNK_SIZE) {
+		rows := make([][]any, len(chunk))
+		for i, e := range chunk {
+			rows[i] = []any{e.Timestamp, e.ServiceName, e.URL, e.APIVer, e.Success, nullString(e.EventID), e.ShortURL, e.Owner}
+		}
+		if err := insertRows(ctx, tx, "analytics_creation_events (time, service, url, api_ver, success, event_id, short_url, owner)", rows,
+			"ON CONFLICT (event_id, time) DO NOTHING"); err != nil {
+			return err
+		}
+	}
+	rollups := make(map[rollupKey]int64)
+	sketches := make(map[string]map[int64]*hll.Sketch) // short URL -> day -> visitors of the batch
+	for chunk := range chunks(redirects, POSTGRES_INSERT_CHUNK_SIZE) {
+		rows := make([][]any, len(chunk))
+		for i, e := range chunk {
+			rows[i] = []any{e.Timestamp, e.ServiceName, e.ShortURL, e.LongURL, e.APIVer, e.Success,
+				e.ReferrerHost, e.Browser, e.OS, e.Device, e.AcceptLanguage, e.IP, e.ClientIP, e.CacheTier, e.Latency.Microseconds(),
+				nullString(e.EventID), e.VisitorID, e.BotClass}
+		}
+		// Only the inserted rows are rolled up, duplicates that already exist are skipped by the insert
+		err := insertRowsReturning(ctx, tx, `analytics_redirect_events (time, service, short_url, long_url, api_ver, success,
+			referrer_host, browser, os, device, accept_language, ip, client_ip, cache_tier, latency_us, event_id, visitor_id, bot_class)`, rows,
+			"ON CONFLICT (event_id, time) DO NOTHING RETURNING short_url, time, success, visitor_id, bot_class", func(scan func(...any) error) error {
+				var k rollupKey
+				var e URLRedirectEvent
+				if err := scan(&k.shortURL, &k.bucket, &e.Success, &e.VisitorID, &e.BotClass); err != nil {
+					return err
+				}
+				if e.IsClick() {
+					if sketches[k.shortURL] == nil {
+						sketches[k.shortURL] = make(map[int64]*hll.Sketch)
+					}
+					addVisitor(sketches[k.shortURL], k.bucket, e.VisitorID)
+					k.bucket = k.bucket.UTC().Truncate(time.Hour)
+					rollups[k]++
+				}
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+	}
+	rows := make([][]any, 0, len(rollups))
+	for k, clicks := range rollups {
+		rows = append(rows, []any{k.shortURL, k.bucket, clicks})
+	}
+	for chunk := range chunks(rows, POSTGRES_INSERT_CHUNK_SIZE) {
+		if err := insertRows(ctx, tx, "analytics_click_rollups (short_url, bucket, clicks)", chunk,
+			"ON CONFLICT (short_url, bucket) DO UPDATE SET clicks = analytics_click_rollups.clicks + EXCLUDED.clicks"); err != nil {
+			return err
+		}
+	}
+	if err := mergeVisitorSketches(ctx, tx, sketches); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// mergeVisitorSketches merges the sketches of a batch into the stored daily sketches.
+// Rows are locked in a fixed order, so that concurrent writers don't deadlock.
+func mergeVisitorSketches(ctx context.Context, tx *sql.Tx, sketches map[string]map[int64]*hll.Sketch) error {
+	shortURLs := make([]string, 0, len(sketches))
+	for shortURL := range sketches {
+		shortURLs = append(shortURLs, shortURL)
+	}
+	sort.Strings(shortURLs)
+	for _, shortURL := range shortURLs {
+		days := make([]int64, 0, len(sketches[shortURL]))
+		for day := range sketches[shortURL] {
+			days = append(days, day)
+		}
+		slices.Sort(days)
+		for _, day := range days {
+			if err := mergeVisitorSketch(ctx, tx, shortURL, time.Unix(0, day).UTC(), sketches[shortURL][day]); err != nil {
+				return fmt.Errorf("merge visitor sketch: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func mergeVisitorSketch(ctx context.Context, tx *sql.Tx, shortURL string, day time.Time, sketch *hll.Sketch) error {
+	empty, _ := hll.New().MarshalBinary()
+	// Insert an empty sketch first, a row that doesn't exist yet can't be locked
+	_, err := tx.ExecContext(ctx, `INSERT INTO analytics_visitor_sketches (short_url, day, sketch) VALUES ($1, $2, $3)
+	ON CONFLICT (short_url, day) DO NOTHING`, shortURL, day, empty)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	err = tx.QueryRowContext(ctx, `SELECT sketch FROM analytics_visitor_sketches WHERE short_url = $1 AND day = $2 FOR UPDATE`,
+		shortURL, day).Scan(&data)
+	if err != nil {
+		return err
+	}
+	stored := hll.New()
+	if err := stored.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	stored.Merge(sketch)
+	data, _ = stored.MarshalBinary()
+	_, err = tx.ExecContext(ctx, `UPDATE analytics_visitor_sketches SET sketch = $3 WHERE short_url = $1 AND day = $2`, shortURL, day, data)
+	return err
+}
+
+type rollupKey struct {
+	shortURL string
+	bucket   time.Time
+}
+
+// ensurePartition creates the monthly partition of table that holds t, unless it is known to exist
+func (ps *PostgresAnalyticsStore) ensurePartition(ctx context.Context, table string, t time.Time) error {
+	from := time.Date(t.UTC().Year(), t.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	name := fmt.Sprintf("%s_y%04dm%02d", table, from.Year(), from.Month())
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.partitions[name] {
+		return nil
+	}
+	// The bounds are literals, partition bounds can't be passed as parameters
+	_, err := ps.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+		name, table, from.Format(time.RFC3339), from.AddDate(0, 1, 0).Format(time.RFC3339)))
+	if err != nil {
+		return fmt.Errorf("create partition %s: %w", name, err)
+	}
+	ps.partitions[name] = true
+	return nil
+}
+
+// insertRows inserts all rows with a single multi-row INSERT statement
+func insertRows(ctx context.Context, tx *sql.Tx, target string, rows [][]any, suffix string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	query, args := insertStatement(target, rows, suffix)
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("insert into %s: %w", strings.Fields(target)[0], err)
+	}
+	return nil
+}
+
+// insertRowsReturning is insertRows for statements with a RETURNING clause, scan is called for every returned row
+func insertRowsReturning(ctx context.Context, tx *sql.Tx, target string, rows [][]any, suffix string, scan func(func(...any) error) error) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	query, args := insertStatement(target, rows, suffix)
+	returned, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("insert into %s: %w", strings.Fields(target)[0], err)
+	}
+	defer returned.Close()
+	for returned.Next() {
+		if err := scan(returned.Scan); err != nil {
+			return fmt.Errorf("scan rows inserted into %s: %w", strings.Fields(target)[0], err)
+		}
+	}
+	if err := returned.Err(); err != nil {
+		return fmt.Errorf("insert into %s: %w", strings.Fields(target)[0], err)
+	}
+	return nil
+}
+
+func insertStatement(target string, rows [][]any, suffix string) (string, []any) {
+	var b strings.Builder
+	args := make([]any, 0, len(rows)*len(rows[0]))
+	fmt.Fprintf(&b, "INSERT INTO %s VALUES ", target)
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for j := range row {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "$%d", len(args)+j+1)
+		}
+		b.WriteString(")")
+		args = append(args, row...)
+	}
+	if suffix != "" {
+		b.WriteString(" " + suffix)
+	}
+	return b.String(), args
+}
+
+// nullString stores empty strings as NULL, e.g. for event ids that must not conflict when they are missing
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// chunks yields consecutive slices of s with at most size elements
+func chunks[T any](s []T, size int) func(yield func([]T) bool) {
+	return func(yield func([]T) bool) {
+		for len(s) > 0 {
+			n := min(size, len(s))
+			if !yield(s[:n]) {
+				return
+			}
+			s = s[n:]
+		}
+	}
+}
+
+func (ps *PostgresAnalyticsStore) reportError(err error) {
+	select {
+	case ps.errors <- err:
+	default:
+	}
+}
+
+func (ps *PostgresAnalyticsStore) Errors() <-chan error {
+	return ps.errors
+}
+
+func (ps *PostgresAnalyticsStore) Ping(ctx context.Context) error {
+	return ps.db.PingContext(ctx)
+}
+
+// Flush does nothing, events are written synchronously
+func (ps *PostgresAnalyticsStore) Flush() {}
+
+// Close does nothing, the database connection is owned by the caller
+func (ps *PostgresAnalyticsStore) Close() {}
+
+// from returns the start of the time range of a query
+func (ps *PostgresAnalyticsStore) from(since time.Duration) time.Time {
+	if since <= 0 {
+		return time.Time{}
+	}
+	return ps.now().Add(-since)
+}
+
+func (ps *PostgresAnalyticsStore) GetLinkStats(ctx context.Context, shortURL string, since time.Duration) (*LinkStats, error) {
+	stats := &LinkStats{ShortURL: shortURL}
+	var first, last sql.NullTime
+	err := ps.db.QueryRowContext(ctx, `
+	SELECT count(*), min(time), max(time) FROM analytics_redirect_events
+	WHERE `+postgresClick+` AND short_url = $1 AND time >= $2
+	`, shortURL, ps.from(since)).Scan(&stats.Clicks, &first, &last)
+	if err != nil {
+		return nil, fmt.Errorf("query link stats: %w", err)
+	}
+	stats.FirstClick = first.Time
+	stats.LastClick = last.Time
+	return stats, nil
+}
+
+func (ps *PostgresAnalyticsStore) GetClickSeries(ctx context.Context, shortURL string, interval time.Duration, since time.Duration) ([]ClickCount, error) {
+	now := ps.now()
+	rows, err := ps.db.QueryContext(ctx, `
+	SELECT date_bin($1::interval, time, TIMESTAMPTZ 'epoch') AS window_start, count(*)
+	FROM analytics_redirect_events
+	WHERE `+postgresClick+` AND short_url = $2 AND time >= $3
+	GROUP BY window_start
+	`, fmt.Sprintf("%d microseconds", interval.Microseconds()), shortURL, ps.from(since))
+	if err != nil {
+		return nil, fmt.Errorf("query click series: %w", err)
+	}
+	defer rows.Close()
+	counts := make(map[int64]int64)
+	for rows.Next() {
+		var start time.Time
+		var clicks int64
+		if err := rows.Scan(&start, &clicks); err != nil {
+			return nil, fmt.Errorf("scan click series: %w", err)
+		}
+		counts[start.UnixNano()] = clicks
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query click series: %w", err)
+	}
+	return buildSeries(counts, now, interval, since), nil
+}
+
+// TopLinks is answered from the hourly rollups, so the time range is rounded down to the full hour
+func (ps *PostgresAnalyticsStore) TopLinks(ctx context.Context, since time.Duration, limit int) ([]RankEntry, error) {
+	from := ps.from(since).UTC().Truncate(time.Hour)
+	return ps.rank(ctx, `
+	SELECT short_url, sum(clicks)::BIGINT AS total FROM analytics_click_rollups
+	WHERE bucket >= $1
+	GROUP BY short_url
+	ORDER BY total DESC, short_url
+	LIMIT $2
+	`, from, limit)
+}
+
+func (ps *PostgresAnalyticsStore) TopReferrers(ctx context.Context, shortURL string, since time.Duration, limit int) ([]RankEntry, error) {
+	return ps.rank(ctx, `
+	SELECT referrer_host, count(*) AS total FROM analytics_redirect_events
+	WHERE `+postgresClick+` AND referrer_host <> '' AND time >= $1 AND ($3 = '' OR short_url = $3)
+	GROUP BY referrer_host
+	ORDER BY total DESC, referrer_host
+	LIMIT $2
+	`, ps.from(since), limit, shortURL)
+}
+
+func (ps *PostgresAnalyticsStore) GetVisitorStats(ctx context.Context, shortURL string, since time.Duration) (*VisitorStats, error) {
+	rows, err := ps.db.QueryContext(ctx, `
+	SELECT day, sketch FROM analytics_visitor_sketches
+	WHERE short_url = $1 AND day >= $2
+	`, shortURL, visitorsFrom(ps.now(), since))
+	if err != nil {
+		return nil, fmt.Errorf("query visitor sketches: %w", err)
+	}
+	defer rows.Close()
+	sketches := make(map[int64]*hll.Sketch)
+	for rows.Next() {
+		var day time.Time
+		var data []byte
+		if err := rows.Scan(&day, &data); err != nil {
+			return nil, fmt.Errorf("scan visitor sketches: %w", err)
+		}
+		sketch := hll.New()
+		if err := sketch.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("decode visitor sketch of %s: %w", day.Format(time.DateOnly), err)
+		}
+		sketches[day.UnixNano()] = sketch
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query visitor sketches: %w", err)
+	}
+	return newVisitorStats(shortURL, sketches), nil
+}
+
+func (ps *PostgresAnalyticsStore) rank(ctx context.Context, query string, args ...any) ([]RankEntry, error) {
+	rows, err := ps.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query ranking: %w", err)
+	}
+	defer rows.Close()
+	var entries []RankEntry
+	for rows.Next() {
+		var e RankEntry
+		if err := rows.Scan(&e.Key, &e.Clicks); err != nil {
+			return nil, fmt.Errorf("scan ranking: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
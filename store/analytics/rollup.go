@@ -0,0 +1,153 @@
+package analytics
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/mactavishz/kuerzen/store/analytics/hll"
+)
+
+// Resolutions of the rollups, buckets are aligned to multiples of the resolution since the Unix epoch
+const (
+	RESOLUTION_HOUR = time.Hour
+	RESOLUTION_DAY  = 24 * time.Hour
+)
+
+// ROLLUP_RESOLUTIONS lists the resolutions from fine to coarse, each is built from the previous one
+var ROLLUP_RESOLUTIONS = []time.Duration{RESOLUTION_HOUR, RESOLUTION_DAY}
+
+// MAX_ROLLUP_REFERRERS bounds the referrer hosts kept per rollup, the hosts with the fewest clicks are dropped
+const MAX_ROLLUP_REFERRERS = 100
+
+// Rollup aggregates the redirects of a short URL in the bucket [Bucket, Bucket + resolution)
+type Rollup struct {
+	ShortURL   string
+	Bucket     time.Time
+	Clicks     int64 // successful redirects, without bot traffic
+	Failures   int64 // failed redirects
+	FirstClick time.Time
+	LastClick  time.Time
+	Visitors   *hll.Sketch      // fingerprints of the visitors of the clicks
+	Referrers  map[string]int64 // clicks per referrer host, clicks without a referrer aren't counted
+}
+
+// RollupStore is implemented by the stores that keep rollups of the redirect events. The rollups are built by the
+// rollup job of the analytics service, they let queries of long ranges skip the raw events and outlive their expiry.
+type RollupStore interface {
+	// ScanRedirects calls fn for the redirect events of shortURL, or of all short URLs if it is empty, in [from, to).
+	// A zero from scans all events. Only ShortURL, Success, BotClass, Timestamp, VisitorID and ReferrerHost of the
+	// events are set.
+	ScanRedirects(ctx context.Context, shortURL string, from time.Time, to time.Time, fn func(*URLRedirectEvent)) error
+	// WriteRollups stores the rollups of the range ending at to and advances the watermark of the resolution to it.
+	// Rollups of a bucket that was written before replace the earlier ones.
+	WriteRollups(ctx context.Context, resolution time.Duration, to time.Time, rollups []Rollup) error
+	// RolledUpUntil returns the watermark of the resolution, zero if nothing was rolled up yet
+	RolledUpUntil(ctx context.Context, resolution time.Duration) (time.Time, error)
+	// Oldest returns the time of the oldest redirect event if resolution is 0, or the bucket of the oldest rollup of
+	// the resolution. It is zero if there is none.
+	Oldest(ctx context.Context, resolution time.Duration) (time.Time, error)
+	ReadRollups(ctx context.Context, resolution time.Duration, q RollupQuery) ([]Rollup, error)
+	// ExpireRedirects deletes the redirect events before the time
+	ExpireRedirects(ctx context.Context, before time.Time) error
+	// ExpireRollups deletes the rollups of the resolution whose bucket starts before the time
+	ExpireRollups(ctx context.Context, resolution time.Duration, before time.Time) error
+}
+
+// RollupQuery selects the rollups of the buckets starting in [From, To)
+type RollupQuery struct {
+	ShortURL  string // all short URLs if empty
+	From      time.Time
+	To        time.Time
+	Visitors  bool // whether to read the visitor sketches, Visitors of the rollups is nil otherwise
+	Referrers bool // whether to read the referrer counts, Referrers of the rollups is nil otherwise
+}
+
+// RollupBuilder aggregates redirects, or rollups of a finer resolution, into rollups
+type RollupBuilder struct {
+	resolution time.Duration
+	rollups    map[rollupKey]*Rollup
+}
+
+func NewRollupBuilder(resolution time.Duration) *RollupBuilder {
+	return &RollupBuilder{
+		resolution: resolution,
+		rollups:    make(map[rollupKey]*Rollup),
+	}
+}
+
+func (b *RollupBuilder) bucket(shortURL string, t time.Time) *Rollup {
+	k := rollupKey{shortURL: shortURL, bucket: time.Unix(0, windowStart(t, b.resolution)).UTC()}
+	r, ok := b.rollups[k]
+	if !ok {
+		r = &Rollup{ShortURL: shortURL, Bucket: k.bucket, Visitors: hll.New(), Referrers: make(map[string]int64)}
+		b.rollups[k] = r
+	}
+	return r
+}
+
+// AddRedirect adds a redirect to its bucket, redirects of bots are neither clicks nor failures
+func (b *RollupBuilder) AddRedirect(e *URLRedirectEvent) {
+	if e.Success && !e.IsClick() {
+		return
+	}
+	r := b.bucket(e.ShortURL, e.Timestamp)
+	if !e.Success {
+		r.Failures++
+		return
+	}
+	r.addClicks(1, e.Timestamp, e.Timestamp)
+	if e.VisitorID != "" {
+		r.Visitors.Add(e.VisitorID)
+	}
+	if e.ReferrerHost != "" {
+		r.Referrers[e.ReferrerHost]++
+	}
+}
+
+// AddRollup adds a rollup of a finer resolution to the bucket that contains it
+func (b *RollupBuilder) AddRollup(o Rollup) {
+	r := b.bucket(o.ShortURL, o.Bucket)
+	r.Failures += o.Failures
+	if o.Clicks > 0 {
+		r.addClicks(o.Clicks, o.FirstClick, o.LastClick)
+	}
+	if o.Visitors != nil {
+		r.Visitors.Merge(o.Visitors)
+	}
+	for host, clicks := range o.Referrers {
+		r.Referrers[host] += clicks
+	}
+}
+
+func (r *Rollup) addClicks(clicks int64, first time.Time, last time.Time) {
+	if r.Clicks == 0 || first.Before(r.FirstClick) {
+		r.FirstClick = first
+	}
+	if r.Clicks == 0 || last.After(r.LastClick) {
+		r.LastClick = last
+	}
+	r.Clicks += clicks
+}
+
+// Rollups returns the rollups ordered by bucket and short URL
+func (b *RollupBuilder) Rollups() []Rollup {
+	rollups := make([]Rollup, 0, len(b.rollups))
+	for _, r := range b.rollups {
+		if len(r.Referrers) > MAX_ROLLUP_REFERRERS {
+			top := make(map[string]int64, MAX_ROLLUP_REFERRERS)
+			for _, e := range rankCounts(r.Referrers, MAX_ROLLUP_REFERRERS) {
+				top[e.Key] = e.Clicks
+			}
+			r.Referrers = top
+		}
+		rollups = append(rollups, *r)
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		if !rollups[i].Bucket.Equal(rollups[j].Bucket) {
+			return rollups[i].Bucket.Before(rollups[j].Bucket)
+		}
+		return rollups[i].ShortURL < rollups[j].ShortURL
+	})
+	return rollups
+}
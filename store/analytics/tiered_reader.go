@@ -0,0 +1,225 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mactavishz/kuerzen/store/analytics/hll"
+)
+
+// Queries of ranges up to these durations prefer the raw events and the hourly rollups, longer ranges coarser data
+const (
+	RAW_QUERY_MAX_RANGE    = 48 * time.Hour
+	HOURLY_QUERY_MAX_RANGE = 14 * 24 * time.Hour
+)
+
+// Retention configures how long the data of each resolution is kept, 0 keeps it forever
+type Retention struct {
+	Raw    time.Duration // redirect events
+	Hourly time.Duration
+	Daily  time.Duration
+}
+
+// For returns the retention of the resolution, 0 stands for the raw events
+func (r Retention) For(resolution time.Duration) time.Duration {
+	switch resolution {
+	case RESOLUTION_HOUR:
+		return r.Hourly
+	case RESOLUTION_DAY:
+		return r.Daily
+	default:
+		return r.Raw
+	}
+}
+
+// TieredReader answers each query from the raw events or from the rollups, depending on the requested range.
+// Ranges answered from rollups are extended to the start of their first bucket. Redirects that haven't been rolled
+// up yet are aggregated when queried, so that recent clicks count as well.
+type TieredReader struct {
+	raw       AnalyticsReader
+	rollups   RollupStore
+	retention Retention
+	now       func() time.Time
+}
+
+func NewTieredReader(raw AnalyticsReader, rollups RollupStore, retention Retention) *TieredReader {
+	return &TieredReader{
+		raw:       raw,
+		rollups:   rollups,
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+// resolution picks the data a query is answered from, 0 for the raw events. It is the finest resolution that divides
+// the interval of the series, that is retained for the whole range and whose preferred range is not exceeded.
+// If there is none, the coarsest resolution that is retained for the whole range is used, or the coarsest that
+// divides the interval if no data covers the range.
+func (tr *TieredReader) resolution(since time.Duration, interval time.Duration) time.Duration {
+	tiers := []struct {
+		resolution time.Duration
+		maxRange   time.Duration // 0 for no limit
+	}{{0, RAW_QUERY_MAX_RANGE}, {RESOLUTION_HOUR, HOURLY_QUERY_MAX_RANGE}, {RESOLUTION_DAY, 0}}
+	best, bestCovered := time.Duration(0), false
+	for _, t := range tiers {
+		if t.resolution > 0 && interval%t.resolution != 0 {
+			continue
+		}
+		retention := tr.retention.For(t.resolution)
+		covered := retention == 0 || (since > 0 && since <= retention)
+		if covered && (t.maxRange == 0 || (since > 0 && since <= t.maxRange)) {
+			return t.resolution
+		}
+		if covered || !bestCovered {
+			best, bestCovered = t.resolution, covered
+		}
+	}
+	return best
+}
+
+// from returns the start of the range, aligned to the buckets of the resolution
+func (tr *TieredReader) from(since time.Duration, resolution time.Duration) time.Time {
+	if since <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, windowStart(tr.now().Add(-since), resolution)).UTC()
+}
+
+// collect calls add for the rollups of q at the resolution. Buckets that haven't been rolled up at the resolution
+// are added from finer resolutions, the redirects that aren't rolled up at all as hourly rollups.
+func (tr *TieredReader) collect(ctx context.Context, resolution time.Duration, q RollupQuery, add func(Rollup)) error {
+	q.To = tr.now()
+	start := q.From
+	for i := len(ROLLUP_RESOLUTIONS) - 1; i >= 0; i-- {
+		res := ROLLUP_RESOLUTIONS[i]
+		if res > resolution {
+			continue
+		}
+		until, err := tr.rollups.RolledUpUntil(ctx, res)
+		if err != nil {
+			return fmt.Errorf("query rollup watermark: %w", err)
+		}
+		if !until.After(start) {
+			continue
+		}
+		tier := q
+		tier.From, tier.To = start, until
+		rollups, err := tr.rollups.ReadRollups(ctx, res, tier)
+		if err != nil {
+			return fmt.Errorf("query rollups: %w", err)
+		}
+		for _, r := range rollups {
+			add(r)
+		}
+		start = until
+	}
+	b := NewRollupBuilder(RESOLUTION_HOUR)
+	if err := tr.rollups.ScanRedirects(ctx, q.ShortURL, start, q.To, b.AddRedirect); err != nil {
+		return fmt.Errorf("query redirects: %w", err)
+	}
+	for _, r := range b.Rollups() {
+		add(r)
+	}
+	return nil
+}
+
+func (tr *TieredReader) GetLinkStats(ctx context.Context, shortURL string, since time.Duration) (*LinkStats, error) {
+	resolution := tr.resolution(since, 0)
+	if resolution == 0 {
+		return tr.raw.GetLinkStats(ctx, shortURL, since)
+	}
+	stats := &LinkStats{ShortURL: shortURL}
+	err := tr.collect(ctx, resolution, RollupQuery{ShortURL: shortURL, From: tr.from(since, resolution)}, func(r Rollup) {
+		if r.Clicks == 0 {
+			return
+		}
+		if stats.Clicks == 0 || r.FirstClick.Before(stats.FirstClick) {
+			stats.FirstClick = r.FirstClick
+		}
+		if stats.Clicks == 0 || r.LastClick.After(stats.LastClick) {
+			stats.LastClick = r.LastClick
+		}
+		stats.Clicks += r.Clicks
+	})
+	if err != nil {
+		return nil, fmt.Errorf("link stats: %w", err)
+	}
+	return stats, nil
+}
+
+func (tr *TieredReader) GetClickSeries(ctx context.Context, shortURL string, interval time.Duration, since time.Duration) ([]ClickCount, error) {
+	resolution := tr.resolution(since, interval)
+	if resolution == 0 {
+		return tr.raw.GetClickSeries(ctx, shortURL, interval, since)
+	}
+	// The interval is a multiple of the resolution, so every bucket falls into a single window
+	counts := make(map[int64]int64)
+	err := tr.collect(ctx, resolution, RollupQuery{ShortURL: shortURL, From: tr.from(since, resolution)}, func(r Rollup) {
+		counts[windowStart(r.Bucket, interval)] += r.Clicks
+	})
+	if err != nil {
+		return nil, fmt.Errorf("click series: %w", err)
+	}
+	return buildSeries(counts, tr.now(), interval, since), nil
+}
+
+func (tr *TieredReader) TopLinks(ctx context.Context, since time.Duration, limit int) ([]RankEntry, error) {
+	resolution := tr.resolution(since, 0)
+	if resolution == 0 {
+		return tr.raw.TopLinks(ctx, since, limit)
+	}
+	counts := make(map[string]int64)
+	err := tr.collect(ctx, resolution, RollupQuery{From: tr.from(since, resolution)}, func(r Rollup) {
+		if r.Clicks > 0 {
+			counts[r.ShortURL] += r.Clicks
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("top links: %w", err)
+	}
+	return rankCounts(counts, limit), nil
+}
+
+// TopReferrers counts the referrers of the rollups, which keep the MAX_ROLLUP_REFERRERS hosts with the most clicks per
+// bucket. Rollups built before the referrers were rolled up have none.
+func (tr *TieredReader) TopReferrers(ctx context.Context, shortURL string, since time.Duration, limit int) ([]RankEntry, error) {
+	resolution := tr.resolution(since, 0)
+	if resolution == 0 {
+		return tr.raw.TopReferrers(ctx, shortURL, since, limit)
+	}
+	counts := make(map[string]int64)
+	q := RollupQuery{ShortURL: shortURL, From: tr.from(since, resolution), Referrers: true}
+	err := tr.collect(ctx, resolution, q, func(r Rollup) {
+		for host, clicks := range r.Referrers {
+			counts[host] += clicks
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("top referrers: %w", err)
+	}
+	return rankCounts(counts, limit), nil
+}
+
+func (tr *TieredReader) GetVisitorStats(ctx context.Context, shortURL string, since time.Duration) (*VisitorStats, error) {
+	resolution := tr.resolution(since, RESOLUTION_DAY)
+	if resolution == 0 {
+		return tr.raw.GetVisitorStats(ctx, shortURL, since)
+	}
+	sketches := make(map[int64]*hll.Sketch)
+	q := RollupQuery{ShortURL: shortURL, From: visitorsFrom(tr.now(), since), Visitors: true}
+	err := tr.collect(ctx, resolution, q, func(r Rollup) {
+		if r.Visitors == nil || r.Visitors.Empty() {
+			return
+		}
+		day := windowStart(r.Bucket, RESOLUTION_DAY)
+		if sketches[day] == nil {
+			sketches[day] = hll.New()
+		}
+		sketches[day].Merge(r.Visitors)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("visitor stats: %w", err)
+	}
+	return newVisitorStats(shortURL, sketches), nil
+}
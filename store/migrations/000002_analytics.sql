@@ -0,0 +1,47 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Events are partitioned by month, the analytics store creates the partitions on demand
+CREATE TABLE IF NOT EXISTS analytics_creation_events (
+  time TIMESTAMP WITH TIME ZONE NOT NULL,
+  service TEXT NOT NULL,
+  url TEXT NOT NULL,
+  api_ver INTEGER NOT NULL,
+  success BOOLEAN NOT NULL
+) PARTITION BY RANGE (time);
+
+CREATE TABLE IF NOT EXISTS analytics_redirect_events (
+  time TIMESTAMP WITH TIME ZONE NOT NULL,
+  service TEXT NOT NULL,
+  short_url TEXT NOT NULL,
+  long_url TEXT NOT NULL,
+  api_ver INTEGER NOT NULL,
+  success BOOLEAN NOT NULL,
+  referrer_host TEXT NOT NULL DEFAULT '',
+  browser TEXT NOT NULL DEFAULT '',
+  os TEXT NOT NULL DEFAULT '',
+  device TEXT NOT NULL DEFAULT '',
+  accept_language TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  client_ip TEXT NOT NULL DEFAULT '',
+  cache_tier TEXT NOT NULL DEFAULT '',
+  latency_us BIGINT NOT NULL DEFAULT 0
+) PARTITION BY RANGE (time);
+-- Index for the queries of a single short URL
+CREATE INDEX IF NOT EXISTS idx_analytics_redirect_events_short_url ON analytics_redirect_events(short_url, time);
+
+-- Hourly number of successful redirects per short URL, maintained on write
+CREATE TABLE IF NOT EXISTS analytics_click_rollups (
+  short_url TEXT NOT NULL,
+  bucket TIMESTAMP WITH TIME ZONE NOT NULL,
+  clicks BIGINT NOT NULL,
+  PRIMARY KEY (short_url, bucket)
+);
+CREATE INDEX IF NOT EXISTS idx_analytics_click_rollups_bucket ON analytics_click_rollups(bucket);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE analytics_click_rollups;
+DROP TABLE analytics_redirect_events;
+DROP TABLE analytics_creation_events;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Event ids are generated by the clients, retried events are only stored once.
+-- Unique indexes of partitioned tables have to include the partition key, retries carry the timestamp of the original event.
+-- Events without an id are NULL and never conflict.
+ALTER TABLE analytics_creation_events ADD COLUMN IF NOT EXISTS event_id TEXT;
+ALTER TABLE analytics_redirect_events ADD COLUMN IF NOT EXISTS event_id TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_analytics_creation_events_event_id ON analytics_creation_events(event_id, time);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_analytics_redirect_events_event_id ON analytics_redirect_events(event_id, time);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX idx_analytics_redirect_events_event_id;
+DROP INDEX idx_analytics_creation_events_event_id;
+ALTER TABLE analytics_redirect_events DROP COLUMN event_id;
+ALTER TABLE analytics_creation_events DROP COLUMN event_id;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE analytics_redirect_events ADD COLUMN IF NOT EXISTS visitor_id TEXT NOT NULL DEFAULT '';
+
+-- HyperLogLog sketch (see store/analytics/hll) of the visitors of a short URL per UTC day, merged on write
+CREATE TABLE IF NOT EXISTS analytics_visitor_sketches (
+  short_url TEXT NOT NULL,
+  day TIMESTAMP WITH TIME ZONE NOT NULL,
+  sketch BYTEA NOT NULL,
+  PRIMARY KEY (short_url, day)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE analytics_visitor_sketches;
+ALTER TABLE analytics_redirect_events DROP COLUMN visitor_id;
+-- +goose StatementEnd
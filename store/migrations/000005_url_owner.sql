@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The owner is declared by the client that shortened the URL, URLs without an owner have an empty one.
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_urls_owner ON urls(owner) WHERE owner <> '';
+-- Creation events name the created short URL and its owner, events recorded before are empty
+ALTER TABLE analytics_creation_events ADD COLUMN IF NOT EXISTS short_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE analytics_creation_events ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE analytics_creation_events DROP COLUMN owner;
+ALTER TABLE analytics_creation_events DROP COLUMN short_url;
+DROP INDEX idx_urls_owner;
+ALTER TABLE urls DROP COLUMN owner;
+-- +goose StatementEnd
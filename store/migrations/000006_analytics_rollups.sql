@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Hourly and daily rollups of the redirect events, built by the rollup job of the analytics service
+CREATE TABLE IF NOT EXISTS analytics_rollups (
+  resolution_seconds INTEGER NOT NULL,
+  short_url TEXT NOT NULL,
+  bucket TIMESTAMP WITH TIME ZONE NOT NULL,
+  clicks BIGINT NOT NULL,
+  failures BIGINT NOT NULL,
+  first_click TIMESTAMP WITH TIME ZONE,
+  last_click TIMESTAMP WITH TIME ZONE,
+  visitors BYTEA, -- HyperLogLog sketch (see store/analytics/hll), NULL without visitors
+  PRIMARY KEY (resolution_seconds, short_url, bucket)
+);
+CREATE INDEX IF NOT EXISTS idx_analytics_rollups_bucket ON analytics_rollups(resolution_seconds, bucket);
+
+-- The end of the range rolled up per resolution
+CREATE TABLE IF NOT EXISTS analytics_rollup_watermarks (
+  resolution_seconds INTEGER PRIMARY KEY,
+  rolled_up_until TIMESTAMP WITH TIME ZONE NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE analytics_rollup_watermarks;
+DROP TABLE analytics_rollups;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The traffic class of the redirector: human, bot or suspected_bot. Events recorded before are empty and count as human.
+ALTER TABLE analytics_redirect_events ADD COLUMN IF NOT EXISTS bot_class TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE analytics_redirect_events DROP COLUMN bot_class;
+-- +goose StatementEnd
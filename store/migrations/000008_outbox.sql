@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Messages written in the transaction of the change they describe, delivered afterwards by the relay of the shortener
+CREATE TABLE IF NOT EXISTS outbox (
+  id BIGSERIAL PRIMARY KEY,
+  topic TEXT NOT NULL,
+  payload BYTEA NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  last_error TEXT NOT NULL DEFAULT '',
+  delivered_at TIMESTAMP WITH TIME ZONE -- NULL until delivered
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(next_attempt_at, id) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_delivered ON outbox(delivered_at) WHERE delivered_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE outbox;
+-- +goose StatementEnd
@@ -0,0 +1,47 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Webhook endpoints registered by owners, the secret signs the payloads sent to the URL
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+  id BIGSERIAL PRIMARY KEY,
+  owner TEXT NOT NULL,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  events TEXT[] NOT NULL,
+  clicks_threshold BIGINT NOT NULL DEFAULT 0, -- for link.clicks_threshold, 0 if not subscribed
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_owner ON webhook_endpoints(owner);
+-- The delivery queue and log, an event is delivered once per endpoint
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id BIGSERIAL PRIMARY KEY,
+  endpoint_id BIGINT NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+  event_id TEXT NOT NULL,
+  event TEXT NOT NULL,
+  payload BYTEA NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  status TEXT NOT NULL DEFAULT 'pending', -- pending, delivered or failed
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  response_status INTEGER NOT NULL DEFAULT 0, -- of the last attempt, 0 if there was no response
+  last_error TEXT NOT NULL DEFAULT '',
+  finished_at TIMESTAMP WITH TIME ZONE, -- NULL while pending
+  UNIQUE (endpoint_id, event_id)
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries(next_attempt_at, id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_finished ON webhook_deliveries(finished_at) WHERE finished_at IS NOT NULL;
+-- Click thresholds crossed by the short URLs, each is announced once per endpoint
+CREATE TABLE IF NOT EXISTS webhook_thresholds (
+  endpoint_id BIGINT NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+  short_url TEXT NOT NULL,
+  threshold BIGINT NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  PRIMARY KEY (endpoint_id, short_url, threshold)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE webhook_thresholds;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhook_endpoints;
+-- +goose StatementEnd
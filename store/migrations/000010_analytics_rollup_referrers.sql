@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Clicks per referrer host of a rollup, as a JSON object. Rollups built before have none.
+ALTER TABLE analytics_rollups ADD COLUMN IF NOT EXISTS referrers JSONB;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE analytics_rollups DROP COLUMN referrers;
+-- +goose StatementEnd
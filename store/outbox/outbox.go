@@ -0,0 +1,182 @@
+// Package outbox implements a transactional outbox in Postgres (see migrations/000008_outbox.sql). Messages are
+// inserted in the transaction of the change they describe, so they exist if and only if the change was committed,
+// and are delivered afterwards with at-least-once semantics.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// MAX_BACKOFF bounds the delay of the next attempt after failed deliveries, the delay doubles with every attempt
+	MAX_BACKOFF = 5 * time.Minute
+	// RECORD_TIMEOUT bounds recording the outcome of a delivery, which is recorded even if the delivery ran out of time
+	RECORD_TIMEOUT = 5 * time.Second
+)
+
+type Message struct {
+	ID        int64 // assigned by Insert
+	Topic     string
+	Payload   []byte
+	CreatedAt time.Time
+	Attempts  int // failed deliveries so far
+}
+
+// Insert adds the messages to the outbox within the transaction
+func Insert(ctx context.Context, tx *sql.Tx, messages ...Message) error {
+	for _, m := range messages {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO outbox (topic, payload) VALUES ($1, $2)", m.Topic, m.Payload); err != nil {
+			return fmt.Errorf("insert outbox message: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeliverFunc delivers a batch of messages. An error fails the whole batch, which is attempted again later, unless it
+// is a *BatchError that fails only some of the messages. Messages the receiver refused for good are returned as
+// rejected, they count as delivered and keep the error.
+type DeliverFunc func(ctx context.Context, messages []Message) (rejected map[int64]error, err error)
+
+// BatchError fails the messages of a batch by id, the other messages of the batch were delivered
+type BatchError struct {
+	Failed map[int64]error
+}
+
+func (e *BatchError) Error() string {
+	for _, err := range e.Failed {
+		return fmt.Sprintf("%d messages failed, e.g. %v", len(e.Failed), err)
+	}
+	return "no messages failed"
+}
+
+type PostgresOutbox struct {
+	db *sql.DB
+}
+
+func NewPostgresOutbox(db *sql.DB) *PostgresOutbox {
+	return &PostgresOutbox{db: db}
+}
+
+// Deliver claims up to limit pending messages that are due, oldest first, passes them to deliver and records the
+// outcome, and returns the number of claimed messages. The messages stay locked until the outcome is committed, other
+// relays skip them, so several relays can deliver concurrently. If the outcome can't be committed the messages are
+// delivered again later. ctx bounds the claim and the delivery, the outcome is recorded within RECORD_TIMEOUT after
+// the delivery returned, so that a delivery that ran out of time still counts as a failed attempt.
+func (o *PostgresOutbox) Deliver(ctx context.Context, limit int, deliver DeliverFunc) (int, error) {
+	// The transaction would be rolled back when ctx ends
+	tx, err := o.db.BeginTx(context.WithoutCancel(ctx), nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	messages, err := claim(ctx, tx, limit)
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	rejected, deliverErr := deliver(ctx, messages)
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), RECORD_TIMEOUT)
+	defer cancel()
+	var batchErr *BatchError
+	if deliverErr != nil && !errors.As(deliverErr, &batchErr) {
+		if err := recordFailure(recordCtx, tx, ids, deliverErr); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("commit: %w", err)
+		}
+		return len(messages), fmt.Errorf("deliver %d messages: %w", len(messages), deliverErr)
+	}
+	if batchErr != nil {
+		delivered := ids[:0]
+		for _, id := range ids {
+			if failure, ok := batchErr.Failed[id]; ok {
+				if err := recordFailure(recordCtx, tx, []int64{id}, failure); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			delivered = append(delivered, id)
+		}
+		ids = delivered
+	}
+	if _, err := tx.ExecContext(recordCtx, "UPDATE outbox SET delivered_at = now() WHERE id = ANY($1)", ids); err != nil {
+		return 0, fmt.Errorf("record delivery: %w", err)
+	}
+	for id, reason := range rejected {
+		if _, err := tx.ExecContext(recordCtx, "UPDATE outbox SET last_error = $2 WHERE id = $1", id, reason.Error()); err != nil {
+			return 0, fmt.Errorf("record rejection: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	if batchErr != nil {
+		return len(messages), fmt.Errorf("deliver %d messages: %w", len(messages), deliverErr)
+	}
+	return len(messages), nil
+}
+
+// recordFailure counts a failed attempt of the messages and delays their next attempt
+func recordFailure(ctx context.Context, tx *sql.Tx, ids []int64, failure error) error {
+	_, err := tx.ExecContext(ctx, `
+	UPDATE outbox SET attempts = attempts + 1, last_error = $2,
+	  next_attempt_at = now() + least(interval '1 second' * power(2, attempts), $3 * interval '1 second')
+	WHERE id = ANY($1)
+	`, ids, failure.Error(), int64(MAX_BACKOFF/time.Second))
+	if err != nil {
+		return fmt.Errorf("record failed delivery: %w", err)
+	}
+	return nil
+}
+
+func claim(ctx context.Context, tx *sql.Tx, limit int) ([]Message, error) {
+	rows, err := tx.QueryContext(ctx, `
+	SELECT id, topic, payload, created_at, attempts FROM outbox
+	WHERE delivered_at IS NULL AND next_attempt_at <= now()
+	ORDER BY id
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("claim outbox messages: %w", err)
+	}
+	defer rows.Close()
+	var messages []Message
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.Topic, &m.Payload, &m.CreatedAt, &m.Attempts); err != nil {
+			return nil, fmt.Errorf("scan outbox messages: %w", err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("claim outbox messages: %w", err)
+	}
+	return messages, nil
+}
+
+// DeleteDelivered deletes the messages delivered before the time and returns their number
+func (o *PostgresOutbox) DeleteDelivered(ctx context.Context, before time.Time) (int64, error) {
+	res, err := o.db.ExecContext(ctx, "DELETE FROM outbox WHERE delivered_at < $1", before)
+	if err != nil {
+		return 0, fmt.Errorf("delete delivered outbox messages: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// Pending returns the number of messages that weren't delivered yet
+func (o *PostgresOutbox) Pending(ctx context.Context) (int64, error) {
+	var n int64
+	if err := o.db.QueryRowContext(ctx, "SELECT count(*) FROM outbox WHERE delivered_at IS NULL").Scan(&n); err != nil {
+		return 0, fmt.Errorf("count pending outbox messages: %w", err)
+	}
+	return n, nil
+}
@@ -4,118 +4,234 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mactavishz/kuerzen/breaker"
 	"github.com/mactavishz/kuerzen/retries"
+	"github.com/mactavishz/kuerzen/store/outbox"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// URLStore retries transient failures itself, the errors it returns are final
 type URLStore interface {
-	CreateShortURL(string, string, context.Context) func() retries.RetryableFuncObject
-	GetLongURL(string, context.Context) func() retries.RetryableFuncObject
+	CreateShortURL(ctx context.Context, shortURL string, longURL string, owner string, messages ...outbox.Message) error
+	GetLongURL(ctx context.Context, shortURL string) (string, error)
+	ListShortURLs(ctx context.Context, owner string) ([]string, error)
 }
 
+// MAX_LISTED_SHORT_URLS bounds the short URLs returned by ListShortURLs
+const MAX_LISTED_SHORT_URLS = 10000
+
+// BUDGET_DEPENDENCY names the retry budget the stores of a process share
+const BUDGET_DEPENDENCY = "postgres"
+
 type PostgresURLStore struct {
-	db     *sql.DB
-	logger *zap.SugaredLogger
+	db      *sql.DB
+	policy  retries.Policy
+	breaker *breaker.Breaker
+	logger  *zap.SugaredLogger
 }
 
 func NewPostgresURLStore(db *sql.DB, logger *zap.SugaredLogger) *PostgresURLStore {
 	return &PostgresURLStore{
 		db:     db,
+		policy: retries.BackgroundPolicy.WithBudget(retries.BudgetFor(BUDGET_DEPENDENCY)),
 		logger: logger,
 	}
 }
 
+// WithPolicy returns a store on the same database that retries with policy the calls whose context has no policy of
+// retries.ContextWithPolicy, retries.BackgroundPolicy by default. The retries take from the budget of
+// BUDGET_DEPENDENCY unless policy has a budget.
+func (pgs *PostgresURLStore) WithPolicy(policy retries.Policy) *PostgresURLStore {
+	c := *pgs
+	if policy.Budget == nil {
+		policy.Budget = pgs.policy.Budget
+	}
+	c.policy = policy
+	return &c
+}
+
+// WithBreaker returns a store on the same database whose attempts go through b, so that they fail fast while the
+// database is down. Stores derived from it with WithPolicy share b.
+func (pgs *PostgresURLStore) WithBreaker(b *breaker.Breaker) *PostgresURLStore {
+	c := *pgs
+	c.breaker = b
+	return &c
+}
+
+// do retries fn with the policy of ctx or else of the store, every attempt passes the breaker. Calls the breaker
+// rejected fail with ErrUnavailable.
+func do[T any](pgs *PostgresURLStore, ctx context.Context, fn func(ctx context.Context) (T, error)) (T, error) {
+	res, err := retries.Do(ctx, retries.PolicyFromContext(ctx, pgs.policy), func(ctx context.Context) (T, error) {
+		return breaker.Do(pgs.breaker, func() (T, error) {
+			return fn(ctx)
+		})
+	})
+	if errors.Is(err, breaker.ErrOpen) {
+		return res, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return res, err
+}
+
 var ErrDuplicateLongURL = errors.New("long URL already exists")
 var ErrShortURLNotFound = errors.New("short URL not found")
 
-func (pgs *PostgresURLStore) CreateShortURL(shortURL string, longURL string, ctx context.Context) func() retries.RetryableFuncObject {
+// ErrUnavailable marks calls that weren't made because the database is known to be down, breaker.RetryAfter tells
+// when to try again
+var ErrUnavailable = errors.New("url store unavailable")
+
+var tracer = otel.Tracer("github.com/mactavishz/kuerzen/store/url")
+
+// startSpan starts the span of an attempt of a store operation
+func startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "PostgresURLStore."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system.name", "postgresql"),
+		attribute.String("db.operation.name", operation),
+	))
+}
+
+// endSpan ends the span of an attempt, a missing or duplicate URL is an expected outcome rather than a failure
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrShortURLNotFound) && !errors.Is(err, ErrDuplicateLongURL) {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// CreateShortURL stores the short URL, owner may be empty. The messages are added to the outbox in the same transaction.
+func (pgs *PostgresURLStore) CreateShortURL(ctx context.Context, shortURL string, longURL string, owner string, messages ...outbox.Message) error {
 	query := `
-		INSERT INTO urls(short_url, long_url)
-		VALUES($1, $2)
+		INSERT INTO urls(short_url, long_url, owner)
+		VALUES($1, $2, $3)
 		`
-	return func() retries.RetryableFuncObject {
-		var rfo retries.RetryableFuncObject
-		rfo.Ctx = ctx
-		rfo.Logger = pgs.logger
+	_, err := do(pgs, ctx, func(ctx context.Context) (_ struct{}, err error) {
 		select {
 		case <-ctx.Done():
 			pgs.logger.Infof("CreateShortURL operation cancelled for %s: %v", shortURL, ctx.Err())
-			rfo.Err = ctx.Err()
-			return rfo
+			return struct{}{}, ctx.Err()
 		default:
 		}
-		dbCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		spanCtx, span := startSpan(ctx, "CreateShortURL")
+		defer func() { endSpan(span, err) }()
+		dbCtx, cancel := context.WithTimeout(spanCtx, 2*time.Second)
 		defer cancel()
 		tx, err := pgs.db.BeginTx(dbCtx, nil)
 		if err != nil {
 			pgs.logger.Errorf("Failed to begin transaction for short URL %s: %v", shortURL, err)
-			rfo.Err = retries.ErrTransient
-			return rfo
+			span.RecordError(err)
+			return struct{}{}, retries.Transient(err)
 		}
 		defer tx.Rollback()
-		_, err = tx.ExecContext(dbCtx, query, shortURL, longURL)
+		_, err = tx.ExecContext(dbCtx, query, shortURL, longURL, owner)
 		if err != nil {
 			var pgErr *pgconn.PgError
 			if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
 				pgs.logger.Errorf("Attempted to create duplicate long URL: %s", longURL)
-				rfo.Err = ErrDuplicateLongURL
-				return rfo
+				return struct{}{}, ErrDuplicateLongURL
 			}
 			pgs.logger.Errorf("Failed to insert short URL %s: %v", shortURL, err)
-			rfo.Err = retries.ErrTransient
-			return rfo
+			span.RecordError(err)
+			return struct{}{}, retries.Transient(err)
+		}
+		if err := outbox.Insert(dbCtx, tx, messages...); err != nil {
+			pgs.logger.Errorf("Failed to write outbox messages of short URL %s: %v", shortURL, err)
+			span.RecordError(err)
+			return struct{}{}, retries.Transient(err)
 		}
 		err = tx.Commit()
 		if err != nil {
 			pgs.logger.Infof("Attempt to commit transaction for short URL %s failed, retrying: %v", shortURL, err)
-			rfo.Err = retries.ErrTransient
-			return rfo
+			span.RecordError(err)
+			return struct{}{}, retries.Transient(err)
 		}
 		pgs.logger.Infow("Successfully created short URL", "shortURL", shortURL, "longURL", longURL)
-		rfo.Err = nil
-		return rfo
-	}
+		return struct{}{}, nil
+	})
+	return err
 }
 
-func (pgs *PostgresURLStore) GetLongURL(shortURL string, ctx context.Context) func() retries.RetryableFuncObject {
-	var longURL string
+// GetLongURL returns the long URL of the short URL, ErrShortURLNotFound if there is none
+func (pgs *PostgresURLStore) GetLongURL(ctx context.Context, shortURL string) (string, error) {
 	query := `
 	SELECT long_url from urls
 	WHERE short_url = $1
 	`
-	return func() retries.RetryableFuncObject {
-		var rfo retries.RetryableFuncObject
-		rfo.Ctx = ctx
-		rfo.Logger = pgs.logger
+	return do(pgs, ctx, func(ctx context.Context) (longURL string, err error) {
 		select {
 		case <-ctx.Done():
 			pgs.logger.Infof("GetLongURL operation cancelled for %s: %v", shortURL, ctx.Err())
-			rfo.Err = ctx.Err()
-			rfo.Rest = append(rfo.Rest, "")
-			return rfo
+			return "", ctx.Err()
 		default:
 		}
-		dbCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		spanCtx, span := startSpan(ctx, "GetLongURL")
+		defer func() { endSpan(span, err) }()
+		dbCtx, cancel := context.WithTimeout(spanCtx, 2*time.Second)
 		defer cancel()
-		err := pgs.db.QueryRowContext(dbCtx, query, shortURL).Scan(&longURL)
+		err = pgs.db.QueryRowContext(dbCtx, query, shortURL).Scan(&longURL)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				pgs.logger.Errorf("Short URL %s not found in DB, no retry.", shortURL)
-				rfo.Err = ErrShortURLNotFound
-				rfo.Rest = append(rfo.Rest, "")
-				return rfo
+				return "", ErrShortURLNotFound
 			}
 			pgs.logger.Infof("Attempt to get long URL for %s from DB failed, retrying: %v", shortURL, err)
-			rfo.Err = retries.ErrTransient
-			rfo.Rest = append(rfo.Rest, "")
-			return rfo
+			span.RecordError(err)
+			return "", retries.Transient(err)
 		}
 		pgs.logger.Infof("Successfully retrieved long URL for %s on attempt.", shortURL)
-		rfo.Err = nil
-		rfo.Rest = append(rfo.Rest, longURL)
-		return rfo
-	}
+		return longURL, nil
+	})
+}
+
+// ListShortURLs returns the short URLs of the owner, newest first
+func (pgs *PostgresURLStore) ListShortURLs(ctx context.Context, owner string) ([]string, error) {
+	query := `
+	SELECT short_url FROM urls
+	WHERE owner = $1
+	ORDER BY created_at DESC
+	LIMIT $2
+	`
+	return do(pgs, ctx, func(ctx context.Context) (_ []string, err error) {
+		select {
+		case <-ctx.Done():
+			pgs.logger.Infof("ListShortURLs operation cancelled for owner %s: %v", owner, ctx.Err())
+			return nil, ctx.Err()
+		default:
+		}
+		spanCtx, span := startSpan(ctx, "ListShortURLs")
+		defer func() { endSpan(span, err) }()
+		dbCtx, cancel := context.WithTimeout(spanCtx, 2*time.Second)
+		defer cancel()
+		rows, err := pgs.db.QueryContext(dbCtx, query, owner, MAX_LISTED_SHORT_URLS)
+		if err != nil {
+			pgs.logger.Infof("Attempt to list short URLs of owner %s failed, retrying: %v", owner, err)
+			span.RecordError(err)
+			return nil, retries.Transient(err)
+		}
+		defer rows.Close()
+		var shortURLs []string
+		for rows.Next() {
+			var shortURL string
+			if err := rows.Scan(&shortURL); err != nil {
+				pgs.logger.Errorf("Failed to scan short URL of owner %s: %v", owner, err)
+				span.RecordError(err)
+				return nil, retries.Transient(err)
+			}
+			// short_url is CHAR(8), shorter IDs are padded with spaces
+			shortURLs = append(shortURLs, strings.TrimRight(shortURL, " "))
+		}
+		if err := rows.Err(); err != nil {
+			pgs.logger.Infof("Attempt to list short URLs of owner %s failed, retrying: %v", owner, err)
+			span.RecordError(err)
+			return nil, retries.Transient(err)
+		}
+		return shortURLs, nil
+	})
 }
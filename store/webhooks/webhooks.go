@@ -0,0 +1,362 @@
+// Package webhooks stores the webhook endpoints of owners and the queue of their deliveries in Postgres (see
+// migrations/000009_webhooks.sql). The queue doubles as the delivery log: deliveries keep their outcome until they
+// are deleted after the retention.
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	STATUS_PENDING   = "pending"
+	STATUS_DELIVERED = "delivered"
+	STATUS_FAILED    = "failed"
+)
+
+const (
+	// MAX_ATTEMPTS bounds the failed attempts of a delivery, it fails for good after the last one
+	MAX_ATTEMPTS = 12
+	// MAX_BACKOFF bounds the delay of the next attempt, the delay starts at 30 seconds and doubles with every attempt
+	MAX_BACKOFF = time.Hour
+)
+
+var ErrEndpointNotFound = errors.New("webhook endpoint not found")
+
+type Endpoint struct {
+	ID              int64 // assigned by CreateEndpoint
+	Owner           string
+	URL             string
+	Secret          string
+	Events          []string
+	ClicksThreshold int64
+	CreatedAt       time.Time
+}
+
+// Subscribes reports whether the endpoint is subscribed to the event
+func (e *Endpoint) Subscribes(event string) bool {
+	for _, s := range e.Events {
+		if s == event {
+			return true
+		}
+	}
+	return false
+}
+
+type Delivery struct {
+	ID             int64 // assigned by Enqueue
+	EndpointID     int64
+	EventID        string // identifies the event, an event is delivered once per endpoint
+	Event          string
+	Payload        []byte
+	CreatedAt      time.Time
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	ResponseStatus int
+	LastError      string
+	FinishedAt     *time.Time
+	// The URL and secret of the endpoint, set for claimed deliveries
+	URL    string
+	Secret string
+}
+
+// Result is the outcome of an attempt to deliver a delivery. Failed attempts are retried until MAX_ATTEMPTS unless
+// Permanent is set.
+type Result struct {
+	ID             int64
+	ResponseStatus int
+	Err            error
+	Permanent      bool
+}
+
+// DeliverFunc attempts the deliveries and returns a result for each of them, deliveries without a result are
+// attempted again at once by the next run
+type DeliverFunc func(ctx context.Context, deliveries []Delivery) []Result
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// CreateEndpoint stores the endpoint and sets its ID and creation time
+func (s *PostgresStore) CreateEndpoint(ctx context.Context, e *Endpoint) error {
+	err := s.db.QueryRowContext(ctx, `
+	INSERT INTO webhook_endpoints (owner, url, secret, events, clicks_threshold)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at
+	`, e.Owner, e.URL, e.Secret, e.Events, e.ClicksThreshold).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert webhook endpoint: %w", err)
+	}
+	return nil
+}
+
+const endpointColumns = "id, owner, url, secret, array_to_string(events, ','), clicks_threshold, created_at"
+
+func scanEndpoints(rows *sql.Rows) ([]Endpoint, error) {
+	defer rows.Close()
+	var endpoints []Endpoint
+	for rows.Next() {
+		var e Endpoint
+		var events string
+		if err := rows.Scan(&e.ID, &e.Owner, &e.URL, &e.Secret, &events, &e.ClicksThreshold, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan webhook endpoints: %w", err)
+		}
+		if events != "" {
+			e.Events = strings.Split(events, ",")
+		}
+		endpoints = append(endpoints, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read webhook endpoints: %w", err)
+	}
+	return endpoints, nil
+}
+
+// ListEndpoints returns the endpoints of the owner, oldest first
+func (s *PostgresStore) ListEndpoints(ctx context.Context, owner string) ([]Endpoint, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+endpointColumns+" FROM webhook_endpoints WHERE owner = $1 ORDER BY id", owner)
+	if err != nil {
+		return nil, fmt.Errorf("list webhook endpoints: %w", err)
+	}
+	return scanEndpoints(rows)
+}
+
+// GetEndpoint returns an endpoint of the owner, ErrEndpointNotFound if the owner has no endpoint with the id
+func (s *PostgresStore) GetEndpoint(ctx context.Context, owner string, id int64) (Endpoint, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+endpointColumns+" FROM webhook_endpoints WHERE owner = $1 AND id = $2", owner, id)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("get webhook endpoint: %w", err)
+	}
+	endpoints, err := scanEndpoints(rows)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if len(endpoints) == 0 {
+		return Endpoint{}, ErrEndpointNotFound
+	}
+	return endpoints[0], nil
+}
+
+// DeleteEndpoint deletes an endpoint of the owner together with its deliveries
+func (s *PostgresStore) DeleteEndpoint(ctx context.Context, owner string, id int64) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM webhook_endpoints WHERE owner = $1 AND id = $2", owner, id)
+	if err != nil {
+		return fmt.Errorf("delete webhook endpoint: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrEndpointNotFound
+	}
+	return nil
+}
+
+// Subscribers returns the endpoints of the owner that are subscribed to the event
+func (s *PostgresStore) Subscribers(ctx context.Context, owner string, event string) ([]Endpoint, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+endpointColumns+" FROM webhook_endpoints WHERE owner = $1 AND $2 = ANY(events) ORDER BY id", owner, event)
+	if err != nil {
+		return nil, fmt.Errorf("list webhook subscribers: %w", err)
+	}
+	return scanEndpoints(rows)
+}
+
+// ThresholdEndpoints returns the endpoints subscribed to a click threshold, with the short URLs that already crossed it
+func (s *PostgresStore) ThresholdEndpoints(ctx context.Context, event string) ([]Endpoint, map[int64]map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+endpointColumns+" FROM webhook_endpoints WHERE $1 = ANY(events) AND clicks_threshold > 0 ORDER BY id", event)
+	if err != nil {
+		return nil, nil, fmt.Errorf("list webhook threshold endpoints: %w", err)
+	}
+	endpoints, err := scanEndpoints(rows)
+	if err != nil || len(endpoints) == 0 {
+		return nil, nil, err
+	}
+	rows, err = s.db.QueryContext(ctx, `
+	SELECT t.endpoint_id, t.short_url FROM webhook_thresholds t
+	JOIN webhook_endpoints e ON e.id = t.endpoint_id AND e.clicks_threshold = t.threshold
+	WHERE $1 = ANY(e.events)
+	`, event)
+	if err != nil {
+		return nil, nil, fmt.Errorf("list crossed webhook thresholds: %w", err)
+	}
+	defer rows.Close()
+	crossed := make(map[int64]map[string]bool)
+	for rows.Next() {
+		var id int64
+		var shortURL string
+		if err := rows.Scan(&id, &shortURL); err != nil {
+			return nil, nil, fmt.Errorf("scan crossed webhook thresholds: %w", err)
+		}
+		if crossed[id] == nil {
+			crossed[id] = make(map[string]bool)
+		}
+		crossed[id][shortURL] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("read crossed webhook thresholds: %w", err)
+	}
+	return endpoints, crossed, nil
+}
+
+func enqueue(ctx context.Context, tx *sql.Tx, d Delivery) error {
+	_, err := tx.ExecContext(ctx, `
+	INSERT INTO webhook_deliveries (endpoint_id, event_id, event, payload)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (endpoint_id, event_id) DO NOTHING
+	`, d.EndpointID, d.EventID, d.Event, d.Payload)
+	if err != nil {
+		return fmt.Errorf("insert webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// Enqueue adds the deliveries to the queue, deliveries of an event that was already queued for the endpoint are skipped
+func (s *PostgresStore) Enqueue(ctx context.Context, deliveries ...Delivery) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	for _, d := range deliveries {
+		if err := enqueue(ctx, tx, d); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// EnqueueThreshold records that the short URL crossed the click threshold of the endpoint and adds the delivery to the
+// queue, unless the threshold was recorded before. It reports whether the delivery was added.
+func (s *PostgresStore) EnqueueThreshold(ctx context.Context, d Delivery, shortURL string, threshold int64) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `
+	INSERT INTO webhook_thresholds (endpoint_id, short_url, threshold)
+	VALUES ($1, $2, $3)
+	ON CONFLICT DO NOTHING
+	`, d.EndpointID, shortURL, threshold)
+	if err != nil {
+		return false, fmt.Errorf("insert webhook threshold: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := enqueue(ctx, tx, d); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit: %w", err)
+	}
+	return true, nil
+}
+
+// Deliver claims up to limit pending deliveries that are due, oldest first, passes them to deliver and records the
+// results, and returns the number of claimed deliveries. Like the outbox, the deliveries stay locked until the results
+// are committed and concurrent dispatchers skip them.
+func (s *PostgresStore) Deliver(ctx context.Context, limit int, deliver DeliverFunc) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	deliveries, err := claim(ctx, tx, limit)
+	if err != nil || len(deliveries) == 0 {
+		return 0, err
+	}
+	for _, r := range deliver(ctx, deliveries) {
+		var lastError string
+		if r.Err != nil {
+			lastError = r.Err.Error()
+		}
+		_, err := tx.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET
+		  attempts = attempts + 1, response_status = $2, last_error = $3,
+		  status = CASE WHEN $3 = '' THEN 'delivered' WHEN $4 OR attempts + 1 >= $5 THEN 'failed' ELSE 'pending' END,
+		  finished_at = CASE WHEN $3 = '' OR $4 OR attempts + 1 >= $5 THEN now() END,
+		  next_attempt_at = now() + least(interval '30 seconds' * power(2, attempts), $6 * interval '1 second')
+		WHERE id = $1
+		`, r.ID, r.ResponseStatus, lastError, r.Permanent, MAX_ATTEMPTS, int64(MAX_BACKOFF/time.Second))
+		if err != nil {
+			return 0, fmt.Errorf("record webhook delivery: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return len(deliveries), nil
+}
+
+func claim(ctx context.Context, tx *sql.Tx, limit int) ([]Delivery, error) {
+	rows, err := tx.QueryContext(ctx, `
+	SELECT d.id, d.endpoint_id, d.event_id, d.event, d.payload, d.created_at, d.attempts, e.url, e.secret
+	FROM webhook_deliveries d JOIN webhook_endpoints e ON e.id = d.endpoint_id
+	WHERE d.status = 'pending' AND d.next_attempt_at <= now()
+	ORDER BY d.id
+	LIMIT $1
+	FOR UPDATE OF d SKIP LOCKED
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("claim webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+	var deliveries []Delivery
+	for rows.Next() {
+		d := Delivery{Status: STATUS_PENDING}
+		if err := rows.Scan(&d.ID, &d.EndpointID, &d.EventID, &d.Event, &d.Payload, &d.CreatedAt, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, fmt.Errorf("scan webhook deliveries: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("claim webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// Deliveries returns the log of the latest deliveries to the endpoint, newest first
+func (s *PostgresStore) Deliveries(ctx context.Context, endpointID int64, limit int) ([]Delivery, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT id, endpoint_id, event_id, event, payload, created_at, status, attempts, next_attempt_at, response_status, last_error, finished_at
+	FROM webhook_deliveries
+	WHERE endpoint_id = $1
+	ORDER BY id DESC
+	LIMIT $2
+	`, endpointID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+	var deliveries []Delivery
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.EndpointID, &d.EventID, &d.Event, &d.Payload, &d.CreatedAt, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.ResponseStatus, &d.LastError, &d.FinishedAt); err != nil {
+			return nil, fmt.Errorf("scan webhook deliveries: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// DeleteFinished deletes the deliveries that were delivered or failed before the time and returns their number
+func (s *PostgresStore) DeleteFinished(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE finished_at < $1", before)
+	if err != nil {
+		return 0, fmt.Errorf("delete finished webhook deliveries: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -9,9 +9,11 @@ echo "=================================================="
 # Define modules in workspace
 modules=(
     "analytics"
+    "breaker"
     "middleware"
     "redirector"
     "retries"
+    "service"
     "shortener"
     "store"
 )